@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// registerAdminRoutes adds the /admin endpoints of sm to mux. They are only
+// served when enabled_endpoints lists admin and admin_token is set, and require
+// it as a bearer token.
+func registerAdminRoutes(mux *http.ServeMux, sm *ScriptManager) {
+	if config.AdminToken == "" {
+		return
+	}
+	mux.Handle("GET /admin/failures", adminOnly(failuresHandler(sm)))
+	mux.Handle("POST /admin/failures/{index}/replay", adminOnly(replayFailureHandler(sm)))
+	mux.Handle("GET /admin/selftest", adminOnly(selftestHandler(sm)))
+	mux.Handle("POST /admin/reload", adminOnly(reloadHandler(sm)))
+	mux.Handle("GET /admin/config", adminOnly(configHandler()))
+	mux.Handle("DELETE /admin/origins/{origin}/scripts", adminOnly(cancelOriginHandler(sm)))
+}
+
+// ErrScriptCancelled is returned to a script cancelled through the admin endpoints
+var ErrScriptCancelled = errors.New("script cancelled by an administrator")
+
+// CancelResponse is the body returned by DELETE /admin/origins/{origin}/scripts
+type CancelResponse struct {
+	Cancelled int `json:"cancelled"`
+}
+
+// cancelOriginHandler serves DELETE /admin/origins/{origin}/scripts, cancelling
+// the running scripts of one client. Its queued scripts still run.
+func cancelOriginHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.PathValue("origin")
+		cancelled := scriptManager.CancelByOrigin(origin)
+		logrus.WithFields(logrus.Fields{
+			"origin":    origin,
+			"cancelled": cancelled,
+		}).Warn("Cancelled the scripts of an origin")
+		writeJSONValue(w, http.StatusOK, CancelResponse{Cancelled: cancelled})
+	}
+}
+
+// adminOnly rejects requests not carrying "Authorization: Bearer <admin_token>"
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, Response{Error: "admin token required"})
+			logrus.WithField("path", r.URL.Path).Warn("Rejected admin request")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postFrom runs script through /data as if sent from the address remote
+func postFrom(sm *ScriptManager, remote, script string) (*httptest.ResponseRecorder, Response) {
+	r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(script))
+	r.RemoteAddr = remote
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, r)
+	var response Response
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec, response
+}
+
+func TestCancelByOrigin(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 5 * time.Second
+		c.WorkerPoolSize = 3
+	})
+	const spin = `const end = Date.now() + 300; while (Date.now() < end) {}; "done"`
+	remotes := []string{"10.0.0.1:40000", "10.0.0.1:40001", "10.0.0.2:40000"}
+	recs := make([]*httptest.ResponseRecorder, len(remotes))
+	responses := make([]Response, len(remotes))
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i], responses[i] = postFrom(sm, remote, spin)
+		}()
+	}
+	waitRunning(t, sm, 3)
+
+	if n := sm.CancelByOrigin("10.0.0.3"); n != 0 {
+		t.Fatalf("cancelled %d scripts of an origin running none", n)
+	}
+	// The origin is the address without its port, both connections count
+	if n := sm.CancelByOrigin("10.0.0.1"); n != 2 {
+		t.Fatalf("cancelled %d scripts, want 2", n)
+	}
+	waitRunning(t, sm, 1)
+	wg.Wait()
+
+	for i := range 2 {
+		if recs[i].Code != http.StatusServiceUnavailable || responses[i].Code != CodeScriptCancelled {
+			t.Errorf("%s: %d %s, want 503 and %s", remotes[i], recs[i].Code, recs[i].Body, CodeScriptCancelled)
+		}
+	}
+	if recs[2].Code != http.StatusOK || responses[2].Result != "done" {
+		t.Errorf("other origin: %d %s, want its script left to finish", recs[2].Code, recs[2].Body)
+	}
+	if n := sm.CancelByOrigin("10.0.0.1"); n != 0 {
+		t.Fatalf("cancelled %d scripts once none run", n)
+	}
+}
+
+func TestCancelOriginHandler(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 5 * time.Second
+		c.EnabledEndpoints = []string{"admin"}
+		c.AdminToken = "secret"
+	})
+	mux := http.NewServeMux()
+	registerRoutes(mux, sm)
+	cancel := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/admin/origins/10.0.0.1/scripts", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+
+	done := make(chan Response)
+	go func() {
+		_, response := postFrom(sm, "10.0.0.1:40000", `for (;;) {}`)
+		done <- response
+	}()
+	waitRunning(t, sm, 1)
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := cancel(token); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q: status = %d, want 401", token, rec.Code)
+		}
+	}
+	waitRunning(t, sm, 1)
+
+	rec := cancel("secret")
+	var body CancelResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK || body.Cancelled != 1 {
+		t.Fatalf("status = %d %s, want 1 cancelled", rec.Code, rec.Body)
+	}
+	select {
+	case response := <-done:
+		if response.Code != CodeScriptCancelled {
+			t.Fatalf("code = %q, want %s", response.Code, CodeScriptCancelled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled script still running")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/sobek"
+)
+
+// allocSampleInterval is how often the allocations of a running script are
+// compared to max_script_alloc_mb
+const allocSampleInterval = 10 * time.Millisecond
+
+// allocApproximate labels the alloc_bytes reported with a result. sobek has no
+// hook on value creation and Go keeps no per-goroutine allocation counter, so
+// allocations cannot be tracked per script: they are sampled from the process
+// heap, and include whatever ran alongside the script.
+const allocApproximate = "approximate"
+
+// watchAllocations interrupts vm with ErrMemoryLimit once the process allocated
+// over limitMB since allocStart, sampling every allocSampleInterval. The count
+// includes whatever ran alongside the script, so under load a script may be
+// stopped for allocations of its neighbours. The returned function stops the
+// watch.
+func watchAllocations(vm *sobek.Runtime, limitMB int, allocStart uint64) func() {
+	if limitMB <= 0 {
+		return func() {}
+	}
+	limit := uint64(limitMB) << 20
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(allocSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if allocated := heapAllocBytes() - allocStart; allocated > limit {
+					vm.Interrupt(fmt.Errorf("%w: script allocated about %d MB, the limit is %d MB", ErrMemoryLimit, allocated>>20, limitMB))
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// allocScript allocates about 100 bytes per element of an n long array
+func allocScript(n string) string {
+	return `const rows = []; for (let i = 0; i < ` + n + `; i++) rows.push({i, s: "row " + i}); rows.length`
+}
+
+func TestAllocAccounting(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 5 * time.Second
+		c.MaxScriptAllocMB = 1024
+	})
+	_, small := postScript(sm, `1 + 1`)
+	_, large := postScript(sm, allocScript("200000"))
+	if small.Error != "" || large.Error != "" {
+		t.Fatalf("errors = %q, %q", small.Error, large.Error)
+	}
+	if large.AllocBytes < 10<<20 {
+		t.Errorf("large script reported %d bytes, want at least 10 MB", large.AllocBytes)
+	}
+	if small.AllocBytes >= large.AllocBytes {
+		t.Errorf("small script reported %d bytes, large one %d", small.AllocBytes, large.AllocBytes)
+	}
+	if large.AllocAccounting != allocApproximate {
+		t.Errorf("alloc_accounting = %q, want %q", large.AllocAccounting, allocApproximate)
+	}
+	if small.AllocBytes > 0 && small.AllocAccounting != allocApproximate {
+		t.Errorf("alloc_accounting = %q, want %q", small.AllocAccounting, allocApproximate)
+	}
+}
+
+func TestAllocAccountingDisabled(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = 5 * time.Second })
+	rec, _ := postScript(sm, allocScript("100000"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s", rec.Code, rec.Body)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "alloc_bytes") || strings.Contains(body, "alloc_accounting") {
+		t.Fatalf("body = %s, want no allocations without max_script_alloc_mb", body)
+	}
+}
+
+func TestScriptAllocLimit(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 10 * time.Second
+		c.MaxScriptAllocMB = 32
+	})
+	start := time.Now()
+	rec, response := postScript(sm, `const rows = []; for (;;) rows.push({s: "row " + rows.length})`)
+	if rec.Code != http.StatusServiceUnavailable || response.Code != CodeMemoryLimit {
+		t.Fatalf("status = %d %s, want 503 and %s", rec.Code, rec.Body, CodeMemoryLimit)
+	}
+	if !strings.Contains(response.Error, "the limit is 32 MB") {
+		t.Errorf("error = %q, want the limit named", response.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("script stopped after %s, want well before script_timeout", elapsed)
+	}
+	if rec, response := postScript(sm, allocScript("1000")); rec.Code != http.StatusOK {
+		t.Fatalf("small script after the limit: %d %s", rec.Code, response.Error)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/grafana/sobek/ast"
+	"github.com/grafana/sobek/parser"
+)
+
+// SyntaxError describes why a script could not be parsed
+type SyntaxError struct {
+	Message string `json:"message"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Message
+}
+
+// parseScript parses a script without running it
+func parseScript(js string) (*ast.Program, error) {
+	program, err := parser.ParseFile(nil, "", js, 0)
+	if err == nil {
+		return program, nil
+	}
+
+	var list parser.ErrorList
+	if errors.As(err, &list) && len(list) > 0 {
+		return nil, &SyntaxError{
+			Message: list[0].Message,
+			Line:    list[0].Position.Line,
+			Column:  list[0].Position.Column,
+		}
+	}
+	return nil, &SyntaxError{Message: err.Error()}
+}
+
+var (
+	astNodeType  = reflect.TypeOf((*ast.Node)(nil)).Elem()
+	astPkgPath   = astNodeType.PkgPath()
+	astSkipField = map[string]bool{
+		// Hoisting bookkeeping, it repeats declarations already present in the body
+		"DeclarationList": true,
+	}
+)
+
+// walkAST calls visit for node and every node below it, depth first. Returning
+// false from visit skips the children of that node.
+func walkAST(node ast.Node, visit func(ast.Node) bool) {
+	walkValue(reflect.ValueOf(node), visit)
+}
+
+func walkValue(v reflect.Value, visit func(ast.Node) bool) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !v.IsNil() {
+			walkValue(v.Elem(), visit)
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		if v.Type().Implements(astNodeType) {
+			if !visit(v.Interface().(ast.Node)) {
+				return
+			}
+		}
+		walkValue(v.Elem(), visit)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkValue(v.Index(i), visit)
+		}
+	case reflect.Struct:
+		// Only the syntax tree itself is walked, not file or position information
+		if v.Type().PkgPath() != astPkgPath {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() || astSkipField[field.Name] {
+				continue
+			}
+			walkValue(v.Field(i), visit)
+		}
+	}
+}
+
+// bindingNames returns the identifiers declared by a binding target, including
+// those nested in destructuring patterns
+func bindingNames(target ast.BindingTarget) []string {
+	var names []string
+	walkAST(target, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.Identifier:
+			names = append(names, node.Name.String())
+		case *ast.PropertyShort:
+			names = append(names, node.Name.Name.String())
+			return false
+		case *ast.PropertyKeyed:
+			// Only the value side of { key: value } declares anything
+			walkAST(node.Value, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Identifier); ok {
+					names = append(names, id.Name.String())
+				}
+				return true
+			})
+			return false
+		}
+		return true
+	})
+	return names
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// addAuditFields stamps a successful response with the hash of the script that
+// produced it and the hash of its result. With audit_hmac_key set, it is also
+// signed so downstream systems can check which script produced which result.
+func addAuditFields(response *Response, script string, now time.Time) error {
+	result, err := json.Marshal(response.Result)
+	if err != nil {
+		return err
+	}
+	response.ScriptSHA256 = sha256Hex([]byte(script))
+	response.ResultSHA256 = sha256Hex(result)
+	response.Timestamp = now.UTC().Format(time.RFC3339Nano)
+	if config.AuditHMACKey != "" {
+		response.Signature = auditSignature([]byte(config.AuditHMACKey), response.ScriptSHA256, response.ResultSHA256, response.Timestamp)
+	}
+	return nil
+}
+
+// auditSignature is the hex HMAC-SHA256 of the script hash, result hash and
+// timestamp, each followed by a newline
+func auditSignature(key []byte, scriptSHA256, resultSHA256, timestamp string) string {
+	mac := hmac.New(sha256.New, key)
+	for _, field := range []string{scriptSHA256, resultSHA256, timestamp} {
+		mac.Write([]byte(field))
+		mac.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditResponse holds the audit members of a /data response and its raw result
+type auditResponse struct {
+	Result       json.RawMessage `json:"result"`
+	ScriptSHA256 string          `json:"script_sha256"`
+	ResultSHA256 string          `json:"result_sha256"`
+	Timestamp    string          `json:"timestamp"`
+	Signature    string          `json:"signature"`
+}
+
+func postAudited(t *testing.T, sm *ScriptManager, script string) auditResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(script)))
+	var response auditResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// verifySignature recomputes the signature the way a downstream system would
+func verifySignature(key string, r auditResponse) bool {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(r.ScriptSHA256 + "\n" + r.ResultSHA256 + "\n" + r.Timestamp + "\n"))
+	signature, err := hex.DecodeString(r.Signature)
+	return err == nil && hmac.Equal(mac.Sum(nil), signature)
+}
+
+func TestAuditFields(t *testing.T) {
+	const key = "audit-key"
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.AuditFields = true
+		c.AuditHMACKey = key
+	})
+	const script = `({total: 6, items: [1, 2, 3]})`
+	response := postAudited(t, sm, script)
+
+	scriptSum := sha256.Sum256([]byte(script))
+	if response.ScriptSHA256 != hex.EncodeToString(scriptSum[:]) {
+		t.Fatalf("script_sha256 = %s, want the hash of the script", response.ScriptSHA256)
+	}
+	resultSum := sha256.Sum256(response.Result)
+	if response.ResultSHA256 != hex.EncodeToString(resultSum[:]) {
+		t.Fatalf("result_sha256 = %s, want the hash of %s", response.ResultSHA256, response.Result)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, response.Timestamp); err != nil {
+		t.Fatalf("timestamp %q: %v", response.Timestamp, err)
+	}
+	if !verifySignature(key, response) {
+		t.Fatal("signature does not verify with the configured key")
+	}
+	if verifySignature("other-key", response) {
+		t.Fatal("signature verifies with another key")
+	}
+	tampered := response
+	tampered.ResultSHA256 = strings.Repeat("0", 64)
+	if verifySignature(key, tampered) {
+		t.Fatal("signature verifies over another result")
+	}
+}
+
+func TestAuditFieldsOmitted(t *testing.T) {
+	tests := []struct {
+		name          string
+		auditFields   bool
+		key           string
+		script        string
+		wantHashes    bool
+		wantSignature bool
+	}{
+		{name: "disabled", script: `1`},
+		{name: "without a key", auditFields: true, script: `1`, wantHashes: true},
+		{name: "failed execution", auditFields: true, key: "k", script: `throw new Error("boom")`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.AuditFields = tt.auditFields
+				c.AuditHMACKey = tt.key
+			})
+			response := postAudited(t, sm, tt.script)
+			if hashes := response.ScriptSHA256 != "" && response.ResultSHA256 != ""; hashes != tt.wantHashes {
+				t.Errorf("hashes present = %t, want %t", hashes, tt.wantHashes)
+			}
+			if signed := response.Signature != ""; signed != tt.wantSignature {
+				t.Errorf("signature present = %t, want %t", signed, tt.wantSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/sobek/ast"
+	"github.com/grafana/sobek/file"
+)
+
+var (
+	ErrBannedSyntax = errors.New("script uses banned syntax")
+)
+
+// bannedSyntaxRules maps each banned_syntax entry to the nodes it rejects
+var bannedSyntaxRules = map[string]func(ast.Node) bool{
+	"generators": func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FunctionLiteral:
+			return n.Generator
+		case *ast.YieldExpression:
+			return true
+		}
+		return false
+	},
+	"async": func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FunctionLiteral:
+			return n.Async
+		case *ast.ArrowFunctionLiteral:
+			return n.Async
+		case *ast.AwaitExpression:
+			return true
+		}
+		return false
+	},
+	"labels": func(node ast.Node) bool {
+		_, ok := node.(*ast.LabelledStatement)
+		return ok
+	},
+	"try": func(node ast.Node) bool {
+		_, ok := node.(*ast.TryStatement)
+		return ok
+	},
+}
+
+// checkBannedSyntax rejects js when it uses one of the banned constructs,
+// naming the construct and where it first appears. Scripts that do not parse
+// are let through, their execution reports the syntax error.
+func checkBannedSyntax(js string, banned []string) error {
+	if len(banned) == 0 {
+		return nil
+	}
+	program, err := parseScript(js)
+	if err != nil {
+		return nil
+	}
+
+	var found string
+	var at file.Idx
+	walkAST(program, func(node ast.Node) bool {
+		if found != "" {
+			return false
+		}
+		for _, name := range banned {
+			if bannedSyntaxRules[name](node) {
+				found, at = name, node.Idx0()
+				return false
+			}
+		}
+		return true
+	})
+	if found == "" {
+		return nil
+	}
+
+	pos := program.File.Position(int(at) - program.File.Base())
+	return fmt.Errorf("%w: %s at line %d, column %d", ErrBannedSyntax, found, pos.Line, pos.Column)
+}
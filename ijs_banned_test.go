@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBannedSyntax(t *testing.T) {
+	all := []string{"generators", "async", "labels", "try"}
+	tests := []struct {
+		name   string
+		banned []string
+		script string
+		want   string // construct reported, "" when the script is let through
+	}{
+		{name: "nothing banned", script: "function* g() { yield 1 }"},
+		{name: "plain script", banned: all, script: "const f = x => x + 1; f(1)"},
+		{name: "generator function", banned: all, script: "function* g() { yield 1 }", want: "generators"},
+		{name: "generator expression", banned: all, script: "const g = function* () {}", want: "generators"},
+		{name: "generator method", banned: all, script: "({ *g() {} })", want: "generators"},
+		{name: "generator class method", banned: all, script: "class A { *g() {} }", want: "generators"},
+		{name: "generator in a default parameter", banned: all, script: "function f(a = function* () {}) {}", want: "generators"},
+		{name: "generator in a template", banned: all, script: "`${function* () {}}`", want: "generators"},
+		{name: "async function", banned: all, script: "async function f() {}", want: "async"},
+		{name: "async arrow", banned: all, script: "const f = async () => 1", want: "async"},
+		{name: "async method", banned: all, script: "({ async f() {} })", want: "async"},
+		{name: "async class method", banned: all, script: "class A { async f() {} }", want: "async"},
+		{name: "async static class method", banned: all, script: "class A { static async f() {} }", want: "async"},
+		{name: "async generator", banned: []string{"async"}, script: "async function* g() {}", want: "async"},
+		{name: "async in a class field", banned: all, script: "class A { f = async () => 1 }", want: "async"},
+		{name: "async in a static block", banned: all, script: "class A { static { const f = async () => 1 } }", want: "async"},
+		{name: "async as an identifier", banned: all, script: "const async = 1; async + 1"},
+		{name: "label", banned: all, script: "outer: for (;;) { break outer }", want: "labels"},
+		{name: "label in a function", banned: all, script: "function f() { l: { break l } }", want: "labels"},
+		{name: "try", banned: all, script: "try { f() } catch (e) {}", want: "try"},
+		{name: "try finally", banned: all, script: "try {} finally {}", want: "try"},
+		{name: "try in an arrow", banned: all, script: "const f = () => { try {} catch {} }", want: "try"},
+		{name: "try in a getter", banned: all, script: "({ get x() { try {} catch {} } })", want: "try"},
+		{name: "try in a static block", banned: all, script: "class A { static { try {} catch {} } }", want: "try"},
+		{name: "only the banned ones", banned: []string{"try"}, script: "function* g() {} async function f() {} l: {}"},
+		{name: "construct in a string", banned: all, script: `"function* g() { try {} catch {} }"`},
+		{name: "construct in a comment", banned: all, script: "// async function f() {}\n1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkBannedSyntax(tt.script, tt.banned)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrBannedSyntax) {
+				t.Fatalf("error = %v, want ErrBannedSyntax", err)
+			}
+			if prefix := ErrBannedSyntax.Error() + ": " + tt.want + " at line"; !strings.HasPrefix(err.Error(), prefix) {
+				t.Fatalf("error = %q, want it to start with %q", err, prefix)
+			}
+		})
+	}
+}
+
+func TestBannedSyntaxPosition(t *testing.T) {
+	err := checkBannedSyntax("const a = 1\nconst f = () => {\n  try {} catch {}\n}", []string{"try"})
+	if want := "script uses banned syntax: try at line 3, column 3"; err == nil || err.Error() != want {
+		t.Fatalf("error = %v, want %q", err, want)
+	}
+}
+
+// TestBannedSyntaxEverywhere checks every way a script reaches a runtime goes
+// through banned_syntax, and that a script that does not parse still fails.
+func TestBannedSyntaxEverywhere(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "helper.js"), []byte("try { 1 } catch (e) { 2 }"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sm := newTestManager(t, func(c *Config) {
+		c.BannedSyntax = []string{"try"}
+		c.EnableRunScript = true
+	})
+	sm.store = &fileScriptStore{dir: dir}
+
+	t.Run("script", func(t *testing.T) {
+		// the function is never called, the check is on the source
+		_, err := sm.ExecuteScriptWithTimeout("function unused() { try {} finally {} }\n1")
+		if !errors.Is(err, ErrBannedSyntax) {
+			t.Fatalf("error = %v, want ErrBannedSyntax", err)
+		}
+	})
+	t.Run("fanout", func(t *testing.T) {
+		_, err := sm.ExecuteBatchSameScript("try { input } catch {}", []map[string]interface{}{{}})
+		if !errors.Is(err, ErrBannedSyntax) {
+			t.Fatalf("error = %v, want ErrBannedSyntax", err)
+		}
+	})
+	t.Run("runScript", func(t *testing.T) {
+		_, err := sm.ExecuteScriptWithTimeout(`runScript("helper")`)
+		if err == nil || !strings.Contains(err.Error(), ErrBannedSyntax.Error()) {
+			t.Fatalf("error = %v, want the banned syntax of helper reported", err)
+		}
+	})
+	t.Run("does not parse", func(t *testing.T) {
+		_, err := sm.ExecuteScriptWithTimeout("try {")
+		if !errors.Is(err, ErrCompileFailed) {
+			t.Fatalf("error = %v, want ErrCompileFailed", err)
+		}
+	})
+}
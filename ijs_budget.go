@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/grafana/sobek"
+)
+
+// ErrRunTimeBudget is returned when the code of a script runs past max_run_time
+var ErrRunTimeBudget = errors.New("run time budget exceeded")
+
+// watchRunTimeBudget interrupts vm with ErrRunTimeBudget once it has run for
+// budget. sobek does not count instructions, so this is wall-clock time, started
+// once the script is compiled. The returned function stops the watch.
+func watchRunTimeBudget(vm *sobek.Runtime, budget time.Duration) func() {
+	if budget <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(budget, func() {
+		vm.Interrupt(ErrRunTimeBudget)
+	})
+	return func() { timer.Stop() }
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunTimeBudget(t *testing.T) {
+	const budget = 100 * time.Millisecond
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 10 * time.Second
+		c.MaxRunTime = budget
+	})
+
+	// A tight loop is cut off near the budget, long before script_timeout
+	start := time.Now()
+	result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "for (;;) {}"})
+	elapsed := time.Since(start)
+	if !errors.Is(result.Error, ErrRunTimeBudget) {
+		t.Fatalf("error = %v, want ErrRunTimeBudget", result.Error)
+	}
+	if elapsed < budget || elapsed > budget+time.Second {
+		t.Fatalf("loop stopped after %s, want about %s", elapsed, budget)
+	}
+	if code := errorCode(result.Error); code != CodeRunTimeBudget {
+		t.Fatalf("code = %s, want %s", code, CodeRunTimeBudget)
+	}
+	rec := httptest.NewRecorder()
+	handleExecutionError(result.Error, rec)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422", rec.Code)
+	}
+
+	// The budget is per execution, a script within it is not affected by an earlier one
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: spinScript(budget / 2)}); result.Error != nil {
+		t.Fatalf("script within the budget failed: %v", result.Error)
+	}
+}
+
+func TestRunTimeBudgetDisabled(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 150 * time.Millisecond
+	})
+	result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "for (;;) {}"})
+	if !errors.Is(result.Error, ErrScriptTimeout) {
+		t.Fatalf("error = %v, want ErrScriptTimeout without max_run_time", result.Error)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resultCache keeps the results of successful executions for ttl, evicting the
+// least recently used entry beyond size entries
+type resultCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // most recently used first
+}
+
+type cachedResult struct {
+	key     [sha256.Size]byte
+	result  ScriptResult
+	expires time.Time
+}
+
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the result stored under key, if it has not expired
+func (c *resultCache) get(key [sha256.Size]byte) (ScriptResult, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return ScriptResult{}, false
+	}
+	entry := elem.Value.(*cachedResult)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return ScriptResult{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.result, true
+}
+
+// put stores a successful result under key
+func (c *resultCache) put(key [sha256.Size]byte, result ScriptResult) {
+	if result.Error != nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	entry := &cachedResult{key: key, result: result, expires: time.Now().Add(c.ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+}
+
+// resultCacheKey hashes everything that shapes the result of a pure script:
+// its source, input, clock, seed and time zone, and the reload generation of
+// the reference data it reads. With result_cache_normalize the source is hashed
+// in its canonical form, the original still being what runs.
+func resultCacheKey(job ScriptJob, reloads uint64) ([sha256.Size]byte, error) {
+	input, err := json.Marshal(job.Input)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	script := job.Script
+	if config.ResultCacheNormalize {
+		script = normalizeScript(script)
+	}
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(script), input} {
+		binary.Write(h, binary.BigEndian, uint64(len(field)))
+		h.Write(field)
+	}
+	binary.Write(h, binary.BigEndian, job.Now.UnixNano())
+	if job.Seed != nil {
+		binary.Write(h, binary.BigEndian, *job.Seed)
+	}
+	if job.Location != nil {
+		h.Write([]byte(job.Location.String()))
+	}
+	binary.Write(h, binary.BigEndian, reloads)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key, nil
+}
+
+// useResultCache reports whether the result of a request may be served from, and
+// stored into, the cache. Results are only reused for scripts known to be pure,
+// which deterministic_mode guarantees and clients may assert with X-Script-Pure.
+// Cache-Control: no-cache forces a fresh run, still caching its result.
+func useResultCache(r *http.Request) (lookup, store bool) {
+	pure, _ := strconv.ParseBool(r.Header.Get("X-Script-Pure"))
+	if !config.DeterministicMode && !pure {
+		return false, false
+	}
+	noCache := strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache")
+	return !noCache, true
+}
+
+// executeCached runs job for a /data request, going through the result cache
+// when it is enabled and the request allows it. X-Cache tells the client
+// whether the result came from the cache.
+func (sm *ScriptManager) executeCached(ctx context.Context, r *http.Request, w http.ResponseWriter, job ScriptJob) ScriptResult {
+	lookup, store := useResultCache(r)
+	// A session script reads state the cache key does not cover
+	if sm.results == nil || !store || job.session != nil {
+		return sm.ExecuteScriptWithContext(ctx, job)
+	}
+
+	key, err := resultCacheKey(job, atomic.LoadUint64(&sm.reloads))
+	if err != nil {
+		logrus.WithError(err).Warn("Cannot hash input for the result cache")
+		return sm.ExecuteScriptWithContext(ctx, job)
+	}
+	if lookup {
+		if result, ok := sm.results.get(key); ok {
+			// Nothing ran for this request
+			result.Duration, result.AllocBytes, result.Stages = 0, 0, StageTimings{}
+			// The cached run may have kept its logs under another logs_on
+			result.Logs = logsFor(job.LogsOn, false, result.Logs)
+			w.Header().Set("X-Cache", "HIT")
+			logrus.Info("Serving script result from cache")
+			return result
+		}
+	}
+
+	w.Header().Set("X-Cache", "MISS")
+	result := sm.ExecuteScriptWithContext(ctx, job)
+	sm.results.put(key, result)
+	return result
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultCacheNormalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize bool
+		first     string
+		second    string
+		wantCache string // X-Cache of the second request
+	}{
+		{name: "same script", first: "1 + 1", second: "1 + 1", wantCache: "HIT"},
+		{name: "layout without normalizing", first: "1 + 1", second: "1  +  1", wantCache: "MISS"},
+		{name: "layout", normalize: true, first: "1 + 1", second: "1  +\t1 ", wantCache: "HIT"},
+		{name: "comments", normalize: true, first: "let a = 2; a * 21", second: "// answer\nlet a = 2; /* doubled */ a * 21", wantCache: "HIT"},
+		{name: "indentation", normalize: true, first: "function f() {\nreturn 42\n}\nf()", second: "function f() {\n    return 42\n}\n\nf()", wantCache: "HIT"},
+		{name: "string contents kept", normalize: true, first: `"a  b"`, second: `"a b"`, wantCache: "MISS"},
+		{name: "template contents kept", normalize: true, first: "`a  ${1}`", second: "`a ${1}`", wantCache: "MISS"},
+		{name: "different code", normalize: true, first: "1 + 1", second: "1 + 2", wantCache: "MISS"},
+		{name: "line breaks kept", normalize: true, first: "let a = 1\nlet b = a\n-1\nb", second: "let a = 1\nlet b = a -1\nb", wantCache: "MISS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.ResultCacheNormalize = tt.normalize
+			})
+			sm.results = newResultCache(10, time.Minute)
+
+			run := func(script string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(script))
+				r.Header.Set("X-Script-Pure", "true")
+				rec := httptest.NewRecorder()
+				handler(sm)(rec, r)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d %s for %q", rec.Code, rec.Body, script)
+				}
+				return rec
+			}
+			first := run(tt.first)
+			if cache := first.Header().Get("X-Cache"); cache != "MISS" {
+				t.Fatalf("first X-Cache = %s, want MISS", cache)
+			}
+			second := run(tt.second)
+			if cache := second.Header().Get("X-Cache"); cache != tt.wantCache {
+				t.Fatalf("second X-Cache = %s, want %s", cache, tt.wantCache)
+			}
+			if tt.wantCache == "HIT" && second.Body.String() != first.Body.String() {
+				t.Fatalf("cached body %s, want %s", second.Body, first.Body)
+			}
+		})
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	files := writeRefData(t, map[string]string{"rates": `{"usd": 1.1}`})
+	config.RefData = files
+	if _, err := sm.reload(); err != nil {
+		t.Fatal(err)
+	}
+	sm.results = newResultCache(2, 200*time.Millisecond)
+
+	// run posts an envelope, returning its X-Cache and result
+	run := func(body string, header http.Header) (string, string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Script-Pure", "true")
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		handler(sm)(rec, r)
+		var response struct {
+			Result json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Header().Get("X-Cache"), string(response.Result)
+	}
+	const counted = `{"script": "input.a + Math.random()", "input": {"a": 1}}`
+
+	steps := []struct {
+		name      string
+		body      string
+		header    http.Header
+		wantCache string
+		same      bool // result is the one of the previous step
+	}{
+		{name: "miss", body: counted, wantCache: "MISS"},
+		{name: "hit", body: counted, wantCache: "HIT", same: true},
+		{name: "other input", body: `{"script": "input.a + Math.random()", "input": {"a": 2}}`, wantCache: "MISS"},
+		{name: "no-cache runs again", body: counted, header: http.Header{"Cache-Control": {"no-cache"}}, wantCache: "MISS"},
+		{name: "no-cache result stored", body: counted, wantCache: "HIT", same: true},
+		{name: "not pure", body: counted, header: http.Header{"X-Script-Pure": {"false"}}, wantCache: ""},
+		{name: "other seed", body: `{"script": "input.a + Math.random()", "input": {"a": 1}, "seed": 7}`, wantCache: "MISS"},
+		{name: "errors not cached", body: `{"script": "throw new Error('x')"}`, wantCache: "MISS"},
+		{name: "errors run again", body: `{"script": "throw new Error('x')"}`, wantCache: "MISS"},
+	}
+	previous := ""
+	for _, step := range steps {
+		cache, result := run(step.body, step.header)
+		if cache != step.wantCache {
+			t.Fatalf("%s: X-Cache = %q, want %q", step.name, cache, step.wantCache)
+		}
+		if step.same && result != previous {
+			t.Fatalf("%s: result %s, want the cached %s", step.name, result, previous)
+		}
+		previous = result
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		run(counted, nil)
+		if cache, _ := run(counted, nil); cache != "HIT" {
+			t.Fatalf("X-Cache = %s before the ttl, want HIT", cache)
+		}
+		time.Sleep(250 * time.Millisecond)
+		if cache, _ := run(counted, nil); cache != "MISS" {
+			t.Fatalf("X-Cache = %s after the ttl, want MISS", cache)
+		}
+	})
+
+	t.Run("least recently used evicted", func(t *testing.T) {
+		sm.results = newResultCache(2, time.Minute)
+		a, b, c := `{"script": "'a'"}`, `{"script": "'b'"}`, `{"script": "'c'"}`
+		run(a, nil)
+		run(b, nil)
+		run(a, nil) // b is now the least recently used
+		run(c, nil)
+		// b last, as running it again caches it
+		for _, check := range [][2]string{{a, "HIT"}, {c, "HIT"}, {b, "MISS"}} {
+			if cache, _ := run(check[0], nil); cache != check[1] {
+				t.Fatalf("X-Cache of %s = %s, want %s", check[0], cache, check[1])
+			}
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		sm.results = newResultCache(2, time.Minute)
+		lookup := `{"script": "refdata.lookup('rates', 'usd')"}`
+		if cache, result := run(lookup, nil); cache != "MISS" || result != "1.1" {
+			t.Fatalf("X-Cache = %s, result %s, want MISS and 1.1", cache, result)
+		}
+		if err := os.WriteFile(files["rates"], []byte(`{"usd": 1.2}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sm.reload(); err != nil {
+			t.Fatal(err)
+		}
+		if cache, result := run(lookup, nil); cache != "MISS" || result != "1.2" {
+			t.Fatalf("X-Cache = %s, result %s after a reload, want MISS and 1.2", cache, result)
+		}
+		if cache, _ := run(lookup, nil); cache != "HIT" {
+			t.Fatalf("X-Cache = %s, want the reloaded result cached", cache)
+		}
+	})
+}
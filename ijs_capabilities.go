@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/grafana/sobek"
+)
+
+// HostFunction describes a global installed by the server
+type HostFunction struct {
+	Name        string `json:"name"`
+	Signature   string `json:"signature,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// hostFunctionDocs documents the host functions by global name. Which of them
+// are reported comes from a VM set up as for an execution, not from this table.
+var hostFunctionDocs = map[string]HostFunction{
+	"timeBudget":     {Signature: "timeBudget(): number", Description: "Milliseconds left before the script is interrupted."},
+	"setStatus":      {Signature: "setStatus(code)", Description: "HTTP status of the response, 200-499, other codes throw a TypeError."},
+	"setContentType": {Signature: "setContentType(type)", Description: "Sends the result as the raw response body with that content type, which the profile must allow."},
+	"console":        {Signature: "console.log(...), info, warn, error, debug", Description: "Records a line, returned in logs as logs_on selects."},
+	"render":         {Signature: "render(template, data): string", Description: "Renders a Go text/template against data."},
+	"regexMatch":     {Signature: "regexMatch(pattern, text, flags)", Description: "Like text.match(new RegExp(pattern, flags)), run by RE2 in linear time."},
+	"regexTest":      {Signature: "regexTest(pattern, text, flags): boolean", Description: "Like new RegExp(pattern, flags).test(text), on RE2."},
+	"progress":       {Signature: "progress(fraction, message)", Description: "Reports how far an async job is, does nothing outside /jobs."},
+	"uuid":           {Signature: "uuid(): string", Description: "Random version 4 UUID."},
+	"encodeBase64":   {Signature: "encodeBase64(data): string", Description: "Base64 of a string or Uint8Array."},
+	"decodeBase64":   {Signature: "decodeBase64(text): string", Description: "Decodes base64."},
+	"encodeHex":      {Signature: "encodeHex(data): string", Description: "Hex of a string or Uint8Array."},
+	"decodeHex":      {Signature: "decodeHex(text): string", Description: "Decodes hex."},
+	"parseCSV":       {Signature: "parseCSV(text, opts)", Description: "Parses CSV into row objects, or arrays with header: false."},
+	"toCSV":          {Signature: "toCSV(rows, opts): string", Description: "Writes row objects or arrays as CSV."},
+	"formatNumber":   {Signature: "formatNumber(n, opts): string", Description: "Formats a number with its integer part grouped by thousands."},
+	"formatDate":     {Signature: "formatDate(date, layout, tz): string", Description: "Formats a Date or epoch milliseconds with a Go layout in an IANA zone."},
+	"runScript":      {Signature: "runScript(name, input)", Description: "Runs a script of the script store and returns its result."},
+	"session":        {Signature: "session.get(key), session.set(key, value)", Description: "Reads or stores JSON values kept between the scripts of a session, only with a session_id."},
+	"refdata":        {Signature: "refdata.lookup(dataset, key)", Description: "Looks a key up in a reference dataset."},
+}
+
+// CapabilityLimits are the limits an execution runs under, 0 meaning unlimited
+type CapabilityLimits struct {
+	ScriptTimeoutMs    int64          `json:"script_timeout_ms"`
+	MaxScriptTimeoutMs int64          `json:"max_script_timeout_ms"`
+	MaxScriptSize      int64          `json:"max_script_size"`
+	MaxMemoryMB        int            `json:"max_memory_mb"`
+	MaxScriptAllocMB   int            `json:"max_script_alloc_mb"`
+	MaxRunTimeMs       int64          `json:"max_run_time_ms"`
+	MaxCallStack       int            `json:"max_call_stack"`
+	MaxResultBytes     int            `json:"max_result_bytes"`
+	MaxUserGlobals     int            `json:"max_user_globals"`
+	MaxHostCalls       map[string]int `json:"max_host_calls,omitempty"`
+}
+
+// Capabilities is the body returned by GET /capabilities
+type Capabilities struct {
+	Profile             string              `json:"profile"`
+	AllowedContentTypes []string            `json:"allowed_content_types"`
+	HostFunctions       []HostFunction      `json:"host_functions"`
+	Globals             []string            `json:"globals"` // standard globals left to scripts
+	RestrictedGlobals   []string            `json:"restricted_globals"`
+	RestrictedMembers   map[string][]string `json:"restricted_members,omitempty"`
+	BannedSyntax        []string            `json:"banned_syntax,omitempty"`
+	FrozenGlobal        bool                `json:"frozen_global"`
+	Limits              CapabilityLimits    `json:"limits"`
+}
+
+// sandboxGlobals sets up a VM as an execution would and splits its globals
+// into the standard ones and those the server installed. Sessions are set up
+// as for a request carrying a session_id.
+func (sm *ScriptManager) sandboxGlobals() (globals []string, hostFunctions []HostFunction) {
+	vm := newRuntime()
+	standard := make(map[string]bool)
+	for _, name := range vm.GlobalObject().GetOwnPropertyNames() {
+		if value := vm.Get(name); value != nil && !sobek.IsNull(value) && !sobek.IsUndefined(value) {
+			standard[name] = true
+		}
+	}
+	job := ScriptJob{}
+	if config.EnableSessions {
+		job.session = &session{}
+	}
+	sm.installHostFunctions(vm, context.Background(), job, &scriptOutput{})
+
+	for _, name := range vm.GlobalObject().GetOwnPropertyNames() {
+		value := vm.Get(name)
+		switch {
+		case value == nil || sobek.IsNull(value) || sobek.IsUndefined(value):
+		case standard[name]:
+			globals = append(globals, name)
+		default:
+			doc := hostFunctionDocs[name]
+			doc.Name = name
+			hostFunctions = append(hostFunctions, doc)
+		}
+	}
+	sort.Strings(globals)
+	sort.Slice(hostFunctions, func(i, j int) bool { return hostFunctions[i].Name < hostFunctions[j].Name })
+	return globals, hostFunctions
+}
+
+// capabilities describes what a script running under profile may use
+func (sm *ScriptManager) capabilities(profileName string, profile SandboxProfile) Capabilities {
+	globals, hostFunctions := sm.sandboxGlobals()
+	restricted := slices.Clone(restrictedGlobals)
+	sort.Strings(restricted)
+	return Capabilities{
+		Profile:             profileName,
+		AllowedContentTypes: profile.AllowedContentTypes,
+		HostFunctions:       hostFunctions,
+		Globals:             globals,
+		RestrictedGlobals:   restricted,
+		RestrictedMembers:   config.RestrictedMembers,
+		BannedSyntax:        config.BannedSyntax,
+		FrozenGlobal:        config.FreezeGlobal,
+		Limits: CapabilityLimits{
+			ScriptTimeoutMs:    config.ScriptTimeout.Milliseconds(),
+			MaxScriptTimeoutMs: longestScriptTimeout().Milliseconds(),
+			MaxScriptSize:      sm.maxScriptSize,
+			MaxMemoryMB:        config.MaxMemoryMB,
+			MaxScriptAllocMB:   config.MaxScriptAllocMB,
+			MaxRunTimeMs:       config.MaxRunTime.Milliseconds(),
+			MaxCallStack:       config.MaxCallStack,
+			MaxResultBytes:     config.MaxResultBytes,
+			MaxUserGlobals:     config.MaxUserGlobals,
+			MaxHostCalls:       config.MaxHostCalls,
+		},
+	}
+}
+
+// capabilitiesHandler serves GET /capabilities, for the profile of the request
+// or the one named by ?profile=
+func capabilitiesHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profileName, profile := profileFor(r)
+		if name := r.URL.Query().Get("profile"); name != "" {
+			var ok bool
+			if profile, ok = namedProfile(name); !ok {
+				writeJSON(w, http.StatusNotFound, Response{Error: "unknown sandbox profile " + name, Code: CodeInvalidRequest})
+				return
+			}
+			profileName = name
+		}
+		writeJSONValue(w, http.StatusOK, scriptManager.capabilities(profileName, profile))
+	}
+}
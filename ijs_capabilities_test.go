@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getCapabilities requests GET /capabilities with query and the profile token
+func getCapabilities(t *testing.T, sm *ScriptManager, query, token string) (int, Capabilities) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/capabilities"+query, nil)
+	if token != "" {
+		r.Header.Set("X-Profile-Token", token)
+	}
+	rec := httptest.NewRecorder()
+	capabilitiesHandler(sm)(rec, r)
+	var c Capabilities
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, c
+}
+
+func hostFunctionNames(c Capabilities) []string {
+	var names []string
+	for _, f := range c.HostFunctions {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestCapabilitiesMatchSandbox(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableStdlib = true
+		c.RestrictedMembers = map[string][]string{"JSON": {"parse"}}
+	})
+	status, c := getCapabilities(t, sm, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+
+	// What is reported is what a script finds
+	for _, f := range c.HostFunctions {
+		if f.Signature == "" || f.Description == "" {
+			t.Errorf("host function %s is not documented", f.Name)
+		}
+		if result, err := sm.ExecuteScriptWithTimeout("typeof " + f.Name); err != nil || result == "undefined" {
+			t.Errorf("host function %s: typeof = %v, %v", f.Name, result, err)
+		}
+	}
+	for _, name := range c.Globals {
+		if result, err := sm.ExecuteScriptWithTimeout("typeof " + name); err != nil || result == "undefined" {
+			t.Errorf("global %s: typeof = %v, %v", name, result, err)
+		}
+	}
+	for _, name := range c.RestrictedGlobals {
+		if strings.Contains(name, ".") {
+			continue
+		}
+		if result, err := sm.ExecuteScriptWithTimeout(name + " === null"); err != nil || result != true {
+			t.Errorf("restricted global %s: %v, %v, want null", name, result, err)
+		}
+		if slices.Contains(c.Globals, name) {
+			t.Errorf("%s is reported both available and restricted", name)
+		}
+	}
+	if !reflect.DeepEqual(c.RestrictedMembers, map[string][]string{"JSON": {"parse"}}) {
+		t.Errorf("restricted_members = %v", c.RestrictedMembers)
+	}
+	if result, err := sm.ExecuteScriptWithTimeout("typeof JSON.parse"); err != nil || result != "undefined" {
+		t.Errorf("typeof JSON.parse = %v, %v", result, err)
+	}
+	for _, name := range []string{"encodeBase64", "formatDate", "setStatus", "console"} {
+		if !slices.Contains(hostFunctionNames(c), name) {
+			t.Errorf("host functions %v lack %s", hostFunctionNames(c), name)
+		}
+	}
+}
+
+func TestCapabilitiesFollowConfig(t *testing.T) {
+	t.Run("stdlib off", func(t *testing.T) {
+		sm := newTestManager(t, nil)
+		_, c := getCapabilities(t, sm, "", "")
+		for _, name := range []string{"encodeBase64", "parseCSV", "formatDate", "runScript", "session"} {
+			if slices.Contains(hostFunctionNames(c), name) {
+				t.Errorf("%s reported with its feature off", name)
+			}
+		}
+	})
+	t.Run("limits", func(t *testing.T) {
+		sm := newTestManager(t, func(c *Config) {
+			c.ScriptTimeout = 1500 * time.Millisecond
+			c.TimeoutJitter = 0.2
+			c.MaxMemoryMB = 300
+			c.MaxScriptAllocMB = 64
+			c.MaxCallStack = 200
+			c.MaxResultBytes = 4096
+			c.MaxUserGlobals = 30
+			c.MaxHostCalls = map[string]int{"uuid": 10}
+			c.FreezeGlobal = true
+			c.BannedSyntax = []string{"with"}
+		})
+		_, c := getCapabilities(t, sm, "", "")
+		want := CapabilityLimits{
+			ScriptTimeoutMs:    1500,
+			MaxScriptTimeoutMs: 1800,
+			MaxScriptSize:      sm.maxScriptSize,
+			MaxMemoryMB:        300,
+			MaxScriptAllocMB:   64,
+			MaxRunTimeMs:       config.MaxRunTime.Milliseconds(),
+			MaxCallStack:       200,
+			MaxResultBytes:     4096,
+			MaxUserGlobals:     30,
+			MaxHostCalls:       map[string]int{"uuid": 10},
+		}
+		if !reflect.DeepEqual(c.Limits, want) {
+			t.Errorf("limits = %+v, want %+v", c.Limits, want)
+		}
+		if !c.FrozenGlobal || !reflect.DeepEqual(c.BannedSyntax, []string{"with"}) {
+			t.Errorf("frozen_global = %t, banned_syntax = %v", c.FrozenGlobal, c.BannedSyntax)
+		}
+	})
+}
+
+func TestCapabilitiesProfiles(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.SandboxProfiles = map[string]SandboxProfile{
+			"public":   {AllowedContentTypes: []string{"application/json"}},
+			"internal": {Tokens: []string{"internal-token"}, AllowedContentTypes: []string{"application/json", "text/*"}},
+		}
+		c.DefaultProfile = "public"
+	})
+	tests := []struct {
+		name        string
+		query       string
+		token       string
+		wantStatus  int
+		wantProfile string
+	}{
+		{name: "default profile", wantStatus: http.StatusOK, wantProfile: "public"},
+		{name: "token", token: "internal-token", wantStatus: http.StatusOK, wantProfile: "internal"},
+		{name: "query", query: "?profile=internal", wantStatus: http.StatusOK, wantProfile: "internal"},
+		{name: "query over token", query: "?profile=public", token: "internal-token", wantStatus: http.StatusOK, wantProfile: "public"},
+		{name: "unknown profile", query: "?profile=nope", wantStatus: http.StatusNotFound},
+		{name: "builtin once profiles are set", query: "?profile=builtin", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, c := getCapabilities(t, sm, tt.query, tt.token)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			if c.Profile != tt.wantProfile {
+				t.Fatalf("profile = %q, want %q", c.Profile, tt.wantProfile)
+			}
+			if want := config.SandboxProfiles[tt.wantProfile].AllowedContentTypes; !reflect.DeepEqual(c.AllowedContentTypes, want) {
+				t.Fatalf("allowed_content_types = %v, want %v", c.AllowedContentTypes, want)
+			}
+		})
+	}
+
+	// The content types reported for a profile are those its scripts may set
+	for _, token := range []string{"", "internal-token"} {
+		_, c := getCapabilities(t, sm, "", token)
+		r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`setContentType("text/csv"); "a,b"`))
+		if token != "" {
+			r.Header.Set("X-Profile-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		handler(sm)(rec, r)
+		allowed := slices.Contains(c.AllowedContentTypes, "text/*")
+		if got := rec.Code == http.StatusOK; got != allowed {
+			t.Errorf("profile %s reports %v but text/csv got %d", c.Profile, c.AllowedContentTypes, rec.Code)
+		}
+	}
+}
+
+func TestCapabilitiesBuiltinProfile(t *testing.T) {
+	sm := newTestManager(t, nil)
+	for _, query := range []string{"", "?profile=builtin"} {
+		status, c := getCapabilities(t, sm, query, "")
+		if status != http.StatusOK || c.Profile != "builtin" || !reflect.DeepEqual(c.AllowedContentTypes, builtinProfile.AllowedContentTypes) {
+			t.Errorf("%q: %d %+v", query, status, c)
+		}
+	}
+	if status, _ := getCapabilities(t, sm, "?profile=public", ""); status != http.StatusNotFound {
+		t.Errorf("unknown profile: status = %d, want 404", status)
+	}
+}
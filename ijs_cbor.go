@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/grafana/sobek"
+)
+
+// cborContentType is the media type clients ask for with Accept to get CBOR
+const cborContentType = "application/cbor"
+
+// cborMode encodes responses the way their JSON form is shaped: structs are
+// keyed by their json tag names, omitempty follows encoding/json and a Date is
+// its RFC 3339 string. Map keys are sorted as the core deterministic encoding
+// does (RFC 8949 section 4.2.1), so the same value always encodes to the same
+// bytes.
+var cborMode = func() cbor.EncMode {
+	mode, err := cbor.EncOptions{
+		Sort:      cbor.SortCoreDeterministic,
+		Time:      cbor.TimeRFC3339Nano,
+		OmitEmpty: cbor.OmitEmptyGoValue,
+		// Floats stay 64-bit, NaN and Infinity included
+		NaNConvert: cbor.NaNConvertNone,
+		InfConvert: cbor.InfConvertNone,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// wantsCBOR reports whether the Accept header of r lists application/cbor.
+// JSON stays the default, q-values are not weighed.
+func wantsCBOR(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if mediaType, _, err := mime.ParseMediaType(part); err == nil && mediaType == cborContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeCBOR writes v as CBOR with cborMode. Byte slices and ArrayBuffers
+// become byte strings where JSON would have used base64.
+func encodeCBOR(w io.Writer, v interface{}) error {
+	if response, ok := v.(Response); ok {
+		response.Result = cborBytes(response.Result)
+		v = response
+	}
+	data, err := cborMode.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// cborBytes replaces every ArrayBuffer of an exported value with its bytes,
+// which the encoder cannot reach inside sobek.ArrayBuffer
+func cborBytes(v interface{}) interface{} {
+	switch val := v.(type) {
+	case sobek.ArrayBuffer:
+		return val.Bytes()
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = cborBytes(item)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = cborBytes(item)
+		}
+		return val
+	default:
+		return v
+	}
+}
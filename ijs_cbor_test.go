@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/grafana/sobek"
+)
+
+func TestEncodeCBOR(t *testing.T) {
+	vm := sobek.New()
+	date := time.Date(2024, 5, 1, 12, 30, 0, 500, time.UTC)
+	tests := []struct {
+		name     string
+		response Response
+		want     map[string]interface{}
+	}{
+		{
+			name:     "empty fields omitted",
+			response: Response{Result: "ok"},
+			want:     map[string]interface{}{"result": "ok"},
+		},
+		{
+			name:     "error with code",
+			response: Response{Error: "boom", Code: CodeScriptError, ErrorName: "TypeError"},
+			want:     map[string]interface{}{"error": "boom", "code": CodeScriptError, "error_name": "TypeError"},
+		},
+		{
+			name: "numbers",
+			response: Response{Result: []interface{}{
+				int64(-3), int64(1) << 40, 1.5, math.Inf(1), true, nil,
+			}},
+			want: map[string]interface{}{"result": []interface{}{
+				int64(-3), uint64(1) << 40, 1.5, math.Inf(1), true, nil,
+			}},
+		},
+		{
+			name:     "nested objects",
+			response: Response{Result: map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{"c"}}}},
+			want:     map[string]interface{}{"result": map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{"c"}}}},
+		},
+		{
+			name:     "bytes",
+			response: Response{Result: []byte{1, 2, 3}},
+			want:     map[string]interface{}{"result": []byte{1, 2, 3}},
+		},
+		{
+			name:     "ArrayBuffer nested",
+			response: Response{Result: map[string]interface{}{"buf": vm.NewArrayBuffer([]byte("hi"))}},
+			want:     map[string]interface{}{"result": map[string]interface{}{"buf": []byte("hi")}},
+		},
+		{
+			name:     "Date as its JSON string",
+			response: Response{Result: date},
+			want:     map[string]interface{}{"result": date.Format(time.RFC3339Nano)},
+		},
+		{
+			name:     "tagged number",
+			response: Response{Result: TaggedNumber{Type: "bigint", Value: "12345678901234567890"}},
+			want:     map[string]interface{}{"result": map[string]interface{}{"type": "bigint", "value": "12345678901234567890"}},
+		},
+		{
+			name:     "logs and timing",
+			response: Response{Result: int64(1), Logs: []ConsoleLine{{Level: "log", Message: "hi"}}, Timing: &ResponseTiming{}},
+			want: map[string]interface{}{
+				"result": uint64(1),
+				"logs":   []interface{}{map[string]interface{}{"level": "log", "message": "hi"}},
+				"timing": map[string]interface{}{"queue_ms": 0.0, "parse_ms": 0.0, "exec_ms": 0.0, "encode_ms": 0.0, "total_ms": 0.0},
+			},
+		},
+	}
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encodeCBOR(&buf, tt.response); err != nil {
+				t.Fatal(err)
+			}
+			var got interface{}
+			if err := dec.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("decoded %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeCBORDeterministic(t *testing.T) {
+	result := map[string]interface{}{"bb": 1, "a": 2, "c": 3, "aaa": 4}
+	var first bytes.Buffer
+	if err := encodeCBOR(&first, Response{Result: result}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		var again bytes.Buffer
+		if err := encodeCBOR(&again, Response{Result: result}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first.Bytes(), again.Bytes()) {
+			t.Fatal("the same value encoded to different bytes")
+		}
+	}
+	// Shorter keys first, then bytewise
+	want := []byte{0xa4, 0x61, 'a', 0x02, 0x61, 'c', 0x03, 0x62, 'b', 'b', 0x01, 0x63, 'a', 'a', 'a', 0x04}
+	if !bytes.Contains(first.Bytes(), want) {
+		t.Fatalf("encoded %x, want the result map as %x", first.Bytes(), want)
+	}
+}
+
+func TestEncodeCBORFloats(t *testing.T) {
+	for _, f := range []float64{1.5, 0, math.NaN(), math.Inf(-1)} {
+		var buf bytes.Buffer
+		if err := encodeCBOR(&buf, Response{Result: f}); err != nil {
+			t.Fatal(err)
+		}
+		// {"result": f}, with f a double precision float: 0xfb and 8 bytes
+		if encoded := buf.Bytes(); len(encoded) != 17 || encoded[8] != 0xfb {
+			t.Fatalf("%v encoded as %x, want a 64-bit float", f, encoded)
+		}
+	}
+}
+
+func TestWantsCBOR(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   bool
+	}{
+		{name: "no Accept"},
+		{name: "json", accept: []string{"application/json"}},
+		{name: "cbor", accept: []string{"application/cbor"}, want: true},
+		{name: "cbor in a list", accept: []string{"application/json, application/cbor;q=0.5"}, want: true},
+		{name: "cbor in a second header", accept: []string{"text/plain", "application/cbor"}, want: true},
+		{name: "other cbor type", accept: []string{"application/cbor-seq"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			for _, accept := range tt.accept {
+				r.Header.Add("Accept", accept)
+			}
+			if got := wantsCBOR(r); got != tt.want {
+				t.Fatalf("wantsCBOR = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "fmt"
+
+// deepClone copies a decoded JSON value, so the VM never shares maps or slices
+// with the caller. It walks the value with an explicit stack rather than
+// recursion, and fails once containers nest deeper than maxDepth, 0 meaning
+// unbounded. Values other than maps and slices are immutable and kept as is.
+func deepClone(v interface{}, maxDepth int) (interface{}, error) {
+	type pending struct {
+		value interface{}
+		depth int // depth of the container holding value
+		store func(interface{})
+	}
+
+	var root interface{}
+	stack := []pending{{value: v, store: func(c interface{}) { root = c }}}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		switch val := p.value.(type) {
+		case map[string]interface{}:
+			if maxDepth > 0 && p.depth+1 > maxDepth {
+				return nil, fmt.Errorf("%w: input is nested deeper than %d levels", ErrInvalidEnvelope, maxDepth)
+			}
+			copied := make(map[string]interface{}, len(val))
+			p.store(copied)
+			for k, item := range val {
+				stack = append(stack, pending{item, p.depth + 1, func(c interface{}) { copied[k] = c }})
+			}
+		case []interface{}:
+			if maxDepth > 0 && p.depth+1 > maxDepth {
+				return nil, fmt.Errorf("%w: input is nested deeper than %d levels", ErrInvalidEnvelope, maxDepth)
+			}
+			copied := make([]interface{}, len(val))
+			p.store(copied)
+			for i, item := range val {
+				stack = append(stack, pending{item, p.depth + 1, func(c interface{}) { copied[i] = c }})
+			}
+		default:
+			p.store(val)
+		}
+	}
+	return root, nil
+}
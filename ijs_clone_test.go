@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeepClone(t *testing.T) {
+	input := map[string]interface{}{
+		"name":   "a",
+		"n":      1.5,
+		"none":   nil,
+		"list":   []interface{}{1.0, map[string]interface{}{"x": true}},
+		"nested": map[string]interface{}{"a": map[string]interface{}{"b": 1.0}},
+	}
+	cloned, err := deepClone(input, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cloned, input) {
+		t.Fatalf("clone = %#v, want %#v", cloned, input)
+	}
+
+	copied := cloned.(map[string]interface{})
+	copied["name"] = "b"
+	copied["list"].([]interface{})[0] = 2.0
+	copied["list"].([]interface{})[1].(map[string]interface{})["x"] = false
+	copied["nested"].(map[string]interface{})["a"].(map[string]interface{})["b"] = 2.0
+	want := map[string]interface{}{
+		"name":   "a",
+		"n":      1.5,
+		"none":   nil,
+		"list":   []interface{}{1.0, map[string]interface{}{"x": true}},
+		"nested": map[string]interface{}{"a": map[string]interface{}{"b": 1.0}},
+	}
+	if !reflect.DeepEqual(input, want) {
+		t.Fatalf("original changed to %#v", input)
+	}
+
+	for _, scalar := range []interface{}{nil, "s", 1.0, true} {
+		if got, err := deepClone(scalar, 1); err != nil || got != scalar {
+			t.Errorf("deepClone(%#v) = %#v, %v", scalar, got, err)
+		}
+	}
+}
+
+func TestDeepCloneDepth(t *testing.T) {
+	// nest returns depth containers, alternating objects and arrays
+	nest := func(depth int) interface{} {
+		var v interface{} = "leaf"
+		for i := 0; i < depth; i++ {
+			if i%2 == 0 {
+				v = []interface{}{v}
+			} else {
+				v = map[string]interface{}{"k": v}
+			}
+		}
+		return v
+	}
+	tests := []struct {
+		name     string
+		depth    int
+		maxDepth int
+		wantErr  bool
+	}{
+		{"within", 3, 4, false},
+		{"at the limit", 4, 4, false},
+		{"past the limit", 5, 4, true},
+		{"unbounded", 10000, 0, false},
+		{"deep past the limit", 10000, 32, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := nest(tt.depth)
+			cloned, err := deepClone(input, tt.maxDepth)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidEnvelope) || !strings.Contains(err.Error(), "nested deeper than") {
+					t.Fatalf("error = %v, want the depth bound exceeded", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cloned, input) {
+				t.Fatal("clone differs from the input")
+			}
+		})
+	}
+}
+
+func TestScriptInputIsolated(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.MaxInputDepth = 4
+	})
+	input := map[string]interface{}{
+		"list":   []interface{}{1.0},
+		"nested": map[string]interface{}{"a": 1.0},
+	}
+	result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{
+		Script: `input.nested.a = 2; input.list[0] = 2; input.added = true; input.nested.a`,
+		Input:  input,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result.Result != int64(2) {
+		t.Fatalf("result = %#v, want the script to see its own change", result.Result)
+	}
+	want := map[string]interface{}{
+		"list":   []interface{}{1.0},
+		"nested": map[string]interface{}{"a": 1.0},
+	}
+	if !reflect.DeepEqual(input, want) {
+		t.Fatalf("input changed to %#v by the script", input)
+	}
+
+	deep := map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": map[string]interface{}{"d": map[string]interface{}{"e": 1.0}}}}}
+	result = sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: `1`, Input: deep})
+	if !errors.Is(result.Error, ErrInvalidEnvelope) {
+		t.Fatalf("error = %v, want input past max_input_depth rejected", result.Error)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/sobek"
+)
+
+// ErrScriptNesting is thrown by runScript past max_script_nesting levels
+var ErrScriptNesting = errors.New("script nesting too deep")
+
+// nestingKey is the context key holding how many runScript calls deep an execution is
+type nestingKey struct{}
+
+func scriptNesting(ctx context.Context) int {
+	depth, _ := ctx.Value(nestingKey{}).(int)
+	return depth
+}
+
+// installRunScript exposes runScript(name, input), running a script from the
+// script store with its own input and returning its result. The nested script
+// shares the deadline of the caller, and its clock, seed and time zone. Errors,
+// including nesting past maxNesting, are thrown as catchable errors.
+func (sm *ScriptManager) installRunScript(vm *sobek.Runtime, ctx context.Context, job ScriptJob, maxNesting int) {
+	vm.Set("runScript", func(name string, input sobek.Value) sobek.Value {
+		depth := scriptNesting(ctx) + 1
+		if depth > maxNesting {
+			panic(vm.NewGoError(fmt.Errorf("%w: runScript(%q) would be %d levels deep, the limit is %d", ErrScriptNesting, name, depth, maxNesting)))
+		}
+
+		script, err := sm.store.Load(name)
+		if err != nil {
+			panic(vm.NewGoError(err))
+		}
+		if err := checkEncoding(script); err != nil {
+			panic(vm.NewGoError(err))
+		}
+		if err := checkDeniedPatterns(script, config.DeniedPatterns); err != nil {
+			panic(vm.NewGoError(err))
+		}
+		if err := checkBannedSyntax(script, config.BannedSyntax); err != nil {
+			panic(vm.NewGoError(err))
+		}
+
+		child := ScriptJob{
+			Script:   script,
+			Now:      job.Now,
+			Seed:     job.Seed,
+			Location: job.Location,
+			Origin:   job.Origin,
+			shared:   job.shared,
+		}
+		if input != nil && !sobek.IsUndefined(input) {
+			child.Input = input.Export()
+		}
+
+		childCtx, cancel := context.WithCancel(context.WithValue(ctx, nestingKey{}, depth))
+		defer cancel()
+		result := sm.executeScript(childCtx, child, cancel)
+		if result.Error != nil {
+			panic(vm.NewGoError(fmt.Errorf("runScript(%q): %w", name, result.Error)))
+		}
+		return vm.ToValue(result.Result)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// composeManager returns a manager with runScript enabled over a store holding scripts
+func composeManager(t *testing.T, scripts map[string]string, configure func(*Config)) *ScriptManager {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name+".js"), []byte(script), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableRunScript = true
+		c.MaxScriptNesting = 3
+		if configure != nil {
+			configure(c)
+		}
+	})
+	sm.store = &fileScriptStore{dir: dir}
+	return sm
+}
+
+func TestRunScript(t *testing.T) {
+	sm := composeManager(t, map[string]string{
+		"double":  `input.n * 2`,
+		"quad":    `runScript("double", {n: runScript("double", input)})`,
+		"self":    `runScript("self", {})`,
+		"counter": `input.depth >= 10 ? input.depth : runScript("counter", {depth: input.depth + 1})`,
+		"throws":  `throw new Error("inner failure")`,
+		"spin":    `for (;;) {}`,
+	}, nil)
+
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "one level", script: `runScript("double", {n: 21})`, want: int64(42)},
+		{name: "two levels", script: `runScript("quad", {n: 3})`, want: int64(12)},
+		{name: "within the limit", script: `runScript("counter", {depth: 8})`, want: int64(10)},
+		{name: "self-recursion cut off", script: `runScript("self", {})`, wantErr: `runScript("self") would be 4 levels deep, the limit is 3`},
+		{name: "past the limit", script: `runScript("counter", {depth: 0})`, wantErr: ErrScriptNesting.Error()},
+		{name: "nesting error is catchable", script: `try { runScript("self", {}) } catch (e) { "caught: " + e.message.includes("nesting too deep") }`, want: "caught: true"},
+		{name: "inner error is catchable", script: `try { runScript("throws") } catch (e) { e.message.includes("inner failure") }`, want: true},
+		{name: "unknown script", script: `runScript("missing")`, wantErr: "script reference not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Fatalf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+
+	t.Run("shares the timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := sm.ExecuteScriptWithTimeout(`runScript("spin")`)
+		if !errors.Is(err, ErrScriptTimeout) && (err == nil || !strings.Contains(err.Error(), ErrScriptTimeout.Error())) {
+			t.Fatalf("error = %v, want the caller's timeout", err)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Fatalf("nested script ran %s, past the caller's timeout", elapsed)
+		}
+	})
+}
+
+func TestRunScriptDisabled(t *testing.T) {
+	sm := composeManager(t, map[string]string{"double": `input.n * 2`}, func(c *Config) {
+		c.EnableRunScript = false
+	})
+	result, err := sm.ExecuteScriptWithTimeout(`typeof runScript`)
+	if err != nil || result != "undefined" {
+		t.Fatalf("typeof runScript = %v, %v, want undefined without enable_run_script", result, err)
+	}
+}
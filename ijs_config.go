@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"time"
 
+	"github.com/grafana/sobek"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
@@ -17,25 +21,154 @@ type Config struct {
 	MaxMemoryMB       int           `yaml:"max_memory_mb"`
 	MaxScriptSize     int64         `yaml:"max_script_size"`
 	ServerPort        int           `yaml:"server_port"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
 	ScriptTimeout     time.Duration `yaml:"script_timeout"`
+	HardKillTimeout   time.Duration `yaml:"hard_kill_timeout"`
+
+	TimeoutPerInputItem time.Duration `yaml:"timeout_per_input_item"`
+	MaxScriptTimeout    time.Duration `yaml:"max_script_timeout"`
+	TimeoutJitter       float64       `yaml:"timeout_jitter"`
+
 	WorkerPoolSize    int           `yaml:"worker_pool_size"`
+	LockOSThread      bool          `yaml:"lock_os_thread"`
+	WarmupScript      string        `yaml:"warmup_script"`
+	WarmupRuns        int           `yaml:"warmup_runs"`
 	LogOnConsole      bool          `yaml:"log_on_console"`
 	ShutdownTimeLimit time.Duration `yaml:"shutdown_allow_time"`
 	ShutdownPause     time.Duration `yaml:"shutdown_pause_time"`
+	PreStopDelay      time.Duration `yaml:"pre_stop_delay"`
+
+	MaxLogTotalMB       int `yaml:"max_log_total_mb"`
+	LogFailureThreshold int `yaml:"log_failure_threshold"`
+
+	WatchdogInterval   time.Duration `yaml:"watchdog_interval"`
+	StuckWorkerAfter   time.Duration `yaml:"stuck_worker_after"`
+	StuckWorkerRestart int           `yaml:"stuck_worker_restart"`
+
+	MaxConcurrentCompiles int `yaml:"max_concurrent_compiles"`
+
+	ResultFloatPrecision int    `yaml:"result_float_precision"`
+	EnableGzip           bool   `yaml:"enable_gzip"`
+	GzipMinBytes         int    `yaml:"gzip_min_bytes"`
+	MaxUserGlobals       int    `yaml:"max_user_globals"`
+	FreezeGlobal         bool   `yaml:"freeze_global"`
+	MaxCallStack         int    `yaml:"max_call_stack"`
+	MaxResultBytes       int    `yaml:"max_result_bytes"`
+	MapExport            string `yaml:"map_export"`
+	NumericResultMode    string `yaml:"numeric_result_mode"`
+	BigIntMode           string `yaml:"bigint_mode"`
+	EnableStdlib         bool   `yaml:"enable_stdlib"`
+	RenderMaxBytes       int    `yaml:"render_max_bytes"`
+	CSVMaxCells          int    `yaml:"csv_max_cells"`
+	EnableUUID           bool   `yaml:"enable_uuid"`
+
+	PriorityWorkers   int      `yaml:"priority_workers"`
+	PriorityTokens    []string `yaml:"priority_tokens"`
+	QueueSize         int      `yaml:"queue_size"`
+	PriorityQueueSize int      `yaml:"priority_queue_size"`
+	SchedulingPolicy  string   `yaml:"scheduling_policy"`
+
+	OverloadPolicy       string        `yaml:"overload_policy"`
+	OverloadQueueTimeout time.Duration `yaml:"overload_queue_timeout"`
+	MaxQueueWait         time.Duration `yaml:"max_queue_wait"`
+
+	MaxExecutionsPerSecond float64       `yaml:"max_executions_per_second"`
+	MaxRunTime             time.Duration `yaml:"max_run_time"`
+
+	MaxJSONDepth   int `yaml:"max_json_depth"`
+	MaxInputKeys   int `yaml:"max_input_keys"`
+	MaxInputDepth  int `yaml:"max_input_depth"`
+	MaxArrayLength int `yaml:"max_array_length"`
+
+	DeterministicMode bool                `yaml:"deterministic_mode"`
+	BannedSyntax      []string            `yaml:"banned_syntax"`
+	RestrictedMembers map[string][]string `yaml:"restricted_members"`
+	DeniedPatterns    []DeniedPattern     `yaml:"denied_patterns"`
+
+	RefData      map[string]string `yaml:"refdata"`
+	PreambleFile string            `yaml:"preamble_file"`
+
+	MaxHostCalls map[string]int `yaml:"max_host_calls"`
+
+	BackoffMessage string `yaml:"backoff_message"`
+
+	ScriptStore    string `yaml:"script_store"`
+	ScriptStoreDir string `yaml:"script_store_dir"`
+
+	EnableRunScript  bool `yaml:"enable_run_script"`
+	MaxScriptNesting int  `yaml:"max_script_nesting"`
+
+	OtelEndpoint string `yaml:"otel_endpoint"`
+
+	MetricLabels   []string `yaml:"metric_labels"`
+	MaxLabelValues int      `yaml:"max_label_values"`
+
+	MemorySpikeTolerance int    `yaml:"memory_spike_tolerance"`
+	RecoverMode          string `yaml:"recover_mode"`
+	MaxScriptAllocMB     int    `yaml:"max_script_alloc_mb"`
+
+	CPUPressurePolicy string  `yaml:"cpu_pressure_policy"`
+	CPULoadThreshold  float64 `yaml:"cpu_load_threshold"`
+
+	MaxConnections        int   `yaml:"max_connections"`
+	MaxTotalInflightBytes int64 `yaml:"max_total_inflight_bytes"`
+
+	CORSAllowedOrigins []string          `yaml:"cors_allowed_origins"`
+	CORSAllowedMethods []string          `yaml:"cors_allowed_methods"`
+	CORSAllowedHeaders []string          `yaml:"cors_allowed_headers"`
+	SecurityHeaders    map[string]string `yaml:"security_headers"`
+
+	AdminToken       string   `yaml:"admin_token"`
+	EnabledEndpoints []string `yaml:"enabled_endpoints"`
+
+	SandboxProfiles map[string]SandboxProfile `yaml:"sandbox_profiles"`
+	DefaultProfile  string                    `yaml:"default_profile"`
+
+	FailureCapture       int  `yaml:"failure_capture"`
+	FailureCaptureBodies bool `yaml:"failure_capture_bodies"`
+
+	EnableResultCache bool          `yaml:"enable_result_cache"`
+	ResultCacheSize   int           `yaml:"result_cache_size"`
+	ResultCacheTTL    time.Duration `yaml:"result_cache_ttl"`
+
+	ResultCacheNormalize bool `yaml:"result_cache_normalize"`
+
+	JobResultTTL time.Duration `yaml:"job_result_ttl"`
+	JobStore     string        `yaml:"job_store"`
+	JobStoreURL  string        `yaml:"job_store_url"`
+
+	SpillDir           string        `yaml:"spill_dir"`
+	SpillMaxBytes      int           `yaml:"spill_max_bytes"`
+	SpillMaxTotalBytes int64         `yaml:"spill_max_total_bytes"`
+	SpillTTL           time.Duration `yaml:"spill_ttl"`
+
+	EnableSessions  bool          `yaml:"enable_sessions"`
+	SessionTTL      time.Duration `yaml:"session_ttl"`
+	SessionMaxBytes int           `yaml:"session_max_bytes"`
+	MaxSessions     int           `yaml:"max_sessions"`
+
+	EnableRepl      bool          `yaml:"enable_repl"`
+	ReplTTL         time.Duration `yaml:"repl_ttl"`
+	ReplMaxMemoryMB int           `yaml:"repl_max_memory_mb"`
+	MaxReplSessions int           `yaml:"max_repl_sessions"`
+
+	MaxSessionMemoryMB int `yaml:"max_session_memory_mb"`
+
+	AuditFields  bool   `yaml:"audit_fields"`
+	AuditHMACKey string `yaml:"audit_hmac_key"`
 }
 
 func initializeConfig() {
 
-	var cfg *Config
-	var err error
-
 	// config file is set in the flags file
 	logrus.Infof("Attempting to load configuration from %s", ConfigFile)
-	cfg, err = loadConfig(ConfigFile)
+	cfg, err := readConfig(ConfigFile, AllowMissingConfig, os.LookupEnv)
 	if err != nil {
 		logrus.Fatalf("Error loading %s configuration: %v\n", ConfigFile, err)
 	}
-	logrus.Infof("Loaded configuration from %s", ConfigFile)
 
 	config = *cfg
 
@@ -48,18 +181,328 @@ func initializeConfig() {
 		logrus.Fatalf("Invalid script size limit: %d bytes, minimum is 2 {}", config.MaxScriptSize)
 	}
 
-	// Log the configuration
-	logrus.Info(fmt.Sprintf(
-		"Loaded configuration: MaxMemoryMB=%d, MaxScriptSize=%d bytes, ServerPort=%d,ScriptTimeout=%s, GracefulShutdownTimeout=%s, GracefulShutdownPause=%s, WorkerPoolSize=%d, LogOnConsole=%t",
-		config.MaxMemoryMB,
-		config.MaxScriptSize,
-		config.ServerPort,
-		config.ScriptTimeout,
-		config.ShutdownTimeLimit,
-		config.ShutdownPause,
-		config.WorkerPoolSize,
-		config.LogOnConsole,
-	))
+	if config.ReadHeaderTimeout <= 0 || config.ReadTimeout <= 0 || config.WriteTimeout <= 0 || config.IdleTimeout <= 0 {
+		logrus.Fatalf("Invalid server timeouts: read_header_timeout=%s, read_timeout=%s, write_timeout=%s, idle_timeout=%s, all must be positive",
+			config.ReadHeaderTimeout, config.ReadTimeout, config.WriteTimeout, config.IdleTimeout)
+	}
+
+	if config.GzipMinBytes < 0 {
+		logrus.Fatalf("Invalid gzip minimum size: %d bytes, minimum is 0", config.GzipMinBytes)
+	}
+
+	if config.MaxUserGlobals < 0 {
+		logrus.Fatalf("Invalid user globals limit: %d, use 0 for unlimited", config.MaxUserGlobals)
+	}
+
+	if config.PriorityWorkers < 0 {
+		logrus.Fatalf("Invalid priority worker count: %d, use 0 to disable the priority lane", config.PriorityWorkers)
+	}
+
+	if config.QueueSize < 0 || config.PriorityQueueSize < 0 {
+		logrus.Fatalf("Invalid queue size: %d/%d, use 0 for one slot per worker", config.QueueSize, config.PriorityQueueSize)
+	}
+
+	switch config.SchedulingPolicy {
+	case "fifo", "wfq":
+	default:
+		logrus.Fatalf("Invalid scheduling policy: %q, use fifo or wfq", config.SchedulingPolicy)
+	}
+
+	for _, name := range config.BannedSyntax {
+		if _, ok := bannedSyntaxRules[name]; !ok {
+			logrus.Fatalf("Invalid banned syntax: %q, use generators, async, labels or try", name)
+		}
+	}
+
+	if err := compileDeniedPatterns(config.DeniedPatterns); err != nil {
+		logrus.Fatalf("Invalid denied pattern: %v", err)
+	}
+
+	if err := removeMembers(sobek.New(), config.RestrictedMembers); err != nil {
+		logrus.Fatalf("Invalid restricted member: %v", err)
+	}
+
+	if err := checkHostCallLimits(config.MaxHostCalls); err != nil {
+		logrus.Fatalf("Invalid max_host_calls: %v", err)
+	}
+
+	switch config.OverloadPolicy {
+	case overloadReject, overloadQueue, overloadShedOldest:
+	default:
+		logrus.Fatalf("Invalid overload policy: %q, use reject, queue or shed_oldest", config.OverloadPolicy)
+	}
+	if config.OverloadQueueTimeout <= 0 {
+		logrus.Fatalf("Invalid overload queue timeout: %s, must be positive", config.OverloadQueueTimeout)
+	}
+	if config.WatchdogInterval < 0 || config.StuckWorkerRestart < 0 {
+		logrus.Fatalf("Invalid watchdog: every %s, restart at %d stuck workers, use 0 to disable either", config.WatchdogInterval, config.StuckWorkerRestart)
+	}
+
+	if config.MaxQueueWait < 0 {
+		logrus.Fatalf("Invalid max queue wait: %s, use 0 for unlimited", config.MaxQueueWait)
+	}
+
+	if config.MaxExecutionsPerSecond < 0 {
+		logrus.Fatalf("Invalid execution rate: %g per second, use 0 for unlimited", config.MaxExecutionsPerSecond)
+	}
+
+	if config.MaxRunTime < 0 {
+		logrus.Fatalf("Invalid run time budget: %s, use 0 for unlimited", config.MaxRunTime)
+	}
+
+	if len(config.SandboxProfiles) > 0 {
+		if _, ok := config.SandboxProfiles[config.DefaultProfile]; !ok {
+			logrus.Fatalf("Invalid default profile: %q is not one of the sandbox_profiles", config.DefaultProfile)
+		}
+	}
+
+	if config.FailureCapture < 0 {
+		logrus.Fatalf("Invalid failure capture size: %d, use 0 to disable", config.FailureCapture)
+	}
+
+	if config.EnableResultCache && (config.ResultCacheSize <= 0 || config.ResultCacheTTL <= 0) {
+		logrus.Fatalf("Invalid result cache: %d entries for %s, both must be positive", config.ResultCacheSize, config.ResultCacheTTL)
+	}
+
+	if config.JobResultTTL <= 0 {
+		logrus.Fatalf("Invalid job result TTL: %s, must be positive", config.JobResultTTL)
+	}
+	switch config.JobStore {
+	case "memory":
+	case "redis":
+		if config.JobStoreURL == "" {
+			logrus.Fatal("Invalid job store: redis needs job_store_url")
+		}
+	default:
+		logrus.Fatalf("Invalid job store: %q, use memory or redis", config.JobStore)
+	}
+
+	if config.EnableSessions && (config.SessionTTL <= 0 || config.SessionMaxBytes <= 0 || config.MaxSessions <= 0) {
+		logrus.Fatalf("Invalid sessions: ttl %s, %d bytes, %d sessions, all must be positive", config.SessionTTL, config.SessionMaxBytes, config.MaxSessions)
+	}
+
+	if config.EnableRepl && (config.ReplTTL <= 0 || config.ReplMaxMemoryMB <= 0 || config.MaxReplSessions <= 0) {
+		logrus.Fatalf("Invalid REPL sessions: ttl %s, %d MB, %d sessions, all must be positive", config.ReplTTL, config.ReplMaxMemoryMB, config.MaxReplSessions)
+	}
+
+	if config.MaxSessionMemoryMB < 0 {
+		logrus.Fatalf("Invalid session memory limit: %d MB, use 0 for unlimited", config.MaxSessionMemoryMB)
+	}
+
+	if config.AuditHMACKey != "" && !config.AuditFields {
+		logrus.Fatalf("Invalid audit configuration: audit_hmac_key is set but audit_fields is off")
+	}
+
+	if config.EnableRunScript && config.MaxScriptNesting < 1 {
+		logrus.Fatalf("Invalid script nesting limit: %d, must be at least 1", config.MaxScriptNesting)
+	}
+
+	if config.MemorySpikeTolerance < 1 {
+		logrus.Fatalf("Invalid memory spike tolerance: %d, must be at least 1", config.MemorySpikeTolerance)
+	}
+
+	if config.MaxLogTotalMB != 0 && config.MaxLogTotalMB < logMaxSizeMB {
+		logrus.Fatalf("Invalid log disk budget: %d MB, use 0 for unlimited or at least %d MB, the size of one log file", config.MaxLogTotalMB, logMaxSizeMB)
+	}
+
+	if config.MaxConcurrentCompiles < 0 {
+		logrus.Fatalf("Invalid concurrent compile limit: %d, use 0 for unlimited", config.MaxConcurrentCompiles)
+	}
+
+	if config.LogFailureThreshold < 0 {
+		logrus.Fatalf("Invalid log failure threshold: %d, use 0 to keep running when logging fails", config.LogFailureThreshold)
+	}
+
+	if config.MaxScriptAllocMB < 0 {
+		logrus.Fatalf("Invalid script allocation limit: %d MB, use 0 for unlimited", config.MaxScriptAllocMB)
+	}
+
+	switch config.CPUPressurePolicy {
+	case cpuPressureNone, cpuPressureThrottle, cpuPressureShed:
+	default:
+		logrus.Fatalf("Invalid CPU pressure policy: %q, use none, throttle or shed", config.CPUPressurePolicy)
+	}
+	if config.CPULoadThreshold <= 0 {
+		logrus.Fatalf("Invalid CPU load threshold: %g, must be positive", config.CPULoadThreshold)
+	}
+
+	switch config.RecoverMode {
+	case recoverModeRestart, recoverModeNone:
+	default:
+		logrus.Fatalf("Invalid recover mode: %q, use restart or none", config.RecoverMode)
+	}
+
+	if config.MaxTotalInflightBytes < 0 {
+		logrus.Fatalf("Invalid in-flight bytes limit: %d, use 0 for unlimited", config.MaxTotalInflightBytes)
+	}
+
+	if config.MaxJSONDepth < 0 {
+		logrus.Fatalf("Invalid JSON depth limit: %d, use 0 for unlimited", config.MaxJSONDepth)
+	}
+
+	if config.MaxInputKeys < 0 || config.MaxInputDepth < 0 {
+		logrus.Fatalf("Invalid input limits: %d keys, depth %d, use 0 for unlimited", config.MaxInputKeys, config.MaxInputDepth)
+	}
+
+	if config.MaxArrayLength < 0 {
+		logrus.Fatalf("Invalid array length limit: %d, use 0 for unlimited", config.MaxArrayLength)
+	}
+
+	if config.RenderMaxBytes < 0 {
+		logrus.Fatalf("Invalid render output limit: %d bytes, use 0 for unlimited", config.RenderMaxBytes)
+	}
+
+	if config.CSVMaxCells < 0 {
+		logrus.Fatalf("Invalid CSV cell limit: %d, use 0 for unlimited", config.CSVMaxCells)
+	}
+
+	if config.WarmupScript != "" && config.WarmupRuns < 1 {
+		logrus.Fatalf("Invalid warmup runs: %d, must be at least 1 when warmup_script is set", config.WarmupRuns)
+	}
+
+	if config.MaxCallStack < 0 {
+		logrus.Fatalf("Invalid call stack limit: %d, use 0 for unlimited", config.MaxCallStack)
+	}
+
+	switch config.MapExport {
+	case "pairs", "object":
+	default:
+		logrus.Fatalf("Invalid map export: %q, use pairs or object", config.MapExport)
+	}
+
+	switch config.NumericResultMode {
+	case "js", "preserve":
+	default:
+		logrus.Fatalf("Invalid numeric result mode: %q, use js or preserve", config.NumericResultMode)
+	}
+
+	switch config.BigIntMode {
+	case bigIntString, bigIntNumber:
+	default:
+		logrus.Fatalf("Invalid BigInt mode: %q, use string or number", config.BigIntMode)
+	}
+
+	if err := checkMetricLabels(config.MetricLabels, config.MaxLabelValues); err != nil {
+		logrus.Fatalf("Invalid metric_labels: %v", err)
+	}
+
+	if config.MaxResultBytes < 0 {
+		logrus.Fatalf("Invalid result size limit: %d bytes, use 0 for unlimited", config.MaxResultBytes)
+	}
+
+	if config.SpillDir != "" {
+		if config.MaxResultBytes == 0 {
+			logrus.Fatal("Invalid spill_dir: without max_result_bytes no result is ever too large to send inline")
+		}
+		if config.SpillMaxBytes <= config.MaxResultBytes {
+			logrus.Fatalf("Invalid spill size limit: %d bytes, must exceed the %d bytes max_result_bytes", config.SpillMaxBytes, config.MaxResultBytes)
+		}
+		if config.SpillMaxTotalBytes < int64(config.SpillMaxBytes) {
+			logrus.Fatalf("Invalid spill space: %d bytes, smaller than one %d bytes spill_max_bytes result", config.SpillMaxTotalBytes, config.SpillMaxBytes)
+		}
+		if config.SpillTTL <= 0 {
+			logrus.Fatalf("Invalid spill TTL: %s, must be positive", config.SpillTTL)
+		}
+	}
+
+	if config.ResultFloatPrecision < -1 {
+		logrus.Fatalf("Invalid result float precision: %d, use -1 for full precision", config.ResultFloatPrecision)
+	}
+
+	checkConfigConsistency()
+
+	// Log the configuration as /admin/config shows it, secrets redacted, one
+	// field per option
+	if view, err := redactedConfig(); err != nil {
+		logrus.WithError(err).Error("Failed to render the loaded configuration")
+	} else {
+		logrus.WithFields(logrus.Fields(view)).Info("Loaded configuration")
+	}
+}
+
+// checkConfigConsistency refuses option combinations that are each valid on
+// their own but break the server at runtime
+func checkConfigConsistency() {
+	if err := checkEnabledEndpoints(config.EnabledEndpoints); err != nil {
+		logrus.Fatalf("Invalid enabled endpoints: %v", err)
+	}
+	if endpointEnabled("admin") && config.AdminToken == "" {
+		logrus.Fatal("Invalid enabled endpoints: admin is listed but admin_token is empty, set a token or drop admin")
+	}
+
+	if config.CPUPressurePolicy != cpuPressureNone {
+		if _, err := readLoadPerCPU(); err != nil {
+			logrus.Fatalf("Invalid CPU pressure policy: %s needs the system load, which cannot be read: %v", config.CPUPressurePolicy, err)
+		}
+	}
+
+	if config.WorkerPoolSize < 1 {
+		logrus.Fatalf("Invalid worker pool size: %d, no script would ever run, use at least 1", config.WorkerPoolSize)
+	}
+
+	if config.ScriptTimeout <= 0 {
+		logrus.Fatalf("Invalid script timeout: %s, must be positive", config.ScriptTimeout)
+	}
+	if config.TimeoutJitter < 0 || config.TimeoutJitter > 0.5 {
+		logrus.Fatalf("Invalid timeout jitter: %g, use a fraction of the timeout between 0 and 0.5", config.TimeoutJitter)
+	}
+	if config.TimeoutPerInputItem < 0 {
+		logrus.Fatalf("Invalid timeout per input item: %s, use 0 to disable", config.TimeoutPerInputItem)
+	}
+	if config.TimeoutPerInputItem > 0 && config.MaxScriptTimeout <= config.ScriptTimeout {
+		logrus.Fatalf("Invalid max script timeout: %s, timeout_per_input_item needs a cap above the %s script_timeout", config.MaxScriptTimeout, config.ScriptTimeout)
+	}
+	// Past this point timeouts are checked against the longest a script may run
+	longest := longestScriptTimeout()
+	if longest >= config.WriteTimeout {
+		logrus.Fatalf("Invalid script timeout: %s, scripts running that long outlive the %s write_timeout and their responses are dropped, lower script_timeout or max_script_timeout, or raise write_timeout", longest, config.WriteTimeout)
+	}
+	if config.HardKillTimeout < 0 || config.HardKillTimeout != 0 && config.HardKillTimeout <= longest {
+		logrus.Fatalf("Invalid hard kill timeout: %s, scripts would be abandoned before the %s script timeout interrupts them, raise it or set it to 0", config.HardKillTimeout, longest)
+	}
+	if config.WatchdogInterval > 0 && config.StuckWorkerAfter <= max(longest, config.HardKillTimeout) {
+		logrus.Fatalf("Invalid stuck worker threshold: %s, workers would be flagged before script_timeout or hard_kill_timeout free them", config.StuckWorkerAfter)
+	}
+
+	if config.ReadHeaderTimeout > config.ReadTimeout {
+		logrus.Fatalf("Invalid read header timeout: %s, longer than the %s read_timeout covering the whole request", config.ReadHeaderTimeout, config.ReadTimeout)
+	}
+
+	// The monitor cancels every script once usage is over the limit, a limit
+	// the idle process already reaches would cancel them all and restart forever
+	baseline := readAllocBytes()
+	if limit := uint64(config.MaxMemoryMB) << 20; limit <= baseline {
+		logrus.Fatalf("Invalid memory limit: %d MB, the process already uses %d MB at startup, raise max_memory_mb", config.MaxMemoryMB, baseline>>20)
+	}
+
+	if config.MaxTotalInflightBytes > 0 && config.MaxTotalInflightBytes < config.MaxScriptSize {
+		logrus.Fatalf("Invalid in-flight bytes limit: %d, scripts up to max_script_size (%d bytes) could never be accepted, raise max_total_inflight_bytes or set it to 0", config.MaxTotalInflightBytes, config.MaxScriptSize)
+	}
+}
+
+// readConfig loads filename or, with allowMissing, the built-in defaults when it
+// does not exist, set from the IJS_ variables found through lookup. The
+// environment only configures a server running on the defaults, a config file
+// is used as is and the variables set alongside it are reported as ignored.
+func readConfig(filename string, allowMissing bool, lookup func(string) (string, bool)) (*Config, error) {
+	cfg, err := loadConfig(filename)
+	if err == nil {
+		for _, name := range envOverrides(lookup) {
+			logrus.WithField("variable", name).Warn("Configuration file in use, ignoring the option set in the environment")
+		}
+		logrus.Infof("Loaded configuration from %s", filename)
+		return cfg, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) || !allowMissing {
+		return nil, err
+	}
+
+	logrus.Warnf("Configuration file %s does not exist, running on built-in defaults", filename)
+	cfg = builtinConfig()
+	if err := applyEnvOverrides(cfg, lookup); err != nil {
+		return nil, fmt.Errorf("applying configuration from the environment: %w", err)
+	}
+	return cfg, nil
 }
 
 func loadConfig(filename string) (*Config, error) {
@@ -70,9 +513,131 @@ func loadConfig(filename string) (*Config, error) {
 	defer file.Close()
 
 	decoder := yaml.NewDecoder(file)
-	var cfg Config
+	cfg := defaultConfig()
 	if err := decoder.Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 	return &cfg, nil
 }
+
+// defaultConfig holds the values of the keys missing from the config file
+func defaultConfig() Config {
+	return Config{
+		ReadHeaderTimeout:    5 * time.Second,
+		ReadTimeout:          10 * time.Second,
+		WriteTimeout:         10 * time.Second,
+		HardKillTimeout:      10 * time.Second,
+		WatchdogInterval:     5 * time.Second,
+		StuckWorkerAfter:     time.Minute,
+		IdleTimeout:          60 * time.Second,
+		ResultFloatPrecision: -1,
+		GzipMinBytes:         1024,
+		MaxCallStack:         10000,
+		WarmupRuns:           100,
+		MemorySpikeTolerance: 3,
+		RecoverMode:          recoverModeRestart,
+		CPUPressurePolicy:    cpuPressureNone,
+		CPULoadThreshold:     1.5,
+		MaxScriptNesting:     4,
+		MapExport:            "pairs",
+		NumericResultMode:    "js",
+		BigIntMode:           bigIntString,
+		ResultCacheSize:      1000,
+		ResultCacheTTL:       5 * time.Minute,
+		JobResultTTL:         10 * time.Minute,
+		JobStore:             "memory",
+		SpillMaxBytes:        100 << 20,
+		SpillMaxTotalBytes:   1 << 30,
+		SpillTTL:             10 * time.Minute,
+		MaxLabelValues:       100,
+		EnabledEndpoints:     defaultEndpoints,
+		SessionTTL:           30 * time.Minute,
+		SessionMaxBytes:      1 << 20,
+		MaxSessions:          1000,
+		ReplTTL:              15 * time.Minute,
+		ReplMaxMemoryMB:      256,
+		MaxReplSessions:      16,
+		RenderMaxBytes:       1 << 20,
+		CSVMaxCells:          100000,
+		BackoffMessage:       "Currently not accepting script, please wait...",
+		ScriptStoreDir:       "./scripts",
+		SchedulingPolicy:     "fifo",
+		OverloadPolicy:       overloadReject,
+		OverloadQueueTimeout: 5 * time.Second,
+		CORSAllowedMethods:   []string{"POST", "OPTIONS"},
+		CORSAllowedHeaders:   []string{"Content-Type", "X-Priority", "X-Pretty", "X-Script-Pure", "X-Profile-Token", "Cache-Control", "traceparent"},
+	}
+}
+
+// builtinConfig is the configuration used with -allow-missing-config when the
+// config file does not exist: the defaults, plus conservative values for the
+// keys the file must otherwise set
+func builtinConfig() *Config {
+	cfg := defaultConfig()
+	cfg.MaxMemoryMB = 512
+	cfg.MaxScriptSize = 256 << 10
+	cfg.ServerPort = 9997
+	cfg.ScriptTimeout = 3 * time.Second
+	cfg.WorkerPoolSize = 2
+	cfg.MaxResultBytes = 10 << 20
+	cfg.MaxJSONDepth = 64
+	cfg.MaxInputDepth = 32
+	cfg.ShutdownTimeLimit = 5 * time.Second
+	cfg.ShutdownPause = 5 * time.Second
+	cfg.LogOnConsole = true
+	cfg.EnableGzip = true
+	return &cfg
+}
+
+// applyEnvOverrides sets every option named in the environment, as IJS_ and
+// the upper-cased key, such as IJS_SERVER_PORT=8080 or
+// IJS_ENABLED_ENDPOINTS="[data, health]". Values are read as YAML, so they are
+// written as they would be in the config file, and replace what cfg holds: a
+// map such as IJS_METRIC_LABELS is the whole map, not merged into the default.
+func applyEnvOverrides(cfg *Config, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key, name := envOption(v.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Map {
+			// yaml adds the keys to a map it decodes into
+			field.Set(reflect.Zero(field.Type()))
+		}
+		if err := yaml.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		logrus.WithField("option", key).Info("Configuration option set from the environment")
+	}
+	return nil
+}
+
+// envOverrides returns the IJS_ variables set for an option
+func envOverrides(lookup func(string) (string, bool)) []string {
+	var names []string
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if _, name := envOption(t.Field(i)); name != "" {
+			if _, ok := lookup(name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// envOption returns the yaml key of a Config field and the variable setting it,
+// "" for a field with no key
+func envOption(field reflect.StructField) (key, name string) {
+	key, _, _ = strings.Cut(field.Tag.Get("yaml"), ",")
+	if key == "" || key == "-" {
+		return "", ""
+	}
+	return key, "IJS_" + strings.ToUpper(key)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// envLookup is a lookup over a fixed environment
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	if err := os.WriteFile(valid, []byte("max_memory_mb: 100\nserver_port: 8080\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("server_port: [8080\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.yaml")
+
+	tests := []struct {
+		name         string
+		file         string
+		allowMissing bool
+		env          map[string]string
+		wantErr      bool
+		wantPort     int
+		wantMemoryMB int
+	}{
+		{name: "file", file: valid, wantPort: 8080, wantMemoryMB: 100},
+		{name: "file ignores the environment", file: valid, env: map[string]string{"IJS_SERVER_PORT": "9000"}, wantPort: 8080, wantMemoryMB: 100},
+		{name: "missing file", file: missing, wantErr: true},
+		{name: "missing file with defaults", file: missing, allowMissing: true, wantPort: 9997, wantMemoryMB: 512},
+		{name: "missing file with defaults and environment", file: missing, allowMissing: true, env: map[string]string{"IJS_SERVER_PORT": "9000"}, wantPort: 9000, wantMemoryMB: 512},
+		{name: "missing file with an invalid variable", file: missing, allowMissing: true, env: map[string]string{"IJS_SERVER_PORT": "high"}, wantErr: true},
+		{name: "invalid file", file: invalid, wantErr: true},
+		{name: "invalid file with defaults allowed", file: invalid, allowMissing: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := readConfig(tt.file, tt.allowMissing, envLookup(tt.env))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ServerPort != tt.wantPort || cfg.MaxMemoryMB != tt.wantMemoryMB {
+				t.Fatalf("port %d and %d MB, want %d and %d MB", cfg.ServerPort, cfg.MaxMemoryMB, tt.wantPort, tt.wantMemoryMB)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(*Config) bool
+	}{
+		{
+			name:  "scalar",
+			env:   map[string]string{"IJS_SCRIPT_TIMEOUT": "2s"},
+			check: func(c *Config) bool { return c.ScriptTimeout == 2*time.Second },
+		},
+		{
+			name:  "list replaced",
+			env:   map[string]string{"IJS_ENABLED_ENDPOINTS": "[data]"},
+			check: func(c *Config) bool { return reflect.DeepEqual(c.EnabledEndpoints, []string{"data"}) },
+		},
+		{
+			name:  "map replaced, not merged",
+			env:   map[string]string{"IJS_MAX_HOST_CALLS": "{fetch: 3}"},
+			check: func(c *Config) bool { return reflect.DeepEqual(c.MaxHostCalls, map[string]int{"fetch": 3}) },
+		},
+		{
+			name:  "string map replaced, not merged",
+			env:   map[string]string{"IJS_REFDATA": "{b: two}"},
+			check: func(c *Config) bool { return reflect.DeepEqual(c.RefData, map[string]string{"b": "two"}) },
+		},
+		{
+			name:  "unset options kept",
+			env:   map[string]string{"IJS_UNKNOWN": "1"},
+			check: func(c *Config) bool { return c.MaxHostCalls["log"] == 1 && c.RefData["a"] == "one" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := builtinConfig()
+			cfg.MaxHostCalls = map[string]int{"log": 1}
+			cfg.RefData = map[string]string{"a": "one"}
+			if err := applyEnvOverrides(cfg, envLookup(tt.env)); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Fatalf("unexpected configuration after %v: %+v", tt.env, cfg)
+			}
+		})
+	}
+}
+
+// TestInitializeConfigFatal runs initializeConfig in a child process, which
+// must exit on a configuration file it cannot parse even with
+// -allow-missing-config
+func TestInitializeConfigFatal(t *testing.T) {
+	if file := os.Getenv("IJS_TEST_CONFIG_FILE"); file != "" {
+		ConfigFile, AllowMissingConfig = file, true
+		initializeConfig()
+		return
+	}
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string // "" for no file at all
+		wantExit bool
+	}{
+		{name: "invalid file", contents: "server_port: [8080\n", wantExit: true},
+		{name: "missing file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "config.yaml")
+			os.Remove(file)
+			if tt.contents != "" {
+				if err := os.WriteFile(file, []byte(tt.contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd := exec.Command(os.Args[0], "-test.run=^TestInitializeConfigFatal$")
+			cmd.Env = append(os.Environ(), "IJS_TEST_CONFIG_FILE="+file)
+			err := cmd.Run()
+			if exited := err != nil; exited != tt.wantExit {
+				t.Fatalf("exited with an error = %t (%v), want %t", exited, err, tt.wantExit)
+			}
+		})
+	}
+}
+
+// TestConfigConsistency runs initializeConfig on the built-in defaults with
+// the options of each case set in the environment of a child process, which
+// must exit with the message naming what to change
+func TestConfigConsistency(t *testing.T) {
+	if os.Getenv("IJS_TEST_CONSISTENCY") != "" {
+		// Ballast the child holds while the memory baseline is read
+		ballast := make([]byte, 0)
+		if mb, err := strconv.Atoi(os.Getenv("IJS_TEST_BALLAST_MB")); err == nil {
+			ballast = make([]byte, mb<<20)
+		}
+		logrus.SetOutput(os.Stderr)
+		ConfigFile, AllowMissingConfig = filepath.Join(t.TempDir(), "missing.yaml"), true
+		initializeConfig()
+		runtime.KeepAlive(ballast)
+		return
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string // "" when the configuration is accepted
+	}{
+		{name: "defaults"},
+		{name: "no workers", env: map[string]string{"IJS_WORKER_POOL_SIZE": "0"}, wantErr: "no script would ever run"},
+		{name: "script timeout past the write timeout", env: map[string]string{"IJS_SCRIPT_TIMEOUT": "5s", "IJS_WRITE_TIMEOUT": "5s"}, wantErr: "outlive the 5s write_timeout"},
+		{name: "scaled timeout past the write timeout", env: map[string]string{"IJS_TIMEOUT_PER_INPUT_ITEM": "1ms", "IJS_MAX_SCRIPT_TIMEOUT": "20s", "IJS_WRITE_TIMEOUT": "10s"}, wantErr: "outlive the 10s write_timeout"},
+		{name: "hard kill before the timeout", env: map[string]string{"IJS_HARD_KILL_TIMEOUT": "1s"}, wantErr: "Invalid hard kill timeout"},
+		{name: "read header timeout past the read timeout", env: map[string]string{"IJS_READ_HEADER_TIMEOUT": "20s", "IJS_READ_TIMEOUT": "10s"}, wantErr: "Invalid read header timeout"},
+		{name: "memory limit under the baseline", env: map[string]string{"IJS_MAX_MEMORY_MB": "16", "IJS_TEST_BALLAST_MB": "32"}, wantErr: "the process already uses"},
+		{name: "in-flight limit under the script size", env: map[string]string{"IJS_MAX_TOTAL_INFLIGHT_BYTES": "10", "IJS_MAX_SCRIPT_SIZE": "100"}, wantErr: "could never be accepted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestConfigConsistency$")
+			cmd.Env = append(os.Environ(), "IJS_TEST_CONSISTENCY=1")
+			for name, value := range tt.env {
+				cmd.Env = append(cmd.Env, name+"="+value)
+			}
+			output, err := cmd.CombinedOutput()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("exited with %v, want the configuration accepted:\n%s", err, output)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("configuration accepted, want an exit on %q", tt.wantErr)
+			}
+			if !strings.Contains(string(output), tt.wantErr) {
+				t.Fatalf("output does not mention %q:\n%s", tt.wantErr, output)
+			}
+		})
+	}
+}
+
+func TestLoadedConfigurationLog(t *testing.T) {
+	savedConfig, savedFile, savedAllow := config, ConfigFile, AllowMissingConfig
+	hook := new(test.Hook)
+	savedHooks := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	logrus.AddHook(hook)
+	t.Cleanup(func() {
+		config, ConfigFile, AllowMissingConfig = savedConfig, savedFile, savedAllow
+		logrus.StandardLogger().ReplaceHooks(savedHooks)
+	})
+	ConfigFile, AllowMissingConfig = filepath.Join(t.TempDir(), "missing.yaml"), true
+	t.Setenv("IJS_AUDIT_FIELDS", "true")
+	t.Setenv("IJS_AUDIT_HMAC_KEY", "secret")
+	t.Setenv("IJS_PRIORITY_TOKENS", "[token]")
+
+	initializeConfig()
+
+	var loaded *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Loaded configuration" {
+			loaded = entry
+		}
+	}
+	if loaded == nil {
+		t.Fatal("no Loaded configuration entry")
+	}
+	tests := []struct {
+		field string
+		want  interface{}
+	}{
+		{field: "server_port", want: 9997},
+		{field: "worker_pool_size", want: 2},
+		{field: "script_timeout", want: "3s"},
+		{field: "audit_hmac_key", want: redacted},
+		{field: "priority_tokens", want: []interface{}{redacted}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			if got, ok := loaded.Data[tt.field]; !ok || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%s = %#v, want %#v", tt.field, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values in the effective configuration
+const redacted = "[REDACTED]"
+
+// redactedConfig returns the configuration in effect keyed as in config.yaml,
+// with the admin token, the audit HMAC key, every client token and the job
+// store password replaced.
+// Options that are empty stay empty, so it shows whether a secret is set.
+func redactedConfig() (map[string]interface{}, error) {
+	cfg := config
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = redacted
+	}
+	if cfg.AuditHMACKey != "" {
+		cfg.AuditHMACKey = redacted
+	}
+	if u, err := url.Parse(cfg.JobStoreURL); err == nil {
+		cfg.JobStoreURL = u.Redacted()
+	} else {
+		cfg.JobStoreURL = redacted
+	}
+	cfg.PriorityTokens = redactTokens(cfg.PriorityTokens)
+	if cfg.SandboxProfiles != nil {
+		profiles := make(map[string]SandboxProfile, len(cfg.SandboxProfiles))
+		for name, profile := range cfg.SandboxProfiles {
+			profile.Tokens = redactTokens(profile.Tokens)
+			profiles[name] = profile
+		}
+		cfg.SandboxProfiles = profiles
+	}
+
+	// Going through YAML gives the option names and duration strings of the file
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var view map[string]interface{}
+	if err := yaml.Unmarshal(data, &view); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// redactTokens returns as many placeholders as there are tokens
+func redactTokens(tokens []string) []string {
+	if tokens == nil {
+		return nil
+	}
+	masked := make([]string, len(tokens))
+	for i := range masked {
+		masked[i] = redacted
+	}
+	return masked
+}
+
+// configHandler serves GET /admin/config
+func configHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view, err := redactedConfig()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, Response{Error: err.Error()})
+			logrus.WithError(err).Error("Failed to render the effective configuration")
+			return
+		}
+		writeJSONValue(w, http.StatusOK, view)
+	}
+}
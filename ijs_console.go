@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/sobek"
+)
+
+// consoleMaxBytes caps the console output kept for one execution, later lines
+// are dropped
+const consoleMaxBytes = 64 << 10
+
+// Values of logs_on, when the console output of a script is returned
+const (
+	logsOnAlways = "always" // with every response
+	logsOnError  = "error"  // only when the script fails, the default
+	logsOnNever  = "never"  // never, console calls are not even recorded
+)
+
+// ConsoleLine is one console call of a script
+type ConsoleLine struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// consoleLog records the console output of an execution
+type consoleLog struct {
+	lines     []ConsoleLine
+	bytes     int
+	truncated bool
+}
+
+// checkLogsOn validates the logs_on option of a request
+func checkLogsOn(mode string) error {
+	switch mode {
+	case "", logsOnAlways, logsOnError, logsOnNever:
+		return nil
+	}
+	return fmt.Errorf("logs_on must be %s, %s or %s, not %q", logsOnAlways, logsOnError, logsOnNever, mode)
+}
+
+// installConsole exposes console.log, info, warn, error and debug. Their output
+// is recorded in logs, arguments joined by spaces with objects as JSON. With a
+// nil logs the calls do nothing.
+func installConsole(vm *sobek.Runtime, logs *consoleLog) {
+	stringify, _ := sobek.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+	console := vm.NewObject()
+	for _, level := range []string{"log", "info", "warn", "error", "debug"} {
+		console.Set(level, func(call sobek.FunctionCall) sobek.Value {
+			if logs != nil {
+				logs.add(level, formatConsoleArgs(vm, stringify, call.Arguments))
+			}
+			return sobek.Undefined()
+		})
+	}
+	vm.Set("console", console)
+}
+
+// formatConsoleArgs joins the arguments of a console call as browsers roughly do
+func formatConsoleArgs(vm *sobek.Runtime, stringify sobek.Callable, args []sobek.Value) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = arg.String()
+		if _, isObject := arg.(*sobek.Object); !isObject {
+			continue
+		}
+		if _, isFunction := sobek.AssertFunction(arg); isFunction {
+			continue
+		}
+		if text, err := stringify(sobek.Undefined(), arg); err == nil && !sobek.IsUndefined(text) {
+			parts[i] = text.String()
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// add records a line, dropping it once consoleMaxBytes are used
+func (l *consoleLog) add(level, message string) {
+	if l.truncated {
+		return
+	}
+	if l.bytes+len(message) > consoleMaxBytes {
+		l.truncated = true
+		l.lines = append(l.lines, ConsoleLine{Level: "warn", Message: fmt.Sprintf("console output truncated at %d bytes", consoleMaxBytes)})
+		return
+	}
+	l.bytes += len(message)
+	l.lines = append(l.lines, ConsoleLine{Level: level, Message: message})
+}
+
+// logsFor returns the console lines a response carries under mode
+func logsFor(mode string, failed bool, lines []ConsoleLine) []ConsoleLine {
+	switch mode {
+	case logsOnAlways:
+		return lines
+	case logsOnNever:
+		return nil
+	default:
+		if failed {
+			return lines
+		}
+		return nil
+	}
+}
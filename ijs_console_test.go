@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogsOn(t *testing.T) {
+	const (
+		succeeds = `console.log("step", 1); console.warn({rows: 2}); "ok"`
+		fails    = `console.log("step", 1); console.warn({rows: 2}); throw new Error("boom")`
+	)
+	lines := []ConsoleLine{{Level: "log", Message: "step 1"}, {Level: "warn", Message: `{"rows":2}`}}
+	tests := []struct {
+		logsOn   string
+		script   string
+		wantLogs []ConsoleLine
+	}{
+		{logsOn: "", script: succeeds},
+		{logsOn: "", script: fails, wantLogs: lines},
+		{logsOn: "error", script: succeeds},
+		{logsOn: "error", script: fails, wantLogs: lines},
+		{logsOn: "always", script: succeeds, wantLogs: lines},
+		{logsOn: "always", script: fails, wantLogs: lines},
+		{logsOn: "never", script: succeeds},
+		{logsOn: "never", script: fails},
+	}
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	for _, tt := range tests {
+		name := tt.logsOn
+		if name == "" {
+			name = "default"
+		}
+		if tt.script == fails {
+			name += "/failure"
+		} else {
+			name += "/success"
+		}
+		t.Run(name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{"script": tt.script, "logs_on": tt.logsOn})
+			rec := postEnvelope(handler(sm), "/data", string(body))
+			var response Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(response.Logs, tt.wantLogs) {
+				t.Fatalf("logs = %+v, want %+v", response.Logs, tt.wantLogs)
+			}
+			if tt.wantLogs == nil && strings.Contains(rec.Body.String(), `"logs"`) {
+				t.Fatalf("body %s carries logs", rec.Body)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		rec := postEnvelope(handler(sm), "/data", `{"script": "1", "logs_on": "sometimes"}`)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "logs_on must be") {
+			t.Fatalf("status = %d %s, want 400", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestConsoleOutput(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	run := func(script string) ScriptResult {
+		return sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: script, LogsOn: logsOnAlways})
+	}
+	tests := []struct {
+		script string
+		want   []ConsoleLine
+	}{
+		{script: `console.info("a", "b", 3, true, null, undefined)`, want: []ConsoleLine{{"info", "a b 3 true null undefined"}}},
+		{script: `console.error({a: [1, {b: 2}]}, [1, 2])`, want: []ConsoleLine{{"error", `{"a":[1,{"b":2}]} [1,2]`}}},
+		{script: `console.debug(function f() {}.name, () => 1)`, want: []ConsoleLine{{"debug", "f () => 1"}}},
+		{script: `const o = {}; o.self = o; console.log(o)`, want: []ConsoleLine{{"log", "[object Object]"}}},
+		{script: `console.log(); console.log(new Date(0).getTime())`, want: []ConsoleLine{{"log", ""}, {"log", "0"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			result := run(tt.script)
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			if !reflect.DeepEqual(result.Logs, tt.want) {
+				t.Fatalf("logs = %+v, want %+v", result.Logs, tt.want)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		result := run(`for (let i = 0; i < 1000; i++) console.log("x".repeat(1000))`)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		last := result.Logs[len(result.Logs)-1]
+		if !result.LogsTruncated || last.Message != "console output truncated at "+strconv.Itoa(consoleMaxBytes)+" bytes" {
+			t.Fatalf("truncated = %t, last line %+v", result.LogsTruncated, last)
+		}
+		if len(result.Logs) != consoleMaxBytes/1000+1 {
+			t.Fatalf("%d lines kept, want %d and the notice", len(result.Logs)-1, consoleMaxBytes/1000)
+		}
+	})
+
+	t.Run("never records nothing", func(t *testing.T) {
+		result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: `for (let i = 0; i < 1000; i++) console.log("x".repeat(1000)); typeof console.log`, LogsOn: logsOnNever})
+		if result.Error != nil || result.Result != "function" || result.Logs != nil || result.LogsTruncated {
+			t.Fatalf("result = %v, logs %d, truncated %t, %v", result.Result, len(result.Logs), result.LogsTruncated, result.Error)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrCPUPressure is returned to non-priority scripts turned away by the shed
+// CPU pressure policy
+var ErrCPUPressure = errors.New("CPU under sustained pressure, retry later")
+
+const (
+	// cpuPollInterval is how often the load average is read, the kernel
+	// recomputes it every 5 seconds
+	cpuPollInterval = 5 * time.Second
+	// cpuPressureReadings is how many readings in a row must be over, or back
+	// under, cpu_load_threshold before service is degraded, or restored
+	cpuPressureReadings = 3
+)
+
+// CPU pressure policies, what the CPU monitor does under sustained load
+const (
+	cpuPressureNone     = "none"     // do nothing
+	cpuPressureThrottle = "throttle" // run half as many normal lane scripts at once
+	cpuPressureShed     = "shed"     // turn away the scripts not on the priority lane
+)
+
+// loadProvider returns the system load, as the 1 minute load average per CPU
+type loadProvider func() (float64, error)
+
+// readLoadPerCPU is the loadProvider used in production, reading /proc/loadavg,
+// so the CPU monitor is only available on Linux
+func readLoadPerCPU() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing /proc/loadavg: %w", err)
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
+
+// cpuMonitor degrades service following cpu_pressure_policy once the load stays
+// over cpu_load_threshold, and restores it once the load stays back under it,
+// so an overloaded node keeps answering instead of thrashing
+type cpuMonitor struct {
+	sm       *ScriptManager
+	readLoad loadProvider
+	clock    clock
+	over     memorySpikeFilter // readings over the threshold while serving normally
+	under    memorySpikeFilter // readings under the threshold while degraded
+	held     int               // normal lane worker slots taken by throttling, owned by throttle while it runs
+	stop     chan struct{}     // closed to stop a running throttle
+	stopped  chan struct{}     // closed once throttle returned
+}
+
+func newCPUMonitor(sm *ScriptManager, readLoad loadProvider, clock clock) *cpuMonitor {
+	m := &cpuMonitor{
+		sm:       sm,
+		readLoad: readLoad,
+		clock:    clock,
+	}
+	m.resetReadings()
+	return m
+}
+
+// run polls the load until shutdown, then gives back the slots it holds
+func (m *cpuMonitor) run() {
+	for !m.sm.isShuttingDown() {
+		m.clock.Sleep(cpuPollInterval)
+		m.check()
+	}
+	m.restore(0)
+}
+
+// check takes one reading and acts on it
+func (m *cpuMonitor) check() {
+	load, err := m.readLoad()
+	if err != nil {
+		logrus.WithError(err).Warn("Cannot read the system load")
+		return
+	}
+	over := load > config.CPULoadThreshold
+	if !m.sm.underCPUPressure() {
+		if m.over.sustained(over) {
+			m.degrade(load)
+		}
+	} else if m.under.sustained(!over) {
+		m.restore(load)
+	}
+}
+
+// degrade switches to the degraded service of the policy. Throttling takes half
+// the worker slots of the normal lane, so the priority lane keeps its full
+// capacity.
+func (m *cpuMonitor) degrade(load float64) {
+	atomic.StoreInt32(&m.sm.cpuPressure, 1)
+	m.resetReadings()
+	logrus.WithFields(logrus.Fields{
+		"load_per_cpu": load,
+		"threshold":    config.CPULoadThreshold,
+		"policy":       config.CPUPressurePolicy,
+	}).Warn("CPU under sustained pressure. Degrading service...")
+
+	if config.CPUPressurePolicy != cpuPressureThrottle {
+		return
+	}
+	m.stop, m.stopped = make(chan struct{}), make(chan struct{})
+	go m.throttle(m.stop, m.stopped)
+}
+
+// throttle takes half the worker slots of the normal lane, waiting for running
+// scripts to free them. It runs apart from the monitor loop, which keeps reading
+// the load meanwhile and restores service even before every slot is taken.
+func (m *cpuMonitor) throttle(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	sem := m.sm.normalLane.workerSem
+	for m.held < cap(sem)/2 {
+		select {
+		case sem <- struct{}{}:
+			m.held++
+		case <-stop:
+			return
+		case <-m.sm.done:
+			return
+		}
+	}
+}
+
+// restore stops throttling, gives back the slots it took and serves normally
+// again
+func (m *cpuMonitor) restore(load float64) {
+	m.resetReadings()
+	if m.stop != nil {
+		close(m.stop)
+		<-m.stopped
+		m.stop, m.stopped = nil, nil
+	}
+	for ; m.held > 0; m.held-- {
+		<-m.sm.normalLane.workerSem
+	}
+	if atomic.CompareAndSwapInt32(&m.sm.cpuPressure, 1, 0) {
+		logrus.WithField("load_per_cpu", load).Info("CPU pressure subsided. Restoring service...")
+	}
+}
+
+// resetReadings starts counting readings over, so a transition needs
+// cpuPressureReadings fresh ones
+func (m *cpuMonitor) resetReadings() {
+	m.over = memorySpikeFilter{tolerance: cpuPressureReadings}
+	m.under = memorySpikeFilter{tolerance: cpuPressureReadings}
+}
+
+// underCPUPressure reports whether the CPU monitor is degrading service
+func (sm *ScriptManager) underCPUPressure() bool {
+	return atomic.LoadInt32(&sm.cpuPressure) == 1
+}
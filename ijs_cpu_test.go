@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// loadReadings returns a loadProvider handing out loads in order, the last one
+// once they are used up
+func loadReadings(loads ...float64) loadProvider {
+	return func() (float64, error) {
+		load := loads[0]
+		if len(loads) > 1 {
+			loads = loads[1:]
+		}
+		if load < 0 {
+			return 0, errors.New("no load average")
+		}
+		return load, nil
+	}
+}
+
+// waitHeld waits for n normal lane worker slots to be taken
+func waitHeld(t *testing.T, sm *ScriptManager, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(sm.normalLane.workerSem) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d worker slots taken, want %d", len(sm.normalLane.workerSem), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCPUMonitor(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		loads        []float64 // -1 for a failed reading
+		wantPressure bool
+		wantHeld     int
+	}{
+		{name: "under the threshold", policy: cpuPressureThrottle, loads: []float64{1, 1, 1}},
+		{name: "spike", policy: cpuPressureThrottle, loads: []float64{3, 3, 1, 3, 3}},
+		{name: "failed readings ignored", policy: cpuPressureThrottle, loads: []float64{3, -1, 3, -1}},
+		{name: "throttled", policy: cpuPressureThrottle, loads: []float64{3, 3, 3}, wantPressure: true, wantHeld: 2},
+		{name: "shed takes no slot", policy: cpuPressureShed, loads: []float64{3, 3, 3}, wantPressure: true},
+		{name: "degraded through a dip", policy: cpuPressureThrottle, loads: []float64{3, 3, 3, 1, 1, 3}, wantPressure: true, wantHeld: 2},
+		{name: "restored", policy: cpuPressureThrottle, loads: []float64{3, 3, 3, 1, 1, 1}},
+		{name: "degraded again", policy: cpuPressureThrottle, loads: []float64{3, 3, 3, 1, 1, 1, 3, 3, 3}, wantPressure: true, wantHeld: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.WorkerPoolSize = 4
+				c.CPUPressurePolicy = tt.policy
+				c.CPULoadThreshold = 2
+			})
+			m := newCPUMonitor(sm, loadReadings(tt.loads...), newFakeClock())
+			t.Cleanup(func() { m.restore(0) })
+
+			for range tt.loads {
+				m.check()
+			}
+			if pressure := sm.underCPUPressure(); pressure != tt.wantPressure {
+				t.Fatalf("pressure = %t, want %t", pressure, tt.wantPressure)
+			}
+			waitHeld(t, sm, tt.wantHeld)
+		})
+	}
+}
+
+func TestCPUMonitorThrottleDoesNotBlock(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 4
+		c.CPUPressurePolicy = cpuPressureThrottle
+		c.CPULoadThreshold = 2
+	})
+	m := newCPUMonitor(sm, loadReadings(3, 3, 3, 1, 1, 1), newFakeClock())
+
+	// Every normal lane slot busy, as with scripts running
+	sem := sm.normalLane.workerSem
+	for i := 0; i < cap(sem); i++ {
+		sem <- struct{}{}
+	}
+
+	checked := make(chan struct{})
+	go func() {
+		for i := 0; i < 6; i++ {
+			m.check()
+		}
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("the monitor loop blocked waiting for worker slots")
+	}
+	if sm.underCPUPressure() {
+		t.Fatal("still degraded once the load went back under")
+	}
+
+	// Throttling stopped before taking anything, freed slots stay free
+	for i := 0; i < cap(sem); i++ {
+		<-sem
+	}
+	time.Sleep(20 * time.Millisecond)
+	waitHeld(t, sm, 0)
+	if m.held != 0 {
+		t.Fatalf("held = %d, want 0", m.held)
+	}
+}
+
+func TestCPUMonitorRun(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 4
+		c.CPUPressurePolicy = cpuPressureThrottle
+		c.CPULoadThreshold = 2
+	})
+
+	readings := 0
+	clock := newFakeClock()
+	start := clock.Now()
+	m := newCPUMonitor(sm, func() (float64, error) {
+		readings++
+		if readings == 3 {
+			// Shutting down once degraded, run gives the slots back
+			go func() {
+				waitHeld(t, sm, 2)
+				sm.Shutdown()
+			}()
+		}
+		return 3, nil
+	}, clock)
+
+	done := make(chan struct{})
+	go func() {
+		m.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return on shutdown")
+	}
+	if sm.underCPUPressure() {
+		t.Fatal("still degraded after shutdown")
+	}
+	waitHeld(t, sm, 0)
+	if polled := clock.Now().Sub(start); polled < 3*cpuPollInterval {
+		t.Fatalf("clock moved %s, want at least %s", polled, 3*cpuPollInterval)
+	}
+}
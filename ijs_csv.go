@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/grafana/sobek"
+)
+
+// csvOptions are the options accepted by parseCSV and toCSV
+type csvOptions struct {
+	Delimiter  string   `json:"delimiter"`  // single character, "," by default
+	Header     bool     `json:"header"`     // first line holds the column names, true by default
+	LazyQuotes bool     `json:"lazyQuotes"` // accept quotes appearing in unquoted fields
+	Columns    []string `json:"columns"`    // toCSV column order, the keys of the first row by default
+}
+
+// installCSV exposes parseCSV(text, opts) and toCSV(rows, opts). Both throw
+// once more than maxCells cells are handled, 0 disables the limit.
+func installCSV(vm *sobek.Runtime, maxCells int) {
+	vm.Set("parseCSV", func(text string, opts sobek.Value) sobek.Value {
+		o := csvArgumentOptions(vm, "parseCSV", opts)
+		r := csv.NewReader(strings.NewReader(text))
+		r.Comma = o.comma
+		r.LazyQuotes = o.LazyQuotes
+		r.FieldsPerRecord = -1
+
+		var header []string
+		rows := []interface{}{}
+		cells := 0
+		for {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				panic(csvError(vm, err))
+			}
+			cells += len(record)
+			if maxCells > 0 && cells > maxCells {
+				panic(vm.NewTypeError("parseCSV: input has more than %d cells", maxCells))
+			}
+
+			if !o.Header {
+				rows = append(rows, stringsToValues(record))
+				continue
+			}
+			if header == nil {
+				header = record
+				continue
+			}
+			row := make(map[string]interface{}, len(header))
+			for i, name := range header {
+				if i < len(record) {
+					row[name] = record[i]
+				} else {
+					row[name] = ""
+				}
+			}
+			rows = append(rows, row)
+		}
+		return vm.ToValue(rows)
+	})
+
+	vm.Set("toCSV", func(rows sobek.Value, opts sobek.Value) string {
+		o := csvArgumentOptions(vm, "toCSV", opts)
+		obj, ok := rows.(*sobek.Object)
+		if !ok || obj.ClassName() != "Array" {
+			panic(vm.NewTypeError("toCSV: rows must be an array"))
+		}
+
+		var sb strings.Builder
+		w := csv.NewWriter(&sb)
+		w.Comma = o.comma
+
+		cells := 0
+		write := func(record []string) {
+			cells += len(record)
+			if maxCells > 0 && cells > maxCells {
+				panic(vm.NewTypeError("toCSV: output has more than %d cells", maxCells))
+			}
+			if err := w.Write(record); err != nil {
+				panic(vm.NewGoError(fmt.Errorf("toCSV: %w", err)))
+			}
+		}
+
+		columns := o.Columns
+		length := obj.Get("length").ToInteger()
+		for i := int64(0); i < length; i++ {
+			row, ok := obj.Get(fmt.Sprint(i)).(*sobek.Object)
+			if !ok {
+				panic(vm.NewTypeError("toCSV: row %d is not an array or object", i))
+			}
+
+			if row.ClassName() == "Array" {
+				items := row.Export().([]interface{})
+				record := make([]string, len(items))
+				for j, cell := range items {
+					record[j] = csvCell(vm.ToValue(cell))
+				}
+				write(record)
+				continue
+			}
+
+			if columns == nil {
+				columns = row.Keys()
+			}
+			if i == 0 && o.Header {
+				write(columns)
+			}
+			record := make([]string, len(columns))
+			for j, name := range columns {
+				record[j] = csvCell(row.Get(name))
+			}
+			write(record)
+		}
+		w.Flush()
+		return sb.String()
+	})
+}
+
+type parsedCSVOptions struct {
+	csvOptions
+	comma rune
+}
+
+// csvArgumentOptions reads the options argument, throwing a TypeError when it is invalid
+func csvArgumentOptions(vm *sobek.Runtime, fn string, arg sobek.Value) parsedCSVOptions {
+	o := parsedCSVOptions{csvOptions: csvOptions{Delimiter: ",", Header: true}}
+	if arg != nil && !sobek.IsUndefined(arg) && !sobek.IsNull(arg) {
+		if err := vm.ExportTo(arg, &o.csvOptions); err != nil {
+			panic(vm.NewTypeError("%s: invalid options: %v", fn, err))
+		}
+	}
+
+	comma, size := utf8.DecodeRuneInString(o.Delimiter)
+	if size == 0 || size != len(o.Delimiter) || comma == '"' || comma == '\r' || comma == '\n' {
+		panic(vm.NewTypeError("%s: delimiter must be a single character other than a quote or newline", fn))
+	}
+	o.comma = comma
+	return o
+}
+
+// csvError turns a parse failure into a JS error carrying its line and column
+func csvError(vm *sobek.Runtime, err error) *sobek.Object {
+	e := vm.NewGoError(fmt.Errorf("parseCSV: %w", err))
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		e.Set("line", parseErr.Line)
+		e.Set("column", parseErr.Column)
+	}
+	return e
+}
+
+// csvCell formats a value as a CSV field, null and undefined become empty
+func csvCell(v sobek.Value) string {
+	if v == nil || sobek.IsUndefined(v) || sobek.IsNull(v) {
+		return ""
+	}
+	return v.String()
+}
+
+func stringsToValues(record []string) []interface{} {
+	values := make([]interface{}, len(record))
+	for i, s := range record {
+		values[i] = s
+	}
+	return values
+}
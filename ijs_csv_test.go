@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSV(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableStdlib = true
+		c.CSVMaxCells = 6
+	})
+	tests := []struct {
+		name    string
+		script  string
+		want    string
+		wantErr string
+	}{
+		{"parse with a header", `parseCSV("a,b\n1,2\n3,4").map(r => r.a + "|" + r.b).join(";")`, "1|2;3|4", ""},
+		{"parse without a header", `JSON.stringify(parseCSV("1,2\n3,4", {header: false}))`, `[["1","2"],["3","4"]]`, ""},
+		{"short row", `parseCSV("a,b\n1").map(r => r.a + "|" + r.b).join(";")`, "1|", ""},
+		{"quoted fields", `JSON.stringify(parseCSV('a\n"x, ""y"""', {}))`, `[{"a":"x, \"y\""}]`, ""},
+		{"delimiter", `parseCSV("a;b\n1;2", {delimiter: ";"}).map(r => r.a + "|" + r.b).join(";")`, "1|2", ""},
+		{"empty input", `JSON.stringify(parseCSV(""))`, `[]`, ""},
+		{"bare quote", `parseCSV('a\nx"y')`, "", "parseCSV:"},
+		{"lazy quotes", `JSON.stringify(parseCSV('a\nx"y', {lazyQuotes: true}))`, `[{"a":"x\"y"}]`, ""},
+		{"error position", `try { parseCSV('a\n"x') } catch (e) { e.line + ":" + e.column }`, "2:3", ""},
+		{"too many cells to parse", `parseCSV("1,2,3\n4,5,6\n7")`, "", "more than 6 cells"},
+		{"objects to CSV", `toCSV([{a: 1, b: "x,y"}, {a: null, b: undefined}])`, "a,b\n1,\"x,y\"\n,\n", ""},
+		{"arrays to CSV", `toCSV([[1, 2], ["3", true]])`, "1,2\n3,true\n", ""},
+		{"columns", `toCSV([{a: 1, b: 2}], {columns: ["b", "a"]})`, "b,a\n2,1\n", ""},
+		{"no header line", `toCSV([{a: 1}], {header: false})`, "1\n", ""},
+		{"too many cells to write", `toCSV([[1, 2, 3], [4, 5, 6], [7]])`, "", "more than 6 cells"},
+		{"rows not an array", `toCSV({a: 1})`, "", "rows must be an array"},
+		{"row not an object", `toCSV([1])`, "", "row 0 is not an array or object"},
+		{"multi-character delimiter", `parseCSV("a", {delimiter: "::"})`, "", "delimiter must be a single character"},
+		{"quote delimiter", `toCSV([[1]], {delimiter: '"'})`, "", "delimiter must be a single character"},
+		{"invalid options", `toCSV([[1]], {columns: 5})`, "", "toCSV: invalid options"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("result = %q, want %q", result, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrDeniedPattern is returned for scripts containing one of the denied_patterns
+var ErrDeniedPattern = errors.New("script contains a denied pattern")
+
+// DeniedPattern is a denied_patterns entry, either a plain string matched as a
+// literal substring, or {pattern: ..., regex: true} for an RE2 expression
+type DeniedPattern struct {
+	Pattern string `yaml:"pattern"`
+	Regex   bool   `yaml:"regex"`
+
+	re *regexp.Regexp // compiled Pattern, set by compileDeniedPatterns for regex entries
+}
+
+// UnmarshalYAML accepts the plain string form of a literal pattern
+func (p *DeniedPattern) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var literal string
+	if err := unmarshal(&literal); err == nil {
+		*p = DeniedPattern{Pattern: literal}
+		return nil
+	}
+	type plain DeniedPattern
+	return unmarshal((*plain)(p))
+}
+
+// compileDeniedPatterns compiles the regex entries of patterns in place
+func compileDeniedPatterns(patterns []DeniedPattern) error {
+	for i, p := range patterns {
+		if p.Pattern == "" {
+			return fmt.Errorf("entry %d is empty", i)
+		}
+		if !p.Regex {
+			continue
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("entry %d: %v", i, err)
+		}
+		patterns[i].re = re
+	}
+	return nil
+}
+
+// checkDeniedPatterns rejects js when it contains one of patterns, naming the
+// pattern but not the script. It runs on the raw source, before any parsing,
+// and again with its escapes decoded, so \u0063onstructor or "\x63onstructor"
+// match constructor too.
+func checkDeniedPatterns(js string, patterns []DeniedPattern) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	sources := []string{js}
+	if unescaped := unescapeJS(js); unescaped != js {
+		sources = append(sources, unescaped)
+	}
+	for _, p := range patterns {
+		for _, source := range sources {
+			matched := false
+			if p.re != nil {
+				matched = p.re.MatchString(source)
+			} else {
+				matched = strings.Contains(source, p.Pattern)
+			}
+			if matched {
+				return fmt.Errorf("%w: %q", ErrDeniedPattern, p.Pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// unescapeJS decodes the \uXXXX, \u{X...} and \xXX escapes of js wherever they
+// are, identifiers and string literals alike. Malformed escapes are kept as is.
+func unescapeJS(js string) string {
+	if !strings.Contains(js, `\`) {
+		return js
+	}
+	var out strings.Builder
+	for i := 0; i < len(js); {
+		if js[i] != '\\' || i+1 == len(js) {
+			out.WriteByte(js[i])
+			i++
+			continue
+		}
+		var hex string
+		next := i + 2
+		switch js[i+1] {
+		case 'u':
+			if end := strings.IndexByte(js[next:], '}'); next < len(js) && js[next] == '{' && end > 0 {
+				hex, next = js[next+1:next+end], next+end+1
+			} else if next+4 <= len(js) {
+				hex, next = js[next:next+4], next+4
+			}
+		case 'x':
+			if next+2 <= len(js) {
+				hex, next = js[next:next+2], next+2
+			}
+		}
+		r, err := strconv.ParseUint(hex, 16, 32)
+		if hex == "" || err != nil || r > 0x10FFFF {
+			// Not an escape decoded here: keep the backslash and the next
+			// byte, so \\u0063 stays the escaped backslash it is
+			out.WriteString(js[i : i+2])
+			i += 2
+			continue
+		}
+		out.WriteRune(rune(r))
+		i = next
+	}
+	return out.String()
+}
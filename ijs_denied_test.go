@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestDeniedPatternsYAML(t *testing.T) {
+	var c struct {
+		DeniedPatterns []DeniedPattern `yaml:"denied_patterns"`
+	}
+	err := yaml.Unmarshal([]byte("denied_patterns:\n  - __proto__\n  - {pattern: 'import\\s*\\(', regex: true}\n"), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DeniedPattern{{Pattern: "__proto__"}, {Pattern: `import\s*\(`, Regex: true}}
+	if len(c.DeniedPatterns) != len(want) {
+		t.Fatalf("patterns = %+v, want %+v", c.DeniedPatterns, want)
+	}
+	for i, p := range c.DeniedPatterns {
+		if p.Pattern != want[i].Pattern || p.Regex != want[i].Regex {
+			t.Fatalf("pattern %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+
+	for _, bad := range [][]DeniedPattern{{{Pattern: ""}}, {{Pattern: "a("}, {Pattern: "(", Regex: true}}} {
+		if err := compileDeniedPatterns(bad); err == nil {
+			t.Errorf("compileDeniedPatterns(%+v) = nil, want an error", bad)
+		}
+	}
+}
+
+func TestCheckDeniedPatterns(t *testing.T) {
+	patterns := []DeniedPattern{
+		{Pattern: "constructor"},
+		{Pattern: "__proto__"},
+		{Pattern: `import\s*\(`, Regex: true},
+	}
+	if err := compileDeniedPatterns(patterns); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		script string
+		want   string // pattern named by the error, "" for an accepted script
+	}{
+		{name: "clean", script: `({a: 1}).a + [1, 2].length`},
+		{name: "literal", script: `({}).constructor`, want: "constructor"},
+		{name: "literal in a string", script: `({})["__proto__"]`, want: "__proto__"},
+		{name: "regex", script: `import ("x")`, want: `import\s*\(`},
+		{name: "regex across lines", script: "import\n(\"x\")", want: `import\s*\(`},
+		{name: "regex not matching", script: `const important = 1; important`},
+		{name: "near miss", script: `const construct = 1; construct`},
+
+		// Spellings that reach the same member without writing it out
+		{name: "unicode escape in an identifier", script: `({}).\u0063onstructor`, want: "constructor"},
+		{name: "braced unicode escape", script: `({}).\u{63}onstructor`, want: "constructor"},
+		{name: "unicode escapes in a string", script: `({})["\u005f\u005fproto__"]`, want: "__proto__"},
+		{name: "hex escape in a string", script: `({})["\x63onstructor"]`, want: "constructor"},
+		{name: "escaped regex", script: `\u0069mport("x")`, want: `import\s*\(`},
+		{name: "escaped backslash", script: `"\\u0063onstructor"`},
+		{name: "malformed escape", script: `"\u00zz\xq"`},
+		{name: "trailing backslash", script: `"a\`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDeniedPatterns(tt.script, patterns)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("checkDeniedPatterns = %v, want accepted", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrDeniedPattern) || !strings.HasSuffix(err.Error(), ": "+`"`+strings.ReplaceAll(tt.want, `\`, `\\`)+`"`) {
+				t.Fatalf("checkDeniedPatterns = %v, want ErrDeniedPattern naming %q", err, tt.want)
+			}
+			if strings.Contains(err.Error(), tt.script) {
+				t.Fatalf("error %q echoes the script", err)
+			}
+		})
+	}
+}
+
+// TestDeniedPatternsEntryPoints checks a denied script is refused whichever way
+// it comes in
+func TestDeniedPatternsEntryPoints(t *testing.T) {
+	const denied = `({}).constructor`
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stored.js"), []byte(denied), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableRunScript = true
+		c.MaxScriptNesting = 2
+		c.DeniedPatterns = []DeniedPattern{{Pattern: "constructor"}}
+	})
+	sm.store = &fileScriptStore{dir: dir}
+
+	for path, h := range map[string]http.HandlerFunc{
+		"/data":   handler(sm),
+		"/fanout": fanoutHandler(sm),
+	} {
+		rec := postEnvelope(h, path, `{"script": "({}).constructor", "inputs": [{}]}`)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeDeniedPattern) {
+			t.Errorf("%s: %d %s, want 400 and %s", path, rec.Code, rec.Body, CodeDeniedPattern)
+		}
+	}
+	if rec := postEnvelope(handler(sm), "/data", `{"script_ref": "stored"}`); !strings.Contains(rec.Body.String(), CodeDeniedPattern) {
+		t.Errorf("stored script: %d %s, want %s", rec.Code, rec.Body, CodeDeniedPattern)
+	}
+	if _, err := sm.ExecuteScriptWithTimeout(`runScript("stored")`); err == nil || !strings.Contains(err.Error(), ErrDeniedPattern.Error()) {
+		t.Errorf("runScript: %v, want %v", err, ErrDeniedPattern)
+	}
+	s := newTestRepl(t, sm)
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: denied, repl: s}); !errors.Is(result.Error, ErrDeniedPattern) {
+		t.Errorf("REPL snippet: %v, want %v", result.Error, ErrDeniedPattern)
+	}
+}
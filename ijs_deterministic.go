@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/grafana/sobek/ast"
+)
+
+// nondeterministicGlobals are host functions whose result depends on when or
+// where the script runs, they are refused in deterministic_mode
+var nondeterministicGlobals = map[string]bool{
+	"timeBudget": true,
+}
+
+// checkDeterministic validates a job for deterministic_mode: the clock and the
+// random source must both be fixed by the envelope, and the script must not
+// reference a nondeterministic host function.
+func checkDeterministic(job ScriptJob) error {
+	if job.Seed == nil || job.Now.IsZero() {
+		return fmt.Errorf("%w: deterministic_mode requires seed and now in a JSON envelope", ErrInvalidEnvelope)
+	}
+
+	program, err := parseScript(job.Script)
+	if err != nil {
+		// Leave it to the execution to report the syntax error
+		return nil
+	}
+
+	var found string
+	walkAST(program, func(node ast.Node) bool {
+		if id, ok := node.(*ast.Identifier); ok && nondeterministicGlobals[id.Name.String()] {
+			found = id.Name.String()
+		}
+		return found == ""
+	})
+	if found != "" {
+		return fmt.Errorf("%w: %s is not allowed in deterministic_mode", ErrInvalidEnvelope, found)
+	}
+	return nil
+}
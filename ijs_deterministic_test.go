@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeterministicMode(t *testing.T) {
+	const fixed = `"seed": 42, "now": "2024-01-01T00:00:00Z"`
+	tests := []struct {
+		name       string
+		body       string
+		raw        bool // sent as a raw script instead of an envelope
+		wantStatus int
+	}{
+		{name: "seed and now", body: `{"script": "[Math.random(), Date.now()]", ` + fixed + `}`, wantStatus: http.StatusOK},
+		{name: "raw script", body: "Math.random()", raw: true, wantStatus: http.StatusBadRequest},
+		{name: "no seed", body: `{"script": "1", "now": "2024-01-01T00:00:00Z"}`, wantStatus: http.StatusBadRequest},
+		{name: "no now", body: `{"script": "1", "seed": 42}`, wantStatus: http.StatusBadRequest},
+		{name: "timeBudget", body: `{"script": "timeBudget()", ` + fixed + `}`, wantStatus: http.StatusBadRequest},
+		{name: "timeBudget in a function", body: `{"script": "function f() { return timeBudget }", ` + fixed + `}`, wantStatus: http.StatusBadRequest},
+		{name: "syntax error left to the execution", body: `{"script": "let = ;", ` + fixed + `}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.DeterministicMode = true
+				c.ScriptTimeout = time.Second
+			})
+			run := func() *httptest.ResponseRecorder {
+				if tt.raw {
+					rec := httptest.NewRecorder()
+					handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(tt.body)))
+					return rec
+				}
+				return postEnvelope(handler(sm), "/data", tt.body)
+			}
+			first := run()
+			if first.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", first.Code, first.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if second := run(); second.Body.String() != first.Body.String() {
+				t.Fatalf("runs differ: %s and %s", first.Body, second.Body)
+			}
+		})
+	}
+}
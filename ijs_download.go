@@ -0,0 +1,63 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxDownloadFilename caps the bytes of a download filename
+const maxDownloadFilename = 255
+
+// download is a result a script asked to be sent as a file
+type download struct {
+	filename    string
+	contentType string
+	body        interface{}
+}
+
+// downloadFrom recognizes a result of the form {__download: true, __filename,
+// __contentType, __body}. Any other result, including an object with
+// __download set to something else than true, is not a download.
+func downloadFrom(result interface{}) (download, bool) {
+	m, ok := result.(map[string]interface{})
+	if !ok || m["__download"] != true {
+		return download{}, false
+	}
+	d := download{body: m["__body"]}
+	d.filename, _ = m["__filename"].(string)
+	d.contentType, _ = m["__contentType"].(string)
+	return d, true
+}
+
+// sanitizeFilename keeps the base name of a script supplied filename, without
+// control characters, quotes or backslashes, so it cannot break out of the
+// Content-Disposition header, and cut to maxDownloadFilename bytes. An empty
+// name becomes "download".
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	for len(name) > maxDownloadFilename {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" {
+		return "download"
+	}
+	return name
+}
+
+// contentDisposition is the Content-Disposition header offering a download as
+// filename, which mime encodes per RFC 2231 when it is not plain ASCII
+func contentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": sanitizeFilename(filename)})
+}
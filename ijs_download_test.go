@@ -0,0 +1,148 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.csv", "report.csv"},
+		{"", "download"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\reports\q1.csv`, "q1.csv"},
+		{"a.csv\r\nSet-Cookie: x=1", "a.csvSet-Cookie: x=1"},
+		{`a".csv`, "a.csv"},
+		{"tab\tname\x00.csv", "tabname.csv"},
+		{" .hidden. ", "hidden"},
+		{"...", "download"},
+		{"rapport-été.csv", "rapport-été.csv"},
+		{"bad\xffbyte.csv", "badbyte.csv"},
+		{strings.Repeat("é", 200), strings.Repeat("é", 127)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.name); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"report.csv", `attachment; filename=report.csv`},
+		{"q1 report.csv", `attachment; filename="q1 report.csv"`},
+		{"a.csv\r\nSet-Cookie: x=1", `attachment; filename="a.csvSet-Cookie: x=1"`},
+		{`a"; filename="evil.exe`, `attachment; filename="a; filename=evil.exe"`},
+		{"rapport-été.csv", `attachment; filename*=utf-8''rapport-%C3%A9t%C3%A9.csv`},
+	}
+	for _, tt := range tests {
+		got := contentDisposition(tt.filename)
+		if got != tt.want {
+			t.Errorf("contentDisposition(%q) = %s, want %s", tt.filename, got, tt.want)
+		}
+		if strings.ContainsAny(got, "\r\n") {
+			t.Errorf("contentDisposition(%q) = %q breaks the header", tt.filename, got)
+		}
+		// What a client reads back is the sanitized name and nothing more
+		_, params, err := mime.ParseMediaType(got)
+		if err != nil || params["filename"] != sanitizeFilename(tt.filename) || len(params) != 1 {
+			t.Errorf("%s parses as %v, %v", got, params, err)
+		}
+	}
+}
+
+func TestDownloadResponse(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = time.Second })
+	tests := []struct {
+		name            string
+		script          string
+		wantType        string
+		wantDisposition string
+		wantBody        string
+	}{
+		{
+			name:            "csv",
+			script:          `({__download: true, __filename: "report.csv", __contentType: "text/plain", __body: "a,b\n1,2\n"})`,
+			wantType:        "text/plain",
+			wantDisposition: `attachment; filename=report.csv`,
+			wantBody:        "a,b\n1,2\n",
+		},
+		{
+			name:            "CRLF in the filename",
+			script:          `({__download: true, __filename: "r.csv\r\nX-Injected: 1", __contentType: "text/plain", __body: "x"})`,
+			wantType:        "text/plain",
+			wantDisposition: `attachment; filename="r.csvX-Injected: 1"`,
+			wantBody:        "x",
+		},
+		{
+			name:            "no content type",
+			script:          `({__download: true, __filename: "data.bin", __body: new Uint8Array([104, 105])})`,
+			wantType:        "application/octet-stream",
+			wantDisposition: `attachment; filename=data.bin`,
+			wantBody:        "hi",
+		},
+		{
+			name:            "no filename",
+			script:          `({__download: true, __contentType: "application/json", __body: {a: 1}})`,
+			wantType:        "application/json",
+			wantDisposition: `attachment; filename=download`,
+			wantBody:        "{\"a\":1}\n",
+		},
+		{
+			name:     "__download not true",
+			script:   `({__download: "yes", __filename: "report.csv", __body: "x"})`,
+			wantType: "application/json",
+			wantBody: `"__download":"yes"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := postScript(sm, tt.script)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != tt.wantDisposition {
+				t.Errorf("Content-Disposition = %q, want %q", got, tt.wantDisposition)
+			}
+			if tt.wantDisposition != "" && rec.Body.String() != tt.wantBody || tt.wantDisposition == "" && !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestDownloadError(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = time.Second })
+	tests := []struct {
+		name       string
+		script     string
+		wantStatus int
+		wantCode   string
+	}{
+		{"script failed", `({__download: true, __filename: "r.csv", __body: "x"}); throw new Error("boom")`, http.StatusInternalServerError, CodeRuntimeError},
+		{"content type outside the profile", `({__download: true, __filename: "r.html", __contentType: "text/html", __body: "<script>"})`, http.StatusBadRequest, CodeContentTypeNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, response := postScript(sm, tt.script)
+			if rec.Code != tt.wantStatus || response.Code != tt.wantCode {
+				t.Fatalf("status = %d %s, want %d and %s", rec.Code, rec.Body, tt.wantStatus, tt.wantCode)
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != "" {
+				t.Fatalf("Content-Disposition = %q on an error", got)
+			}
+		})
+	}
+}
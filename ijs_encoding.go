@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrInvalidEncoding is returned for scripts that are not valid UTF-8
+var ErrInvalidEncoding = errors.New("script is not valid UTF-8")
+
+// checkEncoding rejects js when it is not valid UTF-8, naming the byte offset of
+// the first invalid sequence, where the parser would fail with a syntax error
+// far from the cause.
+func checkEncoding(js string) error {
+	if utf8.ValidString(js) {
+		return nil
+	}
+	for offset := 0; offset < len(js); {
+		r, size := utf8.DecodeRuneInString(js[offset:])
+		if r == utf8.RuneError && size <= 1 {
+			return fmt.Errorf("%w: invalid byte 0x%02x at offset %d", ErrInvalidEncoding, js[offset], offset)
+		}
+		offset += size
+	}
+	return ErrInvalidEncoding
+}
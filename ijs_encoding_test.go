@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string // "" for a valid script
+	}{
+		{name: "ascii", script: `"ok"`},
+		{name: "multibyte", script: `"héllo 世界 🎉"`},
+		{name: "byte order mark", script: "\ufeff1"},
+		{name: "stray byte", script: "'a\xffb'", wantErr: "invalid byte 0xff at offset 2"},
+		{name: "latin-1", script: "'caf\xe9'", wantErr: "invalid byte 0xe9 at offset 4"},
+		{name: "first byte", script: "\x80", wantErr: "at offset 0"},
+		{name: "after multibyte", script: "'é\xc3'", wantErr: "invalid byte 0xc3 at offset 3"},
+		{name: "truncated at the end", script: "'\xe4\xb8", wantErr: "invalid byte 0xe4 at offset 1"},
+		// Spellings that decoders lenient about UTF-8 turn into a valid character
+		{name: "overlong slash", script: "'\xc0\xaf'", wantErr: "invalid byte 0xc0 at offset 1"},
+		{name: "overlong quote", script: "1 + '\xe0\x80\xa7'", wantErr: "invalid byte 0xe0 at offset 5"},
+		{name: "encoded surrogate", script: "'\xed\xa0\x80'", wantErr: "invalid byte 0xed at offset 1"},
+		{name: "past the last code point", script: "'\xf4\x90\x80\x80'", wantErr: "invalid byte 0xf4 at offset 1"},
+		{name: "NUL is valid", script: "'a\x00b'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkEncoding(tt.script)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkEncoding = %v, want valid", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidEncoding) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkEncoding = %v, want ErrInvalidEncoding with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestInvalidEncodingEntryPoints checks a script with invalid bytes is refused
+// with INVALID_ENCODING whichever way it comes in, not failed as a syntax error
+func TestInvalidEncodingEntryPoints(t *testing.T) {
+	const script = "'\xc0\xaf' + 1"
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stored.js"), []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableRunScript = true
+		c.MaxScriptNesting = 2
+	})
+	sm.store = &fileScriptStore{dir: dir}
+
+	post := func(h http.HandlerFunc, body, contentType string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		return rec
+	}
+	form, formType := multipartForm(t, map[string]string{"script": script})
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"raw body":      post(handler(sm), script, ""),
+		"multipart":     post(handler(sm), form, formType),
+		"stored":        post(handler(sm), `{"script_ref": "stored"}`, "application/json"),
+		"fanout stored": post(fanoutHandler(sm), `{"script_ref": "stored", "inputs": [{}]}`, "application/json"),
+	} {
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidEncoding) {
+			t.Errorf("%s: %d %s, want 400 and %s", name, rec.Code, rec.Body, CodeInvalidEncoding)
+		}
+	}
+	if rec := post(explainHandler(sm), script, ""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid byte 0xc0 at offset 1") {
+		t.Errorf("explain: %d %s, want 400 naming the bad byte", rec.Code, rec.Body)
+	}
+	rec := post(submitJobHandler(sm), script, "")
+	var submitted JobStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &submitted); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	job := pollJob(t, sm, submitted.ID)
+	for !job.finished() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		job = pollJob(t, sm, submitted.ID)
+	}
+	if job.Code != CodeInvalidEncoding {
+		t.Errorf("job: %+v, want it failed with %s", job, CodeInvalidEncoding)
+	}
+	if _, err := sm.ExecuteScriptWithTimeout(`runScript("stored")`); err == nil || !strings.Contains(err.Error(), ErrInvalidEncoding.Error()) {
+		t.Errorf("runScript: %v, want %v", err, ErrInvalidEncoding)
+	}
+	s := newTestRepl(t, sm)
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: script, repl: s}); !errors.Is(result.Error, ErrInvalidEncoding) {
+		t.Errorf("REPL snippet: %v, want %v", result.Error, ErrInvalidEncoding)
+	}
+
+	// JSON cannot carry the bytes, they arrive replaced by U+FFFD and run
+	rec = post(handler(sm), "{\"script\": \"'\xc0\xaf'.length\"}", "application/json")
+	if rec.Code != http.StatusOK {
+		t.Errorf("envelope: %d %s, want the replaced characters run", rec.Code, rec.Body)
+	}
+}
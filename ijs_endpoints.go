@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// knownEndpoints are the names enabled_endpoints accepts. An endpoint names a
+// group of routes: "jobs" covers POST /jobs and GET and DELETE /jobs/{id}, "repl"
+// the three REPL routes and "admin" every /admin route.
+var knownEndpoints = []string{
+	"data", "explain", "fanout", "stream-batch", "jobs", "sessions", "repl",
+	"results", "capabilities", "stats", "metrics", "health", "admin",
+}
+
+// defaultEndpoints is every endpoint but admin, which must be enabled explicitly
+var defaultEndpoints = slices.DeleteFunc(slices.Clone(knownEndpoints), func(name string) bool { return name == "admin" })
+
+// checkEnabledEndpoints rejects names that are not endpoints
+func checkEnabledEndpoints(names []string) error {
+	for _, name := range names {
+		if !slices.Contains(knownEndpoints, name) {
+			return fmt.Errorf("unknown endpoint %q, known endpoints are %v", name, knownEndpoints)
+		}
+	}
+	return nil
+}
+
+// endpointEnabled reports whether enabled_endpoints lists name
+func endpointEnabled(name string) bool {
+	return slices.Contains(config.EnabledEndpoints, name)
+}
+
+// registerRoutes adds the routes of the enabled endpoints to mux, so a disabled
+// endpoint answers 404 like any unknown path. Sessions, the REPL and spilled
+// results also need their own feature turned on.
+func registerRoutes(mux *http.ServeMux, sm *ScriptManager) {
+	route := func(endpoint, pattern string, handler http.Handler) {
+		if endpointEnabled(endpoint) {
+			mux.Handle(pattern, handler)
+		}
+	}
+	route("data", "/data", handler(sm))
+	route("explain", "/explain", explainHandler(sm))
+	route("fanout", "/fanout", fanoutHandler(sm))
+	route("stream-batch", "/stream-batch", streamBatchHandler(sm))
+	route("jobs", "POST /jobs", submitJobHandler(sm))
+	route("jobs", "GET /jobs/{id}", jobStatusHandler(sm))
+	route("jobs", "DELETE /jobs/{id}", deleteJobHandler(sm))
+	if config.EnableSessions {
+		route("sessions", "POST /sessions", createSessionHandler(sm))
+	}
+	if config.EnableRepl {
+		route("repl", "POST /repl", createReplHandler(sm))
+		route("repl", "POST /repl/{id}", replSnippetHandler(sm))
+		route("repl", "DELETE /repl/{id}", closeReplHandler(sm))
+	}
+	if sm.spills != nil {
+		route("results", "GET /results/{id}", spillDownloadHandler(sm))
+	}
+	route("capabilities", "GET /capabilities", capabilitiesHandler(sm))
+	route("stats", "/stats", statsHandler(sm))
+	route("metrics", "/metrics", metricsHandler())
+	route("health", "/health", healthHandler())
+	if endpointEnabled("admin") {
+		registerAdminRoutes(mux, sm)
+	}
+}
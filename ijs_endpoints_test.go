@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckEnabledEndpoints(t *testing.T) {
+	if err := checkEnabledEndpoints(knownEndpoints); err != nil {
+		t.Fatalf("every known endpoint: %v", err)
+	}
+	if err := checkEnabledEndpoints(nil); err != nil {
+		t.Fatalf("no endpoint: %v", err)
+	}
+	if err := checkEnabledEndpoints([]string{"data", "shell"}); err == nil || !strings.Contains(err.Error(), `"shell"`) {
+		t.Fatalf("err = %v, want the unknown endpoint named", err)
+	}
+	for _, name := range defaultEndpoints {
+		if name == "admin" {
+			t.Fatal("admin is enabled by default")
+		}
+	}
+}
+
+func TestEnabledEndpoints(t *testing.T) {
+	// Each request is answered by its route when its endpoint is enabled, and
+	// as an unknown path otherwise
+	requests := []struct {
+		endpoint string
+		method   string
+		path     string
+		body     string
+	}{
+		{"data", http.MethodPost, "/data", "1"},
+		{"explain", http.MethodPost, "/explain", "1"},
+		{"fanout", http.MethodPost, "/fanout", `{"script": "1", "inputs": [{}]}`},
+		{"jobs", http.MethodGet, "/jobs/nope", ""},
+		{"capabilities", http.MethodGet, "/capabilities", ""},
+		{"admin", http.MethodGet, "/admin/failures", ""},
+		{"admin", http.MethodGet, "/admin/config", ""},
+	}
+	tests := []struct {
+		name       string
+		enabled    []string
+		adminToken string
+		served     map[string]bool
+	}{
+		{name: "defaults", enabled: defaultEndpoints, adminToken: "secret", served: map[string]bool{"data": true, "explain": true, "fanout": true, "jobs": true, "capabilities": true}},
+		{name: "data only", enabled: []string{"data"}, adminToken: "secret", served: map[string]bool{"data": true}},
+		{name: "admin", enabled: []string{"admin"}, adminToken: "secret", served: map[string]bool{"admin": true}},
+		{name: "admin without a token", enabled: []string{"admin", "data"}, served: map[string]bool{"data": true}},
+		{name: "none", enabled: []string{}, adminToken: "secret", served: map[string]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.EnabledEndpoints = tt.enabled
+				c.AdminToken = tt.adminToken
+			})
+			mux := http.NewServeMux()
+			registerRoutes(mux, sm)
+			for _, req := range requests {
+				r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+				r.Header.Set("Authorization", "Bearer secret")
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, r)
+				// GET /jobs/nope is a 404 of its own, told apart by its JSON body
+				served := rec.Code != http.StatusNotFound || strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json")
+				if served != tt.served[req.endpoint] {
+					t.Errorf("%s %s: %d %s, want served %t", req.method, req.path, rec.Code, rec.Body, tt.served[req.endpoint])
+				}
+			}
+		})
+	}
+}
+
+func TestAdminRoutesUseManager(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.EnabledEndpoints = []string{"admin"}
+		c.AdminToken = "secret"
+	})
+	sm.failures = newFailureRing(4, false)
+	sm.failures.record(ScriptJob{Script: "throw 1"}, errors.New("boom"))
+	saved := scriptManager
+	scriptManager = nil
+	t.Cleanup(func() { scriptManager = saved })
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, sm)
+	r := httptest.NewRequest(http.MethodGet, "/admin/failures", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	var failures []FailureCase
+	if err := json.Unmarshal(rec.Body.Bytes(), &failures); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s: %v", rec.Code, rec.Body, err)
+	}
+	if len(failures) != 1 || failures[0].Error != "boom" {
+		t.Fatalf("failures = %+v, want the one recorded by the manager routes were registered with", failures)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidEnvelope = errors.New("invalid request envelope")
+)
+
+// Envelope is the JSON request body accepted by /data when the request is sent
+// with Content-Type: application/json. multipart/form-data requests carry the
+// script and input as parts, any other content type is taken as the raw script.
+type Envelope struct {
+	Script    string            `json:"script,omitempty"`
+	ScriptRef string            `json:"script_ref,omitempty"`
+	Input     interface{}       `json:"input,omitempty"`
+	Now       *time.Time        `json:"now,omitempty"`
+	Seed      *int64            `json:"seed,omitempty"`
+	Timezone  string            `json:"timezone,omitempty"`
+	SessionID string            `json:"session_id,omitempty"`
+	LogsOn    string            `json:"logs_on,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	InputSchema json.RawMessage `json:"input_schema,omitempty"` // JSON Schema the input must match
+}
+
+// parseRequest builds the job described by a /data request body
+func (sm *ScriptManager) parseRequest(r *http.Request, body []byte) (ScriptJob, error) {
+	job, err := sm.parseBody(r, body)
+	if err == nil && config.DeterministicMode {
+		err = checkDeterministic(job)
+	}
+	if err == nil {
+		job.Labels = requestLabels(r, job.Labels)
+		if sm.execMetrics != nil {
+			err = sm.execMetrics.check(job.Labels)
+		}
+	}
+	return job, err
+}
+
+func (sm *ScriptManager) parseBody(r *http.Request, body []byte) (ScriptJob, error) {
+	job := ScriptJob{Priority: isPriorityRequest(r), Origin: requestOrigin(r)}
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var env Envelope
+		if err := decodeEnvelopeJSON(body, &env); err != nil {
+			return job, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+		}
+		return sm.jobFromEnvelope(job, env, nil)
+	case "multipart/form-data":
+		env, err := parseMultipart(body, params["boundary"])
+		if err != nil {
+			return job, err
+		}
+		return sm.jobFromEnvelope(job, env, nil)
+	default:
+		job.Script = string(body)
+		return job, nil
+	}
+}
+
+// parseMultipart reads an uploaded form into an envelope. The script comes from
+// the required script part, usually a .js file, and the optional input part
+// holds JSON. Other parts are ignored.
+func parseMultipart(body []byte, boundary string) (Envelope, error) {
+	var env Envelope
+	if boundary == "" {
+		return env, fmt.Errorf("%w: multipart request has no boundary", ErrInvalidEnvelope)
+	}
+
+	hasScript := false
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return env, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+		}
+
+		switch part.FormName() {
+		case "script":
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return env, fmt.Errorf("%w: reading script part: %v", ErrInvalidEnvelope, err)
+			}
+			env.Script = string(data)
+			hasScript = true
+		case "input":
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return env, fmt.Errorf("%w: reading input part: %v", ErrInvalidEnvelope, err)
+			}
+			if err := decodeInputJSON(data, &env.Input); err != nil {
+				return env, fmt.Errorf("%w: input part: %v", ErrInvalidEnvelope, err)
+			}
+		}
+		part.Close()
+	}
+
+	if !hasScript {
+		return env, fmt.Errorf("%w: multipart request has no script part", ErrInvalidEnvelope)
+	}
+	return env, nil
+}
+
+// jobFromEnvelope fills job from a decoded envelope. inputs are the items of a
+// /fanout, nil for any other request, and are checked against the input schemas
+// in place of the input of env.
+func (sm *ScriptManager) jobFromEnvelope(job ScriptJob, env Envelope, inputs []map[string]interface{}) (ScriptJob, error) {
+	switch {
+	case env.Script != "" && env.ScriptRef != "":
+		return job, fmt.Errorf("%w: script and script_ref are mutually exclusive", ErrInvalidEnvelope)
+	case env.ScriptRef != "":
+		if sm.store == nil {
+			return job, fmt.Errorf("%w: no script store is configured", ErrInvalidEnvelope)
+		}
+		script, err := sm.store.Load(env.ScriptRef)
+		if err != nil {
+			return job, err
+		}
+		job.Script = script
+	default:
+		job.Script = env.Script
+	}
+
+	if err := sm.checkInputSchema(env, inputs); err != nil {
+		return job, err
+	}
+
+	job.Input = env.Input
+	job.Timeout = scaledTimeout(env.Input)
+	if env.Now != nil {
+		job.Now = *env.Now
+	}
+	job.Seed = env.Seed
+	if env.SessionID != "" {
+		if sm.sessions == nil {
+			return job, fmt.Errorf("%w: sessions are not enabled", ErrInvalidEnvelope)
+		}
+		s, err := sm.sessions.get(env.SessionID)
+		if err != nil {
+			return job, err
+		}
+		job.session = s
+	}
+	if env.Timezone != "" {
+		loc, err := loadLocation(env.Timezone)
+		if err != nil {
+			return job, fmt.Errorf("%w: unknown timezone %q", ErrInvalidEnvelope, env.Timezone)
+		}
+		job.Location = loc
+	}
+	if err := checkLogsOn(env.LogsOn); err != nil {
+		return job, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	job.LogsOn = env.LogsOn
+	job.Labels = env.Labels
+	return job, nil
+}
+
+// decodeEnvelopeJSON decodes a request body into v once checkJSON has found it
+// no deeper than max_json_depth, with its input, or the items of its inputs,
+// within the input limits
+func decodeEnvelopeJSON(data []byte, v interface{}) error {
+	if err := checkJSON(data, config.MaxJSONDepth, configInputLimits(), true); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodeInputJSON decodes an input sent on its own into v once checkJSON has
+// found it within max_json_depth and the input limits
+func decodeInputJSON(data []byte, v interface{}) error {
+	if err := checkJSON(data, config.MaxJSONDepth, configInputLimits(), false); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// inputLimits caps an input: the object properties it holds in total, how deep
+// it nests and the length of its arrays. A limit of 0 disables that check.
+type inputLimits struct {
+	maxKeys, maxDepth, maxArray int
+}
+
+// configInputLimits returns max_input_keys, max_input_depth and max_array_length
+func configInputLimits() inputLimits {
+	return inputLimits{maxKeys: config.MaxInputKeys, maxDepth: config.MaxInputDepth, maxArray: config.MaxArrayLength}
+}
+
+// jsonFrame is an object or array checkJSON is in
+type jsonFrame struct {
+	object  bool
+	wantKey bool   // in an object, the next string is a key
+	key     string // in an object, the key of the value being read
+	items   int    // in an array, the items read so far
+	inputs  bool   // the inputs array of an envelope
+}
+
+// checkJSON scans data token by token, without building any value, and fails as
+// soon as objects and arrays nest deeper than maxDepth, the outermost value
+// being the first level, or an input breaks limits. With envelope the inputs are
+// the input member of the outermost object and the items of its inputs array,
+// otherwise data is one input. A limit of 0 disables that check. Syntax errors
+// are left to the decoding that follows.
+func checkJSON(data []byte, maxDepth int, limits inputLimits, envelope bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var stack []jsonFrame
+	inputBase, inputKeys := -1, 0 // stack length outside the input being read, -1 outside any
+	valueDone := func() {
+		if len(stack) == inputBase {
+			inputBase = -1
+		}
+		if len(stack) > 0 && stack[len(stack)-1].object {
+			stack[len(stack)-1].wantKey = true
+		}
+	}
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if token == json.Delim('}') || token == json.Delim(']') {
+			stack = stack[:len(stack)-1]
+			valueDone()
+			continue
+		}
+		var parent *jsonFrame
+		if len(stack) > 0 {
+			parent = &stack[len(stack)-1]
+		}
+		if parent != nil && parent.object && parent.wantKey {
+			parent.key, _ = token.(string)
+			parent.wantKey = false
+			if inputBase >= 0 {
+				inputKeys++
+				if limits.maxKeys > 0 && inputKeys > limits.maxKeys {
+					return fmt.Errorf("input has more than %d keys", limits.maxKeys)
+				}
+			}
+			continue
+		}
+
+		// token starts a value
+		if inputBase < 0 && startsInput(stack, envelope) {
+			inputBase, inputKeys = len(stack), 0
+		}
+		if parent != nil && !parent.object {
+			parent.items++
+			if inputBase >= 0 && inputBase < len(stack) && limits.maxArray > 0 && parent.items > limits.maxArray {
+				return fmt.Errorf("input has an array of more than %d items", limits.maxArray)
+			}
+		}
+		delim, ok := token.(json.Delim)
+		if !ok {
+			valueDone()
+			continue
+		}
+		if maxDepth > 0 && len(stack)+1 > maxDepth {
+			return fmt.Errorf("body is nested deeper than %d levels", maxDepth)
+		}
+		if inputBase >= 0 && limits.maxDepth > 0 && len(stack)+1-inputBase > limits.maxDepth {
+			return fmt.Errorf("input is nested deeper than %d levels", limits.maxDepth)
+		}
+		stack = append(stack, jsonFrame{
+			object:  delim == '{',
+			wantKey: delim == '{',
+			inputs:  envelope && delim == '[' && len(stack) == 1 && parent.object && strings.EqualFold(parent.key, "inputs"),
+		})
+	}
+}
+
+// startsInput reports whether the value starting on top of stack is an input.
+// Keys are matched as encoding/json does, regardless of case.
+func startsInput(stack []jsonFrame, envelope bool) bool {
+	switch {
+	case !envelope:
+		return len(stack) == 0
+	case len(stack) == 1:
+		return stack[0].object && strings.EqualFold(stack[0].key, "input")
+	case len(stack) == 2:
+		return stack[1].inputs
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nestedJSON returns value wrapped in depth arrays
+func nestedJSON(depth int, value string) string {
+	return strings.Repeat("[", depth) + value + strings.Repeat("]", depth)
+}
+
+// wideJSON returns an object of n keys
+func wideJSON(n int) string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf(`"k%d": %d`, i, i)
+	}
+	return "{" + strings.Join(keys, ", ") + "}"
+}
+
+func TestCheckJSON(t *testing.T) {
+	limits := inputLimits{maxKeys: 5, maxDepth: 3, maxArray: 4}
+	tests := []struct {
+		name     string
+		data     string
+		envelope bool
+		wantErr  string
+	}{
+		{name: "no input", data: `{"script": "1"}`, envelope: true},
+		{name: "input within the limits", data: `{"script": "1", "input": {"a": [1, 2, {"b": 3}]}}`, envelope: true},
+		{name: "wide input", data: `{"input": ` + wideJSON(6) + `}`, envelope: true, wantErr: "more than 5 keys"},
+		{name: "keys counted across objects", data: `{"input": {"a": {"b": 1, "c": 2}, "d": {"e": 1, "f": 2}}}`, envelope: true, wantErr: "more than 5 keys"},
+		{name: "deep input", data: `{"input": ` + nestedJSON(4, "1") + `}`, envelope: true, wantErr: "nested deeper than 3 levels"},
+		{name: "deep input of objects", data: `{"input": {"a": {"b": {"c": {}}}}}`, envelope: true, wantErr: "nested deeper than 3 levels"},
+		{name: "input at the depth limit", data: `{"input": ` + nestedJSON(3, "1") + `}`, envelope: true},
+		{name: "long array", data: `{"input": [1, 2, 3, 4, 5]}`, envelope: true, wantErr: "more than 4 items"},
+		{name: "long nested array", data: `{"input": {"a": [[1, 2, 3, 4, 5]]}}`, envelope: true, wantErr: "more than 4 items"},
+		{name: "scalar input", data: `{"input": "x"}`, envelope: true},
+		{name: "key matched regardless of case", data: `{"Input": ` + wideJSON(6) + `}`, envelope: true, wantErr: "more than 5 keys"},
+		{name: "other members not limited", data: `{"labels": ` + wideJSON(6) + `, "input": {"a": 1}}`, envelope: true},
+		{name: "nested input member not an input", data: `{"labels": {"input": ` + wideJSON(6) + `}}`, envelope: true},
+		{name: "members after the input not counted", data: `{"input": {"a": 1}, "labels": ` + wideJSON(6) + `}`, envelope: true},
+		{name: "inputs checked one by one", data: `{"inputs": [` + wideJSON(5) + `, ` + wideJSON(5) + `, ` + wideJSON(5) + `, ` + wideJSON(5) + `, ` + wideJSON(5) + `]}`, envelope: true},
+		{name: "wide item of inputs", data: `{"inputs": [{"a": 1}, ` + wideJSON(6) + `]}`, envelope: true, wantErr: "more than 5 keys"},
+		{name: "deep item of inputs", data: `{"inputs": [{"a": {"b": {"c": {}}}}]}`, envelope: true, wantErr: "nested deeper than 3 levels"},
+		{name: "input sent on its own", data: wideJSON(5)},
+		{name: "wide input sent on its own", data: wideJSON(6), wantErr: "more than 5 keys"},
+		{name: "deep input sent on its own", data: nestedJSON(4, "1"), wantErr: "nested deeper than 3 levels"},
+		{name: "body too deep", data: `{"labels": ` + nestedJSON(10, "1") + `}`, envelope: true, wantErr: "body is nested deeper than 8 levels"},
+		{name: "syntax error left to decoding", data: `{"input": [1, `, envelope: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJSON([]byte(tt.data), 8, limits, tt.envelope)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInputLimitsOnRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{name: "envelope", contentType: "application/json", body: `{"script": "input.length", "input": [1, 2]}`, wantStatus: http.StatusOK},
+		{name: "wide envelope input", contentType: "application/json", body: `{"script": "1", "input": ` + wideJSON(20) + `}`, wantStatus: http.StatusBadRequest},
+		{name: "deep envelope input", contentType: "application/json", body: `{"script": "1", "input": ` + nestedJSON(5, "1") + `}`, wantStatus: http.StatusBadRequest},
+		{name: "envelope input array at the limit", contentType: "application/json", body: `{"script": "input.list.length", "input": {"list": [1, 2, 3, 4, 5]}}`, wantStatus: http.StatusOK},
+		{name: "long envelope input array", contentType: "application/json", body: `{"script": "1", "input": {"list": [1, 2, 3, 4, 5, 6]}}`, wantStatus: http.StatusBadRequest},
+		{name: "long array in an item of inputs", contentType: "application/json", body: `{"script": "1", "inputs": [[1, 2, 3, 4, 5, 6]]}`, wantStatus: http.StatusBadRequest},
+		{
+			name:        "deep multipart input",
+			contentType: "multipart/form-data; boundary=b",
+			body:        "--b\r\nContent-Disposition: form-data; name=\"script\"\r\n\r\n1\r\n--b\r\nContent-Disposition: form-data; name=\"input\"\r\n\r\n" + nestedJSON(5, "1") + "\r\n--b--\r\n",
+			wantStatus:  http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.MaxInputKeys = 10
+				c.MaxInputDepth = 4
+				c.MaxArrayLength = 5
+			})
+			r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			handler(sm)(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDeepEnvelope(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.MaxScriptSize = 4 << 20
+		c.MaxJSONDepth = 16
+		c.MaxInputDepth = 0
+	})
+	// 1M levels that never close: only a parse that stops at the limit answers
+	// without a syntax error
+	unclosed := `{"script": "1", "labels": ` + strings.Repeat("[", 1<<20)
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		// The envelope is the first level
+		{name: "at the limit", body: `{"script": "1", "input": ` + nestedJSON(15, "1") + `}`, wantStatus: http.StatusOK},
+		{name: "past the limit", body: `{"script": "1", "input": ` + nestedJSON(16, "1") + `}`, wantStatus: http.StatusBadRequest},
+		{name: "past the limit outside the input", body: `{"script": "1", "labels": ` + nestedJSON(16, "1") + `}`, wantStatus: http.StatusBadRequest},
+		{name: "pathologically deep", body: unclosed, wantStatus: http.StatusBadRequest},
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/data":    handler(sm),
+		"/explain": explainHandler(sm),
+		"/fanout":  fanoutHandler(sm),
+	}
+	for _, tt := range tests {
+		for path, h := range handlers {
+			t.Run(tt.name+" "+path, func(t *testing.T) {
+				body := tt.body
+				if path == "/fanout" {
+					body = strings.Replace(body, `"script": "1"`, `"script": "1", "inputs": [{}]`, 1)
+				}
+				rec := postEnvelope(h, path, body)
+				if tt.wantStatus == http.StatusOK {
+					if rec.Code != http.StatusOK {
+						t.Fatalf("status = %d %s", rec.Code, rec.Body)
+					}
+					return
+				}
+				if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), "body is nested deeper than 16 levels") {
+					t.Fatalf("status = %d %s, want %d naming the depth limit", rec.Code, rec.Body, tt.wantStatus)
+				}
+			})
+		}
+	}
+
+	t.Run("stream-batch", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		streamBatchHandler(sm)(rec, httptest.NewRequest(http.MethodPost, "/stream-batch", strings.NewReader("{\"script\": \"2\"}\n"+unclosed+"\n")))
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		if len(lines) != 2 || !strings.Contains(lines[0], `"result":2`) || !strings.Contains(lines[1], "body is nested deeper than 16 levels") {
+			t.Fatalf("lines = %q, want the deep line alone rejected", lines)
+		}
+	})
+}
+
+// postEnvelope sends body to h as a JSON envelope
+func postEnvelope(h http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h(rec, r)
+	return rec
+}
+
+func TestEnvelopeNow(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       string
+	}{
+		{name: "Date", body: `{"script": "new Date().toISOString()", "now": "2024-02-29T12:00:00Z"}`, wantStatus: http.StatusOK, want: `"2024-02-29T12:00:00.000Z"`},
+		{name: "Date.now", body: `{"script": "Date.now()", "now": "2024-02-29T12:00:00.5Z"}`, wantStatus: http.StatusOK, want: `1709208000500`},
+		{name: "offset", body: `{"script": "new Date().toISOString()", "now": "2024-02-29T12:00:00+02:00"}`, wantStatus: http.StatusOK, want: `"2024-02-29T10:00:00.000Z"`},
+		{name: "clock does not move", body: `{"script": "const a = Date.now(); for (let i = 0; i < 100000; i++) {} Date.now() - a", "now": "2024-02-29T12:00:00Z"}`, wantStatus: http.StatusOK, want: `0`},
+		{name: "real clock without now", body: `{"script": "new Date().getUTCFullYear() >= 2024"}`, wantStatus: http.StatusOK, want: `true`},
+		{name: "invalid now", body: `{"script": "1", "now": "yesterday"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+			})
+			rec := postEnvelope(handler(sm), "/data", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.want == "" {
+				return
+			}
+			var response struct {
+				Result json.RawMessage `json:"result"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if string(response.Result) != tt.want {
+				t.Fatalf("result = %s, want %s", response.Result, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvelopeTimezone(t *testing.T) {
+	const summer = `new Date("2024-07-01T12:00:00Z")`
+	tests := []struct {
+		name   string
+		script string
+		want   [2]string // in America/New_York and in Asia/Tokyo
+	}{
+		{name: "getHours", script: summer + ".getHours()", want: [2]string{`8`, `21`}},
+		{name: "getUTCHours", script: summer + ".getUTCHours()", want: [2]string{`12`, `12`}},
+		{name: "getDay", script: `new Date("2024-07-01T02:00:00Z").getDay()`, want: [2]string{`0`, `1`}},
+		{name: "summer offset", script: summer + ".getTimezoneOffset()", want: [2]string{`240`, `-540`}},
+		{name: "winter offset", script: `new Date("2024-01-15T12:00:00Z").getTimezoneOffset()`, want: [2]string{`300`, `-540`}},
+		{name: "toString", script: summer + ".toString()", want: [2]string{`"Mon Jul 01 2024 08:00:00 GMT-0400 (EDT)"`, `"Mon Jul 01 2024 21:00:00 GMT+0900 (JST)"`}},
+		{name: "toLocaleDateString", script: `new Date("2024-07-01T02:00:00Z").toLocaleDateString()`, want: [2]string{`"06/30/2024"`, `"07/01/2024"`}},
+		{name: "local components", script: `new Date(2024, 0, 1).toISOString()`, want: [2]string{`"2024-01-01T05:00:00.000Z"`, `"2023-12-31T15:00:00.000Z"`}},
+		{name: "local date-time string", script: `new Date("2024-03-01T09:30").toISOString()`, want: [2]string{`"2024-03-01T14:30:00.000Z"`, `"2024-03-01T00:30:00.000Z"`}},
+		{name: "Date.parse", script: `Date.parse("2024-03-01T09:30")`, want: [2]string{`1709303400000`, `1709253000000`}},
+		{name: "string with an offset", script: `new Date("2024-03-01T09:30Z").toISOString()`, want: [2]string{`"2024-03-01T09:30:00.000Z"`, `"2024-03-01T09:30:00.000Z"`}},
+		{name: "setHours", script: `const d = ` + summer + `; d.setHours(0, 0); d.toISOString()`, want: [2]string{`"2024-07-01T04:00:00.000Z"`, `"2024-06-30T15:00:00.000Z"`}},
+		{name: "instanceof", script: summer + ` instanceof Date && new Date() instanceof Date`, want: [2]string{`true`, `true`}},
+		{name: "invalid date", script: `isNaN(new Date("nope").getHours())`, want: [2]string{`true`, `true`}},
+	}
+	zones := [2]string{"America/New_York", "Asia/Tokyo"}
+	for _, tt := range tests {
+		for i, zone := range zones {
+			t.Run(tt.name+" "+zone, func(t *testing.T) {
+				sm := newTestManager(t, func(c *Config) {
+					c.ScriptTimeout = time.Second
+				})
+				body, err := json.Marshal(map[string]string{"script": tt.script, "timezone": zone})
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec := postEnvelope(handler(sm), "/data", string(body))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d %s", rec.Code, rec.Body)
+				}
+				var response struct {
+					Result json.RawMessage `json:"result"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				if string(response.Result) != tt.want[i] {
+					t.Fatalf("result = %s, want %s", response.Result, tt.want[i])
+				}
+			})
+		}
+	}
+}
+
+func TestEnvelopeInvalidTimezone(t *testing.T) {
+	sm := newTestManager(t, nil)
+	// Local is the zone of the host, not an IANA name
+	for _, zone := range []string{"Mars/Olympus_Mons", "Local"} {
+		rec := postEnvelope(handler(sm), "/data", `{"script": "1", "timezone": "`+zone+`"}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want 400", zone, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), `unknown timezone \"`+zone+`\"`) {
+			t.Fatalf("%s: body = %s, want the timezone named", zone, rec.Body)
+		}
+	}
+}
+
+// multipartForm encodes parts as a multipart/form-data body, a part named
+// script being sent as a .js file upload
+func multipartForm(t *testing.T, parts map[string]string) (string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range parts {
+		var w io.Writer
+		var err error
+		if name == "script" {
+			w, err = mw.CreateFormFile(name, "report.js")
+		} else {
+			w, err = mw.CreateFormField(name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.String(), mw.FormDataContentType()
+}
+
+func TestMultipartUpload(t *testing.T) {
+	tests := []struct {
+		name        string
+		parts       map[string]string
+		contentType string // overrides the one of the encoded form
+		wantStatus  int
+		want        string // result, or part of the error
+		wantCode    string // CodeInvalidRequest when not set
+	}{
+		{name: "script and input", parts: map[string]string{"script": "input.n * 2", "input": `{"n": 21}`}, wantStatus: http.StatusOK, want: "42"},
+		{name: "script only", parts: map[string]string{"script": "typeof input"}, wantStatus: http.StatusOK, want: `"undefined"`},
+		{name: "other parts ignored", parts: map[string]string{"script": "1", "comment": "not a script"}, wantStatus: http.StatusOK, want: "1"},
+		{name: "no script part", parts: map[string]string{"input": `{"n": 21}`}, wantStatus: http.StatusBadRequest, want: "multipart request has no script part"},
+		{name: "empty form", parts: map[string]string{}, wantStatus: http.StatusBadRequest, want: "multipart request has no script part"},
+		{name: "invalid input", parts: map[string]string{"script": "1", "input": "{n: 1}"}, wantStatus: http.StatusBadRequest, want: "input part"},
+		{name: "no boundary", parts: map[string]string{"script": "1"}, contentType: "multipart/form-data", wantStatus: http.StatusBadRequest, want: "multipart request has no boundary"},
+		{name: "over max_script_size", parts: map[string]string{"script": "'" + strings.Repeat("x", 2000) + "'"}, wantStatus: http.StatusBadRequest, want: ErrScriptTooLarge.Error(), wantCode: CodeScriptTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+			})
+			sm.maxScriptSize = 1024
+
+			body, contentType := multipartForm(t, tt.parts)
+			if tt.contentType != "" {
+				contentType = tt.contentType
+			}
+			r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+			handler(sm)(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+
+			var response struct {
+				Result json.RawMessage `json:"result"`
+				Error  string          `json:"error"`
+				Code   string          `json:"code"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantStatus != http.StatusOK {
+				wantCode := tt.wantCode
+				if wantCode == "" {
+					wantCode = CodeInvalidRequest
+				}
+				if !strings.Contains(response.Error, tt.want) || response.Code != wantCode {
+					t.Fatalf("error = %q %s, want %q and %s", response.Error, response.Code, tt.want, wantCode)
+				}
+				return
+			}
+			if string(response.Result) != tt.want {
+				t.Fatalf("result = %s, want %s", response.Result, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/sobek"
+)
+
+// Error codes sent in the "code" field of error responses, so clients can branch
+// on the kind of failure instead of matching messages. They are a stable
+// contract: a code never changes meaning, new failures get new codes.
+const (
+	CodeInvalidRequest        = "INVALID_REQUEST"
+	CodeInputSchema           = "INPUT_SCHEMA_VIOLATION"
+	CodeInvalidSchema         = "INVALID_SCHEMA"
+	CodeScriptNotFound        = "SCRIPT_NOT_FOUND"
+	CodeSessionNotFound       = "SESSION_NOT_FOUND"
+	CodeReplNotFound          = "REPL_NOT_FOUND"
+	CodeReplBusy              = "REPL_BUSY"
+	CodeResultNotFound        = "RESULT_NOT_FOUND"
+	CodeSessionFull           = "SESSION_FULL"
+	CodeTooManySessions       = "TOO_MANY_SESSIONS"
+	CodeScriptTooLarge        = "SCRIPT_TOO_LARGE"
+	CodeInvalidEncoding       = "INVALID_ENCODING"
+	CodeBannedSyntax          = "BANNED_SYNTAX"
+	CodeDeniedPattern         = "DENIED_PATTERN"
+	CodeSyntaxError           = "SYNTAX_ERROR"
+	CodeRuntimeError          = "RUNTIME_ERROR"
+	CodeScriptError           = "SCRIPT_ERROR"
+	CodeTimeout               = "TIMEOUT"
+	CodeExecutionAbandoned    = "EXECUTION_ABANDONED"
+	CodeRunTimeBudget         = "RUN_TIME_BUDGET"
+	CodeCallStackExceeded     = "CALL_STACK_EXCEEDED"
+	CodeHostCallLimit         = "HOST_CALL_LIMIT"
+	CodeMemoryLimit           = "MEMORY_LIMIT"
+	CodeTooManyGlobals        = "TOO_MANY_GLOBALS"
+	CodeResultTooLarge        = "RESULT_TOO_LARGE"
+	CodeResultArrayTooLong    = "RESULT_ARRAY_TOO_LONG"
+	CodeSpillFull             = "SPILL_FULL"
+	CodeContentTypeNotAllowed = "CONTENT_TYPE_NOT_ALLOWED"
+	CodeNoWorker              = "NO_WORKER"
+	CodeQueueWaitExceeded     = "QUEUE_WAIT_EXCEEDED"
+	CodeScriptShed            = "SCRIPT_SHED"
+	CodeScriptCancelled       = "SCRIPT_CANCELLED"
+	CodeOverloaded            = "OVERLOADED"
+	CodeRequestTooLarge       = "REQUEST_TOO_LARGE"
+	CodeIntakePaused          = "INTAKE_PAUSED"
+	CodeShuttingDown          = "SHUTTING_DOWN"
+	CodeCancelled             = "CANCELLED"
+	CodeInternalError         = "INTERNAL_ERROR"
+)
+
+// errorCode returns the code of an error returned by the script manager. Our
+// own errors are checked first, as a script interrupted by one of them still
+// surfaces through sobek.
+func errorCode(err error) string {
+	var syntaxErr *sobek.CompilerSyntaxError
+	var exception *sobek.Exception
+	var scriptErr *ScriptError
+	switch {
+	case errors.Is(err, ErrInvalidEnvelope), errors.Is(err, ErrInvalidScriptRef):
+		return CodeInvalidRequest
+	case errors.Is(err, ErrInputSchema):
+		return CodeInputSchema
+	case errors.Is(err, ErrInvalidSchema):
+		return CodeInvalidSchema
+	case errors.Is(err, ErrScriptNotFound):
+		return CodeScriptNotFound
+	case errors.Is(err, ErrSessionNotFound):
+		return CodeSessionNotFound
+	case errors.Is(err, ErrReplNotFound):
+		return CodeReplNotFound
+	case errors.Is(err, ErrReplBusy):
+		return CodeReplBusy
+	case errors.Is(err, ErrSpillNotFound):
+		return CodeResultNotFound
+	case errors.Is(err, ErrSessionFull):
+		return CodeSessionFull
+	case errors.Is(err, ErrTooManySessions):
+		return CodeTooManySessions
+	case errors.Is(err, ErrScriptTooLarge):
+		return CodeScriptTooLarge
+	case errors.Is(err, ErrInvalidEncoding):
+		return CodeInvalidEncoding
+	case errors.Is(err, ErrBannedSyntax):
+		return CodeBannedSyntax
+	case errors.Is(err, ErrDeniedPattern):
+		return CodeDeniedPattern
+	case errors.Is(err, ErrCompileFailed), errors.As(err, &syntaxErr):
+		return CodeSyntaxError
+	case errors.Is(err, ErrScriptTimeout):
+		return CodeTimeout
+	case errors.Is(err, ErrExecutionAbandoned):
+		return CodeExecutionAbandoned
+	case errors.Is(err, ErrRunTimeBudget):
+		return CodeRunTimeBudget
+	case errors.Is(err, ErrCallStackExceeded):
+		return CodeCallStackExceeded
+	case errors.Is(err, ErrHostCallLimit):
+		return CodeHostCallLimit
+	case errors.Is(err, ErrMemoryLimit):
+		return CodeMemoryLimit
+	case errors.Is(err, ErrTooManyGlobals):
+		return CodeTooManyGlobals
+	case errors.Is(err, ErrResultTooLarge):
+		return CodeResultTooLarge
+	case errors.Is(err, ErrResultArrayTooLong):
+		return CodeResultArrayTooLong
+	case errors.Is(err, ErrSpillFull):
+		return CodeSpillFull
+	case errors.Is(err, ErrContentTypeNotAllowed):
+		return CodeContentTypeNotAllowed
+	case errors.Is(err, ErrNoWorkerAvailable):
+		return CodeNoWorker
+	case errors.Is(err, ErrQueueWaitExceeded):
+		return CodeQueueWaitExceeded
+	case errors.Is(err, ErrScriptShed):
+		return CodeScriptShed
+	case errors.Is(err, ErrScriptCancelled):
+		return CodeScriptCancelled
+	case errors.Is(err, ErrInflightBytes), errors.Is(err, ErrCPUPressure):
+		return CodeOverloaded
+	case errors.Is(err, ErrRequestTooLarge):
+		return CodeRequestTooLarge
+	case errors.Is(err, ErrShuttingDown):
+		return CodeShuttingDown
+	case errors.Is(err, context.Canceled):
+		return CodeCancelled
+	case errors.As(err, &scriptErr):
+		return CodeScriptError
+	case errors.Is(err, ErrPromiseRejected), errors.Is(err, ErrUnhandledRejection),
+		errors.Is(err, ErrPromisePending), errors.As(err, &exception):
+		return CodeRuntimeError
+	default:
+		return CodeInternalError
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/sobek"
+)
+
+func TestErrorCode(t *testing.T) {
+	_, exception := sobek.New().RunString(`throw new TypeError("bad")`)
+	_, syntaxErr := sobek.Compile("", "1 +", false)
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ErrInvalidEnvelope, CodeInvalidRequest},
+		{ErrInvalidScriptRef, CodeInvalidRequest},
+		{ErrInputSchema, CodeInputSchema},
+		{ErrInvalidSchema, CodeInvalidSchema},
+		{ErrScriptNotFound, CodeScriptNotFound},
+		{ErrSessionNotFound, CodeSessionNotFound},
+		{ErrReplNotFound, CodeReplNotFound},
+		{ErrReplBusy, CodeReplBusy},
+		{ErrSpillNotFound, CodeResultNotFound},
+		{ErrSessionFull, CodeSessionFull},
+		{ErrTooManySessions, CodeTooManySessions},
+		{ErrScriptTooLarge, CodeScriptTooLarge},
+		{ErrInvalidEncoding, CodeInvalidEncoding},
+		{ErrBannedSyntax, CodeBannedSyntax},
+		{ErrDeniedPattern, CodeDeniedPattern},
+		{ErrCompileFailed, CodeSyntaxError},
+		{syntaxErr, CodeSyntaxError},
+		{ErrScriptTimeout, CodeTimeout},
+		{ErrExecutionAbandoned, CodeExecutionAbandoned},
+		{ErrRunTimeBudget, CodeRunTimeBudget},
+		{ErrCallStackExceeded, CodeCallStackExceeded},
+		{ErrHostCallLimit, CodeHostCallLimit},
+		{ErrMemoryLimit, CodeMemoryLimit},
+		{ErrTooManyGlobals, CodeTooManyGlobals},
+		{ErrResultTooLarge, CodeResultTooLarge},
+		{ErrResultArrayTooLong, CodeResultArrayTooLong},
+		{ErrSpillFull, CodeSpillFull},
+		{ErrContentTypeNotAllowed, CodeContentTypeNotAllowed},
+		{ErrNoWorkerAvailable, CodeNoWorker},
+		{ErrQueueWaitExceeded, CodeQueueWaitExceeded},
+		{ErrScriptShed, CodeScriptShed},
+		{ErrScriptCancelled, CodeScriptCancelled},
+		{ErrInflightBytes, CodeOverloaded},
+		{ErrCPUPressure, CodeOverloaded},
+		{ErrRequestTooLarge, CodeRequestTooLarge},
+		{ErrShuttingDown, CodeShuttingDown},
+		{context.Canceled, CodeCancelled},
+		{&ScriptError{Name: "ValidationError", Message: "bad"}, CodeScriptError},
+		{ErrPromiseRejected, CodeRuntimeError},
+		{ErrUnhandledRejection, CodeRuntimeError},
+		{ErrPromisePending, CodeRuntimeError},
+		{exception, CodeRuntimeError},
+		{ErrWorkerPanic, CodeInternalError},
+		{errors.New("unexpected"), CodeInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want+"/"+tt.err.Error(), func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Fatalf("errorCode = %s, want %s", got, tt.want)
+			}
+			// Codes survive the wrapping errors get on their way to the handler
+			if got := errorCode(fmt.Errorf("script execution failed: %w", tt.err)); got != tt.want {
+				t.Fatalf("errorCode of the wrapped error = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorResponseCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		configure  func(*Config)
+		shutdown   bool
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "script too large", script: strings.Repeat("1;", 100), configure: func(c *Config) { c.MaxScriptSize = 50 }, wantStatus: http.StatusBadRequest, wantCode: CodeScriptTooLarge},
+		{name: "syntax error", script: `1 +`, wantStatus: http.StatusBadRequest, wantCode: CodeSyntaxError},
+		{name: "runtime error", script: `null.x`, wantStatus: http.StatusInternalServerError, wantCode: CodeRuntimeError},
+		{name: "thrown error", script: `throw new Error("boom")`, wantStatus: http.StatusInternalServerError, wantCode: CodeRuntimeError},
+		{name: "timeout", script: `for (;;) {}`, configure: func(c *Config) { c.ScriptTimeout = 100 * time.Millisecond }, wantStatus: http.StatusRequestTimeout, wantCode: CodeTimeout},
+		{name: "invalid encoding", script: "'\xff'", wantStatus: http.StatusBadRequest, wantCode: CodeInvalidEncoding},
+		{name: "host call limit", script: `for (;;) render("x", 1)`, configure: func(c *Config) { c.MaxHostCalls = map[string]int{"render": 2} }, wantStatus: http.StatusUnprocessableEntity, wantCode: CodeHostCallLimit},
+		{name: "shutting down", script: `1`, shutdown: true, wantStatus: http.StatusServiceUnavailable, wantCode: CodeShuttingDown},
+		{name: "success has no code", script: `1`, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				if tt.configure != nil {
+					tt.configure(c)
+				}
+			})
+			if tt.shutdown {
+				sm.Shutdown()
+			}
+			rec := httptest.NewRecorder()
+			handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(tt.script)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var response Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != tt.wantCode {
+				t.Fatalf("code = %q, want %q", response.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// TestScriptBodyTooLarge checks every endpoint taking a script refuses a body
+// over max_script_size rather than running what fits under it
+func TestScriptBodyTooLarge(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableRepl = true
+	})
+	sm.maxScriptSize = 50
+	// Cut at the limit this would still be a valid script
+	body := strings.Repeat("1;", 100)
+	for path, h := range map[string]http.HandlerFunc{
+		"/data":    handler(sm),
+		"/explain": explainHandler(sm),
+		"/fanout":  fanoutHandler(sm),
+		"/jobs":    submitJobHandler(sm),
+		"/repl/id": replSnippetHandler(sm),
+	} {
+		t.Run(path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeScriptTooLarge) {
+				t.Fatalf("status = %d %s, want 400 and %s", rec.Code, rec.Body, CodeScriptTooLarge)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(body[:50])))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s for a body at the limit, want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleExecutionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrHostCallLimit, http.StatusUnprocessableEntity},
+		{ErrRunTimeBudget, http.StatusUnprocessableEntity},
+		{ErrCallStackExceeded, http.StatusUnprocessableEntity},
+		{ErrResultTooLarge, http.StatusUnprocessableEntity},
+		{ErrScriptTimeout, http.StatusRequestTimeout},
+		{ErrExecutionAbandoned, http.StatusRequestTimeout},
+		{ErrMemoryLimit, http.StatusServiceUnavailable},
+		{ErrQueueWaitExceeded, http.StatusServiceUnavailable},
+		{ErrSpillFull, http.StatusInsufficientStorage},
+		{ErrDeniedPattern, http.StatusBadRequest},
+		{&ScriptError{Name: "NotFound", Message: "no such order", Status: http.StatusNotFound}, http.StatusNotFound},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleExecutionError(fmt.Errorf("script execution failed: %w", tt.err), rec)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/grafana/sobek/ast"
+	"github.com/sirupsen/logrus"
+)
+
+// ScriptSummary describes what a script does without running it
+type ScriptSummary struct {
+	Functions    []FunctionSummary `json:"functions"`
+	Variables    []string          `json:"variables"`
+	Loops        int               `json:"loops"`
+	Conditionals int               `json:"conditionals"`
+}
+
+// FunctionSummary describes a declared function
+type FunctionSummary struct {
+	Name  string `json:"name"`
+	Arity int    `json:"arity"`
+}
+
+// ExplainResponse is the body returned by /explain
+type ExplainResponse struct {
+	Summary     *ScriptSummary `json:"summary,omitempty"`
+	SyntaxError *SyntaxError   `json:"syntax_error,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// explainScript summarizes a parsed script: its declared functions, its top-level
+// variables and how many loops and conditionals it contains
+func explainScript(program *ast.Program) *ScriptSummary {
+	summary := &ScriptSummary{
+		Functions: []FunctionSummary{},
+		Variables: []string{},
+	}
+
+	for _, stmt := range program.Body {
+		var bindings []*ast.Binding
+		switch s := stmt.(type) {
+		case *ast.VariableStatement:
+			bindings = s.List
+		case *ast.LexicalDeclaration:
+			bindings = s.List
+		}
+		for _, binding := range bindings {
+			summary.Variables = append(summary.Variables, bindingNames(binding.Target)...)
+		}
+	}
+
+	walkAST(program, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.FunctionDeclaration:
+			fn := FunctionSummary{Name: node.Function.Name.Name.String()}
+			if node.Function.ParameterList != nil {
+				fn.Arity = len(node.Function.ParameterList.List)
+			}
+			summary.Functions = append(summary.Functions, fn)
+		case *ast.ForStatement, *ast.ForInStatement, *ast.ForOfStatement,
+			*ast.WhileStatement, *ast.DoWhileStatement:
+			summary.Loops++
+		case *ast.IfStatement, *ast.ConditionalExpression, *ast.SwitchStatement:
+			summary.Conditionals++
+		}
+		return true
+	})
+
+	return summary
+}
+
+// explainHandler parses the submitted script and returns its summary. The script
+// is never executed and no worker is used.
+func explainHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+			logrus.Warn("Request method not allowed")
+			return
+		}
+
+		body, ok := readScriptBody(w, r, scriptManager.maxScriptSize)
+		if !ok {
+			return
+		}
+
+		job, err := scriptManager.parseRequest(r, body)
+		if err != nil {
+			writeJSONValue(w, http.StatusBadRequest, ExplainResponse{Error: err.Error()})
+			return
+		}
+
+		// The parser would report bad bytes as a syntax error far from the cause
+		if err := checkEncoding(job.Script); err != nil {
+			writeJSONValue(w, http.StatusBadRequest, ExplainResponse{Error: err.Error()})
+			return
+		}
+
+		program, err := parseScript(job.Script)
+		var syntaxErr *SyntaxError
+		if errors.As(err, &syntaxErr) {
+			writeJSONValue(w, http.StatusBadRequest, ExplainResponse{SyntaxError: syntaxErr})
+			return
+		}
+
+		writeJSONValue(w, http.StatusOK, ExplainResponse{Summary: explainScript(program)})
+		logrus.Info("Script explained")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExplainScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   ScriptSummary
+	}{
+		{
+			name:   "empty",
+			script: "",
+			want:   ScriptSummary{Functions: []FunctionSummary{}, Variables: []string{}},
+		},
+		{
+			name:   "declarations",
+			script: "var a = 1; let [b, c] = [2, 3]; const {d, e: f} = {}; function sum(x, y) { var local = x; return x + y } function noop() {}",
+			want: ScriptSummary{
+				Functions: []FunctionSummary{{Name: "sum", Arity: 2}, {Name: "noop", Arity: 0}},
+				Variables: []string{"a", "b", "c", "d", "f"},
+			},
+		},
+		{
+			name:   "nested functions",
+			script: "function outer() { function inner(a) {} return inner }",
+			want: ScriptSummary{
+				Functions: []FunctionSummary{{Name: "outer"}, {Name: "inner", Arity: 1}},
+				Variables: []string{},
+			},
+		},
+		{
+			name:   "loops and conditionals",
+			script: "for (;;) { break } for (const k in {}) {} for (const v of []) {} while (false) {} do {} while (false); if (1) {} else if (2) {} const x = 1 ? 2 : 3; switch (x) {}",
+			want: ScriptSummary{
+				Functions:    []FunctionSummary{},
+				Variables:    []string{"x"},
+				Loops:        5,
+				Conditionals: 4,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program, err := parseScript(tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := explainScript(program); !reflect.DeepEqual(*got, tt.want) {
+				t.Fatalf("summary = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantLine   int // line of the syntax error, 0 for none
+	}{
+		{name: "script", method: http.MethodPost, body: "function f(a) { return a }", wantStatus: http.StatusOK},
+		{name: "syntax error", method: http.MethodPost, body: "let a = 1;\nlet b = ;", wantStatus: http.StatusBadRequest, wantLine: 2},
+		{name: "not executed", method: http.MethodPost, body: "while (true) {}", wantStatus: http.StatusOK},
+		{name: "GET", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, nil)
+			rec := httptest.NewRecorder()
+			explainHandler(sm)(rec, httptest.NewRequest(tt.method, "/explain", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.method != http.MethodPost {
+				return
+			}
+			var response ExplainResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantLine != 0 {
+				if response.SyntaxError == nil || response.SyntaxError.Line != tt.wantLine {
+					t.Fatalf("syntax error = %+v, want one on line %d", response.SyntaxError, tt.wantLine)
+				}
+				return
+			}
+			if response.Summary == nil {
+				t.Fatalf("no summary in %s", rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FailureCase is a failed execution kept for debugging
+type FailureCase struct {
+	Index        uint64      `json:"index"`
+	Time         time.Time   `json:"time"`
+	Error        string      `json:"error"`
+	ScriptSHA256 string      `json:"script_sha256"`
+	ScriptLength int         `json:"script_length"`
+	Script       string      `json:"script,omitempty"`
+	Input        interface{} `json:"input,omitempty"`
+
+	job ScriptJob // what is needed to replay the case, only kept with failure_capture_bodies
+}
+
+// failureRing keeps the last failures, overwriting the oldest once full
+type failureRing struct {
+	sync.Mutex
+	cases      []FailureCase
+	next       int    // slot the next failure is written to
+	count      uint64 // failures recorded so far, the index of the next one
+	keepBodies bool
+}
+
+func newFailureRing(capacity int, keepBodies bool) *failureRing {
+	return &failureRing{cases: make([]FailureCase, 0, capacity), keepBodies: keepBodies}
+}
+
+// record stores a failed job, along with its script and input when bodies are kept
+func (fr *failureRing) record(job ScriptJob, err error) {
+	sum := sha256.Sum256([]byte(job.Script))
+	c := FailureCase{
+		Time:         time.Now(),
+		Error:        err.Error(),
+		ScriptSHA256: hex.EncodeToString(sum[:]),
+		ScriptLength: len(job.Script),
+	}
+	if fr.keepBodies {
+		c.Script = job.Script
+		c.Input = job.Input
+		c.job = ScriptJob{
+			Script:   job.Script,
+			Input:    job.Input,
+			Now:      job.Now,
+			Seed:     job.Seed,
+			Location: job.Location,
+			program:  job.program,
+		}
+	}
+
+	fr.Lock()
+	defer fr.Unlock()
+	c.Index = fr.count
+	fr.count++
+	if len(fr.cases) < cap(fr.cases) {
+		fr.cases = append(fr.cases, c)
+	} else {
+		fr.cases[fr.next] = c
+	}
+	fr.next = (fr.next + 1) % cap(fr.cases)
+}
+
+// list returns the retained failures, oldest first
+func (fr *failureRing) list() []FailureCase {
+	fr.Lock()
+	defer fr.Unlock()
+	if len(fr.cases) < cap(fr.cases) {
+		return append([]FailureCase(nil), fr.cases...)
+	}
+	return append(append([]FailureCase(nil), fr.cases[fr.next:]...), fr.cases[:fr.next]...)
+}
+
+// get returns the failure recorded with index, if it is still retained
+func (fr *failureRing) get(index uint64) (FailureCase, bool) {
+	for _, c := range fr.list() {
+		if c.Index == index {
+			return c, true
+		}
+	}
+	return FailureCase{}, false
+}
+
+// failuresHandler lists the captured failures
+func failuresHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if scriptManager.failures == nil {
+			writeJSONValue(w, http.StatusOK, []FailureCase{})
+			return
+		}
+		writeJSONValue(w, http.StatusOK, scriptManager.failures.list())
+	}
+}
+
+// replayFailureHandler runs a captured failure again and returns its outcome
+func replayFailureHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		index, err := strconv.ParseUint(r.PathValue("index"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: "invalid failure index"})
+			return
+		}
+		if scriptManager.failures == nil {
+			writeJSON(w, http.StatusNotFound, Response{Error: "failure capture is disabled"})
+			return
+		}
+		c, ok := scriptManager.failures.get(index)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, Response{Error: "failure is no longer retained"})
+			return
+		}
+		if !scriptManager.failures.keepBodies {
+			writeJSON(w, http.StatusConflict, Response{Error: "replay needs failure_capture_bodies"})
+			return
+		}
+
+		logrus.WithField("index", index).Info("Replaying captured failure")
+		result := scriptManager.ExecuteScriptWithContext(r.Context(), c.job)
+		response := Response{Result: result.Result}
+		if result.Error != nil {
+			response.Error = result.Error.Error()
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailureRingWraps(t *testing.T) {
+	fr := newFailureRing(3, false)
+	for i := 0; i < 5; i++ {
+		fr.record(ScriptJob{Script: fmt.Sprintf("throw %d", i)}, fmt.Errorf("failure %d", i))
+	}
+
+	cases := fr.list()
+	if len(cases) != 3 {
+		t.Fatalf("%d failures retained, want 3", len(cases))
+	}
+	for i, c := range cases {
+		if want := uint64(i + 2); c.Index != want || c.Error != fmt.Sprintf("failure %d", want) {
+			t.Fatalf("failure %d = %d %q, want index %d, oldest first", i, c.Index, c.Error, want)
+		}
+		if c.Script != "" || c.ScriptLength != len("throw 0") {
+			t.Fatalf("failure %d kept script %q of length %d, want only its length", i, c.Script, c.ScriptLength)
+		}
+	}
+	if _, ok := fr.get(1); ok {
+		t.Fatal("failure 1 is still retained after being overwritten")
+	}
+	if c, ok := fr.get(4); !ok || c.Error != "failure 4" {
+		t.Fatalf("get(4) = %+v, %v, want the last failure", c, ok)
+	}
+}
+
+func TestFailureRingBodies(t *testing.T) {
+	for _, keepBodies := range []bool{false, true} {
+		t.Run(fmt.Sprint(keepBodies), func(t *testing.T) {
+			fr := newFailureRing(1, keepBodies)
+			fr.record(ScriptJob{Script: "throw input.secret", Input: map[string]interface{}{"secret": "hunter2"}}, errors.New("hunter2"))
+
+			body, err := json.Marshal(fr.list())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(body), `"script":"throw input.secret"`) && strings.Contains(string(body), `"input":{"secret":"hunter2"}`); got != keepBodies {
+				t.Fatalf("failures = %s, script and input kept = %v, want %v", body, got, keepBodies)
+			}
+		})
+	}
+}
+
+func TestFailureReplay(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	sm.failures = newFailureRing(2, true)
+
+	for _, n := range []int{1, 2, 3} {
+		job := ScriptJob{Script: `if (input.n > 0) throw new Error("bad n " + input.n); 1`, Input: map[string]interface{}{"n": n}}
+		if result := sm.ExecuteScriptWithContext(context.Background(), job); result.Error == nil {
+			t.Fatal("script did not fail")
+		}
+	}
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"}); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	rec := httptest.NewRecorder()
+	failuresHandler(sm)(rec, httptest.NewRequest(http.MethodGet, "/admin/failures", nil))
+	var cases []FailureCase
+	if err := json.Unmarshal(rec.Body.Bytes(), &cases); err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 || cases[0].Index != 1 || cases[1].Index != 2 {
+		t.Fatalf("failures = %+v, want the last two, successes not recorded", cases)
+	}
+
+	replay := func(index string) (int, Response) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/admin/failures/"+index+"/replay", nil)
+		r.SetPathValue("index", index)
+		rec := httptest.NewRecorder()
+		replayFailureHandler(sm)(rec, r)
+		var response Response
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, response
+	}
+
+	// Replaying reproduces the error, with the input of that case
+	status, response := replay("2")
+	if status != http.StatusOK || !strings.Contains(response.Error, "bad n 3") || response.Error != cases[1].Error {
+		t.Fatalf("replay = %d %q, want the captured error %q", status, response.Error, cases[1].Error)
+	}
+
+	tests := []struct {
+		name       string
+		index      string
+		keepBodies bool
+		disabled   bool
+		wantStatus int
+	}{
+		{name: "overwritten", index: "0", keepBodies: true, wantStatus: http.StatusNotFound},
+		{name: "not yet recorded", index: "9", keepBodies: true, wantStatus: http.StatusNotFound},
+		{name: "invalid index", index: "-1", keepBodies: true, wantStatus: http.StatusBadRequest},
+		{name: "without bodies", index: "2", wantStatus: http.StatusConflict},
+		{name: "capture disabled", index: "2", disabled: true, wantStatus: http.StatusNotFound},
+	}
+	ring := sm.failures
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				sm.failures = ring
+				ring.keepBodies = true
+			})
+			ring.keepBodies = tt.keepBodies
+			if tt.disabled {
+				sm.failures = nil
+			}
+			if status, response := replay(tt.index); status != tt.wantStatus {
+				t.Fatalf("replay = %d %q, want %d", status, response.Error, tt.wantStatus)
+			}
+		})
+	}
+}
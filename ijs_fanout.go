@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/sobek"
+	"github.com/sirupsen/logrus"
+)
+
+// FanoutRequest is the body accepted by /fanout: one script, given through the
+// envelope fields, run once per entry of inputs
+type FanoutRequest struct {
+	Envelope
+	Inputs []map[string]interface{} `json:"inputs"`
+}
+
+// FanoutResponse holds one response per input, in input order
+type FanoutResponse struct {
+	Results    []Response        `json:"results,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Code       string            `json:"code,omitempty"`
+	Violations []SchemaViolation `json:"violations,omitempty"` // how the inputs break their schema, located under /inputs/<index>
+}
+
+// compileScript compiles js once so it can be run by several workers. With
+// max_concurrent_compiles set it first waits for a compile slot, so a storm of
+// distinct scripts cannot spend every CPU on parsing.
+func (sm *ScriptManager) compileScript(js string) (*sobek.Program, error) {
+	if sm.compileSem != nil {
+		sm.compileSem <- struct{}{}
+		defer func() { <-sm.compileSem }()
+	}
+	start := time.Now()
+	program, err := sobek.Compile("", js, false)
+	sm.timings.compile.observe(time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCompileFailed, err)
+	}
+	atomic.AddUint64(&sm.compileCount, 1)
+	return program, nil
+}
+
+// ExecuteBatchSameScript compiles script once and runs it with each input across
+// the worker pool, returning the results in input order
+func (sm *ScriptManager) ExecuteBatchSameScript(script string, inputs []map[string]interface{}) ([]ScriptResult, error) {
+	return sm.ExecuteBatchWithContext(context.Background(), ScriptJob{Script: script}, inputs)
+}
+
+// ExecuteBatchWithContext runs job once per input, each run seeing its own input
+// global. The error covers the batch as a whole, a failing run is reported in
+// its ScriptResult.
+func (sm *ScriptManager) ExecuteBatchWithContext(ctx context.Context, job ScriptJob, inputs []map[string]interface{}) ([]ScriptResult, error) {
+	if int64(len(job.Script)) > sm.maxScriptSize {
+		return nil, ErrScriptTooLarge
+	}
+	if sm.isShuttingDown() {
+		return nil, ErrShuttingDown
+	}
+
+	if err := checkEncoding(job.Script); err != nil {
+		return nil, err
+	}
+	if err := checkDeniedPatterns(job.Script, config.DeniedPatterns); err != nil {
+		return nil, err
+	}
+	if err := checkBannedSyntax(job.Script, config.BannedSyntax); err != nil {
+		return nil, err
+	}
+
+	program, err := sm.compileScript(job.Script)
+	if err != nil {
+		return nil, err
+	}
+	job.program = program
+
+	// Never hold more queue slots than the lane has, so the batch does not
+	// reject its own runs
+	slots := make(chan struct{}, sm.laneFor(job).jobQueue.Cap())
+	results := make([]ScriptResult, len(inputs))
+	var wg sync.WaitGroup
+	dispatched := len(inputs)
+dispatch:
+	for i, input := range inputs {
+		// Once shutdown starts nothing more is dispatched, the runs already
+		// started complete and the rest of the batch is marked as shut down
+		select {
+		case slots <- struct{}{}:
+		case <-sm.done:
+			dispatched = i
+			for j := i; j < len(inputs); j++ {
+				results[j] = ScriptResult{Error: ErrShuttingDown}
+			}
+			break dispatch
+		}
+		wg.Add(1)
+		go func(i int, run ScriptJob) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i] = sm.ExecuteScriptWithContext(ctx, run)
+		}(i, withInput(job, input))
+	}
+	wg.Wait()
+
+	if dispatched < len(inputs) {
+		logrus.WithFields(logrus.Fields{
+			"runs":       len(inputs),
+			"dispatched": dispatched,
+		}).Warn("Fan-out batch cut short by shutdown, returning partial results")
+		return results, nil
+	}
+	logrus.WithField("runs", len(inputs)).Info("Fan-out batch completed")
+	return results, nil
+}
+
+// withInput returns a copy of job using input as its input global
+func withInput(job ScriptJob, input map[string]interface{}) ScriptJob {
+	if input != nil {
+		job.Input = input
+	}
+	return job
+}
+
+// fanoutHandler serves /fanout, running one script against many inputs
+func fanoutHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+			logrus.Warn("Request method not allowed")
+			return
+		}
+
+		body, ok := readScriptBody(w, r, scriptManager.maxScriptSize)
+		if !ok {
+			return
+		}
+
+		if !scriptManager.GetAcceptingScript() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(memoryResumeDelay.Seconds())))
+			writeJSONValue(w, http.StatusServiceUnavailable, FanoutResponse{Error: config.BackoffMessage, Code: CodeIntakePaused})
+			return
+		}
+
+		var req FanoutRequest
+		if err := decodeEnvelopeJSON(body, &req); err != nil {
+			writeJSONValue(w, http.StatusBadRequest, FanoutResponse{Error: fmt.Errorf("%w: %v", ErrInvalidEnvelope, err).Error(), Code: CodeInvalidRequest})
+			return
+		}
+
+		job, err := scriptManager.jobFromEnvelope(ScriptJob{Priority: isPriorityRequest(r), Origin: requestOrigin(r)}, req.Envelope, req.Inputs)
+		if err == nil && config.DeterministicMode {
+			err = checkDeterministic(job)
+		}
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrScriptNotFound) || errors.Is(err, ErrSessionNotFound) {
+				status = http.StatusNotFound
+			}
+			response := FanoutResponse{Error: err.Error(), Code: errorCode(err)}
+			var schemaErr *inputSchemaError
+			if errors.As(err, &schemaErr) {
+				response.Violations = schemaErr.violations
+			}
+			writeJSONValue(w, status, response)
+			return
+		}
+
+		results, err := scriptManager.ExecuteBatchWithContext(r.Context(), job, req.Inputs)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrCompileFailed), errors.Is(err, ErrScriptTooLarge), errors.Is(err, ErrBannedSyntax), errors.Is(err, ErrDeniedPattern),
+				errors.Is(err, ErrInvalidEncoding):
+				status = http.StatusBadRequest
+			case errors.Is(err, ErrShuttingDown):
+				status = http.StatusServiceUnavailable
+			}
+			writeJSONValue(w, status, FanoutResponse{Error: err.Error(), Code: errorCode(err)})
+			return
+		}
+
+		response := FanoutResponse{Results: make([]Response, len(results))}
+		for i, result := range results {
+			if result.Error != nil {
+				response.Results[i].Error = result.Error.Error()
+				response.Results[i].Code = errorCode(result.Error)
+			} else {
+				response.Results[i].Result = result.Result
+			}
+		}
+		writeJSONValue(w, http.StatusOK, response)
+	}
+}
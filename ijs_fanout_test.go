@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanoutCompilesOnce(t *testing.T) {
+	tests := []struct {
+		name         string
+		script       string
+		inputs       int
+		wantCompiles uint64
+		wantErr      error
+	}{
+		{name: "one input", script: "input.n * 2", inputs: 1, wantCompiles: 1},
+		{name: "more inputs than workers and queue slots", script: "input.n * 2", inputs: 20, wantCompiles: 1},
+		{name: "no inputs", script: "1", inputs: 0, wantCompiles: 1},
+		{name: "syntax error", script: "input.n *", inputs: 5, wantErr: ErrCompileFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.WorkerPoolSize = 2
+				c.QueueSize = 1
+				c.ScriptTimeout = time.Second
+			})
+			inputs := make([]map[string]interface{}, tt.inputs)
+			for i := range inputs {
+				inputs[i] = map[string]interface{}{"n": i}
+			}
+			results, err := sm.ExecuteBatchSameScript(tt.script, inputs)
+			if compiles := atomic.LoadUint64(&sm.compileCount); compiles != tt.wantCompiles {
+				t.Fatalf("script compiled %d times, want %d", compiles, tt.wantCompiles)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, result := range results {
+				if result.Error != nil || result.Result != int64(i*2) {
+					t.Fatalf("result %d = %v, %v, want %d", i, result.Result, result.Error, i*2)
+				}
+			}
+		})
+	}
+}
+
+func TestFanoutHandler(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 2
+		c.ScriptTimeout = time.Second
+	})
+	inputs := make([]string, 10)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf(`{"n": %d}`, i)
+	}
+	body := `{"script": "if (input.n === 3) throw new Error('three'); input.n", "inputs": [` + strings.Join(inputs, ", ") + `]}`
+
+	rec := postEnvelope(fanoutHandler(sm), "/fanout", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s", rec.Code, rec.Body)
+	}
+	if compiles := atomic.LoadUint64(&sm.compileCount); compiles != 1 {
+		t.Fatalf("script compiled %d times for %d inputs, want once", compiles, len(inputs))
+	}
+	var response FanoutResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != len(inputs) {
+		t.Fatalf("%d results, want %d", len(response.Results), len(inputs))
+	}
+	for i, result := range response.Results {
+		if i == 3 {
+			if result.Code != CodeRuntimeError {
+				t.Fatalf("result 3 = %+v, want a runtime error", result)
+			}
+			continue
+		}
+		if result.Error != "" || result.Result != float64(i) {
+			t.Fatalf("result %d = %+v, want %d", i, result, i)
+		}
+	}
+}
+
+func TestFanoutPartialOnShutdown(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.QueueSize = 1
+		c.ScriptTimeout = 5 * time.Second
+	})
+	inputs := make([]map[string]interface{}, 5)
+	for i := range inputs {
+		inputs[i] = map[string]interface{}{"n": i}
+	}
+
+	type batch struct {
+		results []ScriptResult
+		err     error
+	}
+	done := make(chan batch, 1)
+	go func() {
+		results, err := sm.ExecuteBatchSameScript(`const end = Date.now() + 300; while (Date.now() < end) {} input.n`, inputs)
+		done <- batch{results, err}
+	}()
+	// The first run holds the only slot, the rest of the batch waits for it
+	waitRunning(t, sm, 1)
+	sm.Shutdown()
+
+	got := <-done
+	if got.err != nil {
+		t.Fatalf("error = %v, want the partial results", got.err)
+	}
+	if len(got.results) != len(inputs) {
+		t.Fatalf("%d results, want one per input", len(got.results))
+	}
+	if got.results[0].Error != nil || got.results[0].Result != int64(0) {
+		t.Fatalf("result 0 = %v, %v, want the run started before shutdown completed", got.results[0].Result, got.results[0].Error)
+	}
+	for i, result := range got.results[1:] {
+		if !errors.Is(result.Error, ErrShuttingDown) {
+			t.Errorf("result %d error = %v, want ErrShuttingDown", i+1, result.Error)
+		}
+	}
+}
+
+func TestMaxConcurrentCompiles(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.WorkerPoolSize = 4
+	})
+	sm.compileSem = make(chan struct{}, 2)
+	// Both compile slots taken, the workers have to wait for one
+	sm.compileSem <- struct{}{}
+	sm.compileSem <- struct{}{}
+
+	const scripts = 4
+	var done atomic.Int32
+	var wg sync.WaitGroup
+	for i := range scripts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sm.ExecuteScriptWithTimeout(fmt.Sprintf("%d + 1", i)); err != nil {
+				t.Error(err)
+			}
+			done.Add(1)
+		}()
+	}
+	waitRunning(t, sm, scripts)
+	time.Sleep(100 * time.Millisecond)
+	if n, compiles := done.Load(), atomic.LoadUint64(&sm.compileCount); n != 0 || compiles != 0 {
+		t.Fatalf("%d scripts done and %d compiled without a compile slot", n, compiles)
+	}
+
+	// One slot is enough for every script, one at a time
+	<-sm.compileSem
+	wg.Wait()
+	if compiles := atomic.LoadUint64(&sm.compileCount); compiles != scripts {
+		t.Fatalf("%d scripts compiled, want %d", compiles, scripts)
+	}
+	if held := len(sm.compileSem); held != 1 {
+		t.Fatalf("%d compile slots held once done, want the 1 the test kept", held)
+	}
+}
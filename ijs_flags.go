@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 )
@@ -12,6 +14,9 @@ var (
 	VerboseLevel logrus.Level
 	ConfigFile   string
 	LogFileName  string
+
+	// AllowMissingConfig runs the server on built-in defaults when ConfigFile does not exist
+	AllowMissingConfig bool
 )
 
 func init() {
@@ -19,6 +24,7 @@ func init() {
 	VerboseLevel = logrus.InfoLevel
 	ConfigFile = "./config.yaml"
 	LogFileName = "./logs/ijs.log"
+	AllowMissingConfig, _ = strconv.ParseBool(os.Getenv("IJS_ALLOW_MISSING_CONFIG"))
 }
 
 // ParseFlags parses the command-line flags and sets the global variables
@@ -27,6 +33,7 @@ func ParseFlags() {
 	verboseFlag := flag.String("verbose", "info", "Set the logging level (options: trace, debug, info, warn, error, fatal, panic)")
 	configFlag := flag.String("config", "./config.yaml", "Set the configuration file path")
 	logFlag := flag.String("log", "./logs/ijs.log", "Set the log file path")
+	allowMissingFlag := flag.Bool("allow-missing-config", AllowMissingConfig, "Run on built-in defaults when the configuration file does not exist")
 
 	// Parse the flags
 	flag.Parse()
@@ -37,6 +44,8 @@ func ParseFlags() {
 	// Set the log filename
 	LogFileName = *logFlag
 
+	AllowMissingConfig = *allowMissingFlag
+
 	// Parse and set the global VerboseLevel
 	switch *verboseFlag {
 	case "trace":
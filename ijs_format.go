@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/sobek"
+)
+
+const (
+	// maxFormatDecimals caps the decimals formatNumber writes
+	maxFormatDecimals = 20
+	// maxSeparatorLength caps the group and decimal separators of formatNumber
+	maxSeparatorLength = 4
+	// maxDateLayoutLength caps the layout of formatDate
+	maxDateLayoutLength = 64
+	// maxTimezoneNameLength caps the time zone name of formatDate
+	maxTimezoneNameLength = 64
+)
+
+// numberLocales are the separators formatNumber uses for a locale, as group
+// then decimal separator
+var numberLocales = map[string][2]string{
+	"en": {",", "."},
+	"de": {".", ","},
+	"fr": {" ", ","},
+	"ch": {"'", "."},
+}
+
+// dateLayouts are the named layouts formatDate accepts besides Go layouts
+var dateLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"DateTime":    time.DateTime,
+	"DateOnly":    time.DateOnly,
+	"TimeOnly":    time.TimeOnly,
+	"Kitchen":     time.Kitchen,
+}
+
+// locations caches the zones loaded by formatDate, loading one reads the zone database
+var locations sync.Map
+
+// numberFormatOptions are the options accepted by formatNumber
+type numberFormatOptions struct {
+	Decimals *int    `json:"decimals"` // fixed number of decimals, the shortest exact form by default
+	Locale   string  `json:"locale"`   // separators of en, de, fr or ch, en by default
+	Group    *string `json:"group"`    // group separator, overriding the locale, "" disables grouping
+	Point    *string `json:"point"`    // decimal separator, overriding the locale
+}
+
+// installFormat exposes formatNumber(n, opts) and formatDate(date, layout, tz),
+// formatting with Go rather than Intl, so the output does not depend on the
+// host locale data
+func installFormat(vm *sobek.Runtime) {
+	vm.Set("formatNumber", func(n float64, opts sobek.Value) string {
+		group, point, decimals := numberFormatArguments(vm, opts)
+		return formatNumber(n, decimals, group, point)
+	})
+	vm.Set("formatDate", func(call sobek.FunctionCall) sobek.Value {
+		t := dateArgument(vm, call.Argument(0))
+		layout := call.Argument(1)
+		if sobek.IsUndefined(layout) {
+			layout = vm.ToValue("RFC3339")
+		}
+		tz := "UTC"
+		if arg := call.Argument(2); !sobek.IsUndefined(arg) && !sobek.IsNull(arg) {
+			tz = arg.String()
+		}
+		loc, err := loadLocation(tz)
+		if err != nil {
+			panic(vm.NewTypeError("formatDate: unknown time zone %q", tz))
+		}
+		return vm.ToValue(t.In(loc).Format(dateLayout(vm, layout.String())))
+	})
+}
+
+// numberFormatArguments reads and bounds the options of formatNumber
+func numberFormatArguments(vm *sobek.Runtime, arg sobek.Value) (group, point string, decimals int) {
+	var o numberFormatOptions
+	if arg != nil && !sobek.IsUndefined(arg) && !sobek.IsNull(arg) {
+		if err := vm.ExportTo(arg, &o); err != nil {
+			panic(vm.NewTypeError("formatNumber: invalid options: %v", err))
+		}
+	}
+	if o.Locale == "" {
+		o.Locale = "en"
+	}
+	separators, ok := numberLocales[o.Locale]
+	if !ok {
+		panic(vm.NewTypeError("formatNumber: unknown locale %q, use en, de, fr or ch", o.Locale))
+	}
+	group, point = separators[0], separators[1]
+	if o.Group != nil {
+		group = *o.Group
+	}
+	if o.Point != nil {
+		point = *o.Point
+	}
+	if len(group) > maxSeparatorLength || len(point) > maxSeparatorLength {
+		panic(vm.NewTypeError("formatNumber: separators are limited to %d bytes", maxSeparatorLength))
+	}
+	decimals = -1
+	if o.Decimals != nil {
+		decimals = *o.Decimals
+		if decimals < 0 || decimals > maxFormatDecimals {
+			panic(vm.NewTypeError("formatNumber: decimals must be between 0 and %d", maxFormatDecimals))
+		}
+	}
+	return group, point, decimals
+}
+
+// formatNumber writes n with decimals decimals, -1 for the shortest form that
+// reads back as n, its integer part grouped by thousands
+func formatNumber(n float64, decimals int, group, point string) string {
+	switch {
+	case math.IsNaN(n):
+		return "NaN"
+	case math.IsInf(n, 1):
+		return "Infinity"
+	case math.IsInf(n, -1):
+		return "-Infinity"
+	}
+	digits := strconv.FormatFloat(math.Abs(n), 'f', decimals, 64)
+	integer, fraction, _ := strings.Cut(digits, ".")
+
+	var b strings.Builder
+	// -0 and what rounds to it print without a sign
+	if n < 0 && strings.Trim(digits, "0.") != "" {
+		b.WriteByte('-')
+	}
+	for i, d := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteString(group)
+		}
+		b.WriteRune(d)
+	}
+	if fraction != "" {
+		b.WriteString(point)
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
+
+// dateArgument reads a Date or a number of milliseconds since the epoch
+func dateArgument(vm *sobek.Runtime, arg sobek.Value) time.Time {
+	var msec float64
+	switch v := arg.(type) {
+	case *sobek.Object:
+		if v.ClassName() != "Date" {
+			panic(vm.NewTypeError("formatDate: expected a Date or a number of milliseconds"))
+		}
+		msec = v.ToFloat()
+	default:
+		switch arg.Export().(type) {
+		case int64, float64:
+			msec = arg.ToFloat()
+		default:
+			panic(vm.NewTypeError("formatDate: expected a Date or a number of milliseconds"))
+		}
+	}
+	if math.IsNaN(msec) || math.Abs(msec) > maxDateMsec {
+		panic(vm.NewTypeError("formatDate: invalid date"))
+	}
+	return time.UnixMilli(int64(msec))
+}
+
+// dateLayout resolves a named layout, or checks the length of a Go layout
+func dateLayout(vm *sobek.Runtime, layout string) string {
+	if named, ok := dateLayouts[layout]; ok {
+		return named
+	}
+	if len(layout) > maxDateLayoutLength {
+		panic(vm.NewTypeError("formatDate: layout is limited to %d bytes", maxDateLayoutLength))
+	}
+	return layout
+}
+
+// loadLocation returns the zone name, loading it once. Only IANA names are
+// accepted: "Local", and "" which time.LoadLocation reads as UTC, would make
+// the result depend on the host rather than on the request
+func loadLocation(name string) (*time.Location, error) {
+	if len(name) > maxTimezoneNameLength {
+		return nil, fmt.Errorf("time zone name longer than %d bytes", maxTimezoneNameLength)
+	}
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("time zone %q is not an IANA zone name", name)
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
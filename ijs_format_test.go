@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadLocation(t *testing.T) {
+	for _, name := range []string{"UTC", "America/New_York", "Asia/Tokyo"} {
+		loc, err := loadLocation(name)
+		if err != nil || loc.String() != name {
+			t.Errorf("loadLocation(%q) = %v, %v", name, loc, err)
+		}
+	}
+	for _, name := range []string{"", "Local", "Mars/Olympus_Mons", strings.Repeat("x", maxTimezoneNameLength+1)} {
+		if _, err := loadLocation(name); err == nil {
+			t.Errorf("loadLocation(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestFormatDateTimezone(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableStdlib = true
+	})
+	const date = `new Date("2024-07-01T12:00:00Z")`
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr string
+	}{
+		{"UTC by default", `formatDate(` + date + `, "2006-01-02 15:04 MST")`, "2024-07-01 12:00 UTC", ""},
+		{"null zone", `formatDate(` + date + `, "2006-01-02 15:04 MST", null)`, "2024-07-01 12:00 UTC", ""},
+		{"IANA zone", `formatDate(` + date + `, "2006-01-02 15:04 MST", "Asia/Tokyo")`, "2024-07-01 21:00 JST", ""},
+		{"Local", `formatDate(` + date + `, "RFC3339", "Local")`, nil, `formatDate: unknown time zone "Local"`},
+		{"empty zone", `formatDate(` + date + `, "RFC3339", "")`, nil, `formatDate: unknown time zone ""`},
+		{"unknown zone", `formatDate(` + date + `, "RFC3339", "Mars/Olympus_Mons")`, nil, "formatDate: unknown time zone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMiddleware compresses responses for clients accepting gzip when enabled in the
+// configuration. Responses of gzip_min_bytes or less are sent uncompressed.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.EnableGzip || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: config.GzipMinBytes}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter holds back the start of the body until it is larger than
+// minBytes, then switches to gzip and streams the rest. At most minBytes plus one
+// write are ever buffered, so memory stays bounded for large responses.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes    int
+	status      int
+	buf         []byte
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+// WriteHeader is deferred until we know whether the body gets compressed
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	if g.passthrough {
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) <= g.minBytes {
+		return len(p), nil
+	}
+
+	// Threshold crossed, compress everything from here on
+	g.Header().Set("Content-Encoding", "gzip")
+	g.Header().Del("Content-Length")
+	g.writeHeader()
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	if _, err := g.gz.Write(g.buf); err != nil {
+		return 0, err
+	}
+	g.buf = nil
+	return len(p), nil
+}
+
+// Close finishes the gzip stream, or sends the small buffered body uncompressed
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	if g.passthrough {
+		return nil
+	}
+	g.passthrough = true
+	// The header goes out late here, after the handler may have set the values
+	// of its declared trailers, which must not be sent as headers
+	trailers := g.takeTrailers()
+	g.writeHeader()
+	_, err := g.ResponseWriter.Write(g.buf)
+	g.buf = nil
+	for key, values := range trailers {
+		g.Header()[key] = values
+	}
+	return err
+}
+
+// takeTrailers removes the values of the keys named in the Trailer header from
+// the header and returns them, to be set again once the header is written
+func (g *gzipResponseWriter) takeTrailers() http.Header {
+	trailers := http.Header{}
+	for _, declared := range g.Header().Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if values, ok := g.Header()[key]; ok {
+				trailers[key] = values
+				delete(g.Header(), key)
+			}
+		}
+	}
+	return trailers
+}
+
+// Flush sends what was written so far, compressed or not, to the client
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	} else if !g.passthrough {
+		// Too early to tell the size, the rest of the body goes out uncompressed
+		g.Close()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) writeHeader() {
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+}
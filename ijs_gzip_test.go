@@ -0,0 +1,77 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipThreshold(t *testing.T) {
+	tests := []struct {
+		name       string
+		disabled   bool
+		accept     string
+		writes     []int // sizes of the writes making up the body
+		wantGzip   bool
+		wantNoVary bool
+	}{
+		{name: "empty body", accept: "gzip", writes: nil},
+		{name: "under the threshold", accept: "gzip", writes: []int{99}},
+		{name: "at the threshold", accept: "gzip", writes: []int{100}},
+		{name: "one byte over", accept: "gzip", writes: []int{101}, wantGzip: true},
+		{name: "crossed by a later write", accept: "gzip", writes: []int{60, 40, 1}, wantGzip: true},
+		{name: "large body", accept: "gzip, deflate", writes: []int{100, 5000, 5000}, wantGzip: true},
+		{name: "client without gzip", accept: "deflate", writes: []int{1000}, wantNoVary: true},
+		{name: "gzip disabled", disabled: true, accept: "gzip", writes: []int{1000}, wantNoVary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := config
+			t.Cleanup(func() { config = saved })
+			config.EnableGzip = !tt.disabled
+			config.GzipMinBytes = 100
+
+			var want strings.Builder
+			h := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				for i, n := range tt.writes {
+					chunk := strings.Repeat(string(rune('a'+i)), n)
+					want.WriteString(chunk)
+					io.WriteString(w, chunk)
+				}
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+			}
+			if vary := rec.Header().Get("Vary"); (vary == "Accept-Encoding") == tt.wantNoVary {
+				t.Fatalf("Vary = %q", vary)
+			}
+			body := rec.Body.String()
+			if encoding := rec.Header().Get("Content-Encoding"); (encoding == "gzip") != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", encoding, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(decoded)
+			}
+			if body != want.String() {
+				t.Fatalf("body of %d bytes, want %d", len(body), want.Len())
+			}
+		})
+	}
+}
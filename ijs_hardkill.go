@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrExecutionAbandoned is returned for a script still running hard_kill_timeout
+// after it started, which the worker stopped waiting for
+var ErrExecutionAbandoned = errors.New("script execution abandoned past the hard kill timeout")
+
+// executeBounded runs executeScript, or executeSnippet for a REPL snippet, on a
+// goroutine of its own and waits at most hard_kill_timeout for it. An interrupt
+// only lands between JS instructions, so a script stuck in native code never
+// returns. Such an execution is abandoned, costing a goroutine instead of the
+// worker, which goes on with the next job.
+// ok is false for an abandoned execution.
+func (sm *ScriptManager) executeBounded(ctx context.Context, job ScriptJob, cancel context.CancelFunc) (result ScriptResult, ok bool) {
+	done := make(chan ScriptResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.WithField("panic", r).Error("Script execution panic")
+				done <- ScriptResult{Error: fmt.Errorf("%w: %v", ErrWorkerPanic, r)}
+			}
+		}()
+		if job.repl != nil {
+			done <- sm.executeSnippet(ctx, job, cancel)
+			return
+		}
+		done <- sm.executeScript(ctx, job, cancel)
+	}()
+
+	if config.HardKillTimeout == 0 {
+		return <-done, true
+	}
+	timer := time.NewTimer(config.HardKillTimeout)
+	defer timer.Stop()
+	select {
+	case result = <-done:
+		return result, true
+	case <-timer.C:
+		cancel()
+		atomic.AddUint64(&sm.abandoned, 1)
+		logrus.WithFields(logrus.Fields{
+			"script_length": len(job.Script),
+			"timeout":       config.HardKillTimeout,
+		}).Error("CRITICAL: script execution did not stop, abandoning it to keep the worker")
+		return ScriptResult{Error: fmt.Errorf("%w: still running after %s", ErrExecutionAbandoned, config.HardKillTimeout)}, false
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLockOSThread(t *testing.T) {
+	for _, lock := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lock_os_thread=%t", lock), func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.LockOSThread = lock
+				c.QueueSize = 32
+			})
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, err := sm.ExecuteScriptWithTimeout(fmt.Sprintf("let s = 0; for (let j = 0; j <= %d; j++) s += j; s", i))
+					if err != nil {
+						t.Errorf("script %d: %v", i, err)
+						return
+					}
+					if want := int64(i * (i + 1) / 2); result != want {
+						t.Errorf("script %d = %v, want %d", i, result, want)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// wedgedStore is a script store whose Load blocks until release is closed. A
+// script calling runScript on it is stuck in native code, out of reach of the
+// interrupt of its timeout.
+type wedgedStore struct {
+	release chan struct{}
+}
+
+func (s wedgedStore) Load(name string) (string, error) {
+	<-s.release
+	return "1", nil
+}
+
+func TestHardKill(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.ScriptTimeout = 100 * time.Millisecond
+		c.HardKillTimeout = 300 * time.Millisecond
+		c.EnableRunScript = true
+	})
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	sm.store = wedgedStore{release: release}
+	hook := new(test.Hook)
+	saved := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	logrus.AddHook(hook)
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(saved) })
+
+	start := time.Now()
+	_, err := sm.ExecuteScriptWithTimeout(`runScript("wedged")`)
+	if !errors.Is(err, ErrExecutionAbandoned) {
+		t.Fatalf("error = %v, want ErrExecutionAbandoned", err)
+	}
+	if elapsed := time.Since(start); elapsed < config.HardKillTimeout || elapsed > 2*time.Second {
+		t.Fatalf("abandoned after %s, want just past the %s hard_kill_timeout", elapsed, config.HardKillTimeout)
+	}
+	if countLogs(hook, "CRITICAL: script execution did not stop, abandoning it to keep the worker") != 1 {
+		t.Fatal("abandoned execution not logged")
+	}
+	if got := sm.Stats().AbandonedExecutions; got != 1 {
+		t.Fatalf("abandoned_executions = %d, want 1", got)
+	}
+
+	// The only worker goes on with the next jobs while the execution is stuck
+	for i := 0; i < 3; i++ {
+		if result, err := sm.ExecuteScriptWithTimeout(`1 + 1`); err != nil || result != int64(2) {
+			t.Fatalf("job %d after the abandoned one = %v, %v", i, result, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`runScript("wedged")`)))
+	if rec.Code != http.StatusRequestTimeout || !strings.Contains(rec.Body.String(), CodeExecutionAbandoned) {
+		t.Fatalf("status = %d %s, want 408 and %s", rec.Code, rec.Body, CodeExecutionAbandoned)
+	}
+	if got := sm.Stats().AbandonedExecutions; got != 2 {
+		t.Fatalf("abandoned_executions = %d, want 2", got)
+	}
+}
+
+func TestHardKillDisabled(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 100 * time.Millisecond
+		c.HardKillTimeout = 0
+		c.EnableRunScript = true
+	})
+	release := make(chan struct{})
+	sm.store = wedgedStore{release: release}
+	time.AfterFunc(400*time.Millisecond, func() { close(release) })
+
+	// Without hard_kill_timeout the worker waits the native call out
+	start := time.Now()
+	_, err := sm.ExecuteScriptWithTimeout(`runScript("wedged"); for (;;) {}`)
+	if !errors.Is(err, ErrScriptTimeout) {
+		t.Fatalf("error = %v, want ErrScriptTimeout once the call returned", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("returned after %s, before the stuck call did", elapsed)
+	}
+	if got := sm.Stats().AbandonedExecutions; got != 0 {
+		t.Fatalf("abandoned_executions = %d, want 0", got)
+	}
+}
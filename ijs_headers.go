@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSecurityHeaders are sent on every response, security_headers in the
+// configuration can override them or remove one by setting it to an empty value
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Referrer-Policy":         "no-referrer",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	"Cache-Control":           "no-store",
+}
+
+// securityHeadersMiddleware adds the security headers to every response
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	headers := make(map[string]string, len(defaultSecurityHeaders))
+	for name, value := range defaultSecurityHeaders {
+		headers[name] = value
+	}
+	for name, value := range config.SecurityHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			if value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMiddleware allows browsers on the configured origins to call the API and
+// answers preflight requests itself, before they reach the POST-only handlers
+func corsMiddleware(next http.Handler) http.Handler {
+	methods := strings.Join(config.CORSAllowedMethods, ", ")
+	headers := strings.Join(config.CORSAllowedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := isAllowedOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if preflight {
+			if !allowed {
+				logrus.WithField("origin", origin).Warn("Rejected CORS preflight from disallowed origin")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isAllowedOrigin(origin string) bool {
+	for _, allowed := range config.CORSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
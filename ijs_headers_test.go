@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowed       []string
+		method        string
+		origin        string
+		requestMethod string // Access-Control-Request-Method, set on preflights
+		wantStatus    int
+		wantAllow     string // Access-Control-Allow-Origin
+		wantVary      bool
+		wantNext      bool
+	}{
+		{name: "preflight", allowed: []string{"https://app.example"}, method: http.MethodOptions, origin: "https://app.example", requestMethod: "POST", wantStatus: http.StatusNoContent, wantAllow: "https://app.example", wantVary: true},
+		{name: "preflight origin case", allowed: []string{"https://app.example"}, method: http.MethodOptions, origin: "https://APP.example", requestMethod: "POST", wantStatus: http.StatusNoContent, wantAllow: "https://APP.example", wantVary: true},
+		{name: "preflight from a disallowed origin", allowed: []string{"https://app.example"}, method: http.MethodOptions, origin: "https://evil.example", requestMethod: "POST", wantStatus: http.StatusForbidden, wantVary: true},
+		{name: "preflight with a wildcard", allowed: []string{"*"}, method: http.MethodOptions, origin: "https://any.example", requestMethod: "POST", wantStatus: http.StatusNoContent, wantAllow: "https://any.example", wantVary: true},
+		{name: "request from an allowed origin", allowed: []string{"https://app.example"}, method: http.MethodPost, origin: "https://app.example", wantStatus: http.StatusOK, wantAllow: "https://app.example", wantVary: true, wantNext: true},
+		{name: "request from a disallowed origin", allowed: []string{"https://app.example"}, method: http.MethodPost, origin: "https://evil.example", wantStatus: http.StatusOK, wantVary: true, wantNext: true},
+		{name: "OPTIONS without a request method", allowed: []string{"https://app.example"}, method: http.MethodOptions, origin: "https://app.example", wantStatus: http.StatusOK, wantAllow: "https://app.example", wantVary: true, wantNext: true},
+		{name: "no origin", allowed: []string{"*"}, method: http.MethodPost, wantStatus: http.StatusOK, wantNext: true},
+		{name: "no allowed origins", method: http.MethodOptions, origin: "https://app.example", requestMethod: "POST", wantStatus: http.StatusForbidden, wantVary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := config
+			t.Cleanup(func() { config = saved })
+			config.CORSAllowedOrigins = tt.allowed
+			config.CORSAllowedMethods = []string{"POST", "OPTIONS"}
+			config.CORSAllowedHeaders = []string{"Content-Type", "X-Priority"}
+
+			reached := false
+			h := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}))
+			r := httptest.NewRequest(tt.method, "/data", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if reached != tt.wantNext {
+				t.Fatalf("handler reached = %v, want %v", reached, tt.wantNext)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Fatalf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllow)
+			}
+			if got := rec.Header().Get("Vary") == "Origin"; got != tt.wantVary {
+				t.Fatalf("Vary = %q, want Origin %v", rec.Header().Get("Vary"), tt.wantVary)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "POST, OPTIONS" {
+					t.Fatalf("Access-Control-Allow-Methods = %q", got)
+				}
+				if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type, X-Priority" {
+					t.Fatalf("Access-Control-Allow-Headers = %q", got)
+				}
+				if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+					t.Fatalf("Access-Control-Max-Age = %q", got)
+				}
+			} else if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+				t.Fatalf("Access-Control-Allow-Methods = %q outside a successful preflight", got)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.SecurityHeaders = map[string]string{
+		"x-frame-options":    "SAMEORIGIN", // overrides a default, any case
+		"Referrer-Policy":    "",           // removes a default
+		"Permissions-Policy": "camera=()",  // adds a header
+	}
+
+	rec := httptest.NewRecorder()
+	securityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/data", nil))
+
+	want := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "SAMEORIGIN",
+		"Referrer-Policy":         "",
+		"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+		"Cache-Control":           "no-store",
+		"Permissions-Policy":      "camera=()",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
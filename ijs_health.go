@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// stopping is set once shutdown begins, /health then reports the instance as
+// not ready while it keeps serving requests during the pre-stop delay
+var stopping int32
+
+func setStopping() {
+	atomic.StoreInt32(&stopping, 1)
+}
+
+func isStopping() bool {
+	return atomic.LoadInt32(&stopping) == 1
+}
+
+// memoryPressure is set while the memory monitor holds intake off, /health then
+// reports the instance as unhealthy
+var memoryPressure int32
+
+func setMemoryPressure(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&memoryPressure, v)
+}
+
+func isUnderMemoryPressure() bool {
+	return atomic.LoadInt32(&memoryPressure) == 1
+}
+
+// workersStuck is set while the watchdog holds off a restart under recover_mode
+// none, /health then reports the instance as unhealthy
+var workersStuck int32
+
+func setWorkersStuck(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&workersStuck, v)
+}
+
+func areWorkersStuck() bool {
+	return atomic.LoadInt32(&workersStuck) == 1
+}
+
+// HealthResponse is the body returned by /health
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// healthHandler answers readiness probes, 503 once shutdown has started, while
+// memory usage is over the limit, while too many workers are stuck or while log
+// writes fail
+func healthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isStopping() {
+			writeJSONValue(w, http.StatusServiceUnavailable, HealthResponse{Status: "stopping"})
+			return
+		}
+		if isUnderMemoryPressure() {
+			writeJSONValue(w, http.StatusServiceUnavailable, HealthResponse{Status: "memory_pressure"})
+			return
+		}
+		if areWorkersStuck() {
+			writeJSONValue(w, http.StatusServiceUnavailable, HealthResponse{Status: "workers_stuck"})
+			return
+		}
+		if isLoggingFailed() {
+			writeJSONValue(w, http.StatusServiceUnavailable, HealthResponse{Status: "logging_failed"})
+			return
+		}
+		writeJSONValue(w, http.StatusOK, HealthResponse{Status: "ok"})
+	}
+}
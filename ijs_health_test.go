@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthFlags are the states /health reports on
+type healthFlags struct {
+	stopping, memory, stuck, logging bool
+}
+
+// set raises the flags, all of them cleared when the test ends
+func (f healthFlags) set(t *testing.T) {
+	t.Helper()
+	store := func(addr *int32, on bool) {
+		var v int32
+		if on {
+			v = 1
+		}
+		atomic.StoreInt32(addr, v)
+	}
+	store(&stopping, f.stopping)
+	store(&logWritesFailing, f.logging)
+	setMemoryPressure(f.memory)
+	setWorkersStuck(f.stuck)
+	t.Cleanup(func() {
+		store(&stopping, false)
+		store(&logWritesFailing, false)
+		setMemoryPressure(false)
+		setWorkersStuck(false)
+	})
+}
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		flags      healthFlags
+		wantStatus int
+		want       string
+	}{
+		{name: "ready", wantStatus: http.StatusOK, want: "ok"},
+		{name: "stopping", flags: healthFlags{stopping: true}, wantStatus: http.StatusServiceUnavailable, want: "stopping"},
+		{name: "memory pressure", flags: healthFlags{memory: true}, wantStatus: http.StatusServiceUnavailable, want: "memory_pressure"},
+		{name: "workers stuck", flags: healthFlags{stuck: true}, wantStatus: http.StatusServiceUnavailable, want: "workers_stuck"},
+		{name: "logging failed", flags: healthFlags{logging: true}, wantStatus: http.StatusServiceUnavailable, want: "logging_failed"},
+		{name: "stopping reported first", flags: healthFlags{stopping: true, memory: true, stuck: true, logging: true}, wantStatus: http.StatusServiceUnavailable, want: "stopping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.flags.set(t)
+			rec := httptest.NewRecorder()
+			healthHandler()(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var response HealthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != tt.want {
+				t.Fatalf("health = %q, want %q", response.Status, tt.want)
+			}
+		})
+	}
+}
+
+// During the pre-stop delay /health is not ready while scripts still run
+func TestServingWhileStopping(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	healthFlags{}.set(t)
+	setStopping()
+
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader("1 + 1")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want 200 until the server shuts down", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	healthHandler()(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("health status = %d, want 503", rec.Code)
+	}
+}
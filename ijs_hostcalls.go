@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana/sobek"
+)
+
+// ErrHostCallLimit is thrown by a host function called more than max_host_calls
+// allows for its category in one execution
+var ErrHostCallLimit = errors.New("host function call limit reached")
+
+// hostCallCategories lists the host functions counted under each max_host_calls
+// category, members of a global object written as object.member
+var hostCallCategories = map[string][]string{
+	"refdata":    {"refdata.lookup"},
+	"render":     {"render"},
+	"regex":      {"regexMatch", "regexTest"},
+	"stdlib":     {"encodeBase64", "decodeBase64", "encodeHex", "decodeHex", "formatNumber", "formatDate"},
+	"csv":        {"parseCSV", "toCSV"},
+	"uuid":       {"uuid"},
+	"run_script": {"runScript"},
+	"session":    {"session.get", "session.set"},
+}
+
+// checkHostCallLimits validates the max_host_calls categories and caps
+func checkHostCallLimits(limits map[string]int) error {
+	for category, limit := range limits {
+		if _, ok := hostCallCategories[category]; !ok {
+			known := make([]string, 0, len(hostCallCategories))
+			for name := range hostCallCategories {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown category %q, use one of %s", category, strings.Join(known, ", "))
+		}
+		if limit < 1 {
+			return fmt.Errorf("category %q capped at %d, must be at least 1", category, limit)
+		}
+	}
+	return nil
+}
+
+// limitHostCalls wraps the installed host functions of each capped category so
+// the calls of one execution are counted, throwing a catchable ErrHostCallLimit
+// past the cap. It runs on every fresh VM, so the counts start over each run.
+// Functions left out of the VM, such as disabled features, are skipped.
+func limitHostCalls(vm *sobek.Runtime, limits map[string]int) {
+	for category, limit := range limits {
+		calls := 0
+		for _, path := range hostCallCategories[category] {
+			holder, name := vm.GlobalObject(), path
+			if object, member, ok := strings.Cut(path, "."); ok {
+				parent, isObject := vm.Get(object).(*sobek.Object)
+				if !isObject {
+					continue
+				}
+				holder, name = parent, member
+			}
+			fn, ok := sobek.AssertFunction(holder.Get(name))
+			if !ok {
+				continue
+			}
+
+			holder.Set(name, func(call sobek.FunctionCall) sobek.Value {
+				calls++
+				if calls > limit {
+					panic(vm.NewGoError(fmt.Errorf("%w: %s is over the %s limit of %d calls", ErrHostCallLimit, path, category, limit)))
+				}
+				result, err := fn(call.This, call.Arguments...)
+				if err != nil {
+					panic(err)
+				}
+				return result
+			})
+		}
+	}
+}
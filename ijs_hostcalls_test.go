@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHostCallLimits(t *testing.T) {
+	tests := []struct {
+		limits  map[string]int
+		wantErr string
+	}{
+		{limits: map[string]int{"render": 10, "session": 1}},
+		{limits: map[string]int{"fetch": 3}, wantErr: `unknown category "fetch"`},
+		{limits: map[string]int{"render": 0}, wantErr: "must be at least 1"},
+	}
+	for _, tt := range tests {
+		err := checkHostCallLimits(tt.limits)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkHostCallLimits(%v) = %v, want %q", tt.limits, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHostCallLimit(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableUUID = true
+		c.MaxHostCalls = map[string]int{"render": 5, "regex": 3}
+	})
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "at the cap", script: `let n = 0; for (let i = 0; i < 5; i++) n += render("{{.}}", i).length; n`, want: int64(5)},
+		{name: "past the cap", script: `for (let i = 0; i < 1000; i++) render("{{.}}", i)`, wantErr: true},
+		{name: "catchable", script: `let n = 0; try { for (;;) { render("x", 1); n++ } } catch (e) { n + " " + e.message.includes("render is over the render limit of 5 calls") }`, want: "5 true"},
+		{name: "category shares its count", script: `regexTest("a", "a"); regexMatch("a", "a"); regexTest("a", "a"); regexMatch("a", "a")`, wantErr: true},
+		{name: "uncapped category", script: `for (let i = 0; i < 100; i++) uuid(); "ok"`, want: "ok"},
+		// The runs above left their counts behind, a new run starts over
+		{name: "count starts over", script: `for (let i = 0; i < 5; i++) render("x", 1); "ok"`, want: "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr {
+				if !errors.Is(err, ErrHostCallLimit) || errorCode(err) != CodeHostCallLimit {
+					t.Fatalf("error = %v, want ErrHostCallLimit", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Fatalf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostCallLimitResponse(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.MaxHostCalls = map[string]int{"render": 2}
+	})
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`for (;;) render("x", 1)`)))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeHostCallLimit) {
+		t.Fatalf("status = %d %s, want 422 and %s", rec.Code, rec.Body, CodeHostCallLimit)
+	}
+}
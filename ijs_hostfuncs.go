@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/grafana/sobek"
+)
+
+// Range of statuses a script may pick with setStatus, 5xx stays reserved for
+// real server errors
+const (
+	minScriptStatus = 200
+	maxScriptStatus = 499
+)
+
+// scriptOutput collects what the script asks of the response besides its result
+type scriptOutput struct {
+	status      int
+	contentType string
+	logs        *consoleLog // console output, nil under logs_on never
+}
+
+// installHostFunctions exposes the Go-backed helper functions to the script.
+// ctx is the execution context of the script, its deadline drives timeBudget.
+// Calls affecting the response are recorded in out, and capped categories of
+// host functions are counted per execution under max_host_calls.
+func (sm *ScriptManager) installHostFunctions(vm *sobek.Runtime, ctx context.Context, job ScriptJob, out *scriptOutput) {
+	// timeBudget returns the milliseconds left before the script is interrupted,
+	// allowing long scripts to stop early and return a partial result.
+	vm.Set("timeBudget", func() float64 {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return math.Inf(1)
+		}
+		return float64(max(0, time.Until(deadline).Milliseconds()))
+	})
+
+	// setStatus picks the HTTP status of a successful response, a code outside
+	// 2xx-4xx throws rather than being changed into a status the script did not ask for
+	vm.Set("setStatus", func(code int64) {
+		if code < minScriptStatus || code > maxScriptStatus {
+			panic(vm.NewTypeError("setStatus: status %d is outside %d-%d", code, minScriptStatus, maxScriptStatus))
+		}
+		out.status = int(code)
+	})
+
+	// setContentType sends the result as a raw body of that type instead of the
+	// JSON envelope. The request's sandbox profile decides which types are allowed.
+	vm.Set("setContentType", func(contentType string) {
+		out.contentType = contentType
+	})
+
+	if job.LogsOn != logsOnNever {
+		out.logs = &consoleLog{}
+	}
+	installConsole(vm, out.logs)
+
+	installRender(vm, ctx, config.RenderMaxBytes)
+	installRegex(vm)
+	sm.installProgress(vm, job.jobID)
+
+	if config.EnableUUID {
+		// Only deterministic_mode promises reproducible runs, elsewhere IDs stay unpredictable
+		var seed *int64
+		if config.DeterministicMode {
+			seed = job.Seed
+		}
+		installUUID(vm, seed)
+	}
+
+	if config.EnableStdlib {
+		installStdlib(vm)
+		installCSV(vm, config.CSVMaxCells)
+		installFormat(vm)
+	}
+
+	if config.EnableRunScript && sm.store != nil {
+		sm.installRunScript(vm, ctx, job, config.MaxScriptNesting)
+	}
+
+	if job.session != nil {
+		sm.installSession(vm, job.session)
+	}
+
+	shared := job.shared
+	if shared == nil {
+		shared = sm.currentShared()
+	}
+	if len(shared.refData) > 0 {
+		installRefData(vm, shared.refData)
+	}
+
+	limitHostCalls(vm, config.MaxHostCalls)
+}
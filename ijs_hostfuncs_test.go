@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration // job timeout, 0 for script_timeout
+		script  string
+	}{
+		{name: "within script_timeout", script: "const b = timeBudget(); b > 0 && b <= 1000"},
+		{name: "within the job timeout", timeout: 200 * time.Millisecond, script: "const b = timeBudget(); b > 0 && b <= 200"},
+		{name: "decreases", script: "const a = timeBudget(); const end = Date.now() + 20; while (Date.now() < end) {} timeBudget() < a"},
+		{name: "stops before the deadline", script: "while (timeBudget() > 900) {} true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+			})
+			result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: tt.script, Timeout: tt.timeout})
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			if result.Result != true {
+				t.Fatalf("result = %v, want true", result.Result)
+			}
+		})
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "unset", script: "1", wantStatus: http.StatusOK},
+		{name: "created", script: "setStatus(201); 1", wantStatus: http.StatusCreated},
+		{name: "lowest", script: "setStatus(200); 1", wantStatus: http.StatusOK},
+		{name: "highest", script: "setStatus(499); 1", wantStatus: 499},
+		{name: "client error", script: "setStatus(404); 1", wantStatus: http.StatusNotFound},
+		{name: "last call wins", script: "setStatus(201); setStatus(202); 1", wantStatus: http.StatusAccepted},
+		{name: "server error", script: "setStatus(503); 1", wantStatus: http.StatusInternalServerError, wantCode: CodeRuntimeError},
+		{name: "informational", script: "setStatus(101); 1", wantStatus: http.StatusInternalServerError, wantCode: CodeRuntimeError},
+		{name: "negative", script: "setStatus(-1); 1", wantStatus: http.StatusInternalServerError, wantCode: CodeRuntimeError},
+		{name: "not a number", script: "setStatus('abc'); 1", wantStatus: http.StatusInternalServerError, wantCode: CodeRuntimeError},
+		{name: "caught", script: "try { setStatus(503) } catch (e) { setStatus(e instanceof TypeError ? 409 : 200) } 1", wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+			})
+			rec := httptest.NewRecorder()
+			handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(tt.script)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var response Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != tt.wantCode {
+				t.Fatalf("code = %q, want %q", response.Code, tt.wantCode)
+			}
+			if tt.wantCode != "" && !strings.Contains(response.Error, "setStatus: status") {
+				t.Fatalf("error = %q, want the setStatus TypeError", response.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrInflightBytes is returned when the request bodies being handled would
+// together exceed max_total_inflight_bytes
+var ErrInflightBytes = errors.New("too many request bytes in flight, retry later")
+
+// ErrRequestTooLarge is returned for a request whose Content-Length alone is over
+// max_total_inflight_bytes, which no retry can fit
+var ErrRequestTooLarge = errors.New("request body larger than the in-flight bytes limit")
+
+// inflightBytes accounts for the request body bytes held by all handlers at once
+type inflightBytes struct {
+	max     int64
+	current int64
+}
+
+// reserve takes n bytes from the budget, failing without taking any when they do not fit
+func (b *inflightBytes) reserve(n int64) bool {
+	for {
+		current := atomic.LoadInt64(&b.current)
+		if current+n > b.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.current, current, current+n) {
+			return true
+		}
+	}
+}
+
+func (b *inflightBytes) release(n int64) {
+	atomic.AddInt64(&b.current, -n)
+}
+
+// inflightBytesMiddleware caps the request bytes held across all concurrent
+// requests at max_total_inflight_bytes. A request announcing its Content-Length
+// reserves it up front and gets a 503 when it does not fit, or a 413 when it is
+// over the cap on its own and would never fit. A body of unknown
+// length is counted as it is read, and its reading fails once over the cap.
+// Bytes are given back when the handler returns.
+func inflightBytesMiddleware(next http.Handler) http.Handler {
+	if config.MaxTotalInflightBytes <= 0 {
+		return next
+	}
+	budget := &inflightBytes{max: config.MaxTotalInflightBytes}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > budget.max {
+			writeJSON(w, http.StatusRequestEntityTooLarge, Response{Error: ErrRequestTooLarge.Error(), Code: CodeRequestTooLarge})
+			logrus.WithFields(logrus.Fields{
+				"content_length": r.ContentLength,
+				"limit":          budget.max,
+			}).Warn("Rejected request larger than the in-flight bytes limit")
+			return
+		}
+		if r.ContentLength > 0 {
+			if !budget.reserve(r.ContentLength) {
+				w.Header().Set("Retry-After", "1")
+				writeJSON(w, http.StatusServiceUnavailable, Response{Error: ErrInflightBytes.Error(), Code: CodeOverloaded})
+				logrus.WithFields(logrus.Fields{
+					"content_length": r.ContentLength,
+					"limit":          budget.max,
+				}).Warn("Rejected request over the in-flight bytes limit")
+				return
+			}
+			defer budget.release(r.ContentLength)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body := &inflightBody{ReadCloser: r.Body, budget: budget}
+		defer body.releaseAll()
+		r.Body = body
+		next.ServeHTTP(w, r)
+	})
+}
+
+// inflightBody reserves the bytes of a body of unknown length as they are read
+type inflightBody struct {
+	io.ReadCloser
+	budget   *inflightBytes
+	reserved int64
+}
+
+func (b *inflightBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if !b.budget.reserve(int64(n)) {
+			logrus.WithField("limit", b.budget.max).Warn("Request body read over the in-flight bytes limit")
+			return 0, ErrInflightBytes
+		}
+		b.reserved += int64(n)
+	}
+	return n, err
+}
+
+func (b *inflightBody) releaseAll() {
+	b.budget.release(b.reserved)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInflightBytesMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		held       int // bytes of a request still being handled
+		body       int
+		unknownLen bool
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "fits", body: 50, wantStatus: http.StatusOK},
+		{name: "at the cap", body: 100, wantStatus: http.StatusOK},
+		{name: "over the cap alone", body: 150, wantStatus: http.StatusRequestEntityTooLarge, wantCode: CodeRequestTooLarge},
+		{name: "over the cap alone while others run", held: 80, body: 150, wantStatus: http.StatusRequestEntityTooLarge, wantCode: CodeRequestTooLarge},
+		{name: "does not fit beside others", held: 80, body: 50, wantStatus: http.StatusServiceUnavailable, wantCode: CodeOverloaded},
+		{name: "unknown length fits", body: 50, unknownLen: true, wantStatus: http.StatusOK},
+		{name: "unknown length read over the cap", body: 150, unknownLen: true, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := config
+			config.MaxTotalInflightBytes = 100
+			t.Cleanup(func() { config = saved })
+
+			hold := make(chan struct{})
+			holding := make(chan struct{})
+			handler := inflightBytesMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Hold") != "" {
+					close(holding)
+					<-hold
+					return
+				}
+				if _, err := io.ReadAll(r.Body); err != nil {
+					if !errors.Is(err, ErrInflightBytes) {
+						t.Errorf("read error = %v, want ErrInflightBytes", err)
+					}
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			}))
+
+			if tt.held > 0 {
+				r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(strings.Repeat("x", tt.held)))
+				r.Header.Set("X-Hold", "1")
+				done := make(chan struct{})
+				go func() {
+					handler.ServeHTTP(httptest.NewRecorder(), r)
+					close(done)
+				}()
+				<-holding
+				defer func() {
+					close(hold)
+					<-done
+				}()
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(strings.Repeat("x", tt.body)))
+			if tt.unknownLen {
+				r.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.wantCode != "" {
+				var response Response
+				if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				if response.Code != tt.wantCode {
+					t.Fatalf("code = %q, want %q", response.Code, tt.wantCode)
+				}
+			}
+			if retry := rec.Header().Get("Retry-After") != ""; retry != (tt.wantStatus == http.StatusServiceUnavailable) {
+				t.Fatalf("Retry-After = %q on a %d", rec.Header().Get("Retry-After"), rec.Code)
+			}
+		})
+	}
+}
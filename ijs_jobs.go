@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/sobek"
+	"github.com/sirupsen/logrus"
+)
+
+// Status of an async job
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// maxProgressMessage caps the message a script passes to progress, in bytes
+const maxProgressMessage = 256
+
+// pendingJobTTL is how long the state of an unfinished job is kept after its
+// last change, so a job lost with its instance is forgotten in the end
+const pendingJobTTL = 24 * time.Hour
+
+// progressInterval is the least time between two puts of the progress of a job,
+// the reports in between being coalesced into one put
+const progressInterval = 500 * time.Millisecond
+
+// JobStatus is the body returned by /jobs and /jobs/{id}
+type JobStatus struct {
+	ID       string      `json:"id"`
+	Status   string      `json:"status"`
+	Progress float64     `json:"progress"`
+	Message  string      `json:"message,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Code     string      `json:"code,omitempty"`
+}
+
+// finished reports whether the job has completed, successfully or not
+func (job JobStatus) finished() bool {
+	return job.Status == jobDone || job.Status == jobFailed
+}
+
+// jobTable tracks the jobs this instance runs and writes their state through
+// to the job store on every change, progress reports at most every
+// progressInterval. Finished jobs are kept in the store for job_result_ttl.
+type jobTable struct {
+	sync.Mutex
+	store   JobStore
+	pending map[string]*pendingJob // jobs submitted here that have not finished
+}
+
+// pendingJob is a job of the table. Its lock is held across a put, keeping the
+// puts of one job in order while those of other jobs go on.
+type pendingJob struct {
+	sync.Mutex
+	status  JobStatus
+	lastPut time.Time
+	flush   *time.Timer // puts the progress coalesced since lastPut, nil when there is none
+}
+
+func newJobTable(store JobStore) *jobTable {
+	return &jobTable{store: store, pending: make(map[string]*pendingJob)}
+}
+
+// add registers a new queued job and returns its ID
+func (t *jobTable) add() (string, error) {
+	var raw [16]byte
+	rand.Read(raw[:])
+	id := hex.EncodeToString(raw[:])
+
+	job := &pendingJob{status: JobStatus{ID: id, Status: jobQueued}, lastPut: time.Now()}
+	if err := t.store.Put(job.status, pendingJobTTL); err != nil {
+		return "", err
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.pending[id] = job
+	return id, nil
+}
+
+// lookup returns the pending job id, nil when it is not pending here
+func (t *jobTable) lookup(id string) *pendingJob {
+	t.Lock()
+	defer t.Unlock()
+	return t.pending[id]
+}
+
+// get returns the state of job id, which may run on another instance
+func (t *jobTable) get(id string) (JobStatus, bool, error) {
+	return t.store.Get(id)
+}
+
+// update applies fn to job id and stores the result, doing nothing for jobs
+// not pending here
+func (t *jobTable) update(id string, fn func(job *JobStatus)) {
+	job := t.lookup(id)
+	if job == nil {
+		return
+	}
+	job.Lock()
+	defer job.Unlock()
+	// Finished by an update that looked it up at the same time
+	if job.status.finished() {
+		return
+	}
+	fn(&job.status)
+	ttl := pendingJobTTL
+	if job.status.finished() {
+		t.Lock()
+		delete(t.pending, id)
+		t.Unlock()
+		ttl = config.JobResultTTL
+	}
+	t.put(job, ttl)
+}
+
+// progress records the progress of job id. Within progressInterval of the last
+// put it is only put once the interval is over, with whatever was reported
+// meanwhile, unless a change of state puts it before.
+func (t *jobTable) progress(id string, fraction float64, message string) {
+	job := t.lookup(id)
+	if job == nil {
+		return
+	}
+	job.Lock()
+	defer job.Unlock()
+	if job.status.finished() {
+		return
+	}
+	job.status.Progress, job.status.Message = fraction, message
+	wait := progressInterval - time.Since(job.lastPut)
+	if wait <= 0 {
+		t.put(job, pendingJobTTL)
+		return
+	}
+	if job.flush != nil {
+		return
+	}
+	var flush *time.Timer
+	// Cannot fire before flush is set, the callback needs the lock held here
+	flush = time.AfterFunc(wait, func() {
+		job.Lock()
+		defer job.Unlock()
+		// Superseded by a put made meanwhile
+		if job.flush != flush {
+			return
+		}
+		t.put(job, pendingJobTTL)
+	})
+	job.flush = flush
+}
+
+// put writes the state of job to the store, its lock held, superseding the
+// coalesced progress waiting to be put
+func (t *jobTable) put(job *pendingJob, ttl time.Duration) {
+	if job.flush != nil {
+		job.flush.Stop()
+		job.flush = nil
+	}
+	job.lastPut = time.Now()
+	if err := t.store.Put(job.status, ttl); err != nil {
+		logrus.WithError(err).WithField("job_id", job.status.ID).Error("Failed to store job state")
+	}
+}
+
+// markRunning records that the script of job id started
+func (t *jobTable) markRunning(id string) {
+	t.update(id, func(job *JobStatus) { job.Status = jobRunning })
+}
+
+// finish records the outcome of job id
+func (t *jobTable) finish(id string, result ScriptResult) {
+	t.update(id, func(job *JobStatus) {
+		if result.Error != nil {
+			job.Status = jobFailed
+			job.Error = result.Error.Error()
+			job.Code = errorCode(result.Error)
+			return
+		}
+		job.Status = jobDone
+		job.Progress = 1
+		job.Result = result.Result
+	})
+}
+
+// installProgress exposes progress(fraction, message), letting a script report
+// how far along it is. The fraction is clamped to [0, 1] and the message cut to
+// maxProgressMessage bytes. Outside an async job the call does nothing.
+func (sm *ScriptManager) installProgress(vm *sobek.Runtime, jobID string) {
+	vm.Set("progress", func(fraction float64, message sobek.Value) {
+		if math.IsNaN(fraction) {
+			panic(vm.NewTypeError("progress: fraction must be a number"))
+		}
+		if jobID == "" {
+			return
+		}
+		msg := ""
+		if message != nil && !sobek.IsUndefined(message) && !sobek.IsNull(message) {
+			msg = truncateUTF8(message.String(), maxProgressMessage)
+		}
+		sm.jobs.progress(jobID, min(max(fraction, 0), 1), msg)
+	})
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// submitJob queues job in the background and returns its ID right away
+func (sm *ScriptManager) submitJob(ctx context.Context, job ScriptJob) (string, error) {
+	id, err := sm.jobs.add()
+	if err != nil {
+		return "", err
+	}
+	job.jobID = id
+	go func() {
+		result := sm.ExecuteScriptWithContext(ctx, job)
+		sm.jobs.finish(id, result)
+		logrus.WithFields(logrus.Fields{
+			"job_id": id,
+			"failed": result.Error != nil,
+		}).Info("Async job completed")
+	}()
+	return id, nil
+}
+
+// submitJobHandler serves POST /jobs, which takes the same bodies as /data and
+// answers 202 with the ID to poll at /jobs/{id}
+func submitJobHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readScriptBody(w, r, scriptManager.maxScriptSize)
+		if !ok {
+			return
+		}
+
+		if !scriptManager.GetAcceptingScript() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(memoryResumeDelay.Seconds())))
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: config.BackoffMessage, Code: CodeIntakePaused})
+			return
+		}
+
+		job, err := scriptManager.parseRequest(r, body)
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+
+		// The job outlives the request, but keeps its trace
+		id, err := scriptManager.submitJob(context.WithoutCancel(r.Context()), job)
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: "cannot store the job: " + err.Error()})
+			logrus.WithError(err).Error("Failed to store a new async job")
+			return
+		}
+		logrus.WithField("job_id", id).Info("Async job submitted")
+		w.Header().Set("Location", "/jobs/"+id)
+		writeJSONValue(w, http.StatusAccepted, JobStatus{ID: id, Status: jobQueued})
+	}
+}
+
+// jobStatusHandler serves GET /jobs/{id}
+func jobStatusHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok, err := scriptManager.jobs.get(r.PathValue("id"))
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: "cannot read the job: " + err.Error()})
+			logrus.WithError(err).Error("Failed to read an async job")
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusNotFound, Response{Error: "job not found"})
+			return
+		}
+		writeJSONValue(w, http.StatusOK, job)
+	}
+}
+
+// deleteJobHandler serves DELETE /jobs/{id}, dropping the outcome of a finished
+// job before job_result_ttl. Jobs still pending are refused with a 409.
+func deleteJobHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		job, ok, err := scriptManager.jobs.get(id)
+		if err == nil && ok && !job.finished() {
+			writeJSON(w, http.StatusConflict, Response{Error: "job has not finished"})
+			return
+		}
+		if err == nil && ok {
+			err = scriptManager.jobs.store.Delete(id)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: "cannot delete the job: " + err.Error()})
+			logrus.WithError(err).Error("Failed to delete an async job")
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusNotFound, Response{Error: "job not found"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
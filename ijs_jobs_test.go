@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pollJob reads job id through GET /jobs/{id}
+func pollJob(t *testing.T, sm *ScriptManager, id string) JobStatus {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/jobs/"+id, nil)
+	r.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	jobStatusHandler(sm)(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s", rec.Code, rec.Body)
+	}
+	var job JobStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestJobProgressPolled(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 5 * time.Second
+	})
+	const script = `
+		function wait(ms) { const end = Date.now() + ms; while (Date.now() < end) {} }
+		progress(0.25, "reading rows");
+		wait(progressInterval);
+		progress(0.75, "writing rows");
+		wait(progressInterval);
+		"done"`
+	rec := httptest.NewRecorder()
+	body := strings.ReplaceAll(script, "progressInterval", "700")
+	submitJobHandler(sm)(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d %s, want 202", rec.Code, rec.Body)
+	}
+	var submitted JobStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &submitted); err != nil {
+		t.Fatal(err)
+	}
+
+	// Poll until done, keeping each distinct state seen
+	var seen []JobStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job := pollJob(t, sm, submitted.ID)
+		if len(seen) == 0 || job.Progress != seen[len(seen)-1].Progress || job.Status != seen[len(seen)-1].Status {
+			seen = append(seen, job)
+		}
+		if job.finished() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job not done, states seen %+v", seen)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	want := []struct {
+		status   string
+		progress float64
+		message  string
+	}{
+		{jobRunning, 0.25, "reading rows"},
+		{jobRunning, 0.75, "writing rows"},
+		{jobDone, 1, "writing rows"},
+	}
+	var progressed []JobStatus
+	for _, job := range seen {
+		if job.Progress > 0 {
+			progressed = append(progressed, job)
+		}
+	}
+	if len(progressed) != len(want) {
+		t.Fatalf("states seen %+v, want the progress to advance through %v", seen, want)
+	}
+	for i, job := range progressed {
+		if job.Status != want[i].status || job.Progress != want[i].progress || job.Message != want[i].message {
+			t.Fatalf("state %d = %+v, want %v", i, job, want[i])
+		}
+	}
+	if progressed[2].Result != "done" {
+		t.Fatalf("result = %v, want done", progressed[2].Result)
+	}
+}
+
+func TestJobProgressBounded(t *testing.T) {
+	tests := []struct {
+		name         string
+		call         string
+		wantProgress float64
+		wantMessage  string
+	}{
+		{name: "clamped below", call: `progress(-1, "x")`, wantProgress: 0, wantMessage: "x"},
+		{name: "clamped above", call: `progress(2, "x")`, wantProgress: 1, wantMessage: "x"},
+		{name: "no message", call: `progress(0.5)`, wantProgress: 0.5},
+		{name: "long message cut", call: `progress(0.5, "é".repeat(200))`, wantProgress: 0.5, wantMessage: strings.Repeat("é", maxProgressMessage/2)},
+		{name: "message cut on a character", call: `progress(0.5, "a" + "é".repeat(200))`, wantProgress: 0.5, wantMessage: "a" + strings.Repeat("é", maxProgressMessage/2-1)},
+	}
+	sm := newTestManager(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := sm.jobs.add()
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm := newRuntime()
+			sm.installProgress(vm, id)
+			if _, err := vm.RunString(tt.call); err != nil {
+				t.Fatal(err)
+			}
+			job := sm.jobs.lookup(id)
+			job.Lock()
+			defer job.Unlock()
+			if job.status.Progress != tt.wantProgress || job.status.Message != tt.wantMessage {
+				t.Fatalf("progress %g %q, want %g %q", job.status.Progress, job.status.Message, tt.wantProgress, tt.wantMessage)
+			}
+		})
+	}
+
+	t.Run("not a number", func(t *testing.T) {
+		sm := newTestManager(t, func(c *Config) {
+			c.ScriptTimeout = time.Second
+		})
+		if _, err := sm.ExecuteScriptWithTimeout(`progress(NaN)`); err == nil || !strings.Contains(err.Error(), "fraction must be a number") {
+			t.Fatalf("error = %v, want a TypeError", err)
+		}
+		if result, err := sm.ExecuteScriptWithTimeout(`progress(0.5, "outside a job"); 1`); err != nil || result != int64(1) {
+			t.Fatalf("result = %v, %v, want progress ignored outside a job", result, err)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// jobStoreTimeout bounds one call to a remote job store
+const jobStoreTimeout = 2 * time.Second
+
+// JobStore keeps the state of the async jobs where GET /jobs/{id} reads it. A
+// job runs on the instance it was submitted to, which puts its state on every
+// change, so with a shared store any instance can answer the poll.
+type JobStore interface {
+	// Put stores job under its ID for ttl, 0 keeping it until it is replaced
+	Put(job JobStatus, ttl time.Duration) error
+	// Get returns job id, false when it is unknown or expired
+	Get(id string) (JobStatus, bool, error)
+	Delete(id string) error
+}
+
+// newJobStore creates the store selected by the job_store setting
+func newJobStore(cfg Config) (JobStore, error) {
+	switch cfg.JobStore {
+	case "memory":
+		return newMemoryJobStore(), nil
+	case "redis":
+		opts, err := redis.ParseURL(cfg.JobStoreURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job_store_url: %w", err)
+		}
+		return &redisJobStore{client: redis.NewClient(opts)}, nil
+	default:
+		return nil, fmt.Errorf("unknown job store %q", cfg.JobStore)
+	}
+}
+
+// memoryJobStore keeps the jobs in the process, the default. Expired jobs are
+// swept whenever a new job is put.
+type memoryJobStore struct {
+	sync.Mutex
+	jobs map[string]storedJob
+}
+
+type storedJob struct {
+	job     JobStatus
+	expires time.Time // zero when the job does not expire
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{jobs: make(map[string]storedJob)}
+}
+
+func (s *memoryJobStore) Put(job JobStatus, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if _, ok := s.jobs[job.ID]; !ok {
+		for id, stored := range s.jobs {
+			if stored.expired(now) {
+				delete(s.jobs, id)
+			}
+		}
+	}
+	stored := storedJob{job: job}
+	if ttl > 0 {
+		stored.expires = now.Add(ttl)
+	}
+	s.jobs[job.ID] = stored
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (JobStatus, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.jobs[id]
+	if !ok || stored.expired(time.Now()) {
+		return JobStatus{}, false, nil
+	}
+	return stored.job, true, nil
+}
+
+func (s *memoryJobStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
+
+func (j storedJob) expired(now time.Time) bool {
+	return !j.expires.IsZero() && now.After(j.expires)
+}
+
+// redisJobStore keeps the jobs in Redis as JSON under ijs:job:<id>, expiring
+// them with the key TTL, so instances sharing the server share the jobs
+type redisJobStore struct {
+	client *redis.Client
+}
+
+func redisJobKey(id string) string {
+	return "ijs:job:" + id
+}
+
+func (s *redisJobStore) Put(job JobStatus, ttl time.Duration) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jobStoreTimeout)
+	defer cancel()
+	return s.client.Set(ctx, redisJobKey(job.ID), data, ttl).Err()
+}
+
+func (s *redisJobStore) Get(id string) (JobStatus, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobStoreTimeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, redisJobKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return JobStatus{}, false, nil
+	}
+	if err != nil {
+		return JobStatus{}, false, err
+	}
+	var job JobStatus
+	if err := json.Unmarshal(data, &job); err != nil {
+		return JobStatus{}, false, fmt.Errorf("corrupt job %s: %w", id, err)
+	}
+	return job, true, nil
+}
+
+func (s *redisJobStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), jobStoreTimeout)
+	defer cancel()
+	return s.client.Del(ctx, redisJobKey(id)).Err()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryJobStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		wait    time.Duration
+		deleted bool
+		want    bool
+	}{
+		{name: "get after put", ttl: time.Minute, want: true},
+		{name: "no ttl", ttl: 0, wait: 20 * time.Millisecond, want: true},
+		{name: "expired", ttl: 5 * time.Millisecond, wait: 20 * time.Millisecond},
+		{name: "deleted", ttl: time.Minute, deleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryJobStore()
+			put := JobStatus{ID: "a", Status: jobDone, Progress: 1, Result: "ok"}
+			if err := store.Put(put, tt.ttl); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tt.wait)
+			if tt.deleted {
+				store.Delete("a")
+			}
+			got, ok, err := store.Get("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Fatalf("found = %t, want %t", ok, tt.want)
+			}
+			if ok && got != put {
+				t.Fatalf("got %+v, want %+v", got, put)
+			}
+		})
+	}
+}
+
+func TestMemoryJobStoreSweep(t *testing.T) {
+	store := newMemoryJobStore()
+	store.Put(JobStatus{ID: "old"}, time.Millisecond)
+	store.Put(JobStatus{ID: "kept"}, 0)
+	time.Sleep(5 * time.Millisecond)
+	// Replacing a job sweeps nothing, a new one sweeps the expired
+	store.Put(JobStatus{ID: "kept"}, 0)
+	if len(store.jobs) != 2 {
+		t.Fatalf("%d jobs after a replace, want 2", len(store.jobs))
+	}
+	store.Put(JobStatus{ID: "new"}, 0)
+	if _, ok := store.jobs["old"]; ok || len(store.jobs) != 2 {
+		t.Fatalf("jobs after a new put = %v, want kept and new", store.jobs)
+	}
+}
+
+// recordingJobStore is a memory store remembering every put, which blocks
+// while block is set for that job
+type recordingJobStore struct {
+	*memoryJobStore
+	puts  chan JobStatus
+	block map[string]chan struct{}
+}
+
+func (s *recordingJobStore) Put(job JobStatus, ttl time.Duration) error {
+	if wait, ok := s.block[job.ID]; ok {
+		<-wait
+	}
+	s.puts <- job
+	return s.memoryJobStore.Put(job, ttl)
+}
+
+func newRecordingJobStore() *recordingJobStore {
+	return &recordingJobStore{
+		memoryJobStore: newMemoryJobStore(),
+		puts:           make(chan JobStatus, 100),
+		block:          make(map[string]chan struct{}),
+	}
+}
+
+// drainPuts returns the puts recorded so far
+func (s *recordingJobStore) drainPuts() []JobStatus {
+	var puts []JobStatus
+	for {
+		select {
+		case job := <-s.puts:
+			puts = append(puts, job)
+		default:
+			return puts
+		}
+	}
+}
+
+// progressOf returns the progress of each of puts
+func progressOf(puts []JobStatus) []float64 {
+	progress := []float64{}
+	for _, job := range puts {
+		progress = append(progress, job.Progress)
+	}
+	return progress
+}
+
+func TestJobProgressCoalesced(t *testing.T) {
+	tests := []struct {
+		name      string
+		reports   []float64
+		then      func(table *jobTable, id string) // after the reports, before the interval is over
+		wantNow   []float64                        // progress of the puts made before the interval is over
+		wantPuts  []float64                        // progress of all the puts after add, in order
+		wantFinal string
+	}{
+		{name: "first report put at once", reports: []float64{0.1}, wantNow: []float64{0.1}, wantPuts: []float64{0.1}},
+		{name: "reports in between coalesced", reports: []float64{0.1, 0.2, 0.3, 0.4}, wantNow: []float64{0.1}, wantPuts: []float64{0.1, 0.4}},
+		{
+			name:      "finish supersedes the coalesced put",
+			reports:   []float64{0.1, 0.2},
+			then:      func(table *jobTable, id string) { table.finish(id, ScriptResult{Result: "ok"}) },
+			wantNow:   []float64{0.1, 1},
+			wantPuts:  []float64{0.1, 1},
+			wantFinal: jobDone,
+		},
+		{
+			name:      "change of state supersedes the coalesced put",
+			reports:   []float64{0.1, 0.2, 0.3},
+			then:      func(table *jobTable, id string) { table.markRunning(id) },
+			wantNow:   []float64{0.1, 0.3},
+			wantPuts:  []float64{0.1, 0.3},
+			wantFinal: jobRunning,
+		},
+		{
+			name:    "reports after a finish dropped",
+			reports: []float64{0.1},
+			then: func(table *jobTable, id string) {
+				table.finish(id, ScriptResult{Result: "ok"})
+				table.progress(id, 0.5, "late")
+			},
+			wantNow:   []float64{0.1, 1},
+			wantPuts:  []float64{0.1, 1},
+			wantFinal: jobDone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newRecordingJobStore()
+			table := newJobTable(store)
+			id, err := table.add()
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.drainPuts()
+			// Past the interval of the put made by add
+			table.lookup(id).lastPut = time.Now().Add(-progressInterval)
+
+			for _, fraction := range tt.reports {
+				table.progress(id, fraction, "")
+			}
+			if tt.then != nil {
+				tt.then(table, id)
+			}
+			puts := store.drainPuts()
+			if got := progressOf(puts); !reflect.DeepEqual(got, tt.wantNow) {
+				t.Fatalf("puts before the interval = %v, want %v", got, tt.wantNow)
+			}
+
+			// The timer puts what was coalesced once the interval is over
+			time.Sleep(progressInterval + 100*time.Millisecond)
+			puts = append(puts, store.drainPuts()...)
+			if got := progressOf(puts); !reflect.DeepEqual(got, tt.wantPuts) {
+				t.Fatalf("puts = %v, want %v", got, tt.wantPuts)
+			}
+			if tt.wantFinal != "" {
+				job, _, _ := store.Get(id)
+				if job.Status != tt.wantFinal {
+					t.Fatalf("final status = %s, want %s", job.Status, tt.wantFinal)
+				}
+			}
+		})
+	}
+}
+
+// TestJobFinishRacingFlush lets the timer of a coalesced report fire while the
+// job is locked, so the flush and the finish race for it. Whichever wins, the
+// finished state is the last put and nothing is put after it.
+func TestJobFinishRacingFlush(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		store := newRecordingJobStore()
+		table := newJobTable(store)
+		id, _ := table.add()
+		job := table.lookup(id)
+		job.lastPut = time.Now().Add(-progressInterval)
+		table.progress(id, 0.1, "")
+		table.progress(id, 0.2, "")
+
+		job.Lock()
+		// The flush fires and waits for the lock
+		time.Sleep(progressInterval + 50*time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			table.finish(id, ScriptResult{Result: "ok"})
+			close(done)
+		}()
+		job.Unlock()
+		<-done
+		time.Sleep(50 * time.Millisecond)
+
+		puts := store.drainPuts()
+		if last := puts[len(puts)-1]; last.Status != jobDone {
+			t.Fatalf("last put = %+v, want the finished job", last)
+		}
+		if stored, _, _ := store.Get(id); stored.Status != jobDone || stored.Progress != 1 {
+			t.Fatalf("stored job = %+v, want the finished job", stored)
+		}
+		if table.lookup(id) != nil {
+			t.Fatal("finished job still pending")
+		}
+	}
+}
+
+func TestJobPutsDoNotBlockOtherJobs(t *testing.T) {
+	store := newRecordingJobStore()
+	table := newJobTable(store)
+	slow, _ := table.add()
+	fast, _ := table.add()
+	store.drainPuts()
+
+	unblock := make(chan struct{})
+	store.block[slow] = unblock
+	go table.markRunning(slow)
+	// Wait for the slow put to be under way
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		table.markRunning(fast)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a slow put of one job held up another job")
+	}
+	close(unblock)
+	if job, _, _ := store.Get(fast); job.Status != jobRunning {
+		t.Fatalf("status = %s, want %s", job.Status, jobRunning)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// labelHeaderPrefix starts the headers carrying labels, X-Label-Report-Type
+	// sets report_type
+	labelHeaderPrefix = "X-Label-"
+	// maxLabelValueLength caps the length of one label value
+	maxLabelValueLength = 64
+	// otherLabelValue replaces the values of a label past max_label_values
+	otherLabelValue = "other"
+)
+
+// labelNamePattern is what metric_labels names must look like, a valid
+// Prometheus label name in lower case
+var labelNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// reservedLabels are the label names the execution metrics use themselves
+var reservedLabels = []string{"outcome"}
+
+// checkMetricLabels validates the metric_labels configuration
+func checkMetricLabels(names []string, maxValues int) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("label %q is not a valid label name", name)
+		}
+		for _, reserved := range reservedLabels {
+			if name == reserved {
+				return fmt.Errorf("label %q is reserved", name)
+			}
+		}
+		if seen[name] {
+			return fmt.Errorf("label %q is listed twice", name)
+		}
+		seen[name] = true
+	}
+	if len(names) > 0 && maxValues < 1 {
+		return fmt.Errorf("max_label_values is %d, must be at least 1", maxValues)
+	}
+	return nil
+}
+
+// requestLabels reads the labels of a request from its X-Label-* headers and
+// the envelope, the envelope winning for a label set by both
+func requestLabels(r *http.Request, envelope map[string]string) map[string]string {
+	var labels map[string]string
+	for key, values := range r.Header {
+		suffix, ok := strings.CutPrefix(key, labelHeaderPrefix)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[strings.ReplaceAll(strings.ToLower(suffix), "-", "_")] = values[0]
+	}
+	for name, value := range envelope {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[name] = value
+	}
+	return labels
+}
+
+// executionMetrics counts executions and their durations, broken down by the
+// metric_labels of each job and by outcome, "ok" or the error code
+type executionMetrics struct {
+	names     []string
+	maxValues int
+	count     *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+
+	sync.Mutex
+	values map[string]map[string]struct{} // distinct values seen per label
+}
+
+func newExecutionMetrics(names []string, maxValues int) *executionMetrics {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	all := append(append([]string(nil), names...), "outcome")
+	m := &executionMetrics{
+		names:     names,
+		maxValues: maxValues,
+		count: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ijs_executions_total",
+			Help: "Executions by metric label and outcome, ok or the error code.",
+		}, all),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ijs_execution_duration_seconds",
+			Help:    "Time scripts ran, by metric label and outcome.",
+			Buckets: timingBuckets[:],
+		}, all),
+		values: make(map[string]map[string]struct{}, len(names)),
+	}
+	for _, name := range names {
+		m.values[name] = make(map[string]struct{})
+	}
+	return m
+}
+
+// check rejects labels outside metric_labels and values that are too long or
+// not printable ASCII
+func (m *executionMetrics) check(labels map[string]string) error {
+	for name, value := range labels {
+		if _, ok := m.values[name]; !ok {
+			return fmt.Errorf("%w: label %q is not one of the metric_labels", ErrInvalidEnvelope, name)
+		}
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("%w: label %q is longer than %d bytes", ErrInvalidEnvelope, name, maxLabelValueLength)
+		}
+		for _, c := range value {
+			if c < 0x20 || c > 0x7e {
+				return fmt.Errorf("%w: label %q holds a character outside printable ASCII", ErrInvalidEnvelope, name)
+			}
+		}
+	}
+	return nil
+}
+
+// labelValues returns the values of every label for one execution. Past
+// max_label_values distinct values a label reports new ones as "other", so a
+// client cannot grow the number of series without bound.
+func (m *executionMetrics) labelValues(labels map[string]string, outcome string) []string {
+	m.Lock()
+	defer m.Unlock()
+	values := make([]string, 0, len(m.names)+1)
+	for _, name := range m.names {
+		value := labels[name]
+		seen := m.values[name]
+		if _, ok := seen[value]; !ok && value != "" {
+			if len(seen) >= m.maxValues {
+				if len(seen) == m.maxValues {
+					logrus.WithField("label", name).Warn("Label reached max_label_values, further values are reported as other")
+					seen[otherLabelValue] = struct{}{}
+				}
+				value = otherLabelValue
+			} else {
+				seen[value] = struct{}{}
+			}
+		}
+		values = append(values, value)
+	}
+	return append(values, outcome)
+}
+
+// observe records one execution
+func (m *executionMetrics) observe(labels map[string]string, result ScriptResult) {
+	outcome := "ok"
+	if result.Error != nil {
+		outcome = errorCode(result.Error)
+	}
+	values := m.labelValues(labels, outcome)
+	m.count.WithLabelValues(values...).Inc()
+	m.duration.WithLabelValues(values...).Observe(result.Duration.Seconds())
+}
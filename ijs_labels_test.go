@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckMetricLabels(t *testing.T) {
+	tests := []struct {
+		names     []string
+		maxValues int
+		wantErr   string
+	}{
+		{names: nil, maxValues: 0},
+		{names: []string{"report_type", "tenant_tier"}, maxValues: 10},
+		{names: []string{"Report"}, maxValues: 10, wantErr: "not a valid label name"},
+		{names: []string{"report-type"}, maxValues: 10, wantErr: "not a valid label name"},
+		{names: []string{"__name"}, maxValues: 10, wantErr: "not a valid label name"},
+		{names: []string{"outcome"}, maxValues: 10, wantErr: "reserved"},
+		{names: []string{"tier", "tier"}, maxValues: 10, wantErr: "listed twice"},
+		{names: []string{"tier"}, maxValues: 0, wantErr: "must be at least 1"},
+	}
+	for _, tt := range tests {
+		err := checkMetricLabels(tt.names, tt.maxValues)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkMetricLabels(%v, %d) = %v, want %q", tt.names, tt.maxValues, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRequestLabels(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/data", nil)
+	r.Header.Set("X-Label-Report-Type", "daily")
+	r.Header.Set("X-Label-Tenant-Tier", "gold")
+	r.Header.Set("X-Other", "ignored")
+	got := requestLabels(r, map[string]string{"tenant_tier": "silver", "region": "eu"})
+	want := map[string]string{"report_type": "daily", "tenant_tier": "silver", "region": "eu"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("labels = %v, want %v", got, want)
+	}
+	if got := requestLabels(httptest.NewRequest(http.MethodPost, "/data", nil), nil); got != nil {
+		t.Fatalf("labels of a request without any = %v, want nil", got)
+	}
+}
+
+func TestExecutionMetricsLabels(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 100 * time.Millisecond
+		c.MetricLabels = []string{"tenant_tier", "report_type"}
+		c.MaxLabelValues = 2
+	})
+	sm.execMetrics = newExecutionMetrics(config.MetricLabels, config.MaxLabelValues)
+	post := func(body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		handler(sm)(rec, r)
+		return rec
+	}
+	// count returns the executions counted under report_type, tenant_tier and outcome
+	count := func(values ...string) float64 {
+		return testutil.ToFloat64(sm.execMetrics.count.WithLabelValues(values...))
+	}
+
+	post(`{"script": "1", "labels": {"report_type": "daily"}}`, map[string]string{"X-Label-Tenant-Tier": "gold"})
+	post(`{"script": "1", "labels": {"report_type": "daily"}}`, map[string]string{"X-Label-Tenant-Tier": "gold"})
+	post(`{"script": "for (;;) {}", "labels": {"report_type": "daily", "tenant_tier": "gold"}}`, nil)
+	post(`{"script": "1"}`, nil)
+	if got := count("daily", "gold", "ok"); got != 2 {
+		t.Errorf("daily/gold/ok = %g, want 2", got)
+	}
+	if got := count("daily", "gold", CodeTimeout); got != 1 {
+		t.Errorf("daily/gold/%s = %g, want 1", CodeTimeout, got)
+	}
+	if got := count("", "", "ok"); got != 1 {
+		t.Errorf("unlabelled = %g, want 1", got)
+	}
+	if got := testutil.CollectAndCount(sm.execMetrics.duration); got != 3 {
+		t.Errorf("%d duration series, want 3", got)
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		for name, tt := range map[string]struct {
+			body    string
+			headers map[string]string
+		}{
+			"label not listed":    {body: `{"script": "1", "labels": {"tenant": "acme"}}`},
+			"header not listed":   {body: `{"script": "1"}`, headers: map[string]string{"X-Label-Tenant": "acme"}},
+			"value too long":      {body: `{"script": "1", "labels": {"report_type": "` + strings.Repeat("x", 65) + `"}}`},
+			"value not printable": {body: `{"script": "1", "labels": {"report_type": "daily\n"}}`},
+			"value not ascii":     {body: `{"script": "1", "labels": {"report_type": "été"}}`},
+		} {
+			if rec := post(tt.body, tt.headers); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidRequest) {
+				t.Errorf("%s: %d %s, want 400 and %s", name, rec.Code, rec.Body, CodeInvalidRequest)
+			}
+		}
+	})
+
+	// daily is one of the 2 values report_type may have, weekly the other,
+	// the values after them are counted as other
+	t.Run("max_label_values", func(t *testing.T) {
+		for _, reportType := range []string{"weekly", "monthly", "yearly", "daily"} {
+			post(`{"script": "1", "labels": {"report_type": "`+reportType+`", "tenant_tier": "gold"}}`, nil)
+		}
+		if got := count("weekly", "gold", "ok"); got != 1 {
+			t.Errorf("weekly = %g, want 1", got)
+		}
+		if got := count("other", "gold", "ok"); got != 2 {
+			t.Errorf("other = %g, want the 2 values past the limit", got)
+		}
+		if got := count("daily", "gold", "ok"); got != 3 {
+			t.Errorf("daily = %g, want 3, values seen before the limit keep their series", got)
+		}
+		for _, series := range []string{"monthly", "yearly"} {
+			if got := count(series, "gold", "ok"); got != 0 {
+				t.Errorf("%s has a series past max_label_values", series)
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/netutil"
+)
+
+// newListener opens the server socket, capping the number of simultaneously open
+// connections at max_connections when it is set. Connections over the cap wait in
+// the kernel backlog until one is closed, they never reach a handler goroutine.
+func newListener(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxConnections <= 0 {
+		return ln, nil
+	}
+	logrus.Infof("Limiting the server to %d concurrent connections", config.MaxConnections)
+	return &countingListener{
+		Listener: netutil.LimitListener(ln, config.MaxConnections),
+		max:      int64(config.MaxConnections),
+	}, nil
+}
+
+// countingListener tracks open connections so reaching the cap can be logged,
+// once when it is reached and once when connections are back under it, however
+// many are accepted in between
+type countingListener struct {
+	net.Listener
+	max    int64
+	active int64
+	atCap  int32 // 1 from reaching the cap until back under it
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if atomic.AddInt64(&l.active, 1) >= l.max && atomic.CompareAndSwapInt32(&l.atCap, 0, 1) {
+		logrus.WithField("max_connections", l.max).Warn("Connection limit reached, new connections wait until one closes")
+	}
+	return &countedConn{Conn: conn, listener: l}, nil
+}
+
+// closed accounts for a closed connection
+func (l *countingListener) closed() {
+	if atomic.AddInt64(&l.active, -1) < l.max && atomic.CompareAndSwapInt32(&l.atCap, 1, 0) {
+		logrus.WithField("max_connections", l.max).Info("Connections back under the limit")
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	listener  *countingListener
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.listener.closed)
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// pipeListener accepts one end of a new pipe on every Accept
+type pipeListener struct {
+	net.Listener
+}
+
+func (pipeListener) Accept() (net.Conn, error) {
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestCountingListenerLogsTransitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		ops        string // a for an accept, c to close the oldest open connection
+		wantLimit  int
+		wantUnder  int
+		wantActive int64
+	}{
+		{name: "under the cap", ops: "aca", wantActive: 1},
+		{name: "cap reached", ops: "aa", wantLimit: 1, wantActive: 2},
+		{name: "accepts at the cap logged once", ops: "aaaaa", wantLimit: 1, wantActive: 5},
+		{name: "back under", ops: "aaac", wantLimit: 1, wantActive: 2},
+		{name: "back under once", ops: "aaacc", wantLimit: 1, wantUnder: 1, wantActive: 1},
+		{name: "reached again", ops: "aacaca", wantLimit: 3, wantUnder: 2, wantActive: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := new(test.Hook)
+			saved := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+			logrus.AddHook(hook)
+			t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(saved) })
+
+			l := &countingListener{Listener: pipeListener{}, max: 2}
+			var open []net.Conn
+			for _, op := range tt.ops {
+				if op == 'a' {
+					conn, err := l.Accept()
+					if err != nil {
+						t.Fatal(err)
+					}
+					open = append(open, conn)
+					continue
+				}
+				open[0].Close()
+				// A second close is not counted again
+				open[0].Close()
+				open = open[1:]
+			}
+
+			limit, under := 0, 0
+			for _, entry := range hook.AllEntries() {
+				switch entry.Message {
+				case "Connection limit reached, new connections wait until one closes":
+					limit++
+				case "Connections back under the limit":
+					under++
+				}
+			}
+			if limit != tt.wantLimit || under != tt.wantUnder {
+				t.Fatalf("logged the limit %d times and back under %d times, want %d and %d", limit, under, tt.wantLimit, tt.wantUnder)
+			}
+			if l.active != tt.wantActive {
+				t.Fatalf("active = %d, want %d", l.active, tt.wantActive)
+			}
+		})
+	}
+}
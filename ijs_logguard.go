@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logProbeInterval is how often a line is written to find out whether a failing
+// log destination is back
+const logProbeInterval = 5 * time.Second
+
+// logWritesFailing is set while the log guard holds intake off
+var logWritesFailing int32
+
+func isLoggingFailed() bool {
+	return atomic.LoadInt32(&logWritesFailing) == 1
+}
+
+// fileLogGuard wraps the log file, set by initializeLogging
+var fileLogGuard *logGuard
+
+// logGuard is a dead man's switch on the log file: once threshold writes in a
+// row fail, such as on a full disk, it stops script intake, as scripts must not
+// run without an audit trail, and probes the file until a write succeeds again.
+// Until watch is called it only passes writes through.
+type logGuard struct {
+	w io.Writer
+
+	sync.Mutex
+	sm        *ScriptManager
+	threshold int // 0 until watched
+	failures  int // consecutive failed writes
+
+	// intake orders trip and resume, which act on the state of logWritesFailing
+	// when they run, so the last of them leaves intake as that state says
+	intake sync.Mutex
+}
+
+func newLogGuard(w io.Writer) *logGuard {
+	return &logGuard{w: w}
+}
+
+// watch arms the guard, turning intake of sm off after threshold failed writes
+func (g *logGuard) watch(sm *ScriptManager, threshold int) {
+	g.Lock()
+	defer g.Unlock()
+	g.sm, g.threshold = sm, threshold
+}
+
+func (g *logGuard) Write(p []byte) (int, error) {
+	n, err := g.w.Write(p)
+	g.record(err)
+	return n, err
+}
+
+// record counts a write. It runs under the logrus lock, so it never logs
+// itself: tripping and recovering log from their own goroutine.
+func (g *logGuard) record(err error) {
+	g.Lock()
+	defer g.Unlock()
+	if g.threshold == 0 {
+		return
+	}
+	if err == nil {
+		g.failures = 0
+		if isLoggingFailed() {
+			atomic.StoreInt32(&logWritesFailing, 0)
+			go g.resume()
+		}
+		return
+	}
+	g.failures++
+	if g.failures >= g.threshold && !isLoggingFailed() {
+		atomic.StoreInt32(&logWritesFailing, 1)
+		// The log is what failed, stderr is left to tell why
+		fmt.Fprintf(os.Stderr, "%d log writes failed in a row, last error: %v. Stopping script intake...\n", g.failures, err)
+		go g.trip()
+	}
+}
+
+// trip stops intake, then writes a probe line every logProbeInterval until
+// logging recovers
+func (g *logGuard) trip() {
+	g.intake.Lock()
+	if isLoggingFailed() {
+		g.sm.setAcceptingScript(false)
+	}
+	g.intake.Unlock()
+	ticker := time.NewTicker(logProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLoggingFailed() {
+			return
+		}
+		logrus.Warn("Log writes failing, script intake is off")
+	}
+}
+
+// resume turns intake back on, unless the memory monitor or a shutdown holds
+// it off
+func (g *logGuard) resume() {
+	logrus.Warn("Log writes succeed again")
+	g.intake.Lock()
+	defer g.intake.Unlock()
+	if isLoggingFailed() || isUnderMemoryPressure() || isStopping() {
+		return
+	}
+	g.sm.setAcceptingScript(true)
+	logrus.Info("Resuming script execution now that logging works")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyWriter fails every write while failing is set
+type flakyWriter struct {
+	sync.Mutex
+	failing bool
+	written int
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.failing {
+		return 0, errors.New("no space left on device")
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func (w *flakyWriter) setFailing(failing bool) {
+	w.Lock()
+	defer w.Unlock()
+	w.failing = failing
+}
+
+// waitAccepting waits for the intake of sm to become want
+func waitAccepting(t *testing.T, sm *ScriptManager, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sm.GetAcceptingScript() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("accepting scripts = %t, want %t", !want, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// newWatchedGuard returns a guard over a flakyWriter, armed on sm
+func newWatchedGuard(t *testing.T, sm *ScriptManager, threshold int) (*logGuard, *flakyWriter) {
+	t.Helper()
+	t.Cleanup(func() { atomic.StoreInt32(&logWritesFailing, 0) })
+	w := &flakyWriter{}
+	g := newLogGuard(w)
+	g.watch(sm, threshold)
+	return g, w
+}
+
+func TestLogGuardTrips(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = time.Second })
+	g, w := newWatchedGuard(t, sm, 3)
+
+	w.setFailing(true)
+	for range 2 {
+		if _, err := g.Write([]byte("line\n")); err == nil {
+			t.Fatal("write error not passed on")
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !sm.GetAcceptingScript() || isLoggingFailed() {
+		t.Fatal("intake stopped under the threshold")
+	}
+	g.Write([]byte("line\n"))
+	waitAccepting(t, sm, false)
+	if !isLoggingFailed() {
+		t.Fatal("logging not reported failed")
+	}
+	rec, response := postScript(sm, "1")
+	if rec.Code != http.StatusServiceUnavailable || response.Code != CodeIntakePaused {
+		t.Fatalf("status = %d %s while logging fails, want 503", rec.Code, rec.Body)
+	}
+
+	// One write getting through is enough
+	w.setFailing(false)
+	if _, err := g.Write([]byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitAccepting(t, sm, true)
+	if isLoggingFailed() {
+		t.Fatal("logging still reported failed")
+	}
+	if rec, _ := postScript(sm, "1"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s once logging recovered", rec.Code, rec.Body)
+	}
+}
+
+func TestLogGuardSuccessResetsCount(t *testing.T) {
+	sm := newTestManager(t, nil)
+	g, w := newWatchedGuard(t, sm, 3)
+	// Failures with successes in between never make threshold in a row
+	for range 5 {
+		w.setFailing(true)
+		g.Write([]byte("line\n"))
+		g.Write([]byte("line\n"))
+		w.setFailing(false)
+		g.Write([]byte("line\n"))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !sm.GetAcceptingScript() || isLoggingFailed() {
+		t.Fatal("intake stopped without threshold failures in a row")
+	}
+}
+
+func TestLogGuardFlapping(t *testing.T) {
+	sm := newTestManager(t, nil)
+	g, w := newWatchedGuard(t, sm, 1)
+	// Trips and recoveries in quick succession end with intake as the last
+	// write left it
+	for range 10 {
+		w.setFailing(true)
+		g.Write([]byte("line\n"))
+		w.setFailing(false)
+		g.Write([]byte("line\n"))
+	}
+	waitAccepting(t, sm, true)
+	time.Sleep(20 * time.Millisecond)
+	if !sm.GetAcceptingScript() {
+		t.Fatal("intake off although the last write succeeded")
+	}
+}
+
+func TestLogGuardRecoveryUnderMemoryPressure(t *testing.T) {
+	sm := newTestManager(t, nil)
+	g, w := newWatchedGuard(t, sm, 1)
+	w.setFailing(true)
+	g.Write([]byte("line\n"))
+	waitAccepting(t, sm, false)
+
+	// The memory monitor holds intake off too, it resumes it in its own time
+	atomic.StoreInt32(&memoryPressure, 1)
+	t.Cleanup(func() { atomic.StoreInt32(&memoryPressure, 0) })
+	w.setFailing(false)
+	g.Write([]byte("line\n"))
+	time.Sleep(50 * time.Millisecond)
+	if sm.GetAcceptingScript() {
+		t.Fatal("logging recovery resumed intake under memory pressure")
+	}
+}
+
+func TestLogGuardUnwatched(t *testing.T) {
+	sm := newTestManager(t, nil)
+	w := &flakyWriter{failing: true}
+	g := newLogGuard(w)
+	for range 10 {
+		if _, err := g.Write([]byte("line\n")); err == nil {
+			t.Fatal("write error not passed on")
+		}
+	}
+	w.setFailing(false)
+	if n, err := g.Write([]byte("line\n")); n != 5 || err != nil || w.written != 5 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if !sm.GetAcceptingScript() || isLoggingFailed() {
+		t.Fatal("a guard that is not watched stopped intake")
+	}
+}
@@ -5,11 +5,23 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/natefinch/lumberjack"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// logMaxSizeMB is the size at which the log file is rotated
+	logMaxSizeMB = 50
+	// logBackupTimeFormat is the timestamp lumberjack puts in the backup names
+	logBackupTimeFormat = "2006-01-02T15-04-05.000"
+	// logBudgetInterval is how often the log files are checked against max_log_total_mb
+	logBudgetInterval = time.Minute
+)
+
 func initializeLogging() {
 
 	// Extract the directory from the log file name
@@ -23,7 +35,7 @@ func initializeLogging() {
 
 	fileLogger := &lumberjack.Logger{
 		Filename:   LogFileName,
-		MaxSize:    50,
+		MaxSize:    logMaxSizeMB,
 		MaxBackups: 5,
 		MaxAge:     90,
 		Compress:   true,
@@ -35,10 +47,11 @@ func initializeLogging() {
 		FullTimestamp: true,
 	})
 
+	fileLogGuard = newLogGuard(fileLogger)
 	if config.LogOnConsole {
-		logrus.SetOutput(io.MultiWriter(fileLogger, os.Stdout))
+		logrus.SetOutput(io.MultiWriter(fileLogGuard, os.Stdout))
 	} else {
-		logrus.SetOutput(fileLogger)
+		logrus.SetOutput(fileLogGuard)
 	}
 
 	logrus.SetLevel(VerboseLevel) // Increase verbosity for troubleshooting
@@ -56,3 +69,101 @@ func initializeLogging() {
 		fileLogger.Compress,
 	))
 }
+
+// logBackup is a rotated log file, compressed or not
+type logBackup struct {
+	path    string
+	size    int64
+	rotated time.Time
+}
+
+// logFileUsage returns the size of the log file logFile and its backups, oldest
+// backup first. Backups are recognized the way lumberjack names them, as the
+// base name followed by the rotation time, "ijs-2006-01-02T15-04-05.000.log"
+// and the same with ".gz" once compressed.
+func logFileUsage(logFile string) (int64, []logBackup, error) {
+	dir, base := filepath.Split(logFile)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var total int64
+	var backups []logBackup
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		name := entry.Name()
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if name == base {
+			total += info.Size()
+			continue
+		}
+		stamp, ok := strings.CutPrefix(strings.TrimSuffix(name, ".gz"), prefix)
+		if !ok || !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		rotated, err := time.Parse(logBackupTimeFormat, strings.TrimSuffix(stamp, ext))
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+		backups = append(backups, logBackup{path: filepath.Join(dir, name), size: info.Size(), rotated: rotated})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotated.Before(backups[j].rotated) })
+	return total, backups, nil
+}
+
+// pruneLogBackups removes the oldest backups of logFile until it and its
+// backups fit in budget bytes, whatever lumberjack would still keep. The live
+// file is never removed. It returns the paths removed.
+func pruneLogBackups(logFile string, budget int64) ([]string, error) {
+	total, backups, err := logFileUsage(logFile)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, backup := range backups {
+		if total <= budget {
+			break
+		}
+		if err := os.Remove(backup.path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		total -= backup.size
+		removed = append(removed, backup.path)
+	}
+	return removed, nil
+}
+
+// initializeLogBudget starts the sweep keeping the log files under
+// max_log_total_mb, when set
+func initializeLogBudget() {
+	if config.MaxLogTotalMB == 0 {
+		return
+	}
+	go logBudgetLoop(LogFileName, int64(config.MaxLogTotalMB)<<20)
+}
+
+// logBudgetLoop prunes the log backups every logBudgetInterval, forever
+func logBudgetLoop(logFile string, budget int64) {
+	for {
+		removed, err := pruneLogBackups(logFile, budget)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to prune log backups")
+		}
+		if len(removed) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"removed":  removed,
+				"limit_mb": budget >> 20,
+			}).Warn("Removed log backups over max_log_total_mb")
+		}
+		time.Sleep(logBudgetInterval)
+	}
+}
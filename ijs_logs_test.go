@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeLogFiles creates the files of sizes in dir, named by their keys
+func writeLogFiles(t *testing.T, dir string, sizes map[string]int) {
+	t.Helper()
+	for name, size := range sizes {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// remainingFiles lists the names left in dir
+func remainingFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestLogFileUsage(t *testing.T) {
+	dir := t.TempDir()
+	writeLogFiles(t, dir, map[string]int{
+		"ijs.log":                            100,
+		"ijs-2024-03-01T10-00-00.000.log":    10,
+		"ijs-2024-01-01T10-00-00.000.log.gz": 20,
+		"ijs-2024-02-01T10-00-00.000.log":    30,
+		"ijs-not-a-time.log":                 1000,
+		"ijs-2024-02-01T10-00-00.000.txt":    1000,
+		"other-2024-02-01T10-00-00.000.log":  1000,
+		"ijs.log.bak":                        1000,
+	})
+	if err := os.Mkdir(filepath.Join(dir, "ijs-2024-04-01T10-00-00.000.log"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	total, backups, err := logFileUsage(filepath.Join(dir, "ijs.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 160 {
+		t.Errorf("total = %d, want the log file and its 3 backups, 160", total)
+	}
+	var names []string
+	for _, backup := range backups {
+		names = append(names, filepath.Base(backup.path))
+	}
+	// Oldest first by the time in the name, compressed or not
+	want := []string{"ijs-2024-01-01T10-00-00.000.log.gz", "ijs-2024-02-01T10-00-00.000.log", "ijs-2024-03-01T10-00-00.000.log"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("backups = %v, want %v", names, want)
+	}
+}
+
+func TestPruneLogBackups(t *testing.T) {
+	files := map[string]int{
+		"ijs.log":                            400,
+		"ijs-2024-01-01T10-00-00.000.log.gz": 100,
+		"ijs-2024-02-01T10-00-00.000.log.gz": 200,
+		"ijs-2024-03-01T10-00-00.000.log":    300,
+		"unrelated.txt":                      5000,
+	}
+	tests := []struct {
+		name        string
+		budget      int64
+		wantRemoved []string
+		wantLeft    []string
+	}{
+		{
+			name:     "under budget",
+			budget:   1000,
+			wantLeft: []string{"ijs-2024-01-01T10-00-00.000.log.gz", "ijs-2024-02-01T10-00-00.000.log.gz", "ijs-2024-03-01T10-00-00.000.log", "ijs.log", "unrelated.txt"},
+		},
+		{
+			name:        "oldest removed",
+			budget:      900,
+			wantRemoved: []string{"ijs-2024-01-01T10-00-00.000.log.gz"},
+			wantLeft:    []string{"ijs-2024-02-01T10-00-00.000.log.gz", "ijs-2024-03-01T10-00-00.000.log", "ijs.log", "unrelated.txt"},
+		},
+		{
+			name:        "until under budget",
+			budget:      750,
+			wantRemoved: []string{"ijs-2024-01-01T10-00-00.000.log.gz", "ijs-2024-02-01T10-00-00.000.log.gz"},
+			wantLeft:    []string{"ijs-2024-03-01T10-00-00.000.log", "ijs.log", "unrelated.txt"},
+		},
+		{
+			name:        "live file over budget",
+			budget:      200,
+			wantRemoved: []string{"ijs-2024-01-01T10-00-00.000.log.gz", "ijs-2024-02-01T10-00-00.000.log.gz", "ijs-2024-03-01T10-00-00.000.log"},
+			wantLeft:    []string{"ijs.log", "unrelated.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeLogFiles(t, dir, files)
+			removed, err := pruneLogBackups(filepath.Join(dir, "ijs.log"), tt.budget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, path := range removed {
+				names = append(names, filepath.Base(path))
+			}
+			if !reflect.DeepEqual(names, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", names, tt.wantRemoved)
+			}
+			if left := remainingFiles(t, dir); !reflect.DeepEqual(left, tt.wantLeft) {
+				t.Errorf("left = %v, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestPruneLogBackupsMissingDir(t *testing.T) {
+	if _, err := pruneLogBackups(filepath.Join(t.TempDir(), "gone", "ijs.log"), 1); err == nil {
+		t.Fatal("expected an error for a missing log directory")
+	}
+}
@@ -36,14 +36,24 @@ For example:
 
 func main() {
 
+	ParseFlags()
+
 	initializeLogging()
 
 	initializeConfig()
 
+	initializeLogBudget()
+
+	initializeTracing()
+
 	initializeScriptManager()
 
+	initializeMetrics()
+
 	initializeWebServer(false, "", "")
 
+	handleReloadSignal()
+
 	handleGraceFullShutdown()
 
 }
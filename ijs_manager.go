@@ -4,21 +4,34 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"runtime"
-	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/grafana/sobek"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 // Custom Errors
 var (
-	ErrScriptTimeout     = errors.New("script execution timed out")
-	ErrScriptTooLarge    = errors.New("script size exceeds maximum limit")
-	ErrNoWorkerAvailable = errors.New("no worker available to process script")
+	ErrScriptTimeout      = errors.New("script execution timed out")
+	ErrScriptTooLarge     = errors.New("script size exceeds maximum limit")
+	ErrNoWorkerAvailable  = errors.New("no worker available to process script")
+	ErrQueueWaitExceeded  = errors.New("script waited in the queue past the maximum wait")
+	ErrShuttingDown       = errors.New("server is shutting down")
+	ErrTooManyGlobals     = errors.New("script defined too many global variables")
+	ErrResultTooLarge     = errors.New("script result exceeds maximum size")
+	ErrResultArrayTooLong = errors.New("script result holds an array over the maximum length")
+	ErrCompileFailed      = errors.New("script compilation failed")
+	ErrWorkerPanic        = errors.New("worker panic")
+	ErrCallStackExceeded  = errors.New("maximum call stack size exceeded")
+	ErrMemoryLimit        = errors.New("script cancelled, memory limit exceeded")
 )
 
 // Global Variables
@@ -28,7 +41,7 @@ var (
 
 // Restricted Globals for the VM Environment
 var restrictedGlobals = []string{
-	"eval", "process", "child_process", "require", "global", "globalThis",
+	"eval", "Function", "process", "child_process", "require", "global", "globalThis",
 	"window", "self", "module", "exports", "__dirname", "__filename",
 	"XMLHttpRequest", "fetch", "WebSocket", "Object.defineProperty",
 	"Object.create", "Proxy", "exec", "execSync", "spawn", "fs",
@@ -42,24 +55,85 @@ type ScriptManager struct {
 	sync.RWMutex
 	runningScripts  map[string]RunningScriptInfo
 	maxScriptSize   int64
-	jobQueue        chan ScriptJob
-	workerSem       chan struct{}
+	normalLane      *workerLane
+	priorityLane    *workerLane                // nil when no priority workers are configured
+	shared          atomic.Pointer[sharedData] // reference data and preamble, swapped as a whole by reload
+	reloads         uint64                     // successful reloads, part of the result cache key
+	store           ScriptStore                // nil when no script store is configured
 	cond            *sync.Cond
 	scriptCounter   uint64
-	acceptingScript int32 // 1 means true, toggled off/on
+	compileCount    uint64        // scripts compiled ahead of execution
+	compileSem      chan struct{} // bounds compilations in flight, nil when unbounded
+	abandoned       uint64        // executions given up on past hard_kill_timeout
+	stuckWorkers    uint64        // workers flagged by the watchdog, each job counted once
+	stuckNow        int64         // workers stuck at the last watchdog check
+	workersMu       sync.Mutex
+	workers         map[*workerProgress]struct{} // progress of every live worker
+	limiter         *rate.Limiter                // paces script starts, nil when unthrottled
+	executions      rateMeter
+	timings         runtimeTimings
+	failures        *failureRing      // last failed executions, nil when not captured
+	results         *resultCache      // results of pure scripts, nil when caching is off
+	jobs            *jobTable         // async jobs submitted through /jobs
+	sessions        *sessionTable     // nil when sessions are disabled
+	repls           *replTable        // nil when the REPL is disabled
+	spills          *spillTable       // results spilled to disk, nil when spilling is off
+	execMetrics     *executionMetrics // per label execution metrics, nil until initialized
+	acceptingScript int32             // 1 means true, toggled off/on
+	cpuPressure     int32             // 1 while the CPU monitor degrades service
+	done            chan struct{}
+	shutdownOnce    sync.Once
+}
 
+// workerLane is a job queue served by its own dedicated set of workers
+type workerLane struct {
+	name      string
+	jobQueue  *laneQueue
+	workerSem chan struct{}
+	rejected  uint64 // jobs turned away because the queue was full
 }
 
 // ScriptJob represents a script job in the queue
 type ScriptJob struct {
 	Script     string
+	Priority   bool              // run on the priority lane when one is configured
+	Input      interface{}       // exposed to the script as the input global when set
+	Now        time.Time         // fixed time seen by Date when set, real time otherwise
+	Seed       *int64            // seeds Math.random when set
+	Origin     string            // client the job comes from, used by the wfq scheduling policy
+	Location   *time.Location    // local time zone of Date when set, the server one otherwise
+	LogsOn     string            // when the console output is returned: always, error (the default) or never
+	Timeout    time.Duration     // script_timeout of this job, scaled to its input, 0 for script_timeout
+	Labels     map[string]string // metric_labels the execution metrics of the job carry
 	ResultChan chan ScriptResult
+
+	program   *sobek.Program // precompiled Script, run instead of parsing Script again
+	shared    *sharedData    // reference data and preamble of the execution, the current ones when nil
+	id        string         // script_id in runningScripts, assigned by the worker
+	jobID     string         // async job the script reports progress to, "" for synchronous requests
+	session   *session       // store behind the session global, nil without a session_id
+	repl      *replSession   // REPL session the script runs in as its next snippet, nil for a stateless run
+	spillable bool           // results over max_result_bytes may be spilled to disk instead of failing
+
+	ctx       context.Context // request context, cancels the job when the caller goes away
+	queuedAt  time.Time       // when the job was handed to its lane, max_queue_wait counts from there
+	queueSpan trace.Span      // covers the time spent waiting in the queue
 }
 
 // ScriptResult represents the result of script execution
 type ScriptResult struct {
-	Result interface{}
-	Error  error
+	Result      interface{}
+	Error       error
+	Status      int           // HTTP status requested by the script through setStatus, 0 when unset
+	ContentType string        // content type requested by the script through setContentType, "" for JSON
+	Spill       bool          // over max_result_bytes, to be served from a spill file
+	Logs        []ConsoleLine // console output, as far as the job's LogsOn lets through
+
+	LogsTruncated bool // console output went over consoleMaxBytes, later lines were dropped
+
+	Duration   time.Duration // time the script ran, zero when it did not run
+	AllocBytes uint64        // bytes allocated by the process while the script ran
+	Stages     StageTimings  // Duration and the queue wait split by stage
 }
 
 // RunningScriptInfo stores information about a running script
@@ -67,39 +141,124 @@ type RunningScriptInfo struct {
 	cancelFunc context.CancelFunc
 	vm         *sobek.Runtime
 	script     string
+	lane       *workerLane
+	started    time.Time
+	origin     string // client the script was sent by, see requestOrigin
 }
 
 // Initialize the script manager
 func initializeScriptManager() {
-	scriptManager = NewScriptManager(config.MaxScriptSize, config.WorkerPoolSize)
+	fair := config.SchedulingPolicy == "wfq"
+	scriptManager = NewScriptManager(config.MaxScriptSize,
+		LaneConfig{Workers: config.WorkerPoolSize, QueueSize: config.QueueSize, Fair: fair},
+		LaneConfig{Workers: config.PriorityWorkers, QueueSize: config.PriorityQueueSize, Fair: fair})
+
+	shared, err := scriptManager.loadShared()
+	if err != nil {
+		logrus.Fatalf("Error loading reference data and preamble: %v", err)
+	}
+	scriptManager.shared.Store(shared)
+
+	store, err := newScriptStore(config)
+	if err != nil {
+		logrus.Fatalf("Error creating script store: %v", err)
+	}
+	scriptManager.store = store
+	jobStore, err := newJobStore(config)
+	if err != nil {
+		logrus.Fatalf("Error creating job store: %v", err)
+	}
+	scriptManager.jobs = newJobTable(jobStore)
+	scriptManager.limiter = newExecutionLimiter(config.MaxExecutionsPerSecond)
+	if config.LogFailureThreshold > 0 && fileLogGuard != nil {
+		fileLogGuard.watch(scriptManager, config.LogFailureThreshold)
+	}
+	if config.MaxConcurrentCompiles > 0 {
+		scriptManager.compileSem = make(chan struct{}, config.MaxConcurrentCompiles)
+	}
+	if config.FailureCapture > 0 {
+		scriptManager.failures = newFailureRing(config.FailureCapture, config.FailureCaptureBodies)
+	}
+	if config.EnableResultCache {
+		scriptManager.results = newResultCache(config.ResultCacheSize, config.ResultCacheTTL)
+	}
+	if config.EnableSessions {
+		scriptManager.sessions = newSessionTable()
+	}
+	if config.EnableRepl {
+		scriptManager.repls = newReplTable()
+		go scriptManager.repls.expireLoop(config.ReplTTL, scriptManager.done)
+	}
+	scriptManager.execMetrics = newExecutionMetrics(config.MetricLabels, config.MaxLabelValues)
+	if config.SpillDir != "" {
+		spills, err := newSpillTable(config.SpillDir, config.SpillTTL, config.SpillMaxTotalBytes)
+		if err != nil {
+			logrus.Fatalf("Error creating spill directory: %v", err)
+		}
+		scriptManager.spills = spills
+		go spills.expireLoop(scriptManager.done)
+	}
+	if config.WarmupScript != "" {
+		scriptManager.warmupFromFile(config.WarmupScript, config.WarmupRuns)
+	}
 
 	totalCPUs := runtime.NumCPU()
 	limitedCPUs := max(1, totalCPUs/2)
 	runtime.GOMAXPROCS(limitedCPUs)
 
 	logrus.WithFields(logrus.Fields{
-		"Memory Limit (MB)": config.MaxMemoryMB,
-		"Max Script Size":   config.MaxScriptSize,
-		"CPU Usage":         fmt.Sprintf("%d/%d CPUs", limitedCPUs, totalCPUs),
+		"Memory Limit (MB)":  config.MaxMemoryMB,
+		"Max Script Size":    config.MaxScriptSize,
+		"Workers":            config.WorkerPoolSize,
+		"Priority Workers":   config.PriorityWorkers,
+		"Queue Size":         scriptManager.normalLane.jobQueue.Cap(),
+		"Scheduling Policy":  config.SchedulingPolicy,
+		"Reference Datasets": len(shared.refData),
+		"Preamble":           config.PreambleFile,
+		"CPU Usage":          fmt.Sprintf("%d/%d CPUs", limitedCPUs, totalCPUs),
 	}).Info("ScriptManager configuration initialized")
 }
 
-// NewScriptManager creates and initializes a new ScriptManager
-func NewScriptManager(maxScriptSize int64, workerCount int) *ScriptManager {
+// LaneConfig sizes a worker lane. A QueueSize of 0 gives the lane one queue slot
+// per worker.
+type LaneConfig struct {
+	Workers   int
+	QueueSize int
+	Fair      bool // schedule queued jobs round-robin across origins instead of FIFO
+}
+
+// NewScriptManager creates and initializes a new ScriptManager. The priority
+// lane workers are reserved for priority jobs, 0 workers sends priority jobs to
+// the normal lane.
+func NewScriptManager(maxScriptSize int64, normal LaneConfig, priority LaneConfig) *ScriptManager {
 	sm := &ScriptManager{
 		runningScripts:  make(map[string]RunningScriptInfo),
 		maxScriptSize:   maxScriptSize,
-		jobQueue:        make(chan ScriptJob, workerCount),
-		workerSem:       make(chan struct{}, workerCount),
+		normalLane:      newWorkerLane("normal", normal),
 		acceptingScript: 1,
+		jobs:            newJobTable(newMemoryJobStore()),
+		workers:         make(map[*workerProgress]struct{}),
+		done:            make(chan struct{}),
 	}
 	sm.cond = sync.NewCond(&sm.RWMutex)
 
-	for i := 0; i < workerCount; i++ {
-		go sm.worker()
+	if priority.Workers > 0 {
+		sm.priorityLane = newWorkerLane("priority", priority)
 	}
 
-	go sm.memoryMonitor()
+	for _, lane := range sm.lanes() {
+		for i := 0; i < cap(lane.workerSem); i++ {
+			go sm.worker(lane)
+		}
+	}
+
+	go newMemoryMonitor(sm, readAllocBytes, systemClock{}).run()
+	if config.CPUPressurePolicy == cpuPressureThrottle || config.CPUPressurePolicy == cpuPressureShed {
+		go newCPUMonitor(sm, readLoadPerCPU, systemClock{}).run()
+	}
+	if config.WatchdogInterval > 0 {
+		go newWatchdog(sm, systemClock{}).run()
+	}
 	return sm
 }
 
@@ -116,91 +275,280 @@ func (sm *ScriptManager) setAcceptingScript(v bool) {
 	}
 }
 
-// Worker processes jobs from the jobQueue
-func (sm *ScriptManager) worker() {
+func newWorkerLane(name string, cfg LaneConfig) *workerLane {
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = cfg.Workers
+	}
+	return &workerLane{
+		name:      name,
+		jobQueue:  newLaneQueue(queueSize, cfg.Fair),
+		workerSem: make(chan struct{}, cfg.Workers),
+	}
+}
+
+// lanes returns the configured worker lanes
+func (sm *ScriptManager) lanes() []*workerLane {
+	if sm.priorityLane == nil {
+		return []*workerLane{sm.normalLane}
+	}
+	return []*workerLane{sm.normalLane, sm.priorityLane}
+}
+
+// laneFor picks the lane a job runs on
+func (sm *ScriptManager) laneFor(job ScriptJob) *workerLane {
+	if job.Priority && sm.priorityLane != nil {
+		return sm.priorityLane
+	}
+	return sm.normalLane
+}
+
+// Worker processes jobs from the jobQueue of its lane
+func (sm *ScriptManager) worker(lane *workerLane) {
+	// The job being executed, answered here if the worker panics so its caller does not hang
+	var inFlight *ScriptJob
+	var inFlightCancel context.CancelFunc
+	progress := sm.trackWorker(lane)
+
 	defer func() {
+		sm.untrackWorker(progress)
 		if r := recover(); r != nil {
 			logrus.WithField("panic", r).Error("Worker panic")
+			if inFlight != nil {
+				inFlightCancel()
+				<-lane.workerSem
+				inFlight.reject(fmt.Errorf("%w: %v", ErrWorkerPanic, r))
+			}
+		}
+		if sm.isShuttingDown() {
+			logrus.Info("Worker exiting due to shutdown")
+			return
 		}
 		logrus.Info("Worker exiting. Spawning a replacement...")
-		go sm.worker() // Maintain pool size
+		go sm.worker(lane) // Maintain pool size
 	}()
 
-	for job := range sm.jobQueue {
-		ctx, cancel := context.WithTimeout(context.Background(), config.ScriptTimeout)
-		sm.workerSem <- struct{}{}
+	for {
+		select {
+		case <-sm.done:
+			return
+		case <-lane.jobQueue.ready:
+		}
+		job, ok := lane.jobQueue.pop()
+		if !ok {
+			continue
+		}
 
-		logrus.WithField("script_length", len(job.Script)).Info("Worker executing script")
-		result := sm.executeScript(ctx, job.Script, cancel)
-		<-sm.workerSem
+		job.queueSpan.End()
+
+		// Shutdown may have started while the job was waiting in the queue
+		if sm.isShuttingDown() {
+			job.reject(ErrShuttingDown)
+			continue
+		}
+
+		// The caller may have given up while the job was queued
+		if err := job.ctx.Err(); err != nil {
+			job.reject(err)
+			continue
+		}
+
+		// Wait for our turn when starts are throttled, until the caller gives up.
+		// Wait fails at once when the turn comes after the deadline of the caller,
+		// that job is overloaded as if it had waited in the queue
+		if sm.limiter != nil {
+			if err := sm.limiter.Wait(job.ctx); err != nil {
+				if ctxErr := job.ctx.Err(); ctxErr != nil {
+					err = ctxErr
+				} else {
+					err = fmt.Errorf("%w: its turn under max_executions_per_second is after its deadline", ErrQueueWaitExceeded)
+				}
+				job.reject(err)
+				continue
+			}
+		}
+
+		// A job that waited too long is failed as an overload, script_timeout
+		// only counts from here, so a slow script is told apart from a busy server
+		if wait := time.Since(job.queuedAt); config.MaxQueueWait > 0 && wait > config.MaxQueueWait {
+			logrus.WithFields(logrus.Fields{
+				"lane": lane.name,
+				"wait": wait,
+			}).Warn("Script waited in the queue past max_queue_wait")
+			job.reject(fmt.Errorf("%w: waited %s, the limit is %s", ErrQueueWaitExceeded, wait.Round(time.Millisecond), config.MaxQueueWait))
+			continue
+		}
+		sm.executions.mark()
+		queueWait := time.Since(job.queuedAt)
+
+		timeout := config.ScriptTimeout
+		if job.Timeout > 0 {
+			timeout = job.Timeout
+		}
+		timeout = jitterTimeout(timeout)
+		ctx, cancel := context.WithTimeout(job.ctx, timeout)
+		ctx, span := tracer.Start(ctx, "execution", trace.WithAttributes(
+			attribute.String("lane", lane.name),
+		))
+		lane.workerSem <- struct{}{}
+		inFlight, inFlightCancel = &job, cancel
+
+		logrus.WithFields(logrus.Fields{
+			"script_length": len(job.Script),
+			"lane":          lane.name,
+			"timeout":       timeout,
+		}).Info("Worker executing script")
+		job.id = fmt.Sprintf("script-%d", atomic.AddUint64(&sm.scriptCounter, 1))
+		progress.start(job.id)
+		result, _ := sm.executeBounded(ctx, job, cancel)
+		result.Stages.Queue = queueWait
+		progress.finish()
+		if sm.execMetrics != nil {
+			sm.execMetrics.observe(job.Labels, result)
+		}
+		<-lane.workerSem
+		inFlight, inFlightCancel = nil, nil
+		endSpanWithError(span, result.Error)
+		if result.Error != nil && sm.failures != nil {
+			sm.failures.record(job, result.Error)
+		}
 
 		job.ResultChan <- result
 		close(job.ResultChan)
 	}
 }
 
-// Stop cancels all running scripts and resets the job queue
+// Stop fails all queued jobs and cancels all running scripts
 func (sm *ScriptManager) Stop() {
-	sm.cancelAllScripts()
+	sm.Shutdown()
+	sm.cancelAllScripts(ErrShuttingDown)
 }
 
-// ExecuteScript processes a script with a timeout
-func (sm *ScriptManager) ExecuteScriptWithTimeout(js string) (interface{}, error) {
-	if int64(len(js)) > sm.maxScriptSize {
-		logrus.Warn("Script size exceeds maximum limit")
-		return nil, ErrScriptTooLarge
-	}
-
-	resultChan := make(chan ScriptResult, 1)
-	job := ScriptJob{Script: js, ResultChan: resultChan}
+// Shutdown stops the workers from picking up new jobs and fails every job still
+// waiting in the queue with ErrShuttingDown, so their callers return immediately.
+// Scripts that are already running are left alone.
+func (sm *ScriptManager) Shutdown() {
+	sm.shutdownOnce.Do(func() {
+		// Taking the write lock guarantees no submitter is between its
+		// shutdown check and its send, so nothing can enter the queue after the drain
+		sm.Lock()
+		close(sm.done)
+		sm.Unlock()
+
+		for _, lane := range sm.lanes() {
+			drained := lane.jobQueue.drain()
+			for _, job := range drained {
+				job.reject(ErrShuttingDown)
+			}
+			logrus.WithFields(logrus.Fields{
+				"lane":         lane.name,
+				"drained_jobs": len(drained),
+			}).Info("Job queue drained")
+		}
+	})
+}
 
+func (sm *ScriptManager) isShuttingDown() bool {
 	select {
-	case sm.jobQueue <- job:
-		logrus.WithField("script_length", len(js)).Info("Script queued for execution")
+	case <-sm.done:
+		return true
 	default:
-		logrus.Warn("No available worker for script execution")
-		return nil, ErrNoWorkerAvailable
+		return false
 	}
+}
 
-	result := <-resultChan
+// reject sends err back to the submitter of a job that will not be executed
+func (job ScriptJob) reject(err error) {
+	job.ResultChan <- ScriptResult{Error: err}
+	close(job.ResultChan)
+}
+
+// ExecuteScript processes a script with a timeout
+func (sm *ScriptManager) ExecuteScriptWithTimeout(js string) (interface{}, error) {
+	result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: js})
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return result.Result, nil
 }
 
-// Memory Monitor manages resource usage and cancels scripts if memory limits are exceeded
-func (sm *ScriptManager) memoryMonitor() {
-	var overLimitStart int64
-	for {
-		time.Sleep(100 * time.Millisecond)
-		memStats := &runtime.MemStats{}
-		runtime.ReadMemStats(memStats)
-
-		limitBytes := uint64(config.MaxMemoryMB) << 20
-		if memStats.Alloc > limitBytes {
-			if sm.GetAcceptingScript() {
-				sm.setAcceptingScript(false)
-				logrus.WithFields(logrus.Fields{
-					"usage_mb": memStats.Alloc >> 20,
-					"limit_mb": config.MaxMemoryMB,
-				}).Warn("Memory usage exceeded limit. Cancelling all scripts...")
-				sm.cancelAllScripts()
-			}
-			overLimitStart = sm.enforceMemoryLimit(overLimitStart)
-		} else if overLimitStart != 0 {
-			sm.resetMemoryUsage()
-			overLimitStart = 0
+// ExecuteScriptWithContext queues a job on its lane and waits for its result.
+// Cancelling ctx abandons the job if it is still queued and interrupts it if it is running.
+func (sm *ScriptManager) ExecuteScriptWithContext(ctx context.Context, job ScriptJob) ScriptResult {
+	if int64(len(job.Script)) > sm.maxScriptSize {
+		logrus.Warn("Script size exceeds maximum limit")
+		return ScriptResult{Error: ErrScriptTooLarge}
+	}
+
+	// A precompiled job was checked when it was compiled
+	if job.program == nil {
+		if err := checkEncoding(job.Script); err != nil {
+			logrus.WithError(err).Warn("Rejected script with invalid encoding")
+			return ScriptResult{Error: err}
+		}
+		if err := checkDeniedPatterns(job.Script, config.DeniedPatterns); err != nil {
+			logrus.WithError(err).Warn("Rejected script containing a denied pattern")
+			return ScriptResult{Error: err}
 		}
+		if err := checkBannedSyntax(job.Script, config.BannedSyntax); err != nil {
+			logrus.WithError(err).Warn("Rejected script using banned syntax")
+			return ScriptResult{Error: err}
+		}
+	}
+
+	resultChan := make(chan ScriptResult, 1)
+	job.ResultChan = resultChan
+	job.ctx = ctx
+	job.queuedAt = time.Now()
+	lane := sm.laneFor(job)
+	_, job.queueSpan = tracer.Start(ctx, "queue wait", trace.WithAttributes(
+		attribute.String("lane", lane.name),
+	))
+
+	if err := sm.enqueue(ctx, lane, job); err != nil {
+		endSpanWithError(job.queueSpan, err)
+		switch {
+		case errors.Is(err, ErrShuttingDown):
+			logrus.Warn("Rejected script as the server is shutting down")
+		case errors.Is(err, ErrNoWorkerAvailable):
+			atomic.AddUint64(&lane.rejected, 1)
+			logrus.WithField("lane", lane.name).Warn("No available worker for script execution")
+		case errors.Is(err, ErrCPUPressure):
+			atomic.AddUint64(&lane.rejected, 1)
+			logrus.WithField("lane", lane.name).Warn("Rejected script as the CPU is under pressure")
+		default:
+			logrus.WithError(err).Warn("Caller gave up while waiting for a queue slot")
+		}
+		return ScriptResult{Error: err}
+	}
+	logrus.WithFields(logrus.Fields{
+		"script_length": len(job.Script),
+		"lane":          lane.name,
+	}).Info("Script queued for execution")
+
+	return <-resultChan
+}
+
+// cancelScript interrupts the running script id with reason, which is returned
+// as its error when reason is one. It reports whether the script was running.
+func (sm *ScriptManager) cancelScript(id string, reason interface{}) bool {
+	sm.RLock()
+	entry, ok := sm.runningScripts[id]
+	sm.RUnlock()
+	if ok {
+		entry.vm.Interrupt(reason)
 	}
+	return ok
 }
 
-func (sm *ScriptManager) cancelAllScripts() {
+// cancelAllScripts interrupts every running script, reason being returned as
+// their error
+func (sm *ScriptManager) cancelAllScripts(reason error) {
 	sm.Lock()
 	defer sm.Unlock()
 	for id, entry := range sm.runningScripts {
 		logrus.WithField("script_id", id).Warn("Cancelling script")
-		entry.vm.Interrupt("Script cancelled")
+		entry.vm.Interrupt(reason)
 		if entry.cancelFunc != nil {
 			entry.cancelFunc()
 		}
@@ -209,16 +557,90 @@ func (sm *ScriptManager) cancelAllScripts() {
 	logrus.Warn("All scripts cancelled")
 }
 
-func (sm *ScriptManager) executeScript(ctx context.Context, js string, cancel context.CancelFunc) ScriptResult {
-	vm := sobek.New()
+// CancelByOrigin interrupts every running script sent by origin, leaving the
+// scripts of other clients running, and returns how many it cancelled
+func (sm *ScriptManager) CancelByOrigin(origin string) int {
+	sm.Lock()
+	defer sm.Unlock()
+	cancelled := 0
+	for id, entry := range sm.runningScripts {
+		if entry.origin != origin {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"script_id": id,
+			"origin":    origin,
+		}).Warn("Cancelling script")
+		entry.vm.Interrupt(ErrScriptCancelled)
+		if entry.cancelFunc != nil {
+			entry.cancelFunc()
+		}
+		delete(sm.runningScripts, id)
+		cancelled++
+	}
+	return cancelled
+}
+
+func (sm *ScriptManager) executeScript(ctx context.Context, job ScriptJob, cancel context.CancelFunc) ScriptResult {
+	js := job.Script
+	setupStart := time.Now()
+	vm := newRuntime()
+	if job.shared == nil {
+		job.shared = sm.currentShared()
+	}
+
+	out := &scriptOutput{}
+	sm.installHostFunctions(vm, ctx, job, out)
+	sm.timings.vmSetup.observe(time.Since(setupStart))
+	rejections := trackRejections(vm)
+	promises := newPromiseResolver(vm)
+
+	if job.Input != nil {
+		// The script gets its own copy, the caller's input may be cached or recorded
+		input, err := deepClone(job.Input, config.MaxInputDepth)
+		if err != nil {
+			return ScriptResult{Error: err}
+		}
+		vm.Set("input", input)
+	}
 
-	// Restrict environment
-	for _, global := range restrictedGlobals {
-		vm.Set(global, nil)
+	if !job.Now.IsZero() {
+		now := job.Now
+		vm.SetTimeSource(func() time.Time { return now })
 	}
 
-	// Generate a unique script ID
-	id := fmt.Sprintf("script-%d", atomic.AddUint64(&sm.scriptCounter, 1))
+	if job.Location != nil {
+		installTimezone(vm, job.Location)
+	}
+
+	if job.Seed != nil {
+		vm.SetRandSource(rand.New(rand.NewSource(*job.Seed)).Float64)
+	}
+
+	if err := runPreamble(vm, job.shared); err != nil {
+		return ScriptResult{Error: err}
+	}
+
+	// Keep our own reference so the script cannot replace JSON.stringify to dodge the size check
+	stringify, _ := sobek.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+
+	// Snapshot the globals so the ones added by the script can be counted
+	baseGlobals := make(map[string]struct{})
+	for _, key := range vm.GlobalObject().GetOwnPropertyNames() {
+		baseGlobals[key] = struct{}{}
+	}
+
+	if config.FreezeGlobal {
+		if err := freezeGlobal(vm); err != nil {
+			return ScriptResult{Error: fmt.Errorf("cannot freeze the global object: %w", err)}
+		}
+	}
+
+	// Workers assign the ID, nested runScript calls get one here
+	id := job.id
+	if id == "" {
+		id = fmt.Sprintf("script-%d", atomic.AddUint64(&sm.scriptCounter, 1))
+	}
 
 	// Store the VM and cancelFunc
 	sm.Lock()
@@ -226,13 +648,52 @@ func (sm *ScriptManager) executeScript(ctx context.Context, js string, cancel co
 		cancelFunc: cancel,
 		vm:         vm,
 		script:     js,
+		lane:       sm.laneFor(job),
+		started:    time.Now(),
+		origin:     job.Origin,
 	}
 	sm.Unlock()
+	if job.jobID != "" {
+		sm.jobs.markRunning(job.jobID)
+	}
 
 	resultChan := make(chan ScriptResult, 1)
+	start, allocStart := time.Now(), heapAllocBytes()
+	// Written by the goroutine before it sends its result
+	var stages StageTimings
 
 	go func() {
+		// With lock_os_thread the script has an OS thread to itself while it
+		// runs, it runs on this goroutine, not the one of the worker
+		if config.LockOSThread {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+		}
+
+		// Stages are set before the result is sent, which orders them before its receipt
+		var runStart, encodeStart time.Time
+		send := func(result ScriptResult) {
+			now := time.Now()
+			switch {
+			case !encodeStart.IsZero():
+				stages.Exec, stages.Encode = encodeStart.Sub(runStart), now.Sub(encodeStart)
+			case !runStart.IsZero():
+				stages.Exec = now.Sub(runStart)
+			}
+			resultChan <- result
+		}
+
 		defer func() {
+			// The worker's recover does not reach this goroutine, a panic here
+			// would take the whole process down. Every path sends as it returns,
+			// so a panic means nothing was sent yet.
+			if r := recover(); r != nil {
+				logrus.WithFields(logrus.Fields{
+					"script_id": id,
+					"panic":     r,
+				}).Error("Script execution panic")
+				send(ScriptResult{Error: fmt.Errorf("%w: %v", ErrWorkerPanic, r)})
+			}
 			// Once done, remove from runningScripts
 			sm.Lock()
 			delete(sm.runningScripts, id)
@@ -240,46 +701,169 @@ func (sm *ScriptManager) executeScript(ctx context.Context, js string, cancel co
 			vm = nil
 		}()
 
-		value, err := vm.RunString(js)
+		stopAllocations := watchAllocations(vm, config.MaxScriptAllocMB, allocStart)
+		defer stopAllocations()
+
+		// Compile separately so syntax errors are told apart from exceptions
+		program := job.program
+		if program == nil {
+			var err error
+			parseStart := time.Now()
+			program, err = sm.compileScript(js)
+			stages.Parse = time.Since(parseStart)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"script_id": id,
+					"error":     err,
+				}).Warn("Script failed to compile")
+				send(ScriptResult{Error: err})
+				return
+			}
+		}
+		runStart = time.Now()
+		stopBudget := watchRunTimeBudget(vm, config.MaxRunTime)
+		defer stopBudget()
+		value, err := vm.RunProgram(program)
+		sm.timings.run.observe(time.Since(runStart))
+		if cause := interruptCause(err); cause != nil {
+			logrus.WithFields(logrus.Fields{
+				"script_id": id,
+				"error":     cause,
+			}).Warn("Script interrupted")
+			send(ScriptResult{Error: cause})
+			return
+		}
+		if overflow, ok := err.(*sobek.StackOverflowError); ok {
+			logrus.WithFields(logrus.Fields{
+				"script_id": id,
+				"limit":     config.MaxCallStack,
+			}).Warn("Script exceeded the call stack limit")
+			send(ScriptResult{Error: fmt.Errorf("%w: %s", ErrCallStackExceeded, strings.TrimSpace(overflow.Error()))})
+			return
+		}
 		if err != nil {
+			// Logging the raw exception would run the toString of the thrown value
+			err = thrownError(vm, err)
 			logrus.WithFields(logrus.Fields{
 				"script_id": id,
 				"error":     err,
 			}).Error("Script execution failed")
-			resultChan <- ScriptResult{Error: fmt.Errorf("script execution failed: %w", err)}
+			send(ScriptResult{Error: err})
+			return
+		}
+		if value, err = promises.settle(value); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"script_id": id,
+				"error":     err,
+			}).Error("Script promise did not resolve")
+			send(ScriptResult{Error: err})
+			return
+		}
+		if err := rejections.err(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"script_id": id,
+				"error":     err,
+			}).Error("Script left a promise rejection unhandled")
+			send(ScriptResult{Error: err})
+			return
+		}
+		if config.MaxUserGlobals > 0 {
+			added := 0
+			for _, key := range vm.GlobalObject().GetOwnPropertyNames() {
+				if _, ok := baseGlobals[key]; !ok {
+					added++
+				}
+			}
+			if added > config.MaxUserGlobals {
+				logrus.WithFields(logrus.Fields{
+					"script_id": id,
+					"globals":   added,
+					"limit":     config.MaxUserGlobals,
+				}).Warn("Script defined too many globals")
+				send(ScriptResult{Error: ErrTooManyGlobals})
+				return
+			}
+		}
+		encodeStart = time.Now()
+		err = checkResultSize(vm, stringify, value, config.MaxResultBytes)
+		spill := false
+		if errors.Is(err, ErrResultTooLarge) && job.spillable {
+			// Too large to send inline, still small enough to be spilled to disk
+			err = checkResultSize(vm, stringify, value, config.SpillMaxBytes)
+			spill = err == nil
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"script_id": id,
+				"error":     err,
+			}).Warn("Script result rejected")
+			send(ScriptResult{Error: err})
+			return
+		}
+		exported, err := exportResult(vm, value)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"script_id": id,
+				"error":     err,
+			}).Warn("Script result could not be exported")
+			send(ScriptResult{Error: err})
+			return
+		}
+		if err := checkArrayLengths(exported, config.MaxArrayLength); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"script_id": id,
+				"limit":     config.MaxArrayLength,
+			}).Warn("Script result rejected")
+			send(ScriptResult{Error: fmt.Errorf("%w: %v", ErrResultArrayTooLong, err)})
 			return
 		}
 		logrus.WithField("script_id", id).Info("Script completed successfully")
-		resultChan <- ScriptResult{Result: value.Export()}
+		send(ScriptResult{
+			Result:      exported,
+			Status:      out.status,
+			ContentType: out.contentType,
+			Spill:       spill,
+		})
 	}()
 
+	var result ScriptResult
 	select {
-	case result := <-resultChan:
-		return result
+	case result = <-resultChan:
 	case <-ctx.Done():
-		// Context cancelled: Interrupt the script
-		logrus.WithField("script_id", id).Warn("Interrupting script due to context cancellation")
-		vm.Interrupt("canceled by context")
-		return <-resultChan
+		// Context cancelled: Interrupt the script, unless cancelAllScripts
+		// already did and removed it, keeping the reason it gave
+		sm.RLock()
+		_, running := sm.runningScripts[id]
+		sm.RUnlock()
+		if running {
+			logrus.WithField("script_id", id).Warn("Interrupting script due to context cancellation")
+			reason := ctx.Err()
+			if errors.Is(reason, context.DeadlineExceeded) {
+				reason = ErrScriptTimeout
+			}
+			vm.Interrupt(reason)
+		}
+		result = <-resultChan
 	}
+	result.Duration = time.Since(start)
+	result.AllocBytes = heapAllocBytes() - allocStart
+	result.Stages = stages
+	if out.logs != nil {
+		result.Logs = logsFor(job.LogsOn, result.Error != nil, out.logs.lines)
+		result.LogsTruncated = out.logs.truncated
+	}
+	return result
 }
 
-func (sm *ScriptManager) resetMemoryUsage() {
-	logrus.Info("Memory usage back to normal. Resuming script execution in 10 seconds...")
-	time.Sleep(10 * time.Second)
-	sm.setAcceptingScript(true)
-}
-
-func (sm *ScriptManager) enforceMemoryLimit(overLimitStart int64) int64 {
-	logrus.Warn("Performing garbage collection due to memory limit")
-	runtime.GC()
-	debug.FreeOSMemory()
-	if overLimitStart == 0 {
-		return time.Now().Unix()
-	}
-	if time.Now().Unix()-overLimitStart > 60 {
-		logrus.Error("Memory limit exceeded for over a minute. Restarting...")
-		restart(server, scriptManager)
+// interruptCause returns the error a script was interrupted with, such as
+// ErrRunTimeBudget, nil when err is not an interruption carrying an error.
+// sobek returns interruptions as they are, err is not unwrapped: unwrapping an
+// exception reads the thrown value, which may run script code.
+func interruptCause(err error) error {
+	interrupted, ok := err.(*sobek.InterruptedError)
+	if !ok {
+		return nil
 	}
-	return overLimitStart
+	cause, _ := interrupted.Value().(error)
+	return cause
 }
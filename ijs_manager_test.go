@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(io.Discard)
+	// The monitors of a manager run past its test, reading the config between
+	// tests, which must not look like a node out of memory
+	config = *builtinConfig()
+	os.Exit(m.Run())
+}
+
+// newTestManager sets config to the built-in defaults, changed by configure when
+// it is not nil, and starts a script manager on it. Both are undone when the
+// test ends, so tests using it must not run in parallel.
+func newTestManager(t *testing.T, configure func(*Config)) *ScriptManager {
+	t.Helper()
+	saved := config
+	config = *builtinConfig()
+	if configure != nil {
+		configure(&config)
+	}
+	sm := NewScriptManager(config.MaxScriptSize,
+		LaneConfig{Workers: config.WorkerPoolSize, QueueSize: config.QueueSize},
+		LaneConfig{Workers: config.PriorityWorkers, QueueSize: config.PriorityQueueSize})
+	t.Cleanup(func() {
+		sm.Stop()
+		config = saved
+	})
+	return sm
+}
+
+// fakeClock is a clock that only moves when told to, Sleep advancing it
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestCallStackExceeded(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		repl   bool
+	}{
+		{name: "script", script: "function f(n) { return f(n + 1) + 1 } f(0)"},
+		{name: "mutual recursion", script: "const a = n => b(n) + 1, b = n => a(n) + 1; a(0)"},
+		{name: "repl snippet", script: "function f(n) { return f(n + 1) + 1 } f(0)", repl: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.MaxCallStack = 100
+				c.ScriptTimeout = time.Second
+			})
+			job := ScriptJob{Script: tt.script}
+			if tt.repl {
+				job.repl = newTestRepl(t, sm)
+			}
+			result := sm.ExecuteScriptWithContext(context.Background(), job)
+			if !errors.Is(result.Error, ErrCallStackExceeded) {
+				t.Fatalf("error = %v, want ErrCallStackExceeded", result.Error)
+			}
+			if code := errorCode(result.Error); code != CodeCallStackExceeded {
+				t.Fatalf("code = %s, want %s", code, CodeCallStackExceeded)
+			}
+			msg, prefix := result.Error.Error(), ErrCallStackExceeded.Error()+": "
+			if !strings.HasPrefix(msg, prefix) || len(msg) == len(prefix) {
+				t.Fatalf("error = %q, want %q followed by the overflow", msg, prefix)
+			}
+			if rest := msg[len(prefix):]; rest != strings.TrimSpace(rest) {
+				t.Fatalf("error = %q, want a single space after %q", msg, ErrCallStackExceeded.Error()+":")
+			}
+			rec := httptest.NewRecorder()
+			handleExecutionError(result.Error, rec)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want 422", rec.Code)
+			}
+		})
+	}
+}
+
+// spinScript keeps a worker busy for about d, then returns 1
+func spinScript(d time.Duration) string {
+	return fmt.Sprintf("const end = Date.now() + %d; while (Date.now() < end) {} 1", d.Milliseconds())
+}
+
+// waitQueued waits for n jobs to be waiting in the queue of lane
+func waitQueued(t *testing.T, lane *workerLane, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for lane.jobQueue.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d jobs queued, want %d", lane.jobQueue.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.QueueSize = 2
+		c.ScriptTimeout = 5 * time.Second
+	})
+
+	running := make(chan ScriptResult, 1)
+	go func() {
+		running <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: spinScript(300 * time.Millisecond)})
+	}()
+	waitRunning(t, sm, 1)
+
+	queued := make(chan ScriptResult, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			queued <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"})
+		}()
+	}
+	waitQueued(t, sm.normalLane, 2)
+
+	sm.Shutdown()
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-queued:
+			if !errors.Is(result.Error, ErrShuttingDown) {
+				t.Fatalf("queued job error = %v, want ErrShuttingDown", result.Error)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("queued job not answered on shutdown")
+		}
+	}
+	if n := sm.normalLane.jobQueue.Len(); n != 0 {
+		t.Fatalf("%d jobs left in the queue", n)
+	}
+
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"}); !errors.Is(result.Error, ErrShuttingDown) {
+		t.Fatalf("job submitted after shutdown: error = %v, want ErrShuttingDown", result.Error)
+	}
+
+	// The script that was running is left to finish
+	select {
+	case result := <-running:
+		if result.Error != nil || result.Result != int64(1) {
+			t.Fatalf("running script = %v, %v, want 1", result.Result, result.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("running script did not finish")
+	}
+}
+
+func TestShutdownIdempotent(t *testing.T) {
+	sm := newTestManager(t, nil)
+	sm.Shutdown()
+	sm.Shutdown()
+	if !sm.isShuttingDown() {
+		t.Fatal("manager not shutting down")
+	}
+}
+
+func TestMaxUserGlobals(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		script  string
+		wantErr bool
+	}{
+		{name: "at the limit", limit: 2, script: "var a = 1, b = 2; a + b"},
+		{name: "var over the limit", limit: 2, script: "var a = 1, b = 2, c = 3; a + b + c", wantErr: true},
+		{name: "functions count", limit: 2, script: "var a = 1; function f() {} function g() {} a", wantErr: true},
+		{name: "implicit globals count", limit: 2, script: "x = 1; y = 2; z = 3; x", wantErr: true},
+		{name: "locals do not count", limit: 1, script: "function f() { var a = 1, b = 2, c = 3; return a + b + c } f()"},
+		{name: "unlimited", limit: 0, script: "var a, b, c, d, e; 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.MaxUserGlobals = tt.limit
+				c.ScriptTimeout = time.Second
+			})
+			result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: tt.script})
+			if got := errors.Is(result.Error, ErrTooManyGlobals); got != tt.wantErr {
+				t.Fatalf("error = %v, want ErrTooManyGlobals %v", result.Error, tt.wantErr)
+			}
+			if !tt.wantErr && result.Error != nil {
+				t.Fatal(result.Error)
+			}
+		})
+	}
+}
+
+func TestPriorityLane(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.QueueSize = 1
+		c.PriorityWorkers = 1
+		c.ScriptTimeout = 5 * time.Second
+	})
+
+	// The normal worker is busy and a normal job waits behind it
+	go sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: spinScript(3 * time.Second)})
+	waitRunning(t, sm, 1)
+	normal := make(chan ScriptResult, 1)
+	go func() {
+		normal <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "'normal'"})
+	}()
+	waitQueued(t, sm.normalLane, 1)
+
+	start := time.Now()
+	result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "'priority'", Priority: true})
+	if result.Error != nil || result.Result != "priority" {
+		t.Fatalf("priority job = %v, %v", result.Result, result.Error)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("priority job took %s, it waited for the normal lane", took)
+	}
+	select {
+	case result := <-normal:
+		t.Fatalf("normal job answered before the busy worker freed up: %v, %v", result.Result, result.Error)
+	default:
+	}
+	if n := sm.normalLane.jobQueue.Len(); n != 1 {
+		t.Fatalf("%d jobs queued on the normal lane, want 1", n)
+	}
+}
+
+func TestLaneFor(t *testing.T) {
+	tests := []struct {
+		name            string
+		priorityWorkers int
+		priority        bool
+		want            string
+	}{
+		{name: "normal job", priorityWorkers: 1, want: "normal"},
+		{name: "priority job", priorityWorkers: 1, priority: true, want: "priority"},
+		{name: "priority job without a priority lane", priorityWorkers: 0, priority: true, want: "normal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.PriorityWorkers = tt.priorityWorkers
+			})
+			if lane := sm.laneFor(ScriptJob{Priority: tt.priority}); lane.name != tt.want {
+				t.Fatalf("lane = %s, want %s", lane.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPanicAnswersJob(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.ScriptTimeout = time.Second
+	})
+	// Metrics without their collectors panic the worker once the script has run
+	sm.execMetrics = &executionMetrics{}
+
+	result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"})
+	if !errors.Is(result.Error, ErrWorkerPanic) {
+		t.Fatalf("error = %v, want ErrWorkerPanic", result.Error)
+	}
+	if code := errorCode(result.Error); code != CodeInternalError {
+		t.Fatalf("code = %s, want %s", code, CodeInternalError)
+	}
+
+	// The worker was replaced and its slot given back
+	sm.execMetrics = nil
+	result = sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "2"})
+	if result.Error != nil || result.Result != int64(2) {
+		t.Fatalf("job after the panic = %v, %v, want 2", result.Result, result.Error)
+	}
+	if n := len(sm.normalLane.workerSem); n != 0 {
+		t.Fatalf("%d worker slots still taken", n)
+	}
+}
+
+func TestMaxQueueWait(t *testing.T) {
+	// spin runs a script busy for ms milliseconds
+	spin := func(ms int) string {
+		return fmt.Sprintf("const end = Date.now() + %d; while (Date.now() < end) {}; 'done'", ms)
+	}
+	tests := []struct {
+		name      string
+		blocker   int // milliseconds the single worker is kept busy first
+		script    string
+		wantErr   error
+		wantQueue time.Duration // minimum queue wait reported for a successful run
+	}{
+		{name: "waits too long", blocker: 700, script: spin(0), wantErr: ErrQueueWaitExceeded},
+		{name: "runs too long", script: spin(2000), wantErr: ErrScriptTimeout},
+		// Waited under max_queue_wait, the script gets its whole script_timeout
+		// even though both together are over it
+		{name: "timeout counts from the start", blocker: 300, script: spin(600), wantQueue: 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.WorkerPoolSize = 1
+				c.ScriptTimeout = 800 * time.Millisecond
+				c.MaxQueueWait = 500 * time.Millisecond
+			})
+			blocked := make(chan ScriptResult, 1)
+			if tt.blocker > 0 {
+				go func() {
+					blocked <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: spin(tt.blocker)})
+				}()
+				waitRunning(t, sm, 1)
+			}
+
+			result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: tt.script})
+			if tt.wantErr != nil {
+				if !errors.Is(result.Error, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", result.Error, tt.wantErr)
+				}
+				if errors.Is(result.Error, ErrScriptTimeout) == errors.Is(result.Error, ErrQueueWaitExceeded) {
+					t.Fatalf("error = %v, want a queue wait or a timeout, not both", result.Error)
+				}
+			} else {
+				if result.Error != nil {
+					t.Fatal(result.Error)
+				}
+				if result.Stages.Queue < tt.wantQueue {
+					t.Fatalf("queue wait = %s, want at least %s", result.Stages.Queue, tt.wantQueue)
+				}
+			}
+			if tt.blocker > 0 {
+				if r := <-blocked; r.Error != nil {
+					t.Fatalf("blocking script: %v", r.Error)
+				}
+			}
+		})
+	}
+
+	t.Run("statuses", func(t *testing.T) {
+		for err, want := range map[error]int{ErrQueueWaitExceeded: http.StatusServiceUnavailable, ErrScriptTimeout: http.StatusRequestTimeout} {
+			rec := httptest.NewRecorder()
+			handleExecutionError(err, rec)
+			if rec.Code != want {
+				t.Errorf("%v: status = %d, want %d", err, rec.Code, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// memoryPollInterval is how often the memory usage is read
+	memoryPollInterval = 100 * time.Millisecond
+	// memoryResumeDelay is how long intake stays off after memory usage is back to normal
+	memoryResumeDelay = 10 * time.Second
+	// memoryRestartAfter is how long usage may stay over the limit before the process restarts
+	memoryRestartAfter = time.Minute
+)
+
+// memStatsProvider returns the number of bytes currently allocated
+type memStatsProvider func() uint64
+
+// readAllocBytes is the memStatsProvider used in production
+func readAllocBytes() uint64 {
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	return memStats.Alloc
+}
+
+// clock is the time source of the memory monitor, so tests can drive it
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// memoryMonitor cancels all scripts and stops intake when memory usage stays
+// over max_memory_mb, resumes intake once usage is back under it, and restarts
+// the process when usage does not come down within memoryRestartAfter
+type memoryMonitor struct {
+	sm        *ScriptManager
+	readAlloc memStatsProvider
+	clock     clock
+	restart   func()
+	spikes    memorySpikeFilter
+
+	overLimitSince time.Time // zero while usage is under the limit
+}
+
+// Recover modes, what the monitor does once usage stays over the limit for memoryRestartAfter
+const (
+	recoverModeRestart = "restart" // restart the process in place
+	recoverModeNone    = "none"    // keep intake off and leave restarts to the orchestrator
+)
+
+// restartProcess restarts the process in place, replaced by tests
+var restartProcess = restart
+
+// recoverAction returns how a monitor that gave up on the process recovers it:
+// by restarting it in place, or under recover_mode none by running holdOff,
+// which keeps it up for the orchestrator to restart
+func recoverAction(sm *ScriptManager, holdOff func()) func() {
+	if config.RecoverMode == recoverModeNone {
+		return holdOff
+	}
+	return func() { restartProcess(server, sm) }
+}
+
+func newMemoryMonitor(sm *ScriptManager, readAlloc memStatsProvider, clock clock) *memoryMonitor {
+	m := &memoryMonitor{
+		sm:        sm,
+		readAlloc: readAlloc,
+		clock:     clock,
+		spikes:    memorySpikeFilter{tolerance: config.MemorySpikeTolerance},
+	}
+	m.restart = recoverAction(sm, m.holdOff)
+	return m
+}
+
+// holdOff stands in for the restart under recover_mode none: the process never
+// exits, it keeps intake off and cancels whatever runs, /health reporting the
+// pressure so the orchestrator can decide to restart the container
+func (m *memoryMonitor) holdOff() {
+	logrus.Error("Memory limit exceeded for over a minute. Leaving the restart to the orchestrator...")
+	m.sm.cancelAllScripts(ErrMemoryLimit)
+}
+
+// run polls the memory usage forever
+func (m *memoryMonitor) run() {
+	for {
+		m.clock.Sleep(memoryPollInterval)
+		m.check()
+	}
+}
+
+// check takes one reading and acts on it
+func (m *memoryMonitor) check() {
+	alloc := m.readAlloc()
+	limitBytes := uint64(config.MaxMemoryMB) << 20
+	over := alloc > limitBytes
+	if m.spikes.sustained(over) {
+		setMemoryPressure(true)
+		if m.sm.GetAcceptingScript() {
+			m.sm.setAcceptingScript(false)
+			logrus.WithFields(logrus.Fields{
+				"usage_mb": alloc >> 20,
+				"limit_mb": config.MaxMemoryMB,
+			}).Warn("Memory usage exceeded limit. Cancelling all scripts...")
+			m.sm.cancelAllScripts(ErrMemoryLimit)
+		}
+		m.enforceLimit()
+	} else if !over && !m.overLimitSince.IsZero() {
+		m.resume()
+	}
+}
+
+// resume turns intake back on after memoryResumeDelay
+func (m *memoryMonitor) resume() {
+	logrus.Infof("Memory usage back to normal. Resuming script execution in %s...", memoryResumeDelay)
+	m.clock.Sleep(memoryResumeDelay)
+	m.overLimitSince = time.Time{}
+	setMemoryPressure(false)
+	// The log guard turns intake back on itself once logging recovers
+	if !isLoggingFailed() {
+		m.sm.setAcceptingScript(true)
+	}
+}
+
+// enforceLimit forces a collection and restarts the process once usage has
+// been over the limit for too long
+func (m *memoryMonitor) enforceLimit() {
+	logrus.Warn("Performing garbage collection due to memory limit")
+	runtime.GC()
+	debug.FreeOSMemory()
+	now := m.clock.Now()
+	if m.overLimitSince.IsZero() {
+		m.overLimitSince = now
+		return
+	}
+	if now.Sub(m.overLimitSince) > memoryRestartAfter {
+		if config.RecoverMode != recoverModeNone {
+			logrus.Error("Memory limit exceeded for over a minute. Restarting...")
+		}
+		m.restart()
+		// Only reached when the process stays up, act again a minute later
+		m.overLimitSince = now
+	}
+}
+
+// memorySpikeFilter debounces the memory readings, so a transient spike from GC
+// timing does not cancel every script. Usage counts as over the limit once
+// tolerance readings in a row are, any reading under the limit starts over.
+type memorySpikeFilter struct {
+	tolerance int
+	streak    int
+}
+
+// sustained records one reading and reports whether the pressure is sustained
+func (f *memorySpikeFilter) sustained(over bool) bool {
+	if !over {
+		f.streak = 0
+		return false
+	}
+	f.streak++
+	return f.streak >= f.tolerance
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryReading is one reading fed to the memory monitor, taken after the clock
+// moved on by after
+type memoryReading struct {
+	mb    uint64
+	after time.Duration
+}
+
+func TestMemoryMonitor(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		readings      []memoryReading
+		wantAccepting bool
+		wantPressure  bool
+		wantRestarts  int
+	}{
+		{
+			name:          "under the limit",
+			readings:      []memoryReading{{mb: 50}, {mb: 90}},
+			wantAccepting: true,
+		},
+		{
+			name:          "spike within tolerance",
+			readings:      []memoryReading{{mb: 200}, {mb: 50}, {mb: 200}},
+			wantAccepting: true,
+		},
+		{
+			name:         "sustained over the limit",
+			readings:     []memoryReading{{mb: 200}, {mb: 200}},
+			wantPressure: true,
+		},
+		{
+			name:          "resumed once back under",
+			readings:      []memoryReading{{mb: 200}, {mb: 200}, {mb: 50}},
+			wantAccepting: true,
+		},
+		{
+			name:         "restart after a minute over",
+			readings:     []memoryReading{{mb: 200}, {mb: 200}, {mb: 200, after: 30 * time.Second}, {mb: 200, after: 31 * time.Second}},
+			wantPressure: true,
+			wantRestarts: 1,
+		},
+		{
+			name:         "recover_mode none holds off",
+			mode:         recoverModeNone,
+			readings:     []memoryReading{{mb: 200}, {mb: 200}, {mb: 200, after: 30 * time.Second}, {mb: 200, after: 31 * time.Second}},
+			wantPressure: true,
+		},
+		{
+			name:          "recover_mode none resumed once back under",
+			mode:          recoverModeNone,
+			readings:      []memoryReading{{mb: 200}, {mb: 200}, {mb: 200, after: 61 * time.Second}, {mb: 50}},
+			wantAccepting: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.MaxMemoryMB = 100
+				c.MemorySpikeTolerance = 2
+				if tt.mode != "" {
+					c.RecoverMode = tt.mode
+				}
+			})
+			restarts := 0
+			saved := restartProcess
+			restartProcess = func(*http.Server, *ScriptManager) error {
+				restarts++
+				return nil
+			}
+			t.Cleanup(func() {
+				restartProcess = saved
+				setMemoryPressure(false)
+			})
+
+			var alloc uint64
+			clock := newFakeClock()
+			m := newMemoryMonitor(sm, func() uint64 { return alloc }, clock)
+			for _, reading := range tt.readings {
+				clock.Sleep(reading.after)
+				alloc = reading.mb << 20
+				m.check()
+			}
+			if accepting := sm.GetAcceptingScript(); accepting != tt.wantAccepting {
+				t.Errorf("accepting = %t, want %t", accepting, tt.wantAccepting)
+			}
+			if pressure := isUnderMemoryPressure(); pressure != tt.wantPressure {
+				t.Errorf("pressure = %t, want %t", pressure, tt.wantPressure)
+			}
+			if restarts != tt.wantRestarts {
+				t.Errorf("restarts = %d, want %d", restarts, tt.wantRestarts)
+			}
+		})
+	}
+}
+
+func TestMemoryMonitorCancelsScripts(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.MaxMemoryMB = 100
+		c.MemorySpikeTolerance = 1
+	})
+	t.Cleanup(func() { setMemoryPressure(false) })
+
+	done := make(chan ScriptResult, 1)
+	go func() { done <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "for (;;) {}"}) }()
+	waitRunning(t, sm, 1)
+
+	alloc := uint64(200 << 20)
+	clock := newFakeClock()
+	m := newMemoryMonitor(sm, func() uint64 { return alloc }, clock)
+	m.check()
+	if result := <-done; !errors.Is(result.Error, ErrMemoryLimit) {
+		t.Fatalf("error = %v, want ErrMemoryLimit", result.Error)
+	}
+	if sm.GetAcceptingScript() {
+		t.Fatal("still accepting scripts over the limit")
+	}
+
+	// Intake is only back once memoryResumeDelay passed on the clock
+	alloc = 50 << 20
+	start := clock.Now()
+	m.check()
+	if waited := clock.Now().Sub(start); waited != memoryResumeDelay {
+		t.Fatalf("resumed after %s, want %s", waited, memoryResumeDelay)
+	}
+	if !sm.GetAcceptingScript() {
+		t.Fatal("not accepting scripts once back under the limit")
+	}
+}
+
+func TestMemorySpikeTolerance(t *testing.T) {
+	tests := []struct {
+		name      string
+		tolerance int
+		readings  []uint64 // MB
+		wantActed bool
+	}{
+		{name: "single reading acts", tolerance: 1, readings: []uint64{200}, wantActed: true},
+		{name: "single spike ignored", tolerance: 3, readings: []uint64{200}},
+		{name: "one short of the tolerance", tolerance: 3, readings: []uint64{200, 200}},
+		{name: "sustained", tolerance: 3, readings: []uint64{200, 200, 200}, wantActed: true},
+		{name: "count reset by a reading under", tolerance: 3, readings: []uint64{200, 200, 50, 200, 200}},
+		{name: "sustained after a reset", tolerance: 3, readings: []uint64{200, 200, 50, 200, 200, 200}, wantActed: true},
+		{name: "at the limit is not over", tolerance: 1, readings: []uint64{100, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.MaxMemoryMB = 100
+				c.MemorySpikeTolerance = tt.tolerance
+			})
+			t.Cleanup(func() { setMemoryPressure(false) })
+
+			var alloc uint64
+			m := newMemoryMonitor(sm, func() uint64 { return alloc }, newFakeClock())
+			for _, mb := range tt.readings {
+				alloc = mb << 20
+				m.check()
+			}
+			if acted := !sm.GetAcceptingScript(); acted != tt.wantActed {
+				t.Fatalf("acted = %t after %v, want %t", acted, tt.readings, tt.wantActed)
+			}
+		})
+	}
+}
+
+// TestRecoverModeNone keeps the memory limit exceeded for minutes under
+// recover_mode none: the process is never restarted, intake stays off, /health
+// reports the pressure and scripts started meanwhile are still cancelled
+func TestRecoverModeNone(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.MaxMemoryMB = 100
+		c.MemorySpikeTolerance = 1
+		c.RecoverMode = recoverModeNone
+	})
+	saved := restartProcess
+	restartProcess = func(*http.Server, *ScriptManager) error {
+		t.Error("process restarted under recover_mode none")
+		return nil
+	}
+	t.Cleanup(func() {
+		restartProcess = saved
+		setMemoryPressure(false)
+	})
+
+	alloc := uint64(200 << 20)
+	clock := newFakeClock()
+	m := newMemoryMonitor(sm, func() uint64 { return alloc }, clock)
+	m.check()
+	for minute := 1; minute <= 2; minute++ {
+		done := make(chan ScriptResult, 1)
+		go func() { done <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "for (;;) {}"}) }()
+		waitRunning(t, sm, 1)
+
+		clock.Sleep(memoryRestartAfter + time.Second)
+		m.check()
+		if result := <-done; !errors.Is(result.Error, ErrMemoryLimit) {
+			t.Fatalf("minute %d: error = %v, want the script cancelled with ErrMemoryLimit", minute, result.Error)
+		}
+		if sm.GetAcceptingScript() {
+			t.Fatalf("minute %d: accepting scripts over the limit", minute)
+		}
+		rec := httptest.NewRecorder()
+		healthHandler()(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "memory_pressure") {
+			t.Fatalf("minute %d: /health = %d %s, want memory_pressure", minute, rec.Code, rec.Body)
+		}
+	}
+}
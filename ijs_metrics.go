@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// initializeMetrics registers the collectors exposed on /metrics
+func initializeMetrics() {
+	prometheus.MustRegister(&managerCollector{sm: scriptManager})
+	prometheus.MustRegister(scriptManager.execMetrics.count, scriptManager.execMetrics.duration)
+	logrus.Info("Metrics initialized")
+}
+
+// metricsHandler serves the Prometheus metrics
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+var (
+	laneQueueDepthDesc = prometheus.NewDesc("ijs_lane_queue_depth",
+		"Number of jobs waiting in the lane queue.", []string{"lane"}, nil)
+	laneQueueSizeDesc = prometheus.NewDesc("ijs_lane_queue_size",
+		"Capacity of the lane queue.", []string{"lane"}, nil)
+	laneRejectedDesc = prometheus.NewDesc("ijs_lane_rejected_total",
+		"Jobs rejected because the lane queue was full.", []string{"lane"}, nil)
+	runningScriptsDesc = prometheus.NewDesc("ijs_running_scripts",
+		"Number of scripts currently executing.", nil, nil)
+	executionRateDesc = prometheus.NewDesc("ijs_executions_per_second",
+		"Scripts started during the last complete second.", nil, nil)
+	abandonedDesc = prometheus.NewDesc("ijs_abandoned_executions_total",
+		"Executions still running past hard_kill_timeout, given up on by their worker.", nil, nil)
+	stuckWorkersDesc = prometheus.NewDesc("ijs_stuck_workers",
+		"Workers on the same job for longer than stuck_worker_after at the last watchdog check.", nil, nil)
+	stuckWorkersTotalDesc = prometheus.NewDesc("ijs_stuck_workers_total",
+		"Jobs the watchdog found a worker stuck on.", nil, nil)
+	compileSecondsDesc = prometheus.NewDesc("ijs_compile_seconds",
+		"Time spent compiling scripts into programs.", nil, nil)
+	vmSetupSecondsDesc = prometheus.NewDesc("ijs_vm_setup_seconds",
+		"Time spent creating a VM and installing its host functions, once per execution.", nil, nil)
+	runSecondsDesc = prometheus.NewDesc("ijs_run_seconds",
+		"Time spent running programs on their VM.", nil, nil)
+)
+
+// managerCollector reads the ScriptManager state at scrape time, so the metrics
+// and /stats always report the same numbers
+type managerCollector struct {
+	sm *ScriptManager
+}
+
+func (c *managerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- laneQueueDepthDesc
+	ch <- laneQueueSizeDesc
+	ch <- laneRejectedDesc
+	ch <- runningScriptsDesc
+	ch <- executionRateDesc
+	ch <- abandonedDesc
+	ch <- stuckWorkersDesc
+	ch <- stuckWorkersTotalDesc
+	ch <- compileSecondsDesc
+	ch <- vmSetupSecondsDesc
+	ch <- runSecondsDesc
+}
+
+func (c *managerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.sm.Stats()
+	for _, lane := range stats.Lanes {
+		ch <- prometheus.MustNewConstMetric(laneQueueDepthDesc, prometheus.GaugeValue, float64(lane.QueueDepth), lane.Name)
+		ch <- prometheus.MustNewConstMetric(laneQueueSizeDesc, prometheus.GaugeValue, float64(lane.QueueSize), lane.Name)
+		ch <- prometheus.MustNewConstMetric(laneRejectedDesc, prometheus.CounterValue, float64(lane.Rejected), lane.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(runningScriptsDesc, prometheus.GaugeValue, float64(stats.RunningScripts))
+	ch <- prometheus.MustNewConstMetric(executionRateDesc, prometheus.GaugeValue, float64(stats.ExecutionsPerSecond))
+	ch <- prometheus.MustNewConstMetric(abandonedDesc, prometheus.CounterValue, float64(stats.AbandonedExecutions))
+	ch <- prometheus.MustNewConstMetric(stuckWorkersDesc, prometheus.GaugeValue, float64(stats.StuckWorkers))
+	ch <- prometheus.MustNewConstMetric(stuckWorkersTotalDesc, prometheus.CounterValue, float64(stats.StuckWorkersTotal))
+	ch <- c.sm.timings.compile.metric(compileSecondsDesc)
+	ch <- c.sm.timings.vmSetup.metric(vmSetupSecondsDesc)
+	ch <- c.sm.timings.run.metric(runSecondsDesc)
+}
+
+// ManagerStats is a snapshot of the ScriptManager state, served on /stats
+type ManagerStats struct {
+	AcceptingScripts bool   `json:"accepting_scripts"`
+	CPUPressure      bool   `json:"cpu_pressure"` // service degraded by cpu_pressure_policy
+	RunningScripts   int    `json:"running_scripts"`
+	ScriptsCompiled  uint64 `json:"scripts_compiled"`
+
+	// Executions given up on past hard_kill_timeout, each leaving a goroutine behind
+	AbandonedExecutions uint64 `json:"abandoned_executions"`
+	// Workers found stuck by the watchdog, at its last check and in total
+	StuckWorkers      int64  `json:"stuck_workers"`
+	StuckWorkersTotal uint64 `json:"stuck_workers_total"`
+
+	Runtime RuntimeStats `json:"runtime"`
+
+	ExecutionsPerSecond    int         `json:"executions_per_second"`
+	MaxExecutionsPerSecond float64     `json:"max_executions_per_second,omitempty"`
+	Lanes                  []LaneStats `json:"lanes"`
+}
+
+// LaneStats describes the load of one worker lane
+type LaneStats struct {
+	Name       string `json:"name"`
+	Workers    int    `json:"workers"`
+	QueueSize  int    `json:"queue_size"`
+	QueueDepth int    `json:"queue_depth"`
+	Rejected   uint64 `json:"rejected"`
+}
+
+// Stats returns a snapshot of the manager state
+func (sm *ScriptManager) Stats() ManagerStats {
+	sm.RLock()
+	running := len(sm.runningScripts)
+	sm.RUnlock()
+
+	stats := ManagerStats{
+		AcceptingScripts:    sm.GetAcceptingScript(),
+		CPUPressure:         sm.underCPUPressure(),
+		RunningScripts:      running,
+		ScriptsCompiled:     atomic.LoadUint64(&sm.compileCount),
+		AbandonedExecutions: atomic.LoadUint64(&sm.abandoned),
+		StuckWorkers:        atomic.LoadInt64(&sm.stuckNow),
+		StuckWorkersTotal:   atomic.LoadUint64(&sm.stuckWorkers),
+		ExecutionsPerSecond: sm.executions.rate(),
+		Runtime: RuntimeStats{
+			Compile: sm.timings.compile.stats(),
+			VMSetup: sm.timings.vmSetup.stats(),
+			Run:     sm.timings.run.stats(),
+		},
+	}
+	if sm.limiter != nil {
+		stats.MaxExecutionsPerSecond = float64(sm.limiter.Limit())
+	}
+	for _, lane := range sm.lanes() {
+		stats.Lanes = append(stats.Lanes, LaneStats{
+			Name:       lane.name,
+			Workers:    cap(lane.workerSem),
+			QueueSize:  lane.jobQueue.Cap(),
+			QueueDepth: lane.jobQueue.Len(),
+			Rejected:   atomic.LoadUint64(&lane.rejected),
+		})
+	}
+	return stats
+}
+
+// statsHandler serves the manager statistics as JSON
+func statsHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSONValue(w, http.StatusOK, scriptManager.Stats())
+	}
+}
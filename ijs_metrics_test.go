@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLaneBackpressureMetrics(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.QueueSize = 1
+		c.PriorityWorkers = 2
+		c.PriorityQueueSize = 0
+		c.OverloadPolicy = overloadReject
+		c.ScriptTimeout = 5 * time.Second
+	})
+
+	// One job running, one queued, the next one rejected
+	go sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: spinScript(3 * time.Second)})
+	waitRunning(t, sm, 1)
+	go sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"})
+	waitQueued(t, sm.normalLane, 1)
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"}); !errors.Is(result.Error, ErrNoWorkerAvailable) {
+		t.Fatalf("error = %v, want ErrNoWorkerAvailable", result.Error)
+	}
+
+	stats := sm.Stats()
+	want := []LaneStats{
+		{Name: "normal", Workers: 1, QueueSize: 1, QueueDepth: 1, Rejected: 1},
+		{Name: "priority", Workers: 2, QueueSize: 2}, // a queue slot per worker
+	}
+	if len(stats.Lanes) != len(want) {
+		t.Fatalf("%d lanes, want %d", len(stats.Lanes), len(want))
+	}
+	for i, lane := range stats.Lanes {
+		if lane != want[i] {
+			t.Fatalf("lane %d = %+v, want %+v", i, lane, want[i])
+		}
+	}
+	if stats.RunningScripts != 1 {
+		t.Fatalf("running_scripts = %d, want 1", stats.RunningScripts)
+	}
+
+	expected := `
+# HELP ijs_lane_queue_depth Number of jobs waiting in the lane queue.
+# TYPE ijs_lane_queue_depth gauge
+ijs_lane_queue_depth{lane="normal"} 1
+ijs_lane_queue_depth{lane="priority"} 0
+# HELP ijs_lane_queue_size Capacity of the lane queue.
+# TYPE ijs_lane_queue_size gauge
+ijs_lane_queue_size{lane="normal"} 1
+ijs_lane_queue_size{lane="priority"} 2
+# HELP ijs_lane_rejected_total Jobs rejected because the lane queue was full.
+# TYPE ijs_lane_rejected_total counter
+ijs_lane_rejected_total{lane="normal"} 1
+ijs_lane_rejected_total{lane="priority"} 0
+`
+	if err := testutil.CollectAndCompare(&managerCollector{sm: sm}, strings.NewReader(expected),
+		"ijs_lane_queue_depth", "ijs_lane_queue_size", "ijs_lane_rejected_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimingHistogram(t *testing.T) {
+	var h timingHistogram
+	for _, d := range []time.Duration{50 * time.Microsecond, 300 * time.Microsecond, 2 * time.Millisecond, 10 * time.Second} {
+		h.observe(d)
+	}
+	if stats := h.stats(); stats.Count != 4 || stats.AvgMs != 2500.5875 {
+		t.Fatalf("stats = %+v, want 4 observations averaging 2500.5875ms", stats)
+	}
+	expected := `
+# HELP ijs_test_seconds Test histogram.
+# TYPE ijs_test_seconds histogram
+ijs_test_seconds_bucket{le="0.0001"} 1
+ijs_test_seconds_bucket{le="0.0005"} 2
+ijs_test_seconds_bucket{le="0.001"} 2
+ijs_test_seconds_bucket{le="0.005"} 3
+ijs_test_seconds_bucket{le="0.01"} 3
+ijs_test_seconds_bucket{le="0.05"} 3
+ijs_test_seconds_bucket{le="0.1"} 3
+ijs_test_seconds_bucket{le="0.5"} 3
+ijs_test_seconds_bucket{le="1"} 3
+ijs_test_seconds_bucket{le="5"} 3
+ijs_test_seconds_bucket{le="+Inf"} 4
+ijs_test_seconds_sum 10.00235
+ijs_test_seconds_count 4
+`
+	desc := prometheus.NewDesc("ijs_test_seconds", "Test histogram.", nil, nil)
+	metric := h.metric(desc)
+	if err := testutil.CollectAndCompare(constCollector{desc: desc, metric: metric}, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// constCollector collects one fixed metric
+type constCollector struct {
+	desc   *prometheus.Desc
+	metric prometheus.Metric
+}
+
+func (c constCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+func (c constCollector) Collect(ch chan<- prometheus.Metric) { ch <- c.metric }
+
+func TestRuntimeTimingMetrics(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(&managerCollector{sm: sm})
+	// counts returns the observations of the compile, VM setup and run histograms
+	counts := func() [3]uint64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [3]uint64
+		for _, family := range families {
+			for i, name := range []string{"ijs_compile_seconds", "ijs_vm_setup_seconds", "ijs_run_seconds"} {
+				if family.GetName() == name {
+					got[i] = family.GetMetric()[0].GetHistogram().GetSampleCount()
+				}
+			}
+		}
+		stats := sm.Stats().Runtime
+		if stats.Compile.Count != got[0] || stats.VMSetup.Count != got[1] || stats.Run.Count != got[2] {
+			t.Fatalf("/stats runtime %+v does not match /metrics %v", stats, got)
+		}
+		return got
+	}
+
+	if got := counts(); got != [3]uint64{} {
+		t.Fatalf("observations before any execution = %v", got)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := sm.ExecuteScriptWithTimeout(`[1, 2, 3].map(x => x * 2)`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := counts(); got != [3]uint64{3, 3, 3} {
+		t.Fatalf("observations after 3 executions = %v, want a compile, a VM setup and a run each", got)
+	}
+	if stats := sm.Stats().Runtime; stats.Compile.AvgMs <= 0 || stats.VMSetup.AvgMs <= 0 || stats.Run.AvgMs <= 0 {
+		t.Fatalf("runtime averages %+v, want them above zero", stats)
+	}
+
+	// A fan-out compiles once and runs on a VM per input
+	if rec := postEnvelope(fanoutHandler(sm), "/fanout", `{"script": "input.n", "inputs": [{"n": 1}, {"n": 2}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("fanout: %d %s", rec.Code, rec.Body)
+	}
+	if got := counts(); got != [3]uint64{4, 5, 5} {
+		t.Fatalf("observations after a fan-out over 2 inputs = %v, want 4 compiles, 5 VM setups and 5 runs", got)
+	}
+
+	// A script that does not compile is timed compiling, never runs
+	if _, err := sm.ExecuteScriptWithTimeout(`1 +`); !errors.Is(err, ErrCompileFailed) {
+		t.Fatalf("error = %v, want ErrCompileFailed", err)
+	}
+	if got := counts(); got[0] != 5 || got[2] != 5 {
+		t.Fatalf("observations after a syntax error = %v, want a 5th compile and still 5 runs", got)
+	}
+}
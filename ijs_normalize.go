@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/grafana/sobek/ast"
+)
+
+// lineTerminators are the characters ending a line in JS source
+const lineTerminators = "\n\r\u2028\u2029"
+
+// normalizeScript returns the canonical form of js the result cache hashes with
+// result_cache_normalize, so scripts differing only in comments and layout
+// share an entry. sobek has no code printer to re-emit the tree, so the source
+// is rewritten in place, guided by it: string, template and regex literals,
+// located by parsing, are kept verbatim, and outside them comments are dropped
+// and whitespace collapsed. Line breaks are kept, as automatic semicolon
+// insertion depends on them, and spaces are only dropped where the tokens on
+// either side cannot merge. A script that does not parse, or whose canonical
+// form would not, is returned as is.
+func normalizeScript(js string) string {
+	program, err := parseScript(js)
+	if err != nil {
+		return js
+	}
+	base := program.File.Base()
+	var literals [][2]int
+	walkAST(program, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.StringLiteral, *ast.RegExpLiteral, *ast.TemplateLiteral:
+			literals = append(literals, [2]int{int(node.Idx0()) - base, int(node.Idx1()) - base})
+			return false
+		}
+		return true
+	})
+	slices.SortFunc(literals, func(a, b [2]int) int { return cmp.Compare(a[0], b[0]) })
+
+	var out strings.Builder
+	var last rune // last rune written, 0 before the first
+	space, newline := false, false
+	emit := func(s string) {
+		next, _ := utf8.DecodeRuneInString(s)
+		switch {
+		case newline && last != 0:
+			out.WriteByte('\n')
+		case space && tokensMerge(last, next):
+			out.WriteByte(' ')
+		}
+		space, newline = false, false
+		out.WriteString(s)
+		last, _ = utf8.DecodeLastRuneInString(s)
+	}
+
+	for i := 0; i < len(js); {
+		if len(literals) > 0 && literals[0][0] <= i {
+			end := max(literals[0][1], i)
+			emit(js[i:end])
+			literals = literals[1:]
+			i = end
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(js[i:])
+		switch {
+		case strings.HasPrefix(js[i:], "//"):
+			// The line break ending the comment is read next
+			end := strings.IndexAny(js[i:], lineTerminators)
+			if end < 0 {
+				end = len(js) - i
+			}
+			space = true
+			i += end
+		case strings.HasPrefix(js[i:], "/*"):
+			end := strings.Index(js[i+2:], "*/")
+			if end < 0 {
+				return js
+			}
+			comment := js[i : i+2+end+2]
+			if strings.ContainsAny(comment, lineTerminators) {
+				newline = true
+			}
+			space = true
+			i += len(comment)
+		case strings.ContainsRune(lineTerminators, r):
+			newline = true
+			i += size
+		case unicode.IsSpace(r) || r == '\ufeff':
+			space = true
+			i += size
+		default:
+			emit(js[i : i+size])
+			i += size
+		}
+	}
+
+	normalized := out.String()
+	if _, err := parseScript(normalized); err != nil {
+		return js
+	}
+	return normalized
+}
+
+// tokensMerge reports whether the tokens ending with a and starting with b would
+// read as one without a space between them, as in "var x", "a - -b" or "1 .5"
+func tokensMerge(a, b rune) bool {
+	word := func(r rune) bool {
+		return r == '_' || r == '$' || r == '\\' || r >= utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	operator := func(r rune) bool {
+		return strings.ContainsRune("+-*/%<>=&|^!~?.", r)
+	}
+	switch {
+	case word(a) && word(b), operator(a) && operator(b):
+		return true
+	default:
+		return word(a) && b == '.' || a == '.' && word(b)
+	}
+}
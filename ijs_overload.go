@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrScriptShed is returned to a queued script dropped by the shed_oldest overload policy
+var ErrScriptShed = errors.New("script dropped from the queue to make room for a priority script")
+
+// Overload policies, applied when a job finds its lane queue full
+const (
+	overloadReject     = "reject"      // fail the job with ErrNoWorkerAvailable
+	overloadQueue      = "queue"       // wait up to overload_queue_timeout for a free slot
+	overloadShedOldest = "shed_oldest" // drop the oldest queued non-priority job for a priority job
+)
+
+// enqueue pushes job onto lane following the overload policy
+func (sm *ScriptManager) enqueue(ctx context.Context, lane *workerLane, job ScriptJob) error {
+	if !job.Priority && config.CPUPressurePolicy == cpuPressureShed && sm.underCPUPressure() {
+		return ErrCPUPressure
+	}
+	if config.OverloadPolicy == overloadShedOldest && job.Priority {
+		return sm.pushShedding(lane, job)
+	}
+	var timeout <-chan time.Time
+	for {
+		// The read lock keeps Shutdown from draining the queue while we enqueue
+		sm.RLock()
+		if sm.isShuttingDown() {
+			sm.RUnlock()
+			return ErrShuttingDown
+		}
+		pushed, space := lane.jobQueue.tryPush(job)
+		sm.RUnlock()
+		if pushed {
+			return nil
+		}
+
+		switch config.OverloadPolicy {
+		case overloadQueue:
+		default:
+			return ErrNoWorkerAvailable
+		}
+
+		if timeout == nil {
+			timer := time.NewTimer(config.OverloadQueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-space:
+		case <-timeout:
+			return ErrNoWorkerAvailable
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sm.done:
+			return ErrShuttingDown
+		}
+	}
+}
+
+// pushShedding queues the priority job on lane, dropping the oldest queued
+// non-priority job when the queue is full. Running scripts are never touched,
+// and a queue full of priority jobs rejects job.
+func (sm *ScriptManager) pushShedding(lane *workerLane, job ScriptJob) error {
+	// The read lock keeps Shutdown from draining the queue while we enqueue
+	sm.RLock()
+	if sm.isShuttingDown() {
+		sm.RUnlock()
+		return ErrShuttingDown
+	}
+	pushed, shed := lane.jobQueue.pushShedding(job)
+	sm.RUnlock()
+	if !pushed {
+		return ErrNoWorkerAvailable
+	}
+	if shed != nil {
+		logrus.WithFields(logrus.Fields{
+			"lane":   lane.name,
+			"queued": time.Since(shed.queuedAt),
+		}).Warn("Shedding the oldest queued script for a priority script")
+		endSpanWithError(shed.queueSpan, ErrScriptShed)
+		shed.reject(ErrScriptShed)
+	}
+	return nil
+}
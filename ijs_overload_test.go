@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fillLane starts a script holding the only worker of the normal lane and
+// queues the given jobs behind it, returning the channels their results arrive on
+func fillLane(t *testing.T, sm *ScriptManager, hold time.Duration, jobs ...ScriptJob) (running <-chan ScriptResult, queued []<-chan ScriptResult) {
+	t.Helper()
+	start := func(job ScriptJob) <-chan ScriptResult {
+		done := make(chan ScriptResult, 1)
+		go func() { done <- sm.ExecuteScriptWithContext(context.Background(), job) }()
+		return done
+	}
+	running = start(ScriptJob{Script: spinScript(hold)})
+	waitRunning(t, sm, 1)
+	for i, job := range jobs {
+		queued = append(queued, start(job))
+		waitQueued(t, sm.normalLane, i+1)
+	}
+	return running, queued
+}
+
+func TestOverloadReject(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.QueueSize = 1
+		c.OverloadPolicy = overloadReject
+		c.ScriptTimeout = 5 * time.Second
+	})
+	running, queued := fillLane(t, sm, 300*time.Millisecond, ScriptJob{Script: "'queued'"})
+
+	start := time.Now()
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"}); !errors.Is(result.Error, ErrNoWorkerAvailable) {
+		t.Fatalf("error = %v, want ErrNoWorkerAvailable", result.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("rejected after %s, want right away", elapsed)
+	}
+	if result := <-running; result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result := <-queued[0]; result.Result != "queued" {
+		t.Fatalf("queued job = %v, %v", result.Result, result.Error)
+	}
+}
+
+func TestOverloadQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		hold    time.Duration
+		timeout time.Duration
+		wantErr error
+	}{
+		{name: "slot frees up in time", hold: 100 * time.Millisecond, timeout: 2 * time.Second},
+		{name: "no slot before the timeout", hold: time.Second, timeout: 100 * time.Millisecond, wantErr: ErrNoWorkerAvailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.WorkerPoolSize = 1
+				c.QueueSize = 1
+				c.OverloadPolicy = overloadQueue
+				c.OverloadQueueTimeout = tt.timeout
+				c.ScriptTimeout = 5 * time.Second
+			})
+			fillLane(t, sm, tt.hold, ScriptJob{Script: "1"})
+
+			start := time.Now()
+			result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "'waited'"})
+			if tt.wantErr != nil {
+				if !errors.Is(result.Error, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", result.Error, tt.wantErr)
+				}
+				if elapsed := time.Since(start); elapsed < tt.timeout {
+					t.Fatalf("gave up after %s, before overload_queue_timeout", elapsed)
+				}
+				return
+			}
+			if result.Error != nil || result.Result != "waited" {
+				t.Fatalf("result = %v, %v, want the job to wait for a slot", result.Result, result.Error)
+			}
+		})
+	}
+}
+
+func TestOverloadShedOldest(t *testing.T) {
+	// Without priority workers, priority jobs share the normal lane
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.QueueSize = 2
+		c.PriorityWorkers = 0
+		c.OverloadPolicy = overloadShedOldest
+		c.ScriptTimeout = 5 * time.Second
+	})
+	running, queued := fillLane(t, sm, 300*time.Millisecond,
+		ScriptJob{Script: "'oldest'"},
+		ScriptJob{Script: "'newer'"},
+	)
+
+	// A normal job is rejected, it sheds nothing
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"}); !errors.Is(result.Error, ErrNoWorkerAvailable) {
+		t.Fatalf("normal job error = %v, want ErrNoWorkerAvailable", result.Error)
+	}
+
+	// A priority job takes the place of the oldest queued normal job
+	first := make(chan ScriptResult, 1)
+	go func() {
+		first <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "'first'", Priority: true})
+	}()
+	if result := <-queued[0]; !errors.Is(result.Error, ErrScriptShed) {
+		t.Fatalf("oldest queued job = %v, %v, want ErrScriptShed", result.Result, result.Error)
+	}
+	if code := errorCode(ErrScriptShed); code != CodeScriptShed {
+		t.Fatalf("code = %s, want %s", code, CodeScriptShed)
+	}
+
+	// The next one sheds the remaining normal job, then the queue only holds priority jobs
+	second := make(chan ScriptResult, 1)
+	go func() {
+		second <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "'second'", Priority: true})
+	}()
+	if result := <-queued[1]; !errors.Is(result.Error, ErrScriptShed) {
+		t.Fatalf("newer queued job = %v, %v, want ErrScriptShed", result.Result, result.Error)
+	}
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "'third'", Priority: true}); !errors.Is(result.Error, ErrNoWorkerAvailable) {
+		t.Fatalf("priority job on a queue of priority jobs = %v, want ErrNoWorkerAvailable", result.Error)
+	}
+
+	// The running script was never cancelled, and the priority jobs run once it is done
+	if result := <-running; result.Error != nil {
+		t.Fatalf("running script = %v, want it left to finish", result.Error)
+	}
+	for want, done := range map[string]chan ScriptResult{"first": first, "second": second} {
+		if result := <-done; result.Error != nil || result.Result != want {
+			t.Fatalf("priority job = %v, %v, want %s", result.Result, result.Error, want)
+		}
+	}
+}
+
+func TestOverloadShedOldestPriorityLane(t *testing.T) {
+	// The priority lane only queues priority jobs, none of which is ever shed
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 1
+		c.PriorityWorkers = 1
+		c.PriorityQueueSize = 1
+		c.OverloadPolicy = overloadShedOldest
+		c.ScriptTimeout = 5 * time.Second
+	})
+	start := func(script string) <-chan ScriptResult {
+		done := make(chan ScriptResult, 1)
+		go func() {
+			done <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: script, Priority: true})
+		}()
+		return done
+	}
+	running := start(spinScript(300 * time.Millisecond))
+	waitRunning(t, sm, 1)
+	queued := start("'queued'")
+	waitQueued(t, sm.priorityLane, 1)
+
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1", Priority: true}); !errors.Is(result.Error, ErrNoWorkerAvailable) {
+		t.Fatalf("error = %v, want ErrNoWorkerAvailable", result.Error)
+	}
+	if result := <-running; result.Error != nil {
+		t.Fatalf("running priority script = %v, want it left to finish", result.Error)
+	}
+	if result := <-queued; result.Result != "queued" {
+		t.Fatalf("queued priority job = %v, %v", result.Result, result.Error)
+	}
+}
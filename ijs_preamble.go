@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/grafana/sobek"
+)
+
+// loadPreamble compiles the preamble_file script, nil when none is configured.
+// It is also run once in a VM of its own, so that a preamble that throws fails
+// here rather than every execution after it.
+func (sm *ScriptManager) loadPreamble(path string, refData refDataSet) (*sobek.Program, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preamble: %w", err)
+	}
+	if err := checkEncoding(string(data)); err != nil {
+		return nil, fmt.Errorf("preamble: %w", err)
+	}
+	program, err := sobek.Compile(path, string(data), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile preamble: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ScriptTimeout)
+	defer cancel()
+	vm := newRuntime()
+	sm.installHostFunctions(vm, ctx, ScriptJob{shared: &sharedData{refData: refData}}, &scriptOutput{})
+	stop := context.AfterFunc(ctx, func() { vm.Interrupt(ErrScriptTimeout) })
+	defer stop()
+	if _, err := vm.RunProgram(program); err != nil {
+		return nil, fmt.Errorf("preamble failed: %v", err)
+	}
+	return program, nil
+}
+
+// runPreamble runs the preamble of shared in vm, before the script of the job.
+// Its failure is not the script's doing and is not reported as a script error.
+func runPreamble(vm *sobek.Runtime, shared *sharedData) error {
+	if shared.preamble == nil {
+		return nil
+	}
+	if _, err := vm.RunProgram(shared.preamble); err != nil {
+		return fmt.Errorf("preamble failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePreamble writes the preamble script to a file under t.TempDir
+func writePreamble(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "preamble.js")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPreamble(t *testing.T) {
+	preamble := writePreamble(t, `function double(x) { return x * 2 }`)
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.PreambleFile = preamble
+		c.MaxUserGlobals = 1
+	})
+	if _, err := sm.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr string
+	}{
+		{"function", `double(21)`, int64(42), ""},
+		{"not counted as a user global", `var a = 1; double(a)`, int64(2), ""},
+		{"user globals still counted", `var a = 1, b = 2; double(a + b)`, nil, "global"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreambleFrozen(t *testing.T) {
+	preamble := writePreamble(t, `function double(x) { return x * 2 }`)
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.PreambleFile = preamble
+		c.FreezeGlobal = true
+	})
+	if _, err := sm.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.ExecuteScriptWithTimeout(`"use strict"; double = null`); err == nil || !strings.Contains(err.Error(), "double") {
+		t.Fatalf("error = %v, want the preamble function frozen", err)
+	}
+}
+
+func TestPreambleReadsRefData(t *testing.T) {
+	preamble := writePreamble(t, `var usd = refdata.lookup("rates", "usd")`)
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.PreambleFile = preamble
+		c.RefData = writeRefData(t, map[string]string{"rates": `{"usd": 1.1}`})
+	})
+	if _, err := sm.reload(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := sm.ExecuteScriptWithTimeout(`usd`)
+	if err != nil || result != 1.1 {
+		t.Fatalf("result = %v, %v, want 1.1", result, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	preamble := filepath.Join(dir, "preamble.js")
+	rates := filepath.Join(dir, "rates.json")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(preamble, `function version() { return 1 }`)
+	write(rates, `{"usd": 1.1}`)
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.PreambleFile = preamble
+		c.RefData = map[string]string{"rates": rates}
+	})
+	if _, err := sm.reload(); err != nil {
+		t.Fatal(err)
+	}
+	const script = `[version(), refdata.lookup("rates", "usd")]`
+	check := func(want string) {
+		t.Helper()
+		result, err := sm.ExecuteScriptWithTimeout(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := json.Marshal(result)
+		if string(got) != want {
+			t.Fatalf("result = %s, want %s", got, want)
+		}
+	}
+	check(`[1,1.1]`)
+
+	t.Run("swaps both", func(t *testing.T) {
+		write(preamble, `function version() { return 2 }`)
+		write(rates, `{"usd": 1.2}`)
+		if _, err := sm.reload(); err != nil {
+			t.Fatal(err)
+		}
+		check(`[2,1.2]`)
+	})
+
+	broken := []struct {
+		name     string
+		preamble string
+		rates    string
+		wantErr  string
+	}{
+		{"preamble syntax error", `function version( {`, `{"usd": 1.3}`, "failed to compile preamble"},
+		{"preamble throws", `function version() { return 3 }; throw new Error("boom")`, `{"usd": 1.3}`, "preamble failed"},
+		{"preamble never ends", `function version() { return 3 }; for (;;) {}`, `{"usd": 1.3}`, "preamble failed"},
+		{"invalid refdata", `function version() { return 3 }`, `{"usd":`, "failed to parse reference dataset rates"},
+	}
+	for _, tt := range broken {
+		t.Run(tt.name, func(t *testing.T) {
+			write(preamble, tt.preamble)
+			write(rates, tt.rates)
+			_, err := sm.reload()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+			// Neither the preamble nor the data of the failed reload is used
+			check(`[2,1.2]`)
+		})
+	}
+
+	t.Run("handler", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		reloadHandler(sm).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+		if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "keeping the current reference data and preamble") {
+			t.Fatalf("status %d, body %s, want the failed reload reported with a 500", rec.Code, rec.Body)
+		}
+		write(rates, `{"usd": 1.4}`)
+		rec = httptest.NewRecorder()
+		reloadHandler(sm).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, body %s, want 200", rec.Code, rec.Body)
+		}
+		check(`[3,1.4]`)
+	})
+}
+
+func TestReloadKeepsRunningScript(t *testing.T) {
+	preamble := writePreamble(t, `function version() { return 1 }`)
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 5 * time.Second
+		c.PreambleFile = preamble
+	})
+	if _, err := sm.reload(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan interface{}, 1)
+	go func() {
+		result, err := sm.ExecuteScriptWithTimeout(`var end = Date.now() + 300; while (Date.now() < end) {} version()`)
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- result
+	}()
+	waitRunning(t, sm, 1)
+	if err := os.WriteFile(preamble, []byte(`function version() { return 2 }`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-done; got != int64(1) {
+		t.Fatalf("running script got %v, want the preamble it started with", got)
+	}
+	if result, err := sm.ExecuteScriptWithTimeout(`version()`); err != nil || result != int64(2) {
+		t.Fatalf("result = %v, %v, want the reloaded preamble", result, err)
+	}
+}
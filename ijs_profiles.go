@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrContentTypeNotAllowed is returned when a script picks a content type its
+// sandbox profile does not allow
+var ErrContentTypeNotAllowed = errors.New("content type not allowed")
+
+// SandboxProfile is a named set of permissions given to the requests carrying
+// one of its tokens in the X-Profile-Token header
+type SandboxProfile struct {
+	Tokens              []string `yaml:"tokens"`
+	AllowedContentTypes []string `yaml:"allowed_content_types"` // exact media types, or type/* for a whole family
+}
+
+// builtinProfile applies when no sandbox_profiles are configured. Nothing a
+// browser would render as a page may leave it.
+var builtinProfile = SandboxProfile{
+	AllowedContentTypes: []string{"application/json", "text/plain"},
+}
+
+// profileFor returns the name and profile of the request, the default profile
+// when it carries no valid X-Profile-Token
+func profileFor(r *http.Request) (string, SandboxProfile) {
+	if len(config.SandboxProfiles) == 0 {
+		return "builtin", builtinProfile
+	}
+	if token := r.Header.Get("X-Profile-Token"); token != "" {
+		for name, profile := range config.SandboxProfiles {
+			for _, allowed := range profile.Tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+					return name, profile
+				}
+			}
+		}
+	}
+	return config.DefaultProfile, config.SandboxProfiles[config.DefaultProfile]
+}
+
+// namedProfile returns the profile called name, the builtin one when no
+// sandbox_profiles are configured
+func namedProfile(name string) (SandboxProfile, bool) {
+	if len(config.SandboxProfiles) == 0 {
+		return builtinProfile, name == "builtin"
+	}
+	profile, ok := config.SandboxProfiles[name]
+	return profile, ok
+}
+
+// checkContentType returns ErrContentTypeNotAllowed unless the media type of
+// contentType is on the allowlist of the profile
+func (p SandboxProfile) checkContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: %q is not a valid content type", ErrContentTypeNotAllowed, contentType)
+	}
+	for _, allowed := range p.AllowedContentTypes {
+		allowed = strings.ToLower(allowed)
+		if family, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return nil
+			}
+		} else if mediaType == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrContentTypeNotAllowed, mediaType)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckContentType(t *testing.T) {
+	profile := SandboxProfile{AllowedContentTypes: []string{"application/json", "Text/Plain", "image/*"}}
+	tests := []struct {
+		contentType string
+		allowed     bool
+	}{
+		{"application/json", true},
+		{"text/plain; charset=utf-8", true},
+		{"TEXT/PLAIN", true},
+		{"image/png", true},
+		{"image/svg+xml", true},
+		{"text/html", false},
+		{"application/javascript", false},
+		{"imagex/png", false},
+		{"image", false},
+		{"", false},
+		{"text/html; charset", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			err := profile.checkContentType(tt.contentType)
+			if tt.allowed && err != nil {
+				t.Fatalf("checkContentType = %v, want allowed", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrContentTypeNotAllowed) {
+				t.Fatalf("checkContentType = %v, want ErrContentTypeNotAllowed", err)
+			}
+		})
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/data", nil)
+		if token != "" {
+			r.Header.Set("X-Profile-Token", token)
+		}
+		return r
+	}
+
+	newTestManager(t, nil)
+	if name, _ := profileFor(request("anything")); name != "builtin" {
+		t.Fatalf("profile = %s without sandbox_profiles, want builtin", name)
+	}
+
+	newTestManager(t, func(c *Config) {
+		c.SandboxProfiles = map[string]SandboxProfile{
+			"public":   {},
+			"internal": {Tokens: []string{"secret"}},
+		}
+		c.DefaultProfile = "public"
+	})
+	for token, want := range map[string]string{"": "public", "secret": "internal", "secre": "public", "secrets": "public"} {
+		if name, _ := profileFor(request(token)); name != want {
+			t.Errorf("profile = %s for token %q, want %s", name, token, want)
+		}
+	}
+}
+
+func TestContentTypeProfiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		script     string
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{name: "public text", script: `setContentType("text/plain"); "hello"`, wantStatus: http.StatusOK, wantType: "text/plain", wantBody: "hello"},
+		{name: "public json", script: `setContentType("application/json"); ({a: 1})`, wantStatus: http.StatusOK, wantType: "application/json", wantBody: `"result":{"a":1}`},
+		{name: "public html rejected", script: `setContentType("text/html"); "<b>hi</b>"`, wantStatus: http.StatusBadRequest, wantType: "application/json", wantBody: "content type not allowed: text/html"},
+		{name: "public png rejected", script: `setContentType("image/png"); new Uint8Array([137, 80])`, wantStatus: http.StatusBadRequest, wantType: "application/json", wantBody: "content type not allowed"},
+		{name: "internal html", token: "secret", script: `setContentType("text/html; charset=utf-8"); "<b>hi</b>"`, wantStatus: http.StatusOK, wantType: "text/html; charset=utf-8", wantBody: "<b>hi</b>"},
+		{name: "internal png", token: "secret", script: `setContentType("image/png"); new Uint8Array([137, 80]).buffer`, wantStatus: http.StatusOK, wantType: "image/png", wantBody: "\x89P"},
+		{name: "internal text rejected", token: "secret", script: `setContentType("text/plain"); "hello"`, wantStatus: http.StatusBadRequest, wantType: "application/json", wantBody: "content type not allowed"},
+		{name: "unknown token gets the default", token: "guess", script: `setContentType("text/html"); "<b>hi</b>"`, wantStatus: http.StatusBadRequest, wantType: "application/json", wantBody: "content type not allowed"},
+		{name: "invalid content type", script: `setContentType("not a type"); "x"`, wantStatus: http.StatusBadRequest, wantType: "application/json", wantBody: "is not a valid content type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.SandboxProfiles = map[string]SandboxProfile{
+					"public":   {AllowedContentTypes: []string{"application/json", "text/plain"}},
+					"internal": {Tokens: []string{"secret"}, AllowedContentTypes: []string{"text/html", "image/png"}},
+				}
+				c.DefaultProfile = "public"
+			})
+			r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(tt.script))
+			if tt.token != "" {
+				r.Header.Set("X-Profile-Token", tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler(sm)(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Fatalf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Fatalf("body = %q, want it to contain %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+
+	t.Run("builtin profile", func(t *testing.T) {
+		sm := newTestManager(t, func(c *Config) {
+			c.ScriptTimeout = time.Second
+		})
+		for script, want := range map[string]int{
+			`setContentType("text/plain"); "x"`: http.StatusOK,
+			`setContentType("text/html"); "x"`:  http.StatusBadRequest,
+		} {
+			rec := httptest.NewRecorder()
+			handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(script)))
+			if rec.Code != want {
+				t.Errorf("%s: status = %d %s, want %d", script, rec.Code, rec.Body, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/grafana/sobek"
+)
+
+var (
+	ErrUnhandledRejection = errors.New("unhandled promise rejection")
+	ErrPromiseRejected    = errors.New("script promise rejected")
+	ErrPromisePending     = errors.New("script promise never settled")
+)
+
+// rejectionTracker records the promises rejected without a handler. Promise
+// jobs are drained before RunString returns, so by then a rejection still
+// listed here will never be handled.
+type rejectionTracker struct {
+	vm        *sobek.Runtime
+	unhandled []*sobek.Promise
+}
+
+// trackRejections installs a rejection tracker on vm
+func trackRejections(vm *sobek.Runtime) *rejectionTracker {
+	t := &rejectionTracker{vm: vm}
+	vm.SetPromiseRejectionTracker(func(p *sobek.Promise, op sobek.PromiseRejectionOperation) {
+		switch op {
+		case sobek.PromiseRejectionReject:
+			t.unhandled = append(t.unhandled, p)
+		case sobek.PromiseRejectionHandle:
+			for i, pending := range t.unhandled {
+				if pending == p {
+					t.unhandled = append(t.unhandled[:i], t.unhandled[i+1:]...)
+					break
+				}
+			}
+		}
+	})
+	return t
+}
+
+// err reports the first unhandled rejection, nil when there is none
+func (t *rejectionTracker) err() error {
+	if len(t.unhandled) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnhandledRejection, describeThrown(t.vm, t.unhandled[0].Result()))
+}
+
+// promiseResolver wraps thenables into promises using the builtin Promise.resolve,
+// captured before the script runs so the script cannot replace it
+type promiseResolver struct {
+	vm      *sobek.Runtime
+	ctor    sobek.Value
+	resolve sobek.Callable
+}
+
+func newPromiseResolver(vm *sobek.Runtime) promiseResolver {
+	ctor := vm.Get("Promise")
+	resolve, _ := sobek.AssertFunction(ctor.ToObject(vm).Get("resolve"))
+	return promiseResolver{vm: vm, ctor: ctor, resolve: resolve}
+}
+
+// promiseType is the type a Promise exports as, checked before exporting an
+// object, which would run the getters of any other
+var promiseType = reflect.TypeOf((*sobek.Promise)(nil))
+
+// settle replaces a Promise or thenable result by the value it settled with.
+// Promise jobs are drained before control returns to Go and there are no
+// timers, so a promise still pending at this point will never settle.
+func (pr promiseResolver) settle(value sobek.Value) (sobek.Value, error) {
+	obj, isObj := value.(*sobek.Object)
+	if !isObj {
+		return value, nil
+	}
+	var p *sobek.Promise
+	if obj.ExportType() == promiseType {
+		p = obj.Export().(*sobek.Promise)
+	} else {
+		var then sobek.Value
+		if err := guard(pr.vm, func() { then = obj.Get("then") }); err != nil {
+			return nil, thrownError(pr.vm, err)
+		}
+		if _, thenable := sobek.AssertFunction(then); !thenable {
+			return value, nil
+		}
+		wrapped, err := pr.resolve(pr.ctor, value)
+		if err != nil {
+			return nil, thrownError(pr.vm, err)
+		}
+		p = wrapped.Export().(*sobek.Promise)
+	}
+
+	switch p.State() {
+	case sobek.PromiseStateFulfilled:
+		return p.Result(), nil
+	case sobek.PromiseStateRejected:
+		if se := scriptErrorFrom(pr.vm, p.Result()); se != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPromiseRejected, se)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrPromiseRejected, describeThrown(pr.vm, p.Result()))
+	default:
+		return nil, ErrPromisePending
+	}
+}
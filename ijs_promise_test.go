@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnhandledRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{name: "unhandled", script: "Promise.reject(new Error('lost')); 1", wantErr: "unhandled promise rejection: Error: lost"},
+		{name: "unhandled string", script: "Promise.reject('lost'); 1", wantErr: "unhandled promise rejection: lost"},
+		{name: "thrown in a then", script: "Promise.resolve().then(() => { throw new Error('late') }); 1", wantErr: "unhandled promise rejection: Error: late"},
+		{name: "handled by catch", script: "Promise.reject(new Error('lost')).catch(() => {}); 1"},
+		{name: "handled later in the script", script: "const p = Promise.reject(1); p.catch(() => {}); 1"},
+		{name: "handled in a microtask", script: "const p = Promise.reject(1); Promise.resolve().then(() => p.catch(() => {})); 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+			})
+			result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: tt.script})
+			if tt.wantErr == "" {
+				if result.Error != nil {
+					t.Fatal(result.Error)
+				}
+				return
+			}
+			if !errors.Is(result.Error, ErrUnhandledRejection) || !strings.Contains(result.Error.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", result.Error, tt.wantErr)
+			}
+			if code := errorCode(result.Error); code != CodeRuntimeError {
+				t.Fatalf("code = %s, want %s", code, CodeRuntimeError)
+			}
+		})
+	}
+}
+
+func TestTopLevelPromise(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		want     interface{}
+		wantErr  error
+		wantCode string
+	}{
+		{name: "resolved", script: "Promise.resolve(42)", want: int64(42)},
+		{name: "async function", script: "(async () => { const a = await Promise.resolve(20); return a + 22 })()", want: int64(42)},
+		{name: "chained", script: "Promise.resolve(1).then(n => n + 1).then(n => n * 21)", want: int64(42)},
+		{name: "thenable", script: "({then(resolve) { resolve('done') }})", want: "done"},
+		{name: "not a thenable", script: "({then: 1})", want: map[string]interface{}{"then": int64(1)}},
+		{name: "rejected", script: "Promise.reject(new Error('no'))", wantErr: ErrPromiseRejected, wantCode: CodeRuntimeError},
+		{name: "async throw", script: "(async () => { throw new Error('no') })()", wantErr: ErrPromiseRejected, wantCode: CodeRuntimeError},
+		{name: "rejected with a script error", script: "Promise.reject({name: 'NotFound', code: 404})", wantCode: CodeScriptError},
+		{name: "never settles", script: "new Promise(() => {})", wantErr: ErrPromisePending, wantCode: CodeRuntimeError},
+		{name: "throwing then getter", script: "({get then() { throw new Error('getter') }})", wantCode: CodeRuntimeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+			})
+			result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: tt.script})
+			if tt.wantCode == "" {
+				if result.Error != nil {
+					t.Fatal(result.Error)
+				}
+				if !reflect.DeepEqual(result.Result, tt.want) {
+					t.Fatalf("result = %#v, want %#v", result.Result, tt.want)
+				}
+				return
+			}
+			if tt.wantErr != nil && !errors.Is(result.Error, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", result.Error, tt.wantErr)
+			}
+			if code := errorCode(result.Error); code != tt.wantCode {
+				t.Fatalf("code = %s (%v), want %s", code, result.Error, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// laneQueue holds the jobs waiting for a worker of a lane. With fair set, jobs
+// are kept per origin and handed out round-robin across the origins with
+// pending jobs, so a flood from one origin does not delay the others. Otherwise
+// every job shares one origin and the queue is first in, first out.
+type laneQueue struct {
+	sync.Mutex
+	fair     bool
+	pending  map[string][]ScriptJob
+	origins  []string // origins with pending jobs, next to be served first
+	size     int
+	capacity int
+
+	// ready holds one token per queued job, workers wait on it
+	ready chan struct{}
+	// space is closed, then replaced, each time a job leaves the queue
+	space chan struct{}
+}
+
+func newLaneQueue(capacity int, fair bool) *laneQueue {
+	return &laneQueue{
+		fair:     fair,
+		pending:  make(map[string][]ScriptJob),
+		capacity: capacity,
+		ready:    make(chan struct{}, capacity),
+		space:    make(chan struct{}),
+	}
+}
+
+// tryPush queues job. When the queue is full it returns false and a channel
+// closed once a slot frees up.
+func (q *laneQueue) tryPush(job ScriptJob) (bool, <-chan struct{}) {
+	q.Lock()
+	defer q.Unlock()
+	if q.size >= q.capacity {
+		return false, q.space
+	}
+	q.push(job)
+	return true, nil
+}
+
+// pushShedding queues job like tryPush, except that a full queue makes room
+// by removing the non-priority job queued the longest, returned as shed. The
+// job takes its place, or with fair set joins the jobs of its own origin. It
+// returns false when the queue is full of priority jobs.
+func (q *laneQueue) pushShedding(job ScriptJob) (pushed bool, shed *ScriptJob) {
+	q.Lock()
+	defer q.Unlock()
+	if q.size < q.capacity {
+		q.push(job)
+		return true, nil
+	}
+
+	var oldest *ScriptJob
+	var oldestOrigin string
+	var oldestIndex int
+	for origin, jobs := range q.pending {
+		// Jobs of an origin are in queue order, its first non-priority job is its oldest
+		for i := range jobs {
+			if jobs[i].Priority {
+				continue
+			}
+			if oldest == nil || jobs[i].queuedAt.Before(oldest.queuedAt) {
+				oldest, oldestOrigin, oldestIndex = &jobs[i], origin, i
+			}
+			break
+		}
+	}
+	if oldest == nil {
+		return false, nil
+	}
+	removed := *oldest
+
+	origin := q.originOf(job)
+	if origin == oldestOrigin {
+		q.pending[origin][oldestIndex] = job
+		return true, &removed
+	}
+	// The slot and ready token of the shed job go to job
+	q.pending[oldestOrigin] = slices.Delete(q.pending[oldestOrigin], oldestIndex, oldestIndex+1)
+	if len(q.pending[oldestOrigin]) == 0 {
+		delete(q.pending, oldestOrigin)
+		q.origins = slices.DeleteFunc(q.origins, func(o string) bool { return o == oldestOrigin })
+	}
+	if len(q.pending[origin]) == 0 {
+		q.origins = append(q.origins, origin)
+	}
+	q.pending[origin] = append(q.pending[origin], job)
+	return true, &removed
+}
+
+// push adds job to the queue, which has room for it, q being locked
+func (q *laneQueue) push(job ScriptJob) {
+	origin := q.originOf(job)
+	if len(q.pending[origin]) == 0 {
+		q.origins = append(q.origins, origin)
+	}
+	q.pending[origin] = append(q.pending[origin], job)
+	q.size++
+	q.ready <- struct{}{}
+}
+
+// pop takes the next job, to be called after receiving from ready
+func (q *laneQueue) pop() (ScriptJob, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if q.size == 0 {
+		return ScriptJob{}, false
+	}
+
+	origin := q.origins[0]
+	jobs := q.pending[origin]
+	job := jobs[0]
+	jobs[0] = ScriptJob{}
+	q.origins = q.origins[1:]
+	if len(jobs) == 1 {
+		delete(q.pending, origin)
+	} else {
+		q.pending[origin] = jobs[1:]
+		// The origin goes back at the end of the round
+		q.origins = append(q.origins, origin)
+	}
+	q.size--
+	close(q.space)
+	q.space = make(chan struct{})
+	return job, true
+}
+
+// drain removes and returns every queued job
+func (q *laneQueue) drain() []ScriptJob {
+	var jobs []ScriptJob
+	for {
+		select {
+		case <-q.ready:
+		default:
+		}
+		job, ok := q.pop()
+		if !ok {
+			return jobs
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+// Len returns the number of queued jobs
+func (q *laneQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.size
+}
+
+// Cap returns the number of jobs the queue can hold
+func (q *laneQueue) Cap() int {
+	return q.capacity
+}
+
+func (q *laneQueue) originOf(job ScriptJob) string {
+	if q.fair {
+		return job.Origin
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueJobs turns "a:1" entries into jobs of origin a running script 1
+func queueJobs(entries ...string) []ScriptJob {
+	jobs := make([]ScriptJob, len(entries))
+	for i, entry := range entries {
+		origin, script, _ := strings.Cut(entry, ":")
+		jobs[i] = ScriptJob{Origin: origin, Script: script}
+	}
+	return jobs
+}
+
+// popAll pops every queued job, returning them as "origin:script"
+func popAll(t *testing.T, q *laneQueue) []string {
+	t.Helper()
+	var popped []string
+	for q.Len() > 0 {
+		<-q.ready
+		job, ok := q.pop()
+		if !ok {
+			t.Fatal("pop found no job while the queue was not empty")
+		}
+		popped = append(popped, job.Origin+":"+job.Script)
+	}
+	return popped
+}
+
+func TestLaneQueueOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		fair   bool
+		pushed []string
+		want   []string
+	}{
+		{
+			name:   "fifo",
+			pushed: []string{"a:1", "a:2", "a:3", "b:1", "b:2"},
+			want:   []string{"a:1", "a:2", "a:3", "b:1", "b:2"},
+		},
+		{
+			name:   "wfq alternates origins",
+			fair:   true,
+			pushed: []string{"a:1", "a:2", "a:3", "b:1", "b:2"},
+			want:   []string{"a:1", "b:1", "a:2", "b:2", "a:3"},
+		},
+		{
+			name:   "wfq with three origins",
+			fair:   true,
+			pushed: []string{"a:1", "a:2", "a:3", "a:4", "b:1", "c:1", "c:2"},
+			want:   []string{"a:1", "b:1", "c:1", "a:2", "c:2", "a:3", "a:4"},
+		},
+		{
+			name:   "wfq keeps the order within an origin",
+			fair:   true,
+			pushed: []string{"b:1", "a:1", "b:2", "a:2"},
+			want:   []string{"b:1", "a:1", "b:2", "a:2"},
+		},
+		{
+			name:   "wfq with one origin",
+			fair:   true,
+			pushed: []string{"a:1", "a:2", "a:3"},
+			want:   []string{"a:1", "a:2", "a:3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newLaneQueue(len(tt.pushed), tt.fair)
+			for _, job := range queueJobs(tt.pushed...) {
+				if pushed, _ := q.tryPush(job); !pushed {
+					t.Fatalf("push of %s:%s refused", job.Origin, job.Script)
+				}
+			}
+			if got := popAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("pop order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// An origin flooding the queue does not delay one that arrives later by more
+// than a turn
+func TestLaneQueueFairAfterFlood(t *testing.T) {
+	q := newLaneQueue(10, true)
+	for _, job := range queueJobs("a:1", "a:2", "a:3", "a:4") {
+		q.tryPush(job)
+	}
+	<-q.ready
+	if job, _ := q.pop(); job.Script != "1" {
+		t.Fatalf("first pop = %s:%s, want a:1", job.Origin, job.Script)
+	}
+	q.tryPush(ScriptJob{Origin: "b", Script: "1"})
+	want := []string{"a:2", "b:1", "a:3", "a:4"}
+	if got := popAll(t, q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("pop order = %v, want %v", got, want)
+	}
+}
+
+func TestLaneQueueCapacity(t *testing.T) {
+	q := newLaneQueue(2, true)
+	for _, job := range queueJobs("a:1", "b:1") {
+		if pushed, _ := q.tryPush(job); !pushed {
+			t.Fatal("push refused under capacity")
+		}
+	}
+	pushed, space := q.tryPush(ScriptJob{Origin: "c", Script: "1"})
+	if pushed || space == nil {
+		t.Fatalf("push on a full queue = %v, %v, want false and a space channel", pushed, space)
+	}
+	select {
+	case <-space:
+		t.Fatal("space signalled before a job left")
+	default:
+	}
+
+	<-q.ready
+	q.pop()
+	select {
+	case <-space:
+	default:
+		t.Fatal("space not signalled once a job left")
+	}
+	if pushed, _ := q.tryPush(ScriptJob{Origin: "c", Script: "1"}); !pushed {
+		t.Fatal("push refused after a slot freed up")
+	}
+
+	drained := q.drain()
+	if len(drained) != 2 || q.Len() != 0 || len(q.ready) != 0 {
+		t.Fatalf("drain returned %d jobs, left %d queued and %d ready tokens", len(drained), q.Len(), len(q.ready))
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatal("pop on an empty queue returned a job")
+	}
+}
+
+func TestLaneQueuePushShedding(t *testing.T) {
+	tests := []struct {
+		name     string
+		fair     bool
+		capacity int
+		queued   []string // "origin:script", a script ending in ! being a priority job
+		push     string
+		wantShed string // "" when nothing is shed
+		wantFull bool   // pushShedding refused the job
+		want     []string
+	}{
+		{name: "room left", capacity: 3, queued: []string{":1"}, push: ":p!", want: []string{":1", ":p!"}},
+		{name: "oldest shed", capacity: 3, queued: []string{":1", ":2", ":3"}, push: ":p!", wantShed: ":1", want: []string{":p!", ":2", ":3"}},
+		{name: "priority jobs kept", capacity: 3, queued: []string{":1!", ":2", ":3"}, push: ":p!", wantShed: ":2", want: []string{":1!", ":p!", ":3"}},
+		{name: "full of priority jobs", capacity: 2, queued: []string{":1!", ":2!"}, push: ":p!", wantFull: true, want: []string{":1!", ":2!"}},
+		{name: "wfq same origin", fair: true, capacity: 2, queued: []string{"a:1", "b:2"}, push: "a:p!", wantShed: "a:1", want: []string{"a:p!", "b:2"}},
+		{name: "wfq origin keeps its turn", fair: true, capacity: 3, queued: []string{"a:1", "b:2", "a:3"}, push: "c:p!", wantShed: "a:1", want: []string{"a:3", "b:2", "c:p!"}},
+		{name: "wfq origin emptied", fair: true, capacity: 2, queued: []string{"a:1", "b:2"}, push: "c:p!", wantShed: "a:1", want: []string{"b:2", "c:p!"}},
+		{name: "wfq oldest across origins", fair: true, capacity: 3, queued: []string{"a:1!", "b:2", "a:3"}, push: "c:p!", wantShed: "b:2", want: []string{"a:1!", "c:p!", "a:3"}},
+	}
+	job := func(entry string, at time.Time) ScriptJob {
+		job := queueJobs(entry)[0]
+		job.Priority = strings.HasSuffix(job.Script, "!")
+		job.queuedAt = at
+		return job
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newLaneQueue(tt.capacity, tt.fair)
+			start := time.Now()
+			for i, entry := range tt.queued {
+				if ok, _ := q.tryPush(job(entry, start.Add(time.Duration(i)*time.Millisecond))); !ok {
+					t.Fatalf("%s not queued", entry)
+				}
+			}
+
+			pushed, shed := q.pushShedding(job(tt.push, start.Add(time.Second)))
+			if pushed == tt.wantFull {
+				t.Fatalf("pushed = %v, want %v", pushed, !tt.wantFull)
+			}
+			gotShed := ""
+			if shed != nil {
+				gotShed = shed.Origin + ":" + shed.Script
+			}
+			if gotShed != tt.wantShed {
+				t.Fatalf("shed %q, want %q", gotShed, tt.wantShed)
+			}
+			if got := popAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("popped %v, want %v", got, tt.want)
+			}
+			select {
+			case <-q.ready:
+				t.Fatal("a ready token is left without a job")
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/grafana/sobek"
+)
+
+// refDataSet holds the reference datasets shared by all executions. It is never
+// modified after loading, so concurrent reads need no locking.
+type refDataSet map[string]map[string]interface{}
+
+// loadRefData reads each configured dataset file. A dataset file is a JSON object
+// whose keys are the lookup keys.
+func loadRefData(files map[string]string) (refDataSet, error) {
+	datasets := make(refDataSet, len(files))
+	for name, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read reference dataset %s: %w", name, err)
+		}
+		var entries map[string]interface{}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse reference dataset %s: %w", name, err)
+		}
+		datasets[name] = entries
+	}
+	return datasets, nil
+}
+
+// installRefData exposes refdata.lookup(dataset, key) to the script. Values are
+// copied on every lookup so a script can never mutate the shared datasets.
+func installRefData(vm *sobek.Runtime, datasets refDataSet) {
+	refdata := vm.NewObject()
+	refdata.Set("lookup", func(dataset, key string) sobek.Value {
+		entries, ok := datasets[dataset]
+		if !ok {
+			panic(vm.NewTypeError("refdata.lookup: unknown dataset %q", dataset))
+		}
+		value, ok := entries[key]
+		if !ok {
+			return sobek.Undefined()
+		}
+		copied, _ := deepClone(value, 0)
+		return vm.ToValue(copied)
+	})
+	vm.Set("refdata", refdata)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRefData writes each dataset to its own file under t.TempDir and returns
+// the refdata option pointing at them
+func writeRefData(t *testing.T, datasets map[string]string) map[string]string {
+	t.Helper()
+	dir := t.TempDir()
+	files := make(map[string]string, len(datasets))
+	for name, content := range datasets {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = path
+	}
+	return files
+}
+
+func TestLoadRefData(t *testing.T) {
+	tests := []struct {
+		name     string
+		datasets map[string]string
+		missing  bool
+		wantErr  string
+	}{
+		{name: "datasets", datasets: map[string]string{"rates": `{"usd": 1.1}`, "codes": `{"fr": "France"}`}},
+		{name: "no datasets", datasets: map[string]string{}},
+		{name: "invalid JSON", datasets: map[string]string{"rates": `{"usd":`}, wantErr: "failed to parse reference dataset rates"},
+		{name: "not an object", datasets: map[string]string{"rates": `[1, 2]`}, wantErr: "failed to parse reference dataset rates"},
+		{name: "missing file", datasets: map[string]string{"rates": `{}`}, missing: true, wantErr: "failed to read reference dataset rates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := writeRefData(t, tt.datasets)
+			if tt.missing {
+				for name := range files {
+					files[name] += ".missing"
+				}
+			}
+			set, err := loadRefData(files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(set) != len(tt.datasets) {
+				t.Fatalf("%d datasets loaded, want %d", len(set), len(tt.datasets))
+			}
+		})
+	}
+}
+
+func TestRefDataLookup(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	set, err := loadRefData(writeRefData(t, map[string]string{
+		"rates": `{"usd": 1.1, "list": [1, 2], "nested": {"a": {"b": 1}}}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.shared.Store(&sharedData{refData: set})
+
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr string
+	}{
+		{"value", `refdata.lookup("rates", "usd")`, 1.1, ""},
+		{"missing key", `typeof refdata.lookup("rates", "eur")`, "undefined", ""},
+		{"unknown dataset", `refdata.lookup("nope", "usd")`, nil, `unknown dataset "nope"`},
+		{"copies are independent", `refdata.lookup("rates", "nested").a.b = 2; refdata.lookup("rates", "nested").a.b`, int64(1), ""},
+		{"arrays are copied", `refdata.lookup("rates", "list").push(3); refdata.lookup("rates", "list").length`, int64(2), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+	if got := set["rates"]["nested"].(map[string]interface{})["a"].(map[string]interface{})["b"]; got != 1.0 {
+		t.Fatalf("shared dataset changed to %v", got)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/grafana/sobek"
+)
+
+// installRegex exposes regexMatch and regexTest, backed by Go's RE2 engine. RE2
+// runs in time linear to the input whatever the pattern, unlike the backtracking
+// native RegExp, at the cost of backreferences and lookarounds.
+func installRegex(vm *sobek.Runtime) {
+	// regexMatch follows String.prototype.match: without the g flag the first
+	// match and its groups, with it every match, null when nothing matches
+	vm.Set("regexMatch", func(pattern, text string, flags sobek.Value) sobek.Value {
+		re, global := compileRegex(vm, "regexMatch", pattern, flags)
+		if global {
+			matches := re.FindAllString(text, -1)
+			if matches == nil {
+				return sobek.Null()
+			}
+			return vm.ToValue(matches)
+		}
+
+		loc := re.FindStringSubmatchIndex(text)
+		if loc == nil {
+			return sobek.Null()
+		}
+		groups := make([]interface{}, len(loc)/2)
+		for i := range groups {
+			if loc[2*i] >= 0 {
+				groups[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		return vm.ToValue(groups)
+	})
+
+	vm.Set("regexTest", func(pattern, text string, flags sobek.Value) bool {
+		re, _ := compileRegex(vm, "regexTest", pattern, flags)
+		return re.MatchString(text)
+	})
+}
+
+// compileRegex compiles pattern with the JS-style flags i, m, s and g, reporting
+// whether g was given. Bad patterns and flags throw a TypeError in the script.
+func compileRegex(vm *sobek.Runtime, fn, pattern string, flags sobek.Value) (*regexp.Regexp, bool) {
+	global := false
+	var inline strings.Builder
+	if flags != nil && !sobek.IsUndefined(flags) {
+		for _, flag := range flags.String() {
+			switch flag {
+			case 'i', 'm', 's':
+				inline.WriteRune(flag)
+			case 'g':
+				global = true
+			default:
+				panic(vm.NewTypeError("%s: unsupported flag %q", fn, flag))
+			}
+		}
+	}
+	if inline.Len() > 0 {
+		pattern = "(?" + inline.String() + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		panic(vm.NewTypeError("%s: invalid pattern: %v", fn, err))
+	}
+	return re, global
+}
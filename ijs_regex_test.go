@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegexHelpers(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr string
+	}{
+		{"first match and groups", `JSON.stringify(regexMatch("(\\w+)@(\\w+)", "mail bob@example now"))`, `["bob@example","bob","example"]`, ""},
+		{"unmatched group", `JSON.stringify(regexMatch("a(b)?", "a"))`, `["a",null]`, ""},
+		{"global", `JSON.stringify(regexMatch("\\d+", "1 22 333", "g"))`, `["1","22","333"]`, ""},
+		{"no match", `regexMatch("x", "abc")`, nil, ""},
+		{"no global match", `regexMatch("x", "abc", "g")`, nil, ""},
+		{"test", `regexTest("^ab", "abc")`, true, ""},
+		{"case insensitive", `regexTest("^AB", "abc", "i")`, true, ""},
+		{"multiline", `regexTest("^b$", "a\nb", "m")`, true, ""},
+		{"dot all", `regexTest("a.b", "a\nb", "s")`, true, ""},
+		{"without dot all", `regexTest("a.b", "a\nb")`, false, ""},
+		{"unsupported flag", `regexTest("a", "a", "y")`, nil, `regexTest: unsupported flag 'y'`},
+		{"invalid pattern", `regexMatch("(", "a")`, nil, "regexMatch: invalid pattern"},
+		{"backreference", `regexTest("(a)\\1", "aa")`, nil, "regexTest: invalid pattern"},
+		{"lookahead", `regexTest("a(?=b)", "ab")`, nil, "regexTest: invalid pattern"},
+		{"errors are catchable", `try { regexTest("(", "") } catch (e) { e instanceof TypeError }`, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+}
+
+// TestRegexAdversarialPattern runs patterns that make a backtracking engine
+// take exponential time. RE2 answers in time linear to the input, so the whole
+// table runs well within one script_timeout.
+func TestRegexAdversarialPattern(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 5 * time.Second
+	})
+	for _, pattern := range []string{`(a+)+$`, `(a|aa)+$`, `(a*)*b`, `^(\\w+\\s?)*$`} {
+		t.Run(pattern, func(t *testing.T) {
+			start := time.Now()
+			result, err := sm.ExecuteScriptWithTimeout(`regexTest("` + pattern + `", "a".repeat(100000) + "!")`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != false {
+				t.Fatalf("result = %v, want false", result)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("took %s on an adversarial input", elapsed)
+			}
+		})
+	}
+}
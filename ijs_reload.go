@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/grafana/sobek"
+	"github.com/sirupsen/logrus"
+)
+
+// sharedData is what every execution starts from and reload replaces: the
+// reference datasets and the compiled preamble. It is never modified, a reload
+// swapping in a new one, so a running script keeps the one it started with.
+type sharedData struct {
+	refData  refDataSet
+	preamble *sobek.Program // nil without a preamble_file
+}
+
+// currentShared returns the reference data and preamble new executions get
+func (sm *ScriptManager) currentShared() *sharedData {
+	if shared := sm.shared.Load(); shared != nil {
+		return shared
+	}
+	return &sharedData{}
+}
+
+// loadShared reads the reference dataset files and compiles the preamble
+func (sm *ScriptManager) loadShared() (*sharedData, error) {
+	refData, err := loadRefData(config.RefData)
+	if err != nil {
+		return nil, err
+	}
+	preamble, err := sm.loadPreamble(config.PreambleFile, refData)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedData{refData: refData, preamble: preamble}, nil
+}
+
+// reload reads the reference dataset files and the preamble again and swaps
+// them in at once. When any of them fails to load nothing is swapped, the
+// current datasets and preamble staying in place.
+func (sm *ScriptManager) reload() (int, error) {
+	shared, err := sm.loadShared()
+	if err != nil {
+		return 0, fmt.Errorf("reload failed, keeping the current reference data and preamble: %w", err)
+	}
+	sm.shared.Store(shared)
+	// Results cached before now may have read the previous datasets
+	atomic.AddUint64(&sm.reloads, 1)
+	logrus.WithFields(logrus.Fields{
+		"datasets": len(shared.refData),
+		"preamble": shared.preamble != nil,
+	}).Info("Reference data and preamble reloaded")
+	return len(shared.refData), nil
+}
+
+// handleReloadSignal reloads the reference data and preamble on every SIGHUP
+func handleReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := scriptManager.reload(); err != nil {
+				logrus.WithError(err).Error("SIGHUP reload failed")
+			}
+		}
+	}()
+}
+
+// reloadHandler serves POST /admin/reload
+func reloadHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		datasets, err := scriptManager.reload()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, Response{Error: err.Error()})
+			logrus.WithError(err).Error("Admin reload failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Result: map[string]int{"datasets": datasets}})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/grafana/sobek"
+)
+
+var (
+	errRenderTooLarge = errors.New("output exceeds render_max_bytes")
+	errRenderBlocked  = errors.New("function is not available in templates")
+)
+
+// renderFuncs replaces the template builtins that could reach outside the data,
+// every other builtin only reads the data it is given
+var renderFuncs = template.FuncMap{
+	"call": func(...interface{}) (interface{}, error) { return nil, errRenderBlocked },
+}
+
+// renderTick names the function called at the start of every list of a
+// template, see addRenderTicks
+const renderTick = "renderTick"
+
+// installRender exposes render(template, data), which renders a text/template
+// against a JSON copy of data. Rendering stops once the output grows past
+// maxBytes, or when the script context ends, even for a template looping
+// without writing anything, which is checked on every iteration.
+func installRender(vm *sobek.Runtime, ctx context.Context, maxBytes int) {
+	vm.Set("render", func(text string, data sobek.Value) string {
+		ticks := template.FuncMap{renderTick: func() (string, error) { return "", ctx.Err() }}
+		tmpl, err := template.New("render").Funcs(renderFuncs).Funcs(ticks).Parse(text)
+		if err == nil {
+			err = addRenderTicks(tmpl, ticks)
+		}
+		if err != nil {
+			panic(vm.NewGoError(fmt.Errorf("render: %w", err)))
+		}
+
+		// Only plain data crosses over, the template never sees script functions
+		var encoded []byte
+		if obj, ok := data.(*sobek.Object); ok {
+			encoded, err = obj.MarshalJSON()
+		} else {
+			encoded, err = json.Marshal(data.Export())
+		}
+		var value interface{}
+		if err == nil {
+			err = json.Unmarshal(encoded, &value)
+		}
+		if err != nil {
+			panic(vm.NewTypeError("render: data must be JSON serializable: %v", err))
+		}
+
+		type rendered struct {
+			out string
+			err error
+		}
+		done := make(chan rendered, 1)
+		go func() {
+			w := &renderWriter{ctx: ctx, max: maxBytes}
+			err := tmpl.Execute(w, value)
+			done <- rendered{w.buf.String(), err}
+		}()
+
+		select {
+		case r := <-done:
+			if r.err != nil {
+				panic(vm.NewGoError(fmt.Errorf("render: %w", r.err)))
+			}
+			return r.out
+		case <-ctx.Done():
+			panic(vm.NewGoError(fmt.Errorf("render: %w", ctx.Err())))
+		}
+	})
+}
+
+// addRenderTicks makes every list of the templates of tmpl start with a call to
+// renderTick, which fails once the script context ends. text/template cannot
+// be stopped from outside, and a loop writing nothing, a large range or a
+// recursive template, never reaches renderWriter. Every range iteration and
+// template invocation runs a list, so the call stops them all.
+func addRenderTicks(tmpl *template.Template, ticks template.FuncMap) error {
+	probe, err := template.New("tick").Funcs(ticks).Parse("{{" + renderTick + "}}")
+	if err != nil {
+		return err
+	}
+	tick := probe.Tree.Root.Nodes[0]
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			insertRenderTick(t.Tree.Root, tick)
+		}
+	}
+	return nil
+}
+
+func insertRenderTick(node parse.Node, tick parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			insertRenderTick(child, tick)
+		}
+		n.Nodes = append([]parse.Node{tick}, n.Nodes...)
+	case *parse.IfNode:
+		insertRenderTick(n.List, tick)
+		insertRenderTick(n.ElseList, tick)
+	case *parse.RangeNode:
+		insertRenderTick(n.List, tick)
+		insertRenderTick(n.ElseList, tick)
+	case *parse.WithNode:
+		insertRenderTick(n.List, tick)
+		insertRenderTick(n.ElseList, tick)
+	}
+}
+
+// renderWriter buffers the template output and fails once the context ends or
+// the output exceeds max bytes, which aborts the template execution
+type renderWriter struct {
+	ctx context.Context
+	buf bytes.Buffer
+	max int
+}
+
+func (w *renderWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if w.max > 0 && w.buf.Len()+len(p) > w.max {
+		return 0, errRenderTooLarge
+	}
+	return w.buf.Write(p)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 200 * time.Millisecond
+		c.RenderMaxBytes = 64
+	})
+	tests := []struct {
+		name    string
+		script  string
+		want    string
+		wantErr string
+	}{
+		{"fields", `render("{{.name}} has {{.count}} items", {name: "cart", count: 3})`, "cart has 3 items", ""},
+		{"range", `render("{{range .rows}}{{.name}}={{.n}};{{end}}", {rows: [{name: "a", n: 1}, {name: "b", n: 2}]})`, "a=1;b=2;", ""},
+		{"functions are data", `render("{{.f}}", {f: function() { return 1 }})`, "<no value>", ""},
+		{"call blocked", `render("{{call .f}}", {f: 1})`, "", "not available in templates"},
+		{"output too large", `render("{{range 100}}x{{end}}", {})`, "", "render_max_bytes"},
+		{"invalid template", `render("{{.name", {})`, "", "render:"},
+		{"loop without output", `render("{{range 9999999999}}{{end}}", {})`, "", "deadline exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("render = %q, want %q", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTicksStopTemplates(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"range over an integer", `{{range 9999999999}}{{end}}`},
+		{"nested ranges", `{{range .}}{{range $}}{{range $}}{{range $}}{{end}}{{end}}{{end}}{{end}}`},
+		{"branches", `{{range 9999999999}}{{if .}}{{else}}{{with 1}}{{end}}{{end}}{{end}}`},
+		{"defined template", `{{define "loop"}}{{range 9999999999}}{{end}}{{end}}{{template "loop"}}`},
+	}
+	data := make([]int, 1000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			ticks := template.FuncMap{renderTick: func() (string, error) { return "", ctx.Err() }}
+			tmpl := template.Must(template.New("render").Funcs(renderFuncs).Funcs(ticks).Parse(tt.text))
+			if err := addRenderTicks(tmpl, ticks); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			err := tmpl.Execute(io.Discard, data)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Execute() = %v, want the context deadline", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("template ran %s past its deadline", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/sobek"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrReplNotFound is returned for snippets sent to an unknown or expired REPL session
+var ErrReplNotFound = errors.New("repl session not found or expired")
+
+// ErrReplBusy is returned for a snippet sent while the previous snippet of the
+// session is still running
+var ErrReplBusy = errors.New("repl session is running another snippet")
+
+// replSweepInterval is how often idle REPL sessions are looked for
+const replSweepInterval = 10 * time.Second
+
+// replSession keeps a VM alive between snippets, so each snippet runs in the
+// scope left by the previous ones. Snippets of a session run one at a time.
+type replSession struct {
+	sync.Mutex
+	id         string
+	vm         *sobek.Runtime // nil once the session is closed
+	stringify  sobek.Callable
+	from       sobek.Callable
+	promises   promiseResolver
+	rejections *rejectionTracker
+	globals    map[string]struct{}       // globals of the VM before the first snippet, not part of the scope
+	bindings   map[string]*sobek.Program // reads each top-level let, const and class of the snippets
+	scopeBytes uint64                    // approximate size of the scope after the last snippet
+	lastUsed   time.Time
+}
+
+// replTable holds the open REPL sessions. A session is closed repl_ttl after
+// its last snippet, by a sweep every replSweepInterval.
+type replTable struct {
+	sync.Mutex
+	sessions map[string]*replSession
+}
+
+func newReplTable() *replTable {
+	return &replTable{sessions: make(map[string]*replSession)}
+}
+
+// create opens a new session on a fresh VM and returns its ID, failing once
+// max_repl_sessions are open
+func (t *replTable) create() (string, error) {
+	t.Lock()
+	open := len(t.sessions)
+	t.Unlock()
+	if open >= config.MaxReplSessions {
+		return "", ErrTooManySessions
+	}
+
+	var raw [16]byte
+	rand.Read(raw[:])
+	s := &replSession{
+		id:       hex.EncodeToString(raw[:]),
+		vm:       newRuntime(),
+		bindings: make(map[string]*sobek.Program),
+		lastUsed: time.Now(),
+	}
+	// Keep our own references so snippets cannot replace them
+	s.stringify, _ = sobek.AssertFunction(s.vm.Get("JSON").ToObject(s.vm).Get("stringify"))
+	s.from, _ = sobek.AssertFunction(s.vm.Get("Array").ToObject(s.vm).Get("from"))
+	s.promises = newPromiseResolver(s.vm)
+	s.rejections = trackRejections(s.vm)
+
+	t.Lock()
+	defer t.Unlock()
+	// Checked again, the VM was created outside the lock
+	if len(t.sessions) >= config.MaxReplSessions {
+		return "", ErrTooManySessions
+	}
+	t.sessions[s.id] = s
+	return s.id, nil
+}
+
+// get returns the open session id
+func (t *replTable) get(id string) (*replSession, error) {
+	t.Lock()
+	defer t.Unlock()
+	s, ok := t.sessions[id]
+	if !ok {
+		return nil, ErrReplNotFound
+	}
+	return s, nil
+}
+
+// close drops session id, reporting whether it was open
+func (t *replTable) close(id string) bool {
+	t.Lock()
+	s, ok := t.sessions[id]
+	delete(t.sessions, id)
+	t.Unlock()
+	// A snippet still running keeps the VM until it returns, the session is
+	// unreachable already
+	if ok && s.TryLock() {
+		s.vm = nil
+		s.Unlock()
+	}
+	return ok
+}
+
+// footprints lists the idle sessions with the approximate size of their scope
+func (t *replTable) footprints() []sessionFootprint {
+	t.Lock()
+	defer t.Unlock()
+	list := make([]sessionFootprint, 0, len(t.sessions))
+	for id, s := range t.sessions {
+		if !s.TryLock() {
+			continue
+		}
+		list = append(list, sessionFootprint{kind: "repl", id: id, bytes: s.scopeBytes, lastUsed: s.lastUsed})
+		s.Unlock()
+	}
+	return list
+}
+
+// evict closes session id unless it is running a snippet, reporting whether it did
+func (t *replTable) evict(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	s, ok := t.sessions[id]
+	if !ok || !s.TryLock() {
+		return false
+	}
+	s.vm = nil
+	delete(t.sessions, id)
+	s.Unlock()
+	return true
+}
+
+// sweep closes the sessions idle for longer than ttl. Sessions running a
+// snippet are busy, not idle, and are skipped.
+func (t *replTable) sweep(ttl time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for id, s := range t.sessions {
+		if !s.TryLock() {
+			continue
+		}
+		if now.Sub(s.lastUsed) > ttl {
+			s.vm = nil
+			delete(t.sessions, id)
+			logrus.WithField("repl_id", id).Info("REPL session expired")
+		}
+		s.Unlock()
+	}
+}
+
+// expireLoop sweeps the idle sessions until done is closed
+func (t *replTable) expireLoop(ttl time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(replSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.sweep(ttl)
+		case <-done:
+			return
+		}
+	}
+}
+
+// executeSnippet runs job as the next snippet of its REPL session. It is run by
+// a worker like any script, through executeBounded, so snippets share the lanes,
+// limits and timeouts of stateless scripts. Host functions are installed again
+// for every snippet, as they are bound to its context. A session whose scope
+// holds more than repl_max_memory_mb once the snippet ran is closed.
+func (sm *ScriptManager) executeSnippet(ctx context.Context, job ScriptJob, cancel context.CancelFunc) ScriptResult {
+	if config.LockOSThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	program, err := sm.compileScript(job.Script)
+	if err != nil {
+		return ScriptResult{Error: err}
+	}
+
+	// Not waiting for a running snippet: one abandoned past hard_kill_timeout
+	// would otherwise hold every worker the next snippets are given to
+	s := job.repl
+	if !s.TryLock() {
+		return ScriptResult{Error: ErrReplBusy}
+	}
+	defer s.Unlock()
+	if s.vm == nil {
+		return ScriptResult{Error: ErrReplNotFound}
+	}
+	vm := s.vm
+	s.lastUsed = time.Now()
+
+	out := &scriptOutput{}
+	sm.installHostFunctions(vm, ctx, job, out)
+	if s.globals == nil {
+		// The session gets the preamble of its first snippet
+		if err := runPreamble(vm, sm.currentShared()); err != nil {
+			return ScriptResult{Error: err}
+		}
+		// Taken once the host functions and preamble are in, only what snippets add is scope
+		s.globals = make(map[string]struct{})
+		for _, key := range vm.GlobalObject().GetOwnPropertyNames() {
+			s.globals[key] = struct{}{}
+		}
+	}
+	s.rejections.unhandled = nil
+
+	sm.Lock()
+	sm.runningScripts[job.id] = RunningScriptInfo{
+		cancelFunc: cancel,
+		vm:         vm,
+		script:     job.Script,
+		lane:       sm.laneFor(job),
+		started:    time.Now(),
+		origin:     job.Origin,
+	}
+	sm.Unlock()
+	// Interrupt on cancellation unless cancelAllScripts already did, keeping its reason
+	stopInterrupt := context.AfterFunc(ctx, func() {
+		sm.RLock()
+		_, running := sm.runningScripts[job.id]
+		sm.RUnlock()
+		if running {
+			reason := ctx.Err()
+			if errors.Is(reason, context.DeadlineExceeded) {
+				reason = ErrScriptTimeout
+			}
+			vm.Interrupt(reason)
+		}
+	})
+	stopBudget := watchRunTimeBudget(vm, config.MaxRunTime)
+
+	limit := uint64(config.ReplMaxMemoryMB) << 20
+	start, allocStart := time.Now(), heapAllocBytes()
+	result := s.evaluate(program, out)
+	// Measured while the snippet can still be interrupted, reading the scope runs its getters
+	s.declare(job.Script)
+	scope, err := s.measureScope(limit)
+	if err != nil && result.Error == nil {
+		result = ScriptResult{Error: err}
+	}
+	result.Duration = time.Since(start)
+	result.AllocBytes = heapAllocBytes() - allocStart
+
+	stopBudget()
+	stopInterrupt()
+	sm.Lock()
+	delete(sm.runningScripts, job.id)
+	sm.Unlock()
+	// The next snippet must not see an interrupt that came in late
+	vm.ClearInterrupt()
+
+	s.scopeBytes = scope
+	if scope > limit {
+		s.vm = nil
+		sm.repls.Lock()
+		delete(sm.repls.sessions, s.id)
+		sm.repls.Unlock()
+		logrus.WithFields(logrus.Fields{
+			"repl_id":  s.id,
+			"scope_mb": scope >> 20,
+			"limit_mb": config.ReplMaxMemoryMB,
+		}).Warn("REPL session closed over its memory limit")
+		return ScriptResult{Error: fmt.Errorf("%w: repl session holds over %d MB", ErrMemoryLimit, config.ReplMaxMemoryMB), Duration: result.Duration, AllocBytes: result.AllocBytes}
+	}
+	return result
+}
+
+// evaluate runs program on the session VM and exports its result, with the same
+// checks as a stateless execution but for max_user_globals, the scope being
+// meant to grow
+func (s *replSession) evaluate(program *sobek.Program, out *scriptOutput) ScriptResult {
+	value, err := s.vm.RunProgram(program)
+	if cause := interruptCause(err); cause != nil {
+		return ScriptResult{Error: cause}
+	}
+	if overflow, ok := err.(*sobek.StackOverflowError); ok {
+		return ScriptResult{Error: fmt.Errorf("%w: %s", ErrCallStackExceeded, strings.TrimSpace(overflow.Error()))}
+	}
+	if err != nil {
+		return ScriptResult{Error: thrownError(s.vm, err)}
+	}
+	if value, err = s.promises.settle(value); err != nil {
+		return ScriptResult{Error: err}
+	}
+	if err := s.rejections.err(); err != nil {
+		return ScriptResult{Error: err}
+	}
+	if err := checkResultSize(s.vm, s.stringify, value, config.MaxResultBytes); err != nil {
+		return ScriptResult{Error: err}
+	}
+	exported, err := exportResult(s.vm, value)
+	if err != nil {
+		return ScriptResult{Error: err}
+	}
+	if err := checkArrayLengths(exported, config.MaxArrayLength); err != nil {
+		return ScriptResult{Error: fmt.Errorf("%w: %v", ErrResultArrayTooLong, err)}
+	}
+	return ScriptResult{Result: exported, Status: out.status, ContentType: out.contentType}
+}
+
+// ReplResponse is the body returned by POST /repl
+type ReplResponse struct {
+	ReplID string `json:"repl_id"`
+}
+
+// createReplHandler serves POST /repl
+func createReplHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := scriptManager.repls.create()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: err.Error(), Code: errorCode(err)})
+			logrus.WithError(err).Warn("Rejected REPL session creation")
+			return
+		}
+		logrus.WithField("repl_id", id).Info("REPL session created")
+		writeJSONValue(w, http.StatusCreated, ReplResponse{ReplID: id})
+	}
+}
+
+// replSnippetHandler serves POST /repl/{id}, running the raw request body as
+// the next snippet of the session
+func replSnippetHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readScriptBody(w, r, scriptManager.maxScriptSize)
+		if !ok {
+			return
+		}
+
+		if !scriptManager.GetAcceptingScript() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(memoryResumeDelay.Seconds())))
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: config.BackoffMessage, Code: CodeIntakePaused})
+			logrus.Warn("Rejected snippet as the system is not accepting scripts")
+			return
+		}
+
+		session, err := scriptManager.repls.get(r.PathValue("id"))
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, Response{Error: err.Error(), Code: errorCode(err)})
+			return
+		}
+
+		result := scriptManager.ExecuteScriptWithContext(r.Context(), ScriptJob{
+			Script:   string(body),
+			Priority: isPriorityRequest(r),
+			Origin:   requestOrigin(r),
+			repl:     session,
+		})
+		scriptManager.enforceSessionMemory()
+		response := Response{Result: result.Result}
+		w.Header().Set("Content-Type", "application/json")
+		if result.Error != nil {
+			switch {
+			case errors.Is(result.Error, ErrReplNotFound):
+				w.WriteHeader(http.StatusNotFound)
+			case errors.Is(result.Error, ErrReplBusy):
+				w.WriteHeader(http.StatusConflict)
+			default:
+				handleExecutionError(result.Error, w)
+			}
+			response.Error = result.Error.Error()
+			response.Code = errorCode(result.Error)
+		}
+		if err := encodeResponse(w, response, isPrettyRequest(r)); err != nil {
+			logrus.WithError(err).Error("Failed to encode response")
+		}
+	}
+}
+
+// closeReplHandler serves DELETE /repl/{id}
+func closeReplHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !scriptManager.repls.close(id) {
+			writeJSON(w, http.StatusNotFound, Response{Error: ErrReplNotFound.Error(), Code: errorCode(ErrReplNotFound)})
+			return
+		}
+		logrus.WithField("repl_id", id).Info("REPL session closed")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRepl opens a REPL session on sm, creating its table on the first call
+func newTestRepl(t *testing.T, sm *ScriptManager) *replSession {
+	t.Helper()
+	if sm.repls == nil {
+		sm.repls = newReplTable()
+	}
+	id, err := sm.repls.create()
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	s, err := sm.repls.get(id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	return s
+}
+
+// runTestSnippet runs snippet in session s the way POST /repl/{id} does
+func runTestSnippet(sm *ScriptManager, s *replSession, snippet string) ScriptResult {
+	return sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: snippet, repl: s})
+}
+
+func TestReplKeepsState(t *testing.T) {
+	tests := []struct {
+		name     string
+		snippets []string
+		want     interface{}
+		code     string
+	}{
+		{name: "var", snippets: []string{"var a = 2", "a * 21"}, want: int64(42)},
+		{name: "let and const", snippets: []string{"let a = 40", "const b = 2", "a + b"}, want: int64(42)},
+		{name: "function", snippets: []string{"function twice(x) { return 2 * x }", "twice(21)"}, want: int64(42)},
+		{name: "class", snippets: []string{"class P { get v() { return 42 } }", "new P().v"}, want: int64(42)},
+		{name: "object mutated", snippets: []string{"var o = {n: 1}", "o.n += 41", "o.n"}, want: int64(42)},
+		{name: "state kept after a failure", snippets: []string{"var a = 42", "throw new Error('boom')", "a"}, want: int64(42)},
+		{name: "syntax error", snippets: []string{"var a = "}, code: CodeSyntaxError},
+		{name: "redeclared let", snippets: []string{"let a = 1", "let a = 2"}, code: CodeRuntimeError},
+		{name: "timeout", snippets: []string{"for (;;) {}"}, code: CodeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.EnableRepl = true
+				c.ScriptTimeout = 200 * time.Millisecond
+			})
+			s := newTestRepl(t, sm)
+			var result ScriptResult
+			for _, snippet := range tt.snippets {
+				result = runTestSnippet(sm, s, snippet)
+			}
+			if tt.code != "" {
+				if code := errorCode(result.Error); code != tt.code {
+					t.Fatalf("code = %s (%v), want %s", code, result.Error, tt.code)
+				}
+				return
+			}
+			if result.Error != nil {
+				t.Fatalf("error: %v", result.Error)
+			}
+			if result.Result != tt.want {
+				t.Fatalf("result = %#v, want %#v", result.Result, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplRunsOnWorkers(t *testing.T) {
+	t.Run("shed under CPU pressure", func(t *testing.T) {
+		sm := newTestManager(t, func(c *Config) {
+			c.EnableRepl = true
+			c.CPUPressurePolicy = cpuPressureShed
+		})
+		s := newTestRepl(t, sm)
+		sm.cpuPressure = 1
+		if result := runTestSnippet(sm, s, "1"); !errors.Is(result.Error, ErrCPUPressure) {
+			t.Fatalf("error = %v, want ErrCPUPressure", result.Error)
+		}
+	})
+
+	t.Run("listed as running", func(t *testing.T) {
+		sm := newTestManager(t, func(c *Config) { c.EnableRepl = true })
+		s := newTestRepl(t, sm)
+		done := make(chan ScriptResult)
+		go func() { done <- runTestSnippet(sm, s, "for (;;) {}") }()
+		deadline := time.Now().Add(time.Second)
+		for {
+			sm.RLock()
+			running := len(sm.runningScripts)
+			sm.RUnlock()
+			if running == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("snippet never listed in runningScripts")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if result := runTestSnippet(sm, s, "1"); !errors.Is(result.Error, ErrReplBusy) {
+			t.Fatalf("concurrent snippet error = %v, want ErrReplBusy", result.Error)
+		}
+		sm.cancelAllScripts(ErrScriptCancelled)
+		if result := <-done; !errors.Is(result.Error, ErrScriptCancelled) {
+			t.Fatalf("error = %v, want ErrScriptCancelled", result.Error)
+		}
+	})
+}
+
+func TestReplSweep(t *testing.T) {
+	tests := []struct {
+		name     string
+		idle     time.Duration
+		busy     bool
+		wantOpen bool
+	}{
+		{name: "recently used", idle: time.Second, wantOpen: true},
+		{name: "idle past the ttl", idle: time.Hour},
+		{name: "busy past the ttl", idle: time.Hour, busy: true, wantOpen: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) { c.EnableRepl = true })
+			s := newTestRepl(t, sm)
+			s.lastUsed = time.Now().Add(-tt.idle)
+			if tt.busy {
+				s.Lock()
+			}
+			sm.repls.sweep(time.Minute)
+			if tt.busy {
+				s.Unlock()
+			}
+			_, err := sm.repls.get(s.id)
+			if open := err == nil; open != tt.wantOpen {
+				t.Fatalf("open = %t, want %t", open, tt.wantOpen)
+			}
+			if !tt.wantOpen {
+				if result := runTestSnippet(sm, s, "1"); !errors.Is(result.Error, ErrReplNotFound) {
+					t.Fatalf("snippet after expiry error = %v, want ErrReplNotFound", result.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestReplMemoryLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		snippet string
+		over    bool
+	}{
+		{name: "small scope", snippet: "var a = 'x'.repeat(1000)"},
+		{name: "garbage is not held", snippet: "for (let i = 0; i < 200; i++) 'x'.repeat(100000); 1"},
+		{name: "global string", snippet: "var a = 'x'.repeat(2 << 20)", over: true},
+		{name: "let binding", snippet: "let a = 'x'.repeat(2 << 20)", over: true},
+		{name: "typed array", snippet: "const a = new Uint8Array(2 << 20)", over: true},
+		{name: "nested in an object", snippet: "var o = {list: [{s: 'x'.repeat(2 << 20)}]}", over: true},
+		{name: "map entries", snippet: "var m = new Map([['k', 'x'.repeat(2 << 20)]])", over: true},
+		{name: "behind a throwing getter", snippet: "var o = {get a() { throw 1 }, b: 'x'.repeat(2 << 20)}", over: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.EnableRepl = true
+				c.ReplMaxMemoryMB = 1
+			})
+			s := newTestRepl(t, sm)
+			result := runTestSnippet(sm, s, tt.snippet)
+			if over := errors.Is(result.Error, ErrMemoryLimit); over != tt.over {
+				t.Fatalf("over = %t (%v), want %t", over, result.Error, tt.over)
+			}
+			if _, err := sm.repls.get(s.id); (err != nil) != tt.over {
+				t.Fatalf("session closed = %t, want %t", err != nil, tt.over)
+			}
+		})
+	}
+}
+
+func TestMeasureScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		snippet  string
+		min, max uint64
+	}{
+		{name: "nothing declared", snippet: "1 + 1", max: 0},
+		{name: "string", snippet: "var s = 'x'.repeat(10000)", min: 10000, max: 10100},
+		{name: "shared object counted once", snippet: "var a = {s: 'x'.repeat(10000)}; var b = a", min: 10000, max: 10200},
+		{name: "cycle", snippet: "var a = {}; a.self = a; var s = 'x'.repeat(10000); 0", min: 10000, max: 10200},
+		{name: "array buffer", snippet: "let b = new ArrayBuffer(10000)", min: 10000, max: 10100},
+		{name: "float64 array", snippet: "let f = new Float64Array(1000)", min: 8000, max: 8100},
+		{name: "set", snippet: "const s = new Set(['x'.repeat(10000)])", min: 10000, max: 10300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) { c.EnableRepl = true })
+			s := newTestRepl(t, sm)
+			if result := runTestSnippet(sm, s, tt.snippet); result.Error != nil {
+				t.Fatalf("error: %v", result.Error)
+			}
+			if s.scopeBytes < tt.min || s.scopeBytes > tt.max {
+				t.Fatalf("scope = %d bytes, want %d to %d", s.scopeBytes, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestReplSnippetHandler(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.EnableRepl = true })
+	s := newTestRepl(t, sm)
+	mux := http.NewServeMux()
+	mux.Handle("POST /repl/{id}", replSnippetHandler(sm))
+
+	tests := []struct {
+		name   string
+		id     string
+		busy   bool
+		status int
+		body   string
+	}{
+		{name: "snippet", id: s.id, status: http.StatusOK, body: `"result":2`},
+		{name: "unknown session", id: "nope", status: http.StatusNotFound, body: CodeReplNotFound},
+		{name: "busy session", id: s.id, busy: true, status: http.StatusConflict, body: CodeReplBusy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.busy {
+				s.Lock()
+				defer s.Unlock()
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/repl/"+tt.id, strings.NewReader("1 + 1")))
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+				t.Fatalf("got %d %s, want %d containing %s", w.Code, w.Body, tt.status, tt.body)
+			}
+		})
+	}
+}
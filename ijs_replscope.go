@@ -0,0 +1,203 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/grafana/sobek"
+	"github.com/grafana/sobek/ast"
+)
+
+// What the scope meter counts for the parts of a value it cannot see into
+const (
+	scopeValueBytes  = 16 // a primitive, or one more reference to a counted object
+	scopeObjectBytes = 64 // an object or function, before its properties
+)
+
+// Export types of the values the scope meter does not list the properties of
+var (
+	arrayBufferType = reflect.TypeOf(sobek.ArrayBuffer{})
+	mapEntriesType  = reflect.TypeOf([][2]interface{}{})
+	setValuesType   = reflect.TypeOf([]interface{}{})
+)
+
+// declare records the top-level let, const and class bindings of snippet. They
+// live in the scope of the session without being properties of the global
+// object, so each gets a program reading it.
+func (s *replSession) declare(snippet string) {
+	program, err := parseScript(snippet)
+	if err != nil {
+		return
+	}
+	for _, statement := range program.Body {
+		var names []string
+		switch st := statement.(type) {
+		case *ast.LexicalDeclaration:
+			for _, binding := range st.List {
+				names = append(names, bindingNames(binding.Target)...)
+			}
+		case *ast.ClassDeclaration:
+			names = append(names, st.Class.Name.Name.String())
+		}
+		for _, name := range names {
+			if _, ok := s.bindings[name]; ok {
+				continue
+			}
+			if read, err := sobek.Compile("", name, false); err == nil {
+				s.bindings[name] = read
+			}
+		}
+	}
+}
+
+// measureScope returns the approximate bytes held by the scope of the session,
+// the globals and top-level bindings its snippets declared, counting no further
+// than just past limit. Reading the scope may run getters, the error is the
+// interruption, such as ErrScriptTimeout, that cut the measure short.
+func (s *replSession) measureScope(limit uint64) (uint64, error) {
+	m := newScopeMeter(s.vm, s.from, limit)
+	global := s.vm.GlobalObject()
+	for _, name := range global.GetOwnPropertyNames() {
+		if _, ok := s.globals[name]; ok || m.done() {
+			continue
+		}
+		m.total += uint64(len(name))
+		var value sobek.Value
+		if m.try(func() { value = global.Get(name) }) {
+			m.add(value)
+		}
+	}
+	for name, read := range s.bindings {
+		if m.done() {
+			break
+		}
+		// A binding still in its temporal dead zone throws, it holds nothing yet
+		value, err := s.vm.RunProgram(read)
+		if m.check(err) {
+			m.total += uint64(len(name))
+			m.add(value)
+		}
+	}
+	return m.measure()
+}
+
+// scopeMeter approximates the memory held by the values reachable from a scope.
+// A string counts its length, a typed array or ArrayBuffer its bytes, a Map or
+// Set its entries and any other object a fixed overhead plus its enumerable own
+// properties. Each object is counted once. What closures capture, and
+// properties that are not enumerable, are out of reach and not counted.
+type scopeMeter struct {
+	vm      *sobek.Runtime
+	from    sobek.Callable // Array.from, listing the entries of a Map or Set
+	call    sobek.Callable // runs fn as a native function, so what it throws is caught
+	fn      func()
+	seen    map[*sobek.Object]struct{}
+	pending []*sobek.Object // counted objects whose properties are not yet
+	limit   uint64
+	total   uint64
+	err     error // the interruption that cut the measure short
+}
+
+func newScopeMeter(vm *sobek.Runtime, from sobek.Callable, limit uint64) *scopeMeter {
+	m := &scopeMeter{
+		vm:    vm,
+		from:  from,
+		seen:  make(map[*sobek.Object]struct{}),
+		limit: limit,
+	}
+	// Made once, guard would make a function for every property read
+	m.call, _ = sobek.AssertFunction(vm.ToValue(func(sobek.FunctionCall) sobek.Value {
+		m.fn()
+		return sobek.Undefined()
+	}))
+	return m
+}
+
+// try runs f, which reads script values and may run getters, reporting whether
+// it returned without throwing
+func (m *scopeMeter) try(f func()) bool {
+	m.fn = f
+	_, err := m.call(sobek.Undefined())
+	return m.check(err)
+}
+
+// check reports whether err is nil. An interruption ends the measure, any other
+// error only skips the value that could not be read.
+func (m *scopeMeter) check(err error) bool {
+	if interrupted, ok := err.(*sobek.InterruptedError); ok {
+		m.err = interruptCause(interrupted)
+		if m.err == nil {
+			m.err = interrupted
+		}
+	}
+	return err == nil
+}
+
+// done reports whether the measure is over, past its limit or interrupted
+func (m *scopeMeter) done() bool {
+	return m.err != nil || m.total > m.limit
+}
+
+// add counts value, queueing an object not seen before so its properties are
+// counted in turn
+func (m *scopeMeter) add(value sobek.Value) {
+	switch v := value.(type) {
+	case *sobek.Object:
+		if _, ok := m.seen[v]; ok {
+			m.total += scopeValueBytes
+			return
+		}
+		m.seen[v] = struct{}{}
+		m.total += scopeObjectBytes
+		m.pending = append(m.pending, v)
+	case sobek.String:
+		m.total += scopeValueBytes + uint64(v.Length())
+	default:
+		m.total += scopeValueBytes
+	}
+}
+
+// measure counts the queued objects and everything they lead to, and returns
+// the total
+func (m *scopeMeter) measure() (uint64, error) {
+	for len(m.pending) > 0 && !m.done() {
+		obj := m.pending[len(m.pending)-1]
+		m.pending = m.pending[:len(m.pending)-1]
+		m.expand(obj)
+	}
+	return m.total, m.err
+}
+
+// expand counts what obj holds
+func (m *scopeMeter) expand(obj *sobek.Object) {
+	// Exporting a buffer or typed array copies nothing, it is a view on its bytes.
+	// Maps and Sets, whose entries are no properties, are listed by Array.from.
+	switch t := obj.ExportType(); {
+	case t == arrayBufferType:
+		m.total += uint64(len(obj.Export().(sobek.ArrayBuffer).Bytes()))
+		return
+	case t == mapEntriesType || t == setValuesType && obj.ClassName() != "Array":
+		entries, err := m.from(sobek.Undefined(), obj)
+		if m.check(err) {
+			m.add(entries)
+		}
+		return
+	case t != nil && t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Interface && t.Elem().Kind() != reflect.Array:
+		m.total += uint64(reflect.ValueOf(obj.Export()).Len()) * uint64(t.Elem().Size())
+		return
+	}
+
+	var keys []string
+	if !m.try(func() { keys = obj.Keys() }) {
+		return
+	}
+	for _, key := range keys {
+		if m.done() {
+			return
+		}
+		m.total += uint64(len(key))
+		var value sobek.Value
+		if m.try(func() { value = obj.Get(key) }) {
+			m.add(value)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+
+	"github.com/grafana/sobek"
+)
+
+// exportResult converts the final value of a script into the Go value encoded in
+// the response. Exporting an object runs its getters, so it is done under guard.
+func exportResult(vm *sobek.Runtime, value sobek.Value) (interface{}, error) {
+	var exported interface{}
+	if err := guard(vm, func() { exported = value.Export() }); err != nil {
+		return nil, thrownError(vm, err)
+	}
+	v := exportCollections(exported, config.MapExport == "object")
+	v = exportBigInts(v, config.BigIntMode)
+	v = roundFloats(v, config.ResultFloatPrecision)
+	if config.NumericResultMode == "preserve" {
+		v = tagNumbers(v)
+	}
+	return v, nil
+}
+
+// TaggedNumber is how a number is encoded with numeric_result_mode preserve, so
+// strictly typed clients are told integers from fractions without guessing, and
+// how a BigInt keeps its digits as a string
+type TaggedNumber struct {
+	Type  string      `json:"type"` // int, float or bigint
+	Value interface{} `json:"value"`
+}
+
+// maxSafeInteger is the largest integer a JS number holds exactly
+const maxSafeInteger = 1<<53 - 1
+
+// tagNumbers replaces every number of an exported value with a TaggedNumber.
+// sobek exports a number as int64 or float64 depending on how it was produced,
+// so the tag goes by the value instead: integer-valued safe integers are int,
+// everything else is float. JSON has no NaN nor infinities, their value is the
+// string JS prints them as.
+func tagNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case int64:
+		if val >= -maxSafeInteger && val <= maxSafeInteger {
+			return TaggedNumber{Type: "int", Value: val}
+		}
+		return TaggedNumber{Type: "float", Value: float64(val)}
+	case float64:
+		switch {
+		case math.IsNaN(val):
+			return TaggedNumber{Type: "float", Value: "NaN"}
+		case math.IsInf(val, 1):
+			return TaggedNumber{Type: "float", Value: "Infinity"}
+		case math.IsInf(val, -1):
+			return TaggedNumber{Type: "float", Value: "-Infinity"}
+		}
+		if val == math.Trunc(val) && math.Abs(val) <= maxSafeInteger {
+			return TaggedNumber{Type: "int", Value: int64(val)}
+		}
+		return TaggedNumber{Type: "float", Value: val}
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = tagNumbers(item)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = tagNumbers(item)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+// BigInt modes, how a BigInt in a result is encoded
+const (
+	bigIntString = "string" // always {"type": "bigint", "value": "123"}
+	bigIntNumber = "number" // a plain number within ±2^53-1, as string otherwise
+)
+
+// exportBigInts replaces every BigInt of an exported value, which sobek exports
+// as a *big.Int, with a TaggedNumber holding its decimal digits, so no client
+// parsing the JSON as doubles loses precision. With bigint_mode number the
+// BigInts a double holds exactly are plain numbers instead.
+func exportBigInts(v interface{}, mode string) interface{} {
+	switch val := v.(type) {
+	case *big.Int:
+		if mode == bigIntNumber && val.IsInt64() {
+			if i := val.Int64(); i >= -maxSafeInteger && i <= maxSafeInteger {
+				return i
+			}
+		}
+		return TaggedNumber{Type: "bigint", Value: val.String()}
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = exportBigInts(item, mode)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = exportBigInts(item, mode)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+// exportCollections rewrites the Maps and Sets of an exported value so they
+// encode to JSON. sobek exports a Map as [key, value] pairs, which become an
+// array of two-element arrays, or with asObject an object keyed by the string
+// form of each key. A Set is already exported as an array of its values.
+func exportCollections(v interface{}, asObject bool) interface{} {
+	switch val := v.(type) {
+	case [][2]interface{}:
+		if asObject {
+			obj := make(map[string]interface{}, len(val))
+			for _, pair := range val {
+				obj[mapKeyString(pair[0])] = exportCollections(pair[1], asObject)
+			}
+			return obj
+		}
+		pairs := make([]interface{}, len(val))
+		for i, pair := range val {
+			pairs[i] = []interface{}{exportCollections(pair[0], asObject), exportCollections(pair[1], asObject)}
+		}
+		return pairs
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = exportCollections(item, asObject)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = exportCollections(item, asObject)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+var (
+	mapExportType = reflect.TypeOf([][2]interface{}(nil))
+	setExportType = reflect.TypeOf([]interface{}(nil))
+)
+
+// isCollection reports whether obj is a Map or a Set. It goes by the internal
+// type sobek exports them as, which a script cannot fake by swapping prototypes.
+// Arrays share the export type of a Set, but not its class.
+func isCollection(obj *sobek.Object) bool {
+	switch obj.ExportType() {
+	case mapExportType:
+		return true
+	case setExportType:
+		return obj.ClassName() != "Array"
+	default:
+		return false
+	}
+}
+
+// mapKeyString formats a Map key the way String(key) would in JS
+func mapKeyString(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case float64:
+		return strconv.FormatFloat(k, 'f', -1, 64)
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprint(k)
+	}
+}
+
+// collectionReplacer is a JSON.stringify replacer encoding Maps and Sets as they
+// will be exported, so the size check sees their content instead of {}, and
+// BigInts as their digits, which JSON.stringify otherwise throws on
+func collectionReplacer(vm *sobek.Runtime) sobek.Value {
+	return vm.ToValue(func(call sobek.FunctionCall) sobek.Value {
+		value := call.Argument(1)
+		if obj, ok := value.(*sobek.Object); ok && isCollection(obj) {
+			return vm.ToValue(exportCollections(obj.Export(), config.MapExport == "object"))
+		}
+		if n, ok := value.Export().(*big.Int); ok {
+			return vm.ToValue(n.String())
+		}
+		return value
+	})
+}
+
+// roundFloats walks an exported script result and rounds every float64 to the
+// given number of decimal places. A negative precision returns the value untouched.
+// Integral values are left alone so integers stored as float64 are never altered.
+func roundFloats(v interface{}, precision int) interface{} {
+	if precision < 0 {
+		return v
+	}
+
+	switch val := v.(type) {
+	case float64:
+		return roundFloat(val, precision)
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = roundFloats(item, precision)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = roundFloats(item, precision)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+// checkArrayLengths walks an exported result and fails on the first array longer
+// than maxLength, 0 disabling the check. Exported Maps and Sets count as arrays.
+func checkArrayLengths(v interface{}, maxLength int) error {
+	if maxLength <= 0 {
+		return nil
+	}
+	switch val := v.(type) {
+	case []interface{}:
+		if len(val) > maxLength {
+			return fmt.Errorf("array of %d items, more than %d", len(val), maxLength)
+		}
+		for _, item := range val {
+			if err := checkArrayLengths(item, maxLength); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range val {
+			if err := checkArrayLengths(item, maxLength); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkResultSize measures the result inside the VM and returns ErrResultTooLarge when it
+// exceeds maxBytes, before anything is exported. Strings are measured directly, other values
+// through stringify, which must be the original JSON.stringify captured before the script ran.
+// Lengths are counted in UTF-16 code units, close enough to bytes for a size guard.
+func checkResultSize(vm *sobek.Runtime, stringify sobek.Callable, value sobek.Value, maxBytes int) error {
+	if maxBytes <= 0 || value == nil {
+		return nil
+	}
+
+	if s, ok := value.(sobek.String); ok {
+		if s.Length() > maxBytes {
+			return ErrResultTooLarge
+		}
+		return nil
+	}
+
+	if _, ok := value.(*sobek.Object); !ok {
+		return nil
+	}
+	encoded, err := stringify(sobek.Undefined(), value, collectionReplacer(vm))
+	if err != nil {
+		return thrownError(vm, err)
+	}
+	if s, ok := encoded.(sobek.String); ok && s.Length() > maxBytes {
+		return ErrResultTooLarge
+	}
+	return nil
+}
+
+func roundFloat(f float64, precision int) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) || f == math.Trunc(f) {
+		return f
+	}
+	scale := math.Pow(10, float64(precision))
+	rounded := math.Round(f*scale) / scale
+	// Very large magnitudes overflow when scaled, they have no fractional digits to round anyway
+	if math.IsInf(rounded, 0) || math.IsNaN(rounded) {
+		return f
+	}
+	return rounded
+}
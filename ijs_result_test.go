@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "within the limits", script: `"x".repeat(100)`, wantStatus: http.StatusOK},
+		{name: "oversized string", script: `"x".repeat(2000)`, wantStatus: http.StatusUnprocessableEntity, wantCode: CodeResultTooLarge},
+		{name: "oversized string built by doubling", script: `let s = "x"; while (s.length < 4096) s += s; s`, wantStatus: http.StatusUnprocessableEntity, wantCode: CodeResultTooLarge},
+		{name: "oversized object", script: `({text: "x".repeat(2000)})`, wantStatus: http.StatusUnprocessableEntity, wantCode: CodeResultTooLarge},
+		{name: "array too long", script: `Array.from({length: 20}, (_, i) => i)`, wantStatus: http.StatusUnprocessableEntity, wantCode: CodeResultArrayTooLong},
+		{name: "nested array too long", script: `({items: Array(20).fill(0)})`, wantStatus: http.StatusUnprocessableEntity, wantCode: CodeResultArrayTooLong},
+		{name: "runtime error still a 500", script: `throw new Error("boom")`, wantStatus: http.StatusInternalServerError, wantCode: CodeRuntimeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.MaxResultBytes = 1000
+				c.MaxArrayLength = 10
+			})
+			rec := httptest.NewRecorder()
+			handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(tt.script)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var response Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != tt.wantCode {
+				t.Fatalf("code = %q, want %q", response.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestTagNumbers(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{name: "int", value: int64(3), want: TaggedNumber{Type: "int", Value: int64(3)}},
+		{name: "integral float", value: 3.0, want: TaggedNumber{Type: "int", Value: int64(3)}},
+		{name: "fraction", value: 3.5, want: TaggedNumber{Type: "float", Value: 3.5}},
+		{name: "unsafe integer", value: float64(1 << 60), want: TaggedNumber{Type: "float", Value: float64(1 << 60)}},
+		{name: "NaN", value: math.NaN(), want: TaggedNumber{Type: "float", Value: "NaN"}},
+		{name: "Infinity", value: math.Inf(1), want: TaggedNumber{Type: "float", Value: "Infinity"}},
+		{name: "-Infinity", value: math.Inf(-1), want: TaggedNumber{Type: "float", Value: "-Infinity"}},
+		{
+			name:  "nested",
+			value: map[string]interface{}{"a": []interface{}{math.NaN(), "x"}},
+			want:  map[string]interface{}{"a": []interface{}{TaggedNumber{Type: "float", Value: "NaN"}, "x"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tagNumbers(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("tagNumbers = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreservedNonFiniteNumbers(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{script: "NaN", want: `{"type":"float","value":"NaN"}`},
+		{script: "1 / 0", want: `{"type":"float","value":"Infinity"}`},
+		{script: "[-1 / 0, 0.5]", want: `[{"type":"float","value":"-Infinity"},{"type":"float","value":0.5}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.NumericResultMode = "preserve"
+			})
+			if got := resultJSON(t, sm, tt.script); got != tt.want {
+				t.Fatalf("result = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// resultJSON runs script through the /data handler and returns the result
+// member of the response as it was encoded
+func resultJSON(t *testing.T, sm *ScriptManager, script string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(script)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s", rec.Code, rec.Body)
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return string(response.Result)
+}
+
+func TestFloatPrecision(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision int
+		script    string
+		want      string
+	}{
+		{name: "full precision", precision: -1, script: "1 / 3", want: "0.3333333333333333"},
+		{name: "no decimals", precision: 0, script: "[2.5, -2.5, 0.4]", want: "[3,-3,0]"},
+		{name: "two decimals", precision: 2, script: "1 / 3", want: "0.33"},
+		{name: "rounds half away from zero", precision: 2, script: "[0.125, -0.125]", want: "[0.13,-0.13]"},
+		{name: "binary representation", precision: 2, script: "1.005", want: "1"},
+		{name: "integers untouched", precision: 2, script: "[3, 2 ** 53, 1e300]", want: "[3,9007199254740992,1e+300]"},
+		{name: "nested", precision: 3, script: "({a: [Math.PI, {b: Math.E}], s: '0.123456'})", want: `{"a":[3.142,{"b":2.718}],"s":"0.123456"}`},
+		{name: "tiny fractions", precision: 3, script: "[0.0001, 1e-10]", want: "[0,0]"},
+		{name: "large magnitude", precision: 10, script: "1e300 + 0.5", want: "1e+300"},
+		{name: "high precision", precision: 15, script: "0.1 + 0.2", want: "0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.ResultFloatPrecision = tt.precision
+			})
+			if got := resultJSON(t, sm, tt.script); got != tt.want {
+				t.Fatalf("result = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectionResults(t *testing.T) {
+	tests := []struct {
+		name      string
+		mapExport string
+		script    string
+		want      string
+	}{
+		{name: "Set", script: `new Set([1, "a", 1, {b: 2}])`, want: `[1,"a",{"b":2}]`},
+		{name: "empty Set", script: `new Set()`, want: `[]`},
+		{name: "Map as pairs", script: `new Map([["a", 1], [2, "b"], [null, true]])`, want: `[["a",1],[2,"b"],[null,true]]`},
+		{name: "Map with object keys", script: `new Map([[{id: 1}, "x"]])`, want: `[[{"id":1},"x"]]`},
+		{name: "empty Map", script: `new Map()`, want: `[]`},
+		{name: "Map as object", mapExport: "object", script: `new Map([["a", 1], [2, "b"], [null, true], [1.5, 0]])`, want: `{"1.5":0,"2":"b","a":1,"null":true}`},
+		{name: "nested as pairs", script: `new Map([["s", new Set([new Map([["k", 1]])])]])`, want: `[["s",[[["k",1]]]]]`},
+		{name: "nested as object", mapExport: "object", script: `new Map([["s", new Set([new Map([["k", 1]])])]])`, want: `{"s":[{"k":1}]}`},
+		{name: "inside objects and arrays", script: `({list: [new Set([1, 2])], m: new Map([["a", new Set()]])})`, want: `{"list":[[1,2]],"m":[["a",[]]]}`},
+		{name: "arrays left alone", script: `[[1, 2], ["a", "b"]]`, want: `[[1,2],["a","b"]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				if tt.mapExport != "" {
+					c.MapExport = tt.mapExport
+				}
+			})
+			if got := resultJSON(t, sm, tt.script); got != tt.want {
+				t.Fatalf("result = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("counted by max_result_bytes", func(t *testing.T) {
+		sm := newTestManager(t, func(c *Config) {
+			c.ScriptTimeout = time.Second
+			c.MaxResultBytes = 1000
+		})
+		rec := httptest.NewRecorder()
+		handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`new Map([["a", "x".repeat(2000)]])`)))
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeResultTooLarge) {
+			t.Fatalf("status = %d %s, want the Map content counted", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestCheckArrayLengths(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     interface{}
+		maxLength int
+		wantErr   bool
+	}{
+		{name: "scalar", value: "x", maxLength: 2},
+		{name: "at the limit", value: []interface{}{1, 2}, maxLength: 2},
+		{name: "too long", value: []interface{}{1, 2, 3}, maxLength: 2, wantErr: true},
+		{name: "nested in an object", value: map[string]interface{}{"a": []interface{}{1, 2, 3}}, maxLength: 2, wantErr: true},
+		{name: "nested in an array", value: []interface{}{[]interface{}{1, 2, 3}}, maxLength: 2, wantErr: true},
+		{name: "disabled", value: []interface{}{1, 2, 3}, maxLength: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkArrayLengths(tt.value, tt.maxLength); (err != nil) != tt.wantErr {
+				t.Fatalf("checkArrayLengths = %v, want an error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A result array is refused before it is built out in Go or encoded
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.MaxArrayLength = 10
+	})
+	for script, wantErr := range map[string]bool{
+		`Array(10).fill(0)`: false,
+		`Array(11).fill(0)`: true,
+		`new Set(Array.from({length: 11}, (_, i) => i))`: true,
+	} {
+		_, err := sm.ExecuteScriptWithTimeout(script)
+		if wantErr && !errors.Is(err, ErrResultArrayTooLong) || !wantErr && err != nil {
+			t.Errorf("%s: error = %v, want ErrResultArrayTooLong %t", script, err, wantErr)
+		}
+	}
+}
+
+func TestBigIntResults(t *testing.T) {
+	// The JSON each script's result encodes to, under bigint_mode string and number
+	tests := []struct {
+		script string
+		string string
+		number string
+	}{
+		{script: "123456789012345678901234567890n", string: `{"type":"bigint","value":"123456789012345678901234567890"}`, number: `{"type":"bigint","value":"123456789012345678901234567890"}`},
+		{script: "-123456789012345678901234567890n", string: `{"type":"bigint","value":"-123456789012345678901234567890"}`, number: `{"type":"bigint","value":"-123456789012345678901234567890"}`},
+		{script: "42n", string: `{"type":"bigint","value":"42"}`, number: `42`},
+		{script: "0n", string: `{"type":"bigint","value":"0"}`, number: `0`},
+		{script: "-(2n ** 53n - 1n)", string: `{"type":"bigint","value":"-9007199254740991"}`, number: `-9007199254740991`},
+		{script: "2n ** 53n - 1n", string: `{"type":"bigint","value":"9007199254740991"}`, number: `9007199254740991`},
+		{script: "2n ** 53n", string: `{"type":"bigint","value":"9007199254740992"}`, number: `{"type":"bigint","value":"9007199254740992"}`},
+		{script: "2n ** 64n", string: `{"type":"bigint","value":"18446744073709551616"}`, number: `{"type":"bigint","value":"18446744073709551616"}`},
+		{
+			script: "({id: 2n ** 70n, n: 7n, rows: [1n, 1.5, 'x']})",
+			string: `{"id":{"type":"bigint","value":"1180591620717411303424"},"n":{"type":"bigint","value":"7"},"rows":[{"type":"bigint","value":"1"},1.5,"x"]}`,
+			number: `{"id":{"type":"bigint","value":"1180591620717411303424"},"n":7,"rows":[1,1.5,"x"]}`,
+		},
+		{script: "new Map([['a', 10n ** 20n]])", string: `[["a",{"type":"bigint","value":"100000000000000000000"}]]`, number: `[["a",{"type":"bigint","value":"100000000000000000000"}]]`},
+		{script: "Promise.resolve(5n)", string: `{"type":"bigint","value":"5"}`, number: `5`},
+	}
+	for _, mode := range []string{bigIntString, bigIntNumber} {
+		sm := newTestManager(t, func(c *Config) {
+			c.ScriptTimeout = time.Second
+			c.BigIntMode = mode
+		})
+		for _, tt := range tests {
+			t.Run(mode+" "+tt.script, func(t *testing.T) {
+				want := tt.string
+				if mode == bigIntNumber {
+					want = tt.number
+				}
+				if got := resultJSON(t, sm, tt.script); got != want {
+					t.Fatalf("result = %s, want %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestBigIntFanoutResults(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.BigIntMode = bigIntNumber
+	})
+	rec := postEnvelope(fanoutHandler(sm), "/fanout", `{"script": "BigInt(input.n) ** 20n", "inputs": [{"n": 2}, {"n": 10}]}`)
+	want := `{"results":[{"result":1048576},{"result":{"type":"bigint","value":"100000000000000000000"}}]}`
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != want {
+		t.Fatalf("status = %d %s, want %s", rec.Code, rec.Body, want)
+	}
+}
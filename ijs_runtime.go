@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/grafana/sobek"
+)
+
+// newRuntime creates a VM configured for running untrusted scripts. Every VM,
+// whatever it is used for, must come from here so they all behave the same.
+func newRuntime() *sobek.Runtime {
+	vm := sobek.New()
+	vm.SetFieldNameMapper(jsFieldNameMapper{})
+	if config.MaxCallStack > 0 {
+		vm.SetMaxCallStackSize(config.MaxCallStack)
+	}
+	hardenRuntime(vm)
+	return vm
+}
+
+// unlinkFunctionConstructors deletes the constructor of the prototype of each
+// kind of function. Function and its async and generator siblings compile code
+// from a string like eval does, and removing the Function global alone leaves
+// them reachable from any function, host functions included.
+var unlinkFunctionConstructors = sobek.MustCompile("", `[function () {}, function* () {}, async function () {}].forEach(function (f) {
+	delete Object.getPrototypeOf(f).constructor
+})`, false)
+
+// hardenRuntime removes the restricted globals, the constructors of functions
+// and the restricted_members from the VM. Members were checked to be removable
+// at startup.
+func hardenRuntime(vm *sobek.Runtime) {
+	// Run first, restricted_members may remove Object.getPrototypeOf
+	if _, err := vm.RunProgram(unlinkFunctionConstructors); err != nil {
+		panic(fmt.Sprintf("cannot unlink the function constructors: %v", err))
+	}
+	for _, global := range restrictedGlobals {
+		vm.Set(global, nil)
+	}
+	removeMembers(vm, config.RestrictedMembers)
+}
+
+// freezeGlobal freezes the global object, so that scripts can neither add
+// globals nor replace or delete the existing ones. It must run once everything
+// the execution installs on the global object, host functions and input, is set.
+func freezeGlobal(vm *sobek.Runtime) error {
+	freeze, ok := sobek.AssertFunction(vm.Get("Object").ToObject(vm).Get("freeze"))
+	if !ok {
+		return errors.New("Object.freeze is not a function")
+	}
+	_, err := freeze(sobek.Undefined(), vm.GlobalObject())
+	return err
+}
+
+// removeMembers deletes, for each parent, the listed members from it. A parent
+// is a global or a dotted path from one, such as Object.prototype. This runs on
+// a fresh VM before any script, so nothing has been frozen yet, and only fails
+// for a parent that is not an object, or a member it does not own or cannot
+// delete, still removing every other member.
+func removeMembers(vm *sobek.Runtime, members map[string][]string) error {
+	var errs []error
+	for parent, names := range members {
+		obj, err := resolveObject(vm, parent)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, name := range names {
+			// Catches misspelled members, which would otherwise stay silently
+			if !hasOwn(obj, name) {
+				errs = append(errs, fmt.Errorf("%s has no member %s", parent, name))
+				continue
+			}
+			if err := obj.Delete(name); err != nil {
+				errs = append(errs, fmt.Errorf("cannot delete %s.%s: %w", parent, name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveObject walks a dotted path from the global object
+func resolveObject(vm *sobek.Runtime, path string) (*sobek.Object, error) {
+	obj := vm.GlobalObject()
+	for _, part := range strings.Split(path, ".") {
+		next, ok := obj.Get(part).(*sobek.Object)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object", path)
+		}
+		obj = next
+	}
+	return obj, nil
+}
+
+// hasOwn reports whether name is an own property of obj
+func hasOwn(obj *sobek.Object, name string) bool {
+	for _, key := range obj.GetOwnPropertyNames() {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jsFieldNameMapper presents Go values injected into the VM with JS-style names.
+// Struct fields use their json tag name when present ("-" hides the field),
+// otherwise the lowerCamel form of the Go name. Methods are always lowerCamel.
+type jsFieldNameMapper struct{}
+
+func (jsFieldNameMapper) FieldName(_ reflect.Type, f reflect.StructField) string {
+	if tag, ok := f.Tag.Lookup("json"); ok {
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return lowerCamel(f.Name)
+}
+
+func (jsFieldNameMapper) MethodName(_ reflect.Type, m reflect.Method) string {
+	return lowerCamel(m.Name)
+}
+
+// lowerCamel lowercases the leading capitals of a Go name: TenantId becomes tenantId,
+// ID becomes id and URLPath becomes urlPath
+func lowerCamel(name string) string {
+	runes := []rune(name)
+	for i := 0; i < len(runes) && unicode.IsUpper(runes[i]); i++ {
+		// Keep the capital starting the next word, as in the P of URLPath
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
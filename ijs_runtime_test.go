@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLowerCamel(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"TenantId", "tenantId"},
+		{"ID", "id"},
+		{"URLPath", "urlPath"},
+		{"HTTPServer", "httpServer"},
+		{"X", "x"},
+		{"already", "already"},
+		{"Élan", "élan"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lowerCamel(tt.name); got != tt.want {
+				t.Fatalf("lowerCamel(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+type mappedRecord struct {
+	TenantID string
+	URLPath  string
+	Amount   int    `json:"total_amount,omitempty"`
+	Secret   string `json:"-"`
+	Note     string `json:",omitempty"`
+}
+
+func (mappedRecord) DisplayName() string { return "record" }
+
+func TestFieldNameMapper(t *testing.T) {
+	tests := []struct {
+		script string
+		want   interface{}
+	}{
+		{script: "record.tenantID", want: "acme"},
+		{script: "record.urlPath", want: "/a"},
+		{script: "record.total_amount", want: int64(3)},
+		{script: "typeof record.Amount", want: "undefined"},
+		{script: "typeof record.secret + typeof record.Secret", want: "undefinedundefined"},
+		{script: "record.note", want: "n"},
+		{script: "record.displayName()", want: "record"},
+		{script: "typeof record.TenantID", want: "undefined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			vm := newRuntime()
+			vm.Set("record", mappedRecord{TenantID: "acme", URLPath: "/a", Amount: 3, Secret: "s", Note: "n"})
+			value, err := vm.RunString(tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := value.Export(); got != tt.want {
+				t.Fatalf("%s = %#v, want %#v", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFunctionConstructorUnreachable tries the ways of reaching a constructor
+// compiling code from a string, none of which may hand one back
+func TestFunctionConstructorUnreachable(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableUUID = true
+	})
+	// Each expression evaluates to what a script would call with code; it must
+	// not be a function building one from a string
+	for _, reach := range []string{
+		`Function`,
+		`eval`,
+		`(function () {}).constructor`,
+		`(() => {}).constructor`,
+		`(class {}).constructor`,
+		`(function* () {}).constructor`,
+		`(async function () {}).constructor`,
+		`(async () => {}).constructor`,
+		`Object.getPrototypeOf(function () {}).constructor`,
+		`Object.getPrototypeOf(function* () {}).constructor`,
+		`Object.getPrototypeOf(async function () {}).constructor`,
+		`uuid.constructor`,
+		`render.constructor`,
+		`[].map.constructor`,
+		`JSON.parse.constructor`,
+		`(1).constructor.constructor`,
+		`Error.constructor`,
+		`(function () { return this })().Function`,
+		`this.Function`,
+		`(0, eval)`,
+	} {
+		t.Run(reach, func(t *testing.T) {
+			script := `(() => {
+				let made
+				try { made = (` + reach + `)("return 41 + 1") } catch (e) { return "threw" }
+				try { made = typeof made === "function" ? made() : made } catch (e) { return "threw" }
+				return made === 42 ? "compiled" : "not compiled"
+			})()`
+			result, err := sm.ExecuteScriptWithTimeout(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result == "compiled" {
+				t.Fatalf("%s compiled code from a string", reach)
+			}
+			// new works the same
+			result, err = sm.ExecuteScriptWithTimeout(`(() => { try { const f = new (` + reach + `)("return 42"); return typeof f === "function" && f() === 42 } catch (e) { return false } })()`)
+			if err != nil || result != false {
+				t.Fatalf("new %s = %v, %v, want no compiled function", reach, result, err)
+			}
+		})
+	}
+}
+
+func TestRestrictedGlobals(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	for _, name := range restrictedGlobals {
+		// A dotted entry only shadows a global of that literal name, members are
+		// removed with restricted_members, see TestRestrictedMembers
+		if strings.Contains(name, ".") {
+			continue
+		}
+		result, err := sm.ExecuteScriptWithTimeout(`typeof ` + name + ` === "object" && ` + name + ` === null`)
+		if err != nil || result != true {
+			t.Errorf("%s = %v, %v, want null", name, result, err)
+		}
+	}
+}
+
+func TestRestrictedMembers(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.RestrictedMembers = map[string][]string{
+			"Object":          {"defineProperty", "setPrototypeOf"},
+			"Math":            {"random"},
+			"Array.prototype": {"fill"},
+		}
+	})
+	tests := []struct {
+		script string
+		want   interface{}
+	}{
+		{`typeof Object.defineProperty`, "undefined"},
+		{`typeof Math.random`, "undefined"},
+		{`typeof [].fill`, "undefined"},
+		// Other names for the same objects
+		{`typeof ({}).constructor.defineProperty`, "undefined"},
+		{`typeof Object["define" + "Property"]`, "undefined"},
+		{`typeof Object.getPrototypeOf({}).constructor.defineProperty`, "undefined"},
+		{`typeof Object.getPrototypeOf([]).fill`, "undefined"},
+		{`typeof Array.from([1]).fill`, "undefined"},
+		{`"defineProperty" in Object || "random" in Math`, false},
+		// Putting a member back only lasts for the execution
+		{`Math.random = () => 4; Math.random()`, int64(4)},
+		{`typeof Math.random`, "undefined"},
+		// Members not listed stay
+		{`typeof Object.keys + typeof Math.floor + typeof [].map`, "functionfunctionfunction"},
+		{`typeof Reflect.defineProperty`, "function"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Fatalf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+
+	t.Run("REPL sessions", func(t *testing.T) {
+		s := newTestRepl(t, sm)
+		result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: `typeof Math.random`, repl: s})
+		if result.Error != nil || result.Result != "undefined" {
+			t.Fatalf("result = %v, %v, want undefined", result.Result, result.Error)
+		}
+	})
+}
+
+func TestRemoveMembersErrors(t *testing.T) {
+	tests := []struct {
+		members map[string][]string
+		wantErr string
+	}{
+		{members: map[string][]string{"Math": {"random"}}},
+		{members: map[string][]string{"Math": {"rnadom"}}, wantErr: "Math has no member rnadom"},
+		{members: map[string][]string{"Nope": {"x"}}, wantErr: "Nope is not an object"},
+		{members: map[string][]string{"Math.PI": {"x"}}, wantErr: "Math.PI is not an object"},
+		// Inherited, the member is not on the object named
+		{members: map[string][]string{"Math": {"toString"}}, wantErr: "Math has no member toString"},
+	}
+	for _, tt := range tests {
+		err := removeMembers(newRuntime(), tt.members)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("removeMembers(%v) = %v, want %q", tt.members, err, tt.wantErr)
+		}
+	}
+}
+
+// TestFreezeGlobal tries the ways of adding, replacing or deleting a global
+// with freeze_global set
+func TestFreezeGlobal(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.FreezeGlobal = true
+		c.EnableUUID = true
+	})
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "var", script: `var a = 1; a`, wantErr: "Cannot define global variable 'a'"},
+		{name: "function", script: `function f() {}; 1`, wantErr: "Cannot redefine global function 'f'"},
+		{name: "undeclared assignment", script: `x = 1; typeof x`, want: "undefined"},
+		{name: "strict undeclared assignment", script: `"use strict"; x = 1`, wantErr: "ReferenceError: x is not defined"},
+		{name: "this", script: `this.x = 1; typeof x`, want: "undefined"},
+		{name: "this of a sloppy function", script: `(function () { this.x = 1 })(); typeof x`, want: "undefined"},
+		{name: "defineProperty", script: `Object.defineProperty(this, "x", {value: 1})`, wantErr: "object is not extensible"},
+		{name: "Reflect.defineProperty", script: `Reflect.defineProperty(this, "x", {value: 1}) || typeof x`, want: "undefined"},
+		{name: "Reflect.set", script: `Reflect.set(this, "x", 1) || typeof x`, want: "undefined"},
+		{name: "replace a host function", script: `uuid = null; typeof uuid`, want: "function"},
+		{name: "strict replace", script: `"use strict"; uuid = null`, wantErr: "Cannot assign to read only property 'uuid'"},
+		{name: "redefine a host function", script: `Object.defineProperty(this, "uuid", {value: 1})`, wantErr: "TypeError"},
+		{name: "delete", script: `delete this.uuid; typeof uuid`, want: "function"},
+		{name: "strict delete", script: `"use strict"; delete this.uuid`, wantErr: "Cannot delete property 'uuid'"},
+		{name: "setPrototypeOf", script: `Object.setPrototypeOf(this, {x: 1})`, wantErr: "is not extensible"},
+		{name: "__proto__", script: `this.__proto__ = {x: 1}`, wantErr: "is not extensible"},
+		{name: "Reflect.setPrototypeOf", script: `Reflect.setPrototypeOf(this, {x: 1}) || typeof x`, want: "undefined"},
+		{name: "frozen", script: `Object.isFrozen(this)`, want: true},
+		// What still works
+		{name: "let and const", script: `let l = 1; const c = 2; l + c`, want: int64(3)},
+		{name: "class", script: `class C { get v() { return 4 } }; new C().v`, want: int64(4)},
+		{name: "IIFE", script: `(function () { var v = 2; function twice(x) { return 2 * x } return twice(v) })()`, want: int64(4)},
+		// The freeze is shallow: members of globals, and Object.prototype the
+		// global object inherits from, stay writable for the execution
+		{name: "member of a global", script: `Math.max = () => 0; Math.max(1, 2)`, want: int64(0)},
+		{name: "Object.prototype", script: `Object.prototype.x = 1; typeof x`, want: "number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Fatalf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+
+	t.Run("input", func(t *testing.T) {
+		for script, want := range map[string]interface{}{
+			`input.n`:              int64(1),
+			`input = 2; input.n`:   int64(1),
+			`input.n = 3; input.n`: int64(3),
+		} {
+			result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: script, Input: map[string]interface{}{"n": 1}})
+			if result.Error != nil || result.Result != want {
+				t.Errorf("%s = %v, %v, want %v", script, result.Result, result.Error, want)
+			}
+		}
+	})
+
+	t.Run("each execution starts frozen", func(t *testing.T) {
+		if _, err := sm.ExecuteScriptWithTimeout(`Object.prototype.leak = 1`); err != nil {
+			t.Fatal(err)
+		}
+		if result, err := sm.ExecuteScriptWithTimeout(`typeof leak`); err != nil || result != "undefined" {
+			t.Fatalf("typeof leak = %v, %v, want undefined in a later execution", result, err)
+		}
+	})
+}
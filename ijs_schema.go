@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+var (
+	ErrInputSchema   = errors.New("input does not match its schema")
+	ErrInvalidSchema = errors.New("invalid input schema")
+)
+
+// inputSchemaURL names the schema being compiled, references to anything else
+// are refused
+const inputSchemaURL = "ijs:///input.schema.json"
+
+// SchemaViolation is one way an input breaks its schema
+type SchemaViolation struct {
+	Path    string `json:"path"`    // JSON pointer into the input, "" for the input itself
+	Keyword string `json:"keyword"` // JSON pointer to the failing keyword of the schema
+	Message string `json:"message"`
+}
+
+// inputSchemaError lists the violations of an input, it matches ErrInputSchema
+type inputSchemaError struct {
+	violations []SchemaViolation
+}
+
+func (e *inputSchemaError) Error() string {
+	parts := make([]string, len(e.violations))
+	for i, v := range e.violations {
+		parts[i] = fmt.Sprintf("%s: %s", cmp.Or(v.Path, "/"), v.Message)
+	}
+	return ErrInputSchema.Error() + ": " + strings.Join(parts, "; ")
+}
+
+func (e *inputSchemaError) Unwrap() error { return ErrInputSchema }
+
+// noSchemaLoader refuses every resource, so a $ref cannot make the server read
+// files or reach the network
+type noSchemaLoader struct{}
+
+func (noSchemaLoader) Load(url string) (any, error) {
+	return nil, fmt.Errorf("loading %s is not allowed", url)
+}
+
+// compileInputSchema compiles a JSON Schema document, of the latest draft unless
+// it names another with $schema
+func compileInputSchema(data []byte) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	c.UseLoader(noSchemaLoader{})
+	if err := c.AddResource(inputSchemaURL, doc); err != nil {
+		return nil, err
+	}
+	return c.Compile(inputSchemaURL)
+}
+
+// validateInput checks input against schema, returning an inputSchemaError
+// listing every violation
+func validateInput(schema *jsonschema.Schema, input interface{}) error {
+	err := schema.Validate(input)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+	var violations []SchemaViolation
+	var walk func(unit jsonschema.OutputUnit)
+	walk = func(unit jsonschema.OutputUnit) {
+		if unit.Error != nil && len(unit.Errors) == 0 {
+			violations = append(violations, SchemaViolation{
+				Path:    unit.InstanceLocation,
+				Keyword: unit.KeywordLocation,
+				Message: unit.Error.String(),
+			})
+		}
+		for _, child := range unit.Errors {
+			walk(child)
+		}
+	}
+	walk(*validationErr.DetailedOutput())
+	return &inputSchemaError{violations: violations}
+}
+
+// checkInputSchema validates the input of env against the schema registered
+// with its script_ref, if any, then against its input_schema, if any. For a
+// /fanout, inputs are its items, each validated in place of the input of env,
+// which only stands in for an item left null, and the violations of an item are
+// located under /inputs/<index>. A broken registered schema is a server error,
+// a broken input_schema the client's.
+func (sm *ScriptManager) checkInputSchema(env Envelope, inputs []map[string]interface{}) error {
+	var schemas []*jsonschema.Schema
+	if store, ok := sm.store.(inputSchemaStore); ok && env.ScriptRef != "" {
+		data, err := store.LoadInputSchema(env.ScriptRef)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			schema, err := compileInputSchema(data)
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidSchema, env.ScriptRef, err)
+			}
+			schemas = append(schemas, schema)
+		}
+	}
+	if len(env.InputSchema) > 0 {
+		schema, err := compileInputSchema(env.InputSchema)
+		if err != nil {
+			return fmt.Errorf("%w: input_schema: %v", ErrInvalidEnvelope, err)
+		}
+		schemas = append(schemas, schema)
+	}
+	if len(schemas) == 0 {
+		return nil
+	}
+	if inputs == nil {
+		return validateInputs(schemas, env.Input)
+	}
+	var violations []SchemaViolation
+	for i, item := range inputs {
+		input := env.Input
+		if item != nil {
+			input = item
+		}
+		err := validateInputs(schemas, input)
+		var schemaErr *inputSchemaError
+		if !errors.As(err, &schemaErr) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, v := range schemaErr.violations {
+			v.Path = fmt.Sprintf("/inputs/%d%s", i, v.Path)
+			violations = append(violations, v)
+		}
+	}
+	if len(violations) > 0 {
+		return &inputSchemaError{violations: violations}
+	}
+	return nil
+}
+
+// validateInputs checks input against each of schemas in turn, stopping at the
+// first it does not match
+func validateInputs(schemas []*jsonschema.Schema, input interface{}) error {
+	for _, schema := range schemas {
+		if err := validateInput(schema, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rowsSchema = `{"type": "object", "required": ["n"], "properties": {"n": {"type": "integer"}, "rows": {"type": "array", "items": {"type": "integer"}}}}`
+
+func TestCompileInputSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{name: "object", schema: rowsSchema},
+		{name: "older draft", schema: `{"$schema": "http://json-schema.org/draft-07/schema#", "type": "object"}`},
+		{name: "local $ref", schema: `{"$defs": {"n": {"type": "integer"}}, "properties": {"n": {"$ref": "#/$defs/n"}}}`},
+		{name: "remote $ref", schema: `{"$ref": "https://example.com/schema.json"}`, wantErr: true},
+		{name: "file $ref", schema: `{"$ref": "file:///etc/passwd"}`, wantErr: true},
+		{name: "not JSON", schema: `{"type":`, wantErr: true},
+		{name: "invalid keyword value", schema: `{"type": 42}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileInputSchema([]byte(tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileInputSchema = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	schema, err := compileInputSchema([]byte(rowsSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateInput(schema, map[string]interface{}{"n": json.Number("1")}); err != nil {
+		t.Fatalf("valid input: %v", err)
+	}
+	err = validateInput(schema, map[string]interface{}{"rows": []interface{}{json.Number("1"), "two", "three"}})
+	schemaErr, ok := err.(*inputSchemaError)
+	if !ok {
+		t.Fatalf("err = %v, want an inputSchemaError", err)
+	}
+	var paths []string
+	for _, v := range schemaErr.violations {
+		paths = append(paths, v.Path)
+	}
+	// Every violation is listed, the missing property at the input itself
+	if want := []string{"", "/rows/1", "/rows/2"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("paths = %q, want %q (%v)", paths, want, err)
+	}
+	if !strings.HasPrefix(err.Error(), ErrInputSchema.Error()+": /: ") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// schemaManager returns a manager whose store holds typed.js, checked against
+// rowsSchema, and broken.js, whose registered schema does not compile
+func schemaManager(t *testing.T) *ScriptManager {
+	t.Helper()
+	sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = time.Second })
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"typed.js":           "input.n * 2",
+		"typed.schema.json":  rowsSchema,
+		"broken.js":          "1",
+		"broken.schema.json": `{"type":`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sm.store = &fileScriptStore{dir: dir}
+	return sm
+}
+
+func TestInputSchemaRequests(t *testing.T) {
+	sm := schemaManager(t)
+	tests := []struct {
+		name           string
+		body           string
+		wantStatus     int
+		wantCode       string
+		wantViolations []string
+	}{
+		{name: "inline valid", body: `{"script": "input.n", "input_schema": ` + rowsSchema + `, "input": {"n": 1}}`, wantStatus: http.StatusOK},
+		{name: "inline invalid", body: `{"script": "input.n", "input_schema": ` + rowsSchema + `, "input": {"n": "1"}}`, wantStatus: http.StatusBadRequest, wantCode: CodeInputSchema, wantViolations: []string{"/n"}},
+		{name: "inline missing input", body: `{"script": "1", "input_schema": ` + rowsSchema + `}`, wantStatus: http.StatusBadRequest, wantCode: CodeInputSchema, wantViolations: []string{""}},
+		{name: "inline malformed", body: `{"script": "1", "input_schema": {"type": 42}}`, wantStatus: http.StatusBadRequest, wantCode: CodeInvalidRequest},
+		{name: "registered valid", body: `{"script_ref": "typed", "input": {"n": 2}}`, wantStatus: http.StatusOK},
+		{name: "registered invalid", body: `{"script_ref": "typed", "input": {"rows": ["a"]}}`, wantStatus: http.StatusBadRequest, wantCode: CodeInputSchema, wantViolations: []string{"", "/rows/0"}},
+		{name: "registered and inline", body: `{"script_ref": "typed", "input_schema": {"properties": {"n": {"maximum": 5}}}, "input": {"n": 6}}`, wantStatus: http.StatusBadRequest, wantCode: CodeInputSchema, wantViolations: []string{"/n"}},
+		{name: "registered malformed", body: `{"script_ref": "broken", "input": {}}`, wantStatus: http.StatusInternalServerError, wantCode: CodeInvalidSchema},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postEnvelope(handler(sm), "/data", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var response Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", response.Code, tt.wantCode)
+			}
+			var paths []string
+			for _, v := range response.Violations {
+				paths = append(paths, v.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.wantViolations) {
+				t.Errorf("violations at %q, want %q", paths, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestFanoutInputSchema(t *testing.T) {
+	sm := schemaManager(t)
+	tests := []struct {
+		name           string
+		body           string
+		wantStatus     int
+		wantResults    []string
+		wantViolations []string
+	}{
+		{
+			name:        "every item valid",
+			body:        `{"script": "input.n", "input_schema": ` + rowsSchema + `, "inputs": [{"n": 1}, {"n": 2}]}`,
+			wantStatus:  http.StatusOK,
+			wantResults: []string{"1", "2"},
+		},
+		{
+			name:           "one item invalid",
+			body:           `{"script": "input.n", "input_schema": ` + rowsSchema + `, "inputs": [{"n": 1}, {"n": "2"}, {"rows": [1, "x"]}]}`,
+			wantStatus:     http.StatusBadRequest,
+			wantViolations: []string{"/inputs/1/n", "/inputs/2", "/inputs/2/rows/1"},
+		},
+		{
+			name:        "null item takes the envelope input",
+			body:        `{"script": "input.n", "input_schema": ` + rowsSchema + `, "input": {"n": 7}, "inputs": [null, {"n": 1}]}`,
+			wantStatus:  http.StatusOK,
+			wantResults: []string{"7", "1"},
+		},
+		{
+			name:           "null item with an invalid envelope input",
+			body:           `{"script": "input.n", "input_schema": ` + rowsSchema + `, "inputs": [{"n": 1}, null]}`,
+			wantStatus:     http.StatusBadRequest,
+			wantViolations: []string{"/inputs/1"},
+		},
+		{
+			name:        "registered schema",
+			body:        `{"script_ref": "typed", "inputs": [{"n": 1}, {"n": 2}]}`,
+			wantStatus:  http.StatusOK,
+			wantResults: []string{"2", "4"},
+		},
+		{
+			name:           "registered schema, item invalid",
+			body:           `{"script_ref": "typed", "inputs": [{"n": 1}, {}]}`,
+			wantStatus:     http.StatusBadRequest,
+			wantViolations: []string{"/inputs/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postEnvelope(fanoutHandler(sm), "/fanout", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var response struct {
+				Results []struct {
+					Result json.RawMessage `json:"result"`
+				} `json:"results"`
+				Code       string            `json:"code"`
+				Violations []SchemaViolation `json:"violations"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			var results, paths []string
+			for _, result := range response.Results {
+				results = append(results, string(result.Result))
+			}
+			for _, v := range response.Violations {
+				paths = append(paths, v.Path)
+			}
+			if !reflect.DeepEqual(results, tt.wantResults) {
+				t.Errorf("results = %q, want %q", results, tt.wantResults)
+			}
+			if !reflect.DeepEqual(paths, tt.wantViolations) {
+				t.Errorf("violations at %q, want %q", paths, tt.wantViolations)
+			}
+			if tt.wantViolations != nil && response.Code != CodeInputSchema {
+				t.Errorf("code = %q, want %q", response.Code, CodeInputSchema)
+			}
+		})
+	}
+}
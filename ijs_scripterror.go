@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/sobek"
+)
+
+const (
+	// maxErrorNameLength caps the name of an error thrown by a script
+	maxErrorNameLength = 64
+	// maxErrorMessageLength caps its message
+	maxErrorMessageLength = 1024
+	// Range a thrown error's code must be in to be its status, 5xx stays
+	// reserved for real server errors
+	minScriptErrorStatus = 400
+	maxScriptErrorStatus = 499
+)
+
+// ScriptError is a failure a script signalled on purpose by throwing a plain
+// object such as {name: "ValidationError", message: "...", code: 422}. Errors
+// created with new Error() and thrown primitives are runtime errors instead.
+type ScriptError struct {
+	Name    string
+	Message string
+	Status  int // HTTP status of the response, from code, 400 without one in range
+}
+
+func (e *ScriptError) Error() string {
+	return e.Name + ": " + e.Message
+}
+
+// scriptErrorFrom returns the ScriptError thrown as value, nil when value is
+// not a plain object with a string name. Its properties are read under guard,
+// as they may be getters or proxy traps that throw in turn.
+func scriptErrorFrom(vm *sobek.Runtime, value sobek.Value) *ScriptError {
+	obj, ok := value.(*sobek.Object)
+	if !ok {
+		return nil
+	}
+	var se *ScriptError
+	if err := guard(vm, func() { se = readScriptError(obj) }); err != nil {
+		return nil
+	}
+	return se
+}
+
+func readScriptError(obj *sobek.Object) *ScriptError {
+	if obj.ClassName() != "Object" {
+		return nil
+	}
+	name, ok := obj.Get("name").(sobek.String)
+	if !ok || name.Length() == 0 {
+		return nil
+	}
+	se := &ScriptError{Name: truncateUTF8(name.String(), maxErrorNameLength), Status: http.StatusBadRequest}
+	if message := obj.Get("message"); message != nil && !sobek.IsUndefined(message) {
+		se.Message = truncateUTF8(message.String(), maxErrorMessageLength)
+	}
+	if code := obj.Get("code"); code != nil && !sobek.IsUndefined(code) {
+		if status := code.ToInteger(); status >= minScriptErrorStatus && status <= maxScriptErrorStatus {
+			se.Status = int(status)
+		}
+	}
+	return se
+}
+
+// thrownError returns the ScriptError behind the exception err, err otherwise.
+// The message of the exception is the thrown value converted to a string, which
+// runs its toString, so it is taken under guard, along with the Go error the
+// exception wraps, and both are kept for once the VM is gone.
+func thrownError(vm *sobek.Runtime, err error) error {
+	if cause := interruptCause(err); cause != nil {
+		return cause
+	}
+	var exception *sobek.Exception
+	if !errors.As(err, &exception) {
+		return fmt.Errorf("script execution failed: %w", err)
+	}
+	if se := scriptErrorFrom(vm, exception.Value()); se != nil {
+		return fmt.Errorf("script execution failed: %w", se)
+	}
+	thrown := &thrownException{exception: exception}
+	if err := guard(vm, func() {
+		thrown.message = exception.Error()
+		thrown.wrapped = exception.Unwrap()
+	}); err != nil {
+		if cause := interruptCause(err); cause != nil {
+			return cause
+		}
+		thrown.message = "uncaught exception, its value cannot be converted to a string"
+	}
+	return fmt.Errorf("script execution failed: %w", thrown)
+}
+
+// thrownException is a sobek.Exception whose message and wrapped error are
+// resolved up front, so inspecting it never calls back into the VM
+type thrownException struct {
+	exception *sobek.Exception
+	message   string
+	wrapped   error // Go error thrown by a host function, nil otherwise
+}
+
+func (e *thrownException) Error() string {
+	return e.message
+}
+
+func (e *thrownException) Unwrap() error {
+	return e.wrapped
+}
+
+// As lets errors.As find the exception itself
+func (e *thrownException) As(target interface{}) bool {
+	if exception, ok := target.(**sobek.Exception); ok {
+		*exception = e.exception
+		return true
+	}
+	return false
+}
+
+// describeThrown returns the string form of a value a script threw or rejected
+// with, taken under guard as it runs the value's toString
+func describeThrown(vm *sobek.Runtime, value sobek.Value) string {
+	var s string
+	if err := guard(vm, func() { s = value.String() }); err != nil {
+		return "value cannot be converted to a string"
+	}
+	return s
+}
+
+// guard runs f, which reads script values from Go, the way sobek runs a call
+// from Go: an exception thrown or an interrupt raised in it is returned instead
+// of unwinding the goroutine. Reading a script value, through Get, Export or
+// String, runs its getters, proxy traps and toString, script code that can
+// throw anything, outside of any execution that would catch it.
+func guard(vm *sobek.Runtime, f func()) error {
+	call, _ := sobek.AssertFunction(vm.ToValue(func(sobek.FunctionCall) sobek.Value {
+		f()
+		return sobek.Undefined()
+	}))
+	_, err := call(sobek.Undefined())
+	return err
+}
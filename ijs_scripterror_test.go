@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/sobek"
+)
+
+func TestThrownErrors(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = 200 * time.Millisecond })
+	tests := []struct {
+		name   string
+		script string
+		code   string
+		status int
+	}{
+		{"custom error object", `throw {name: "ValidationError", message: "bad input", code: 422}`, CodeScriptError, 422},
+		{"code above 4xx", `throw {name: "Teapot", code: 599}`, CodeScriptError, http.StatusBadRequest},
+		{"code below 4xx", `throw {name: "Teapot", code: 302}`, CodeScriptError, http.StatusBadRequest},
+		{"code not a number", `throw {name: "Teapot", code: "E42"}`, CodeScriptError, http.StatusBadRequest},
+		{"no code", `throw {name: "Teapot"}`, CodeScriptError, http.StatusBadRequest},
+		{"highest 4xx", `throw {name: "Teapot", code: 499}`, CodeScriptError, 499},
+		{"native error", `throw new Error("boom")`, CodeRuntimeError, http.StatusInternalServerError},
+		{"thrown primitive", `throw "boom"`, CodeRuntimeError, http.StatusInternalServerError},
+		{"throwing name getter", `throw {get name() { throw new Error("boom") }}`, CodeRuntimeError, http.StatusInternalServerError},
+		{"throwing toString", `throw {toString() { throw new Error("boom") }}`, CodeRuntimeError, http.StatusInternalServerError},
+		{"throwing getter in the result", `({get a() { throw new Error("boom") }})`, CodeRuntimeError, http.StatusInternalServerError},
+		{"throwing then getter", `({get then() { throw new Error("boom") }})`, CodeRuntimeError, http.StatusInternalServerError},
+		{"rejection with a throwing toString", `Promise.reject({toString() { throw 1 }})`, CodeRuntimeError, http.StatusInternalServerError},
+		{"looping toString", `throw {toString() { for (;;) {} }}`, CodeTimeout, http.StatusRequestTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if code := errorCode(err); code != tt.code {
+				t.Errorf("code = %s, want %s (%v)", code, tt.code, err)
+			}
+			rec := httptest.NewRecorder()
+			handleExecutionError(err, rec)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestScriptErrorFrom(t *testing.T) {
+	vm := sobek.New()
+	throwing := vm.NewProxy(vm.NewObject(), &sobek.ProxyTrapConfig{
+		Get: func(*sobek.Object, string, sobek.Value) sobek.Value {
+			panic(vm.NewTypeError("trap"))
+		},
+	})
+	tests := []struct {
+		name  string
+		value sobek.Value
+		want  *ScriptError
+	}{
+		{"plain object", vm.ToValue(map[string]interface{}{"name": "NotFound", "message": "no such item", "code": 404}), &ScriptError{Name: "NotFound", Message: "no such item", Status: 404}},
+		{"no code", vm.ToValue(map[string]interface{}{"name": "NotFound"}), &ScriptError{Name: "NotFound", Status: http.StatusBadRequest}},
+		{"no name", vm.ToValue(map[string]interface{}{"message": "no such item"}), nil},
+		{"primitive", vm.ToValue("NotFound"), nil},
+		{"throwing proxy", vm.ToValue(throwing), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scriptErrorFrom(vm, tt.value)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("scriptErrorFrom() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrownErrorProxy(t *testing.T) {
+	vm := sobek.New()
+	vm.Set("thrown", vm.NewProxy(vm.NewObject(), &sobek.ProxyTrapConfig{
+		Get: func(*sobek.Object, string, sobek.Value) sobek.Value {
+			panic(vm.NewTypeError("trap"))
+		},
+	}))
+	_, err := vm.RunString(`throw thrown`)
+	err = thrownError(vm, err)
+	var exception *sobek.Exception
+	if !errors.As(err, &exception) {
+		t.Fatalf("thrownError() = %v, want a runtime error", err)
+	}
+}
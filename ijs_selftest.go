@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// selftestCase is a known sandbox escape attempt. Script evaluates to true when
+// the escape worked, so a protection holds when the script returns anything
+// else or fails. Setup, when set, runs first in its own execution.
+type selftestCase struct {
+	name       string
+	setup      string
+	script     string
+	disruptive bool // affects other scripts, only run on request
+}
+
+var selftestCases = []selftestCase{
+	{
+		name:   "process global",
+		script: `typeof process !== "undefined" && process !== null && process.env !== undefined`,
+	},
+	{
+		name:   "require",
+		script: `require("fs") !== undefined`,
+	},
+	{
+		name:   "eval",
+		script: `eval("true")`,
+	},
+	{
+		name:   "Function constructor",
+		script: `typeof Function === "function"`,
+	},
+	{
+		name:   "function constructor chain",
+		script: `typeof (function () {}).constructor("return 1") === "function"`,
+	},
+	{
+		name:   "async and generator function constructors",
+		script: `typeof (async function () {}).constructor("return 1") === "function" || typeof (function* () {}).constructor("yield 1") === "function"`,
+	},
+	{
+		name:   "constructor chain from a host function",
+		script: `typeof timeBudget.constructor.constructor("return 1") === "function"`,
+	},
+	{
+		name:   "prototype pollution across executions",
+		setup:  `Object.prototype.polluted = true; Array.prototype.polluted = true`,
+		script: `({}).polluted === true || [].polluted === true`,
+	},
+	{
+		name:   "unbounded recursion stopped",
+		script: `(function f() { return f() })()`,
+	},
+	{
+		name:   "infinite loop interrupted",
+		script: `while (true) {}`,
+	},
+	{
+		name:       "memory bomb caught",
+		script:     `var a = []; while (true) { a.push(new Array(1e6).fill(0)) }`,
+		disruptive: true,
+	},
+}
+
+// SelftestResult reports whether one protection held
+type SelftestResult struct {
+	Name      string `json:"name"`
+	Protected bool   `json:"protected"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// SelftestResponse is the body returned by /admin/selftest
+type SelftestResponse struct {
+	Protected bool             `json:"protected"`
+	Cases     []SelftestResult `json:"cases"`
+}
+
+// runSelftest runs the escape attempts through the normal execution path,
+// skipping the disruptive ones unless asked to
+func (sm *ScriptManager) runSelftest(ctx context.Context, disruptive bool) SelftestResponse {
+	response := SelftestResponse{Protected: true}
+	for _, c := range selftestCases {
+		result := SelftestResult{Name: c.name}
+		if c.disruptive && !disruptive {
+			result.Skipped = true
+			result.Protected = true
+			result.Detail = "disruptive, run with ?disruptive=true"
+			response.Cases = append(response.Cases, result)
+			continue
+		}
+
+		if c.setup != "" {
+			sm.ExecuteScriptWithContext(ctx, ScriptJob{Script: c.setup})
+		}
+		run := sm.ExecuteScriptWithContext(ctx, ScriptJob{Script: c.script})
+		switch {
+		case errors.Is(run.Error, ErrNoWorkerAvailable), errors.Is(run.Error, ErrShuttingDown), ctx.Err() != nil:
+			result.Detail = "not run: " + errors.Join(run.Error, ctx.Err()).Error()
+		case run.Error != nil:
+			result.Protected = true
+			result.Detail = run.Error.Error()
+		default:
+			result.Protected = run.Result != true
+			if !result.Protected {
+				result.Detail = "escape succeeded"
+			}
+		}
+
+		if !result.Protected {
+			response.Protected = false
+			logrus.WithFields(logrus.Fields{
+				"case":   c.name,
+				"detail": result.Detail,
+			}).Error("Self-test protection did not hold")
+		}
+		response.Cases = append(response.Cases, result)
+	}
+	return response
+}
+
+// selftestHandler serves /admin/selftest, answering 500 when a protection did not hold
+func selftestHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		disruptive, _ := strconv.ParseBool(r.URL.Query().Get("disruptive"))
+		logrus.WithField("disruptive", disruptive).Info("Running sandbox self-test")
+
+		response := scriptManager.runSelftest(r.Context(), disruptive)
+		status := http.StatusOK
+		if !response.Protected {
+			status = http.StatusInternalServerError
+		}
+		writeJSONValue(w, status, response)
+	}
+}
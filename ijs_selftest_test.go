@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSelftestBuiltinCases(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = 200 * time.Millisecond })
+	response := sm.runSelftest(context.Background(), false)
+	if len(response.Cases) != len(selftestCases) {
+		t.Fatalf("%d cases reported, want %d", len(response.Cases), len(selftestCases))
+	}
+	for i, result := range response.Cases {
+		c := selftestCases[i]
+		t.Run(c.name, func(t *testing.T) {
+			if !result.Protected {
+				t.Fatalf("not protected: %s", result.Detail)
+			}
+			if result.Skipped != c.disruptive {
+				t.Fatalf("skipped = %t, want %t", result.Skipped, c.disruptive)
+			}
+		})
+	}
+	if !response.Protected {
+		t.Fatal("response not protected")
+	}
+}
+
+func TestSelftestReportsEscapes(t *testing.T) {
+	tests := []struct {
+		name          string
+		script        string
+		wantProtected bool
+	}{
+		{name: "escape succeeded", script: "true"},
+		{name: "escape returned something else", script: "false", wantProtected: true},
+		{name: "escape failed", script: "throw new Error('blocked')", wantProtected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, nil)
+			saved := selftestCases
+			selftestCases = []selftestCase{{name: tt.name, script: tt.script}}
+			t.Cleanup(func() { selftestCases = saved })
+
+			response := sm.runSelftest(context.Background(), false)
+			if response.Protected != tt.wantProtected || response.Cases[0].Protected != tt.wantProtected {
+				t.Fatalf("protected = %t, want %t", response.Protected, tt.wantProtected)
+			}
+		})
+	}
+}
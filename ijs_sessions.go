@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/sobek"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found or expired")
+	ErrSessionFull     = errors.New("session store is full")
+	ErrTooManySessions = errors.New("too many open sessions")
+)
+
+// session is a small key-value store shared by the scripts run with its ID.
+// Values are kept as JSON, so every get hands the script its own copy.
+type session struct {
+	sync.Mutex
+	values   map[string]json.RawMessage
+	size     int // bytes held by keys and values
+	lastUsed time.Time
+	evicted  bool // dropped by enforceSessionMemory, scripts still holding it cannot set
+}
+
+// sessionTable holds the open sessions. A session expires session_ttl after it
+// was last used, expired sessions being swept whenever one is created.
+type sessionTable struct {
+	sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[string]*session)}
+}
+
+// create opens a new session and returns its ID
+func (t *sessionTable) create() (string, error) {
+	var raw [16]byte
+	rand.Read(raw[:])
+	id := hex.EncodeToString(raw[:])
+
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for sessionID, s := range t.sessions {
+		if s.expired(now) {
+			delete(t.sessions, sessionID)
+		}
+	}
+	if len(t.sessions) >= config.MaxSessions {
+		return "", ErrTooManySessions
+	}
+	t.sessions[id] = &session{values: make(map[string]json.RawMessage), lastUsed: now}
+	return id, nil
+}
+
+// get returns the open session id, marking it as used
+func (t *sessionTable) get(id string) (*session, error) {
+	t.Lock()
+	defer t.Unlock()
+	s, ok := t.sessions[id]
+	now := time.Now()
+	if !ok || s.expired(now) {
+		delete(t.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	s.Lock()
+	s.lastUsed = now
+	s.Unlock()
+	return s, nil
+}
+
+func (s *session) expired(now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	return now.Sub(s.lastUsed) > config.SessionTTL
+}
+
+// set stores value under key, nil removing the key, failing when the session
+// would grow past session_max_bytes
+func (s *session) set(key string, value json.RawMessage) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.evicted {
+		return ErrSessionNotFound
+	}
+	size := s.size
+	if old, ok := s.values[key]; ok {
+		size -= len(key) + len(old)
+	}
+	if value == nil {
+		delete(s.values, key)
+		s.size = size
+		return nil
+	}
+	size += len(key) + len(value)
+	if size > config.SessionMaxBytes {
+		return ErrSessionFull
+	}
+	s.values[key] = value
+	s.size = size
+	return nil
+}
+
+func (s *session) get(key string) (json.RawMessage, bool) {
+	s.Lock()
+	defer s.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// installSession exposes the session global: session.get(key) returns a copy
+// of the stored value, undefined when missing, and session.set(key, value)
+// stores a JSON-serializable value, undefined removing the key
+func (sm *ScriptManager) installSession(vm *sobek.Runtime, s *session) {
+	obj := vm.NewObject()
+	obj.Set("get", func(key string) sobek.Value {
+		raw, ok := s.get(key)
+		if !ok {
+			return sobek.Undefined()
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			panic(vm.NewGoError(err))
+		}
+		return vm.ToValue(value)
+	})
+	obj.Set("set", func(key string, value sobek.Value) {
+		if value == nil || sobek.IsUndefined(value) {
+			s.set(key, nil)
+			return
+		}
+		raw, err := json.Marshal(value.Export())
+		if err != nil {
+			panic(vm.NewTypeError("session.set: value is not JSON-serializable: %v", err))
+		}
+		if err := s.set(key, raw); err != nil {
+			panic(vm.NewGoError(err))
+		}
+		sm.enforceSessionMemory()
+	})
+	vm.Set("session", obj)
+}
+
+// SessionResponse is the body returned by POST /sessions
+type SessionResponse struct {
+	SessionID string `json:"session_id"`
+}
+
+// createSessionHandler serves POST /sessions
+func createSessionHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := scriptManager.sessions.create()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: err.Error(), Code: errorCode(err)})
+			logrus.WithError(err).Warn("Rejected session creation")
+			return
+		}
+		logrus.WithField("session_id", id).Info("Session created")
+		writeJSONValue(w, http.StatusCreated, SessionResponse{SessionID: id})
+	}
+}
+
+// sessionFootprint is the approximate memory held by one stateful session, a
+// session store or a REPL session, as weighed by enforceSessionMemory
+type sessionFootprint struct {
+	kind     string // "session" or "repl"
+	id       string
+	bytes    uint64
+	lastUsed time.Time
+}
+
+// footprints lists the open sessions with the bytes their keys and values hold
+func (t *sessionTable) footprints() []sessionFootprint {
+	t.Lock()
+	defer t.Unlock()
+	list := make([]sessionFootprint, 0, len(t.sessions))
+	for id, s := range t.sessions {
+		s.Lock()
+		list = append(list, sessionFootprint{kind: "session", id: id, bytes: uint64(s.size), lastUsed: s.lastUsed})
+		s.Unlock()
+	}
+	return list
+}
+
+// evict drops session id, scripts still holding it can read but no longer set
+func (t *sessionTable) evict(id string) {
+	t.Lock()
+	s, ok := t.sessions[id]
+	delete(t.sessions, id)
+	t.Unlock()
+	if ok {
+		s.Lock()
+		s.evicted = true
+		s.Unlock()
+	}
+}
+
+// enforceSessionMemory evicts stateful sessions, the largest first and the
+// least recently used among equals, until the memory they hold together is
+// back under max_session_memory_mb. Sizes are what each session holds now,
+// approximately: a session store counts its keys and JSON values, a REPL
+// session the size of its scope as measured after its last snippet. A REPL
+// session running a snippet is left alone.
+func (sm *ScriptManager) enforceSessionMemory() {
+	limit := uint64(config.MaxSessionMemoryMB) << 20
+	if limit == 0 {
+		return
+	}
+	var all []sessionFootprint
+	if sm.sessions != nil {
+		all = append(all, sm.sessions.footprints()...)
+	}
+	if sm.repls != nil {
+		all = append(all, sm.repls.footprints()...)
+	}
+	var total uint64
+	for _, f := range all {
+		total += f.bytes
+	}
+	if total <= limit {
+		return
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].bytes != all[j].bytes {
+			return all[i].bytes > all[j].bytes
+		}
+		return all[i].lastUsed.Before(all[j].lastUsed)
+	})
+	for _, f := range all {
+		if total <= limit {
+			break
+		}
+		switch f.kind {
+		case "session":
+			sm.sessions.evict(f.id)
+		case "repl":
+			if !sm.repls.evict(f.id) {
+				continue
+			}
+		}
+		total -= f.bytes
+		logrus.WithFields(logrus.Fields{
+			"kind":     f.kind,
+			"id":       f.id,
+			"bytes":    f.bytes,
+			"total_mb": total >> 20,
+			"limit_mb": config.MaxSessionMemoryMB,
+		}).Warn("Evicted a session over the aggregate session memory limit")
+	}
+}
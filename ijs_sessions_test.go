@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCap(t *testing.T) {
+	tests := []struct {
+		name    string
+		open    int
+		expired int // of the open sessions, how many are past session_ttl
+		wantErr error
+	}{
+		{name: "under the cap", open: 2},
+		{name: "at the cap", open: 3, wantErr: ErrTooManySessions},
+		{name: "expired sessions make room", open: 3, expired: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestManager(t, func(c *Config) {
+				c.MaxSessions = 3
+				c.SessionTTL = time.Minute
+			})
+			table := newSessionTable()
+			for i := 0; i < tt.open; i++ {
+				id, err := table.create()
+				if err != nil {
+					t.Fatalf("session %d: %v", i, err)
+				}
+				if i < tt.expired {
+					table.sessions[id].lastUsed = time.Now().Add(-time.Hour)
+				}
+			}
+			if _, err := table.create(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplSessionCap(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.MaxReplSessions = 2 })
+	newTestRepl(t, sm)
+	s := newTestRepl(t, sm)
+	if _, err := sm.repls.create(); !errors.Is(err, ErrTooManySessions) {
+		t.Fatalf("error = %v, want ErrTooManySessions", err)
+	}
+	sm.repls.close(s.id)
+	if _, err := sm.repls.create(); err != nil {
+		t.Fatalf("after a close: %v", err)
+	}
+}
+
+func TestSessionSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		sets     [][2]string // key and JSON value, "" removing the key
+		wantErr  error
+		wantSize int
+	}{
+		{name: "counts keys and values", sets: [][2]string{{"a", `"xyz"`}, {"bb", "1"}}, wantSize: 1 + 5 + 2 + 1},
+		{name: "replacing a value", sets: [][2]string{{"a", `"xyz"`}, {"a", "1"}}, wantSize: 2},
+		{name: "removing a key", sets: [][2]string{{"a", `"xyz"`}, {"a", ""}}, wantSize: 0},
+		{name: "over session_max_bytes", sets: [][2]string{{"a", `"` + strings.Repeat("x", 100) + `"`}}, wantErr: ErrSessionFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestManager(t, func(c *Config) { c.SessionMaxBytes = 64 })
+			s := &session{values: make(map[string]json.RawMessage)}
+			var err error
+			for _, set := range tt.sets {
+				var value json.RawMessage
+				if set[1] != "" {
+					value = json.RawMessage(set[1])
+				}
+				err = s.set(set[0], value)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && s.size != tt.wantSize {
+				t.Fatalf("size = %d, want %d", s.size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestEnforceSessionMemory(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name string
+		// Sizes of the session stores and REPL scopes, in KB, the first used
+		// least recently. A store of n KB holds exactly n KB.
+		stores, repls []int
+		busy          int // index of a REPL session running a snippet, -1 for none
+		wantStores    []bool
+		wantRepls     []bool
+	}{
+		{
+			name:   "under the limit",
+			stores: []int{300}, repls: []int{300}, busy: -1,
+			wantStores: []bool{true}, wantRepls: []bool{true},
+		},
+		{
+			name:   "largest first",
+			stores: []int{200, 600}, repls: []int{400}, busy: -1,
+			wantStores: []bool{true, false}, wantRepls: []bool{true},
+		},
+		{
+			name:   "least recently used among equals",
+			stores: []int{400, 400}, repls: []int{400}, busy: -1,
+			wantStores: []bool{false, true}, wantRepls: []bool{true},
+		},
+		{
+			name:   "largest REPL scope",
+			stores: []int{100}, repls: []int{300, 800}, busy: -1,
+			wantStores: []bool{true}, wantRepls: []bool{true, false},
+		},
+		{
+			name:   "busy REPL session left alone",
+			stores: []int{300}, repls: []int{800, 900}, busy: 1,
+			wantStores: []bool{true}, wantRepls: []bool{false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.MaxSessionMemoryMB = 1
+				c.SessionMaxBytes = mb
+				c.SessionTTL = 24 * time.Hour
+			})
+			sm.sessions = newSessionTable()
+			used := time.Now().Add(-time.Hour)
+			var stores []string
+			for _, kb := range tt.stores {
+				id, err := sm.sessions.create()
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := sm.sessions.sessions[id]
+				if err := s.set("k", json.RawMessage(`"`+strings.Repeat("x", kb<<10-3)+`"`)); err != nil {
+					t.Fatal(err)
+				}
+				s.lastUsed = used
+				used = used.Add(time.Second)
+				stores = append(stores, id)
+			}
+			var repls []*replSession
+			for _, kb := range tt.repls {
+				s := newTestRepl(t, sm)
+				s.scopeBytes = uint64(kb) << 10
+				s.lastUsed = used
+				used = used.Add(time.Second)
+				repls = append(repls, s)
+			}
+			if tt.busy >= 0 {
+				repls[tt.busy].Lock()
+				defer repls[tt.busy].Unlock()
+			}
+
+			sm.enforceSessionMemory()
+			for i, id := range stores {
+				if _, open := sm.sessions.sessions[id]; open != tt.wantStores[i] {
+					t.Errorf("session store %d open = %t, want %t", i, open, tt.wantStores[i])
+				}
+			}
+			for i, s := range repls {
+				if _, open := sm.repls.sessions[s.id]; open != tt.wantRepls[i] {
+					t.Errorf("REPL session %d open = %t, want %t", i, open, tt.wantRepls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplEvictedByScope(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) { c.MaxSessionMemoryMB = 1 })
+	small, large := newTestRepl(t, sm), newTestRepl(t, sm)
+	for s, snippet := range map[*replSession]string{
+		small: "var s = 'x'.repeat(1000)",
+		large: "var s = 'x'.repeat(600 << 10)",
+	} {
+		if result := runTestSnippet(sm, s, snippet); result.Error != nil {
+			t.Fatalf("%s: %v", snippet, result.Error)
+		}
+	}
+	// Garbage the small session made does not count, only what it holds
+	if result := runTestSnippet(sm, small, "for (let i = 0; i < 100; i++) 'y'.repeat(100 << 10); s.length"); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result := runTestSnippet(sm, small, "var t = 'x'.repeat(500 << 10)"); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	sm.enforceSessionMemory()
+	if _, err := sm.repls.get(large.id); !errors.Is(err, ErrReplNotFound) {
+		t.Fatalf("largest session not evicted: %v", err)
+	}
+	if _, err := sm.repls.get(small.id); err != nil {
+		t.Fatalf("smaller session evicted: %v", err)
+	}
+}
+
+func TestSessionRequests(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.MaxSessions = 10
+		c.SessionMaxBytes = 64
+		c.SessionTTL = time.Minute
+	})
+	sm.sessions = newSessionTable()
+	run := func(id, script string) (int, string) {
+		body, _ := json.Marshal(map[string]string{"script": script, "session_id": id})
+		rec := postEnvelope(handler(sm), "/data", string(body))
+		return rec.Code, rec.Body.String()
+	}
+	id, err := sm.sessions.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values outlive the script setting them, every get returning a copy
+	if code, body := run(id, `session.set("cart", {items: [1, 2]}); session.get("cart").items.push(3); "ok"`); code != http.StatusOK {
+		t.Fatalf("set: %d %s", code, body)
+	}
+	if code, body := run(id, `session.get("cart").items.length`); code != http.StatusOK || !strings.Contains(body, `"result":2`) {
+		t.Fatalf("get: %d %s, want the stored 2 items", code, body)
+	}
+	if code, body := run(id, `typeof session.get("missing")`); !strings.Contains(body, `"undefined"`) {
+		t.Fatalf("missing key: %d %s", code, body)
+	}
+
+	// Growing past session_max_bytes throws and keeps the stored value
+	if code, body := run(id, `session.set("cart", "x".repeat(100))`); code == http.StatusOK || !strings.Contains(body, ErrSessionFull.Error()) {
+		t.Fatalf("over session_max_bytes: %d %s, want %v", code, body, ErrSessionFull)
+	}
+	if code, body := run(id, `try { session.set("big", "x".repeat(100)) } catch (e) { "caught" }`); !strings.Contains(body, `"caught"`) {
+		t.Fatalf("over session_max_bytes not catchable: %d %s", code, body)
+	}
+	if code, body := run(id, `session.get("cart").items.length`); !strings.Contains(body, `"result":2`) {
+		t.Fatalf("after a failed set: %d %s, want the stored value kept", code, body)
+	}
+
+	// A session unused for session_ttl is gone, the value with it
+	sm.sessions.sessions[id].lastUsed = time.Now().Add(-2 * time.Minute)
+	if code, body := run(id, `session.get("cart")`); code == http.StatusOK || !strings.Contains(body, CodeSessionNotFound) {
+		t.Fatalf("expired session: %d %s, want %s", code, body, CodeSessionNotFound)
+	}
+	if _, ok := sm.sessions.sessions[id]; ok {
+		t.Fatal("expired session still in the table")
+	}
+	if code, body := run("unknown", `1`); !strings.Contains(body, CodeSessionNotFound) {
+		t.Fatalf("unknown session: %d %s, want %s", code, body, CodeSessionNotFound)
+	}
+}
+
+func TestSessionEvicted(t *testing.T) {
+	newTestManager(t, func(c *Config) {
+		c.MaxSessions = 10
+		c.SessionMaxBytes = 64
+		c.SessionTTL = time.Minute
+	})
+	table := newSessionTable()
+	id, err := table.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := table.get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set("a", json.RawMessage("1")); err != nil {
+		t.Fatal(err)
+	}
+	table.evict(id)
+
+	// A script still holding the session reads what it had, but cannot set
+	if value, ok := s.get("a"); !ok || string(value) != "1" {
+		t.Fatalf("get after eviction = %s, %t", value, ok)
+	}
+	if err := s.set("b", json.RawMessage("2")); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("set after eviction = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := table.get(id); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("get of an evicted session = %v, want ErrSessionNotFound", err)
+	}
+}
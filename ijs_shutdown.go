@@ -22,8 +22,19 @@ func handleGraceFullShutdown() {
 
 	// Wait for a signal
 	<-stop
+
+	// Keep serving while the load balancer notices /health going unready
+	setStopping()
+	if config.PreStopDelay > 0 {
+		logrus.Infof("Reporting not ready, shutting down in %s", config.PreStopDelay)
+		time.Sleep(config.PreStopDelay)
+	}
+
 	logrus.Info("Shutting down server gracefully...")
 
+	// Fail the queued jobs first so their handlers return before the server waits on them
+	scriptManager.Shutdown()
+
 	// Create a context with a timeout for shutdown operations
 	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeLimit)
 	defer cancel()
@@ -34,7 +45,9 @@ func handleGraceFullShutdown() {
 	}
 
 	// Stop all running scripts using the ScriptManager
-	scriptManager.cancelAllScripts()
+	scriptManager.cancelAllScripts(ErrShuttingDown)
+
+	shutdownTracing(ctx)
 	logrus.Info("All workers stopped. Exiting after " + config.ShutdownPause.String() + " clean up pause.")
 
 	// Allow time for cleanup operations to complete
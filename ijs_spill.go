@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrSpillNotFound is returned for a spilled result already downloaded or expired
+	ErrSpillNotFound = errors.New("spilled result not found or expired")
+	// ErrSpillFull is returned when a result does not fit in spill_max_total_bytes
+	ErrSpillFull = errors.New("no spill space left")
+)
+
+// spillSweepInterval is how often expired spill files are looked for
+const spillSweepInterval = 10 * time.Second
+
+// spillFile is a result written to disk, waiting to be downloaded
+type spillFile struct {
+	path        string
+	contentType string
+	size        int64
+	expires     time.Time
+}
+
+// spillTable holds the results spilled to spill_dir. A file is removed once
+// downloaded, or spill_ttl after it was written. The files together never
+// take more than spill_max_total_bytes.
+type spillTable struct {
+	sync.Mutex
+	dir      string
+	ttl      time.Duration
+	maxTotal int64
+	used     int64 // bytes of the files on disk, and of those being written
+	files    map[string]*spillFile
+}
+
+func newSpillTable(dir string, ttl time.Duration, maxTotal int64) (*spillTable, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &spillTable{dir: dir, ttl: ttl, maxTotal: maxTotal, files: make(map[string]*spillFile)}, nil
+}
+
+// store writes result to a spill file and returns the ID it is served under. A
+// raw result is written as is, any other as the JSON response it would have been.
+func (t *spillTable) store(result ScriptResult) (string, error) {
+	f, err := os.CreateTemp(t.dir, "ijs-spill-*")
+	if err != nil {
+		return "", err
+	}
+	sw := &spillWriter{t: t, w: f}
+	contentType := "application/json"
+	if isRawContentType(result.ContentType) {
+		contentType = result.ContentType
+		err = writeRawResult(sw, result.Result)
+	} else {
+		err = json.NewEncoder(sw).Encode(Response{Result: result.Result, Logs: result.Logs})
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		t.release(sw.n)
+		return "", err
+	}
+
+	var raw [16]byte
+	rand.Read(raw[:])
+	id := hex.EncodeToString(raw[:])
+	t.Lock()
+	t.files[id] = &spillFile{path: f.Name(), contentType: contentType, size: sw.n, expires: time.Now().Add(t.ttl)}
+	t.Unlock()
+	return id, nil
+}
+
+// take removes file id from the table, its caller serves and deletes it
+func (t *spillTable) take(id string) (*spillFile, error) {
+	t.Lock()
+	defer t.Unlock()
+	file, ok := t.files[id]
+	if !ok || time.Now().After(file.expires) {
+		return nil, ErrSpillNotFound
+	}
+	delete(t.files, id)
+	return file, nil
+}
+
+// remove deletes a file taken from the table and frees its space
+func (t *spillTable) remove(file *spillFile) {
+	if err := os.Remove(file.path); err != nil {
+		logrus.WithError(err).Warn("Failed to remove spill file")
+	}
+	t.release(file.size)
+}
+
+func (t *spillTable) release(n int64) {
+	t.Lock()
+	t.used -= n
+	t.Unlock()
+}
+
+// sweep removes the files not downloaded within the TTL
+func (t *spillTable) sweep() {
+	t.Lock()
+	now := time.Now()
+	var expired []*spillFile
+	for id, file := range t.files {
+		if now.After(file.expires) {
+			expired = append(expired, file)
+			delete(t.files, id)
+		}
+	}
+	t.Unlock()
+	for _, file := range expired {
+		t.remove(file)
+	}
+	if len(expired) > 0 {
+		logrus.WithField("files", len(expired)).Info("Removed expired spill files")
+	}
+}
+
+// expireLoop sweeps the expired files until done is closed
+func (t *spillTable) expireLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(spillSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.sweep()
+		case <-done:
+			return
+		}
+	}
+}
+
+// spillWriter counts the bytes written against spill_max_total_bytes, failing
+// the write that would go over
+type spillWriter struct {
+	t *spillTable
+	w io.Writer
+	n int64
+}
+
+func (sw *spillWriter) Write(p []byte) (int, error) {
+	sw.t.Lock()
+	if sw.t.used+int64(len(p)) > sw.t.maxTotal {
+		sw.t.Unlock()
+		return 0, fmt.Errorf("%w: spill files use %d of %d bytes", ErrSpillFull, sw.t.used, sw.t.maxTotal)
+	}
+	sw.t.used += int64(len(p))
+	sw.t.Unlock()
+	sw.n += int64(len(p))
+	return sw.w.Write(p)
+}
+
+// spillDownloadHandler serves GET /results/{id}, a result is downloaded once
+func spillDownloadHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, err := scriptManager.spills.take(r.PathValue("id"))
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, Response{Error: err.Error(), Code: errorCode(err)})
+			return
+		}
+		defer scriptManager.spills.remove(file)
+
+		f, err := os.Open(file.path)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, Response{Error: "spilled result is unreadable", Code: CodeInternalError})
+			logrus.WithError(err).Error("Failed to open spill file")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", file.contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(file.size, 10))
+		if _, err := io.Copy(w, f); err != nil {
+			logrus.WithError(err).Warn("Failed to send spilled result")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spillManager returns a manager spilling results over 100 bytes, up to
+// 10000 bytes each and maxTotal together, to a temporary directory
+func spillManager(t *testing.T, ttl time.Duration, maxTotal int64) *ScriptManager {
+	t.Helper()
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.MaxResultBytes = 100
+		c.SpillMaxBytes = 10000
+	})
+	spills, err := newSpillTable(t.TempDir(), ttl, maxTotal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.spills = spills
+	return sm
+}
+
+// spillFiles counts the files in the spill directory of sm
+func spillFiles(t *testing.T, sm *ScriptManager) int {
+	t.Helper()
+	entries, err := os.ReadDir(sm.spills.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func postScript(sm *ScriptManager, script string) (*httptest.ResponseRecorder, Response) {
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(script)))
+	var response Response
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec, response
+}
+
+func downloadSpill(sm *ScriptManager, url string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	r.SetPathValue("id", strings.TrimPrefix(url, "/results/"))
+	rec := httptest.NewRecorder()
+	spillDownloadHandler(sm)(rec, r)
+	return rec
+}
+
+func TestSpill(t *testing.T) {
+	sm := spillManager(t, time.Minute, 1<<20)
+
+	// Under max_result_bytes the result stays inline
+	if rec, response := postScript(sm, `"small"`); rec.Code != http.StatusOK || response.Result != "small" || response.ResultURL != "" {
+		t.Fatalf("small result: %d %s", rec.Code, rec.Body)
+	}
+	if n := spillFiles(t, sm); n != 0 {
+		t.Fatalf("%d spill files for an inline result", n)
+	}
+
+	rec, response := postScript(sm, `({rows: Array.from({length: 100}, (_, i) => i)})`)
+	if rec.Code != http.StatusOK || response.Result != nil || !strings.HasPrefix(response.ResultURL, "/results/") {
+		t.Fatalf("large result: %d %s, want a result_url instead of the result", rec.Code, rec.Body)
+	}
+	if n := spillFiles(t, sm); n != 1 {
+		t.Fatalf("%d spill files, want 1", n)
+	}
+	got := downloadSpill(sm, response.ResultURL)
+	if got.Code != http.StatusOK || got.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("download: %d %q", got.Code, got.Header().Get("Content-Type"))
+	}
+	var spilled struct {
+		Result struct {
+			Rows []int `json:"rows"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(got.Body.Bytes(), &spilled); err != nil || len(spilled.Result.Rows) != 100 || spilled.Result.Rows[99] != 99 {
+		t.Fatalf("downloaded %s, %v, want the 100 rows", got.Body, err)
+	}
+
+	// A result is downloaded once, its file going with it
+	if n := spillFiles(t, sm); n != 0 {
+		t.Fatalf("%d spill files after the download, want 0", n)
+	}
+	if again := downloadSpill(sm, response.ResultURL); again.Code != http.StatusNotFound || !strings.Contains(again.Body.String(), CodeResultNotFound) {
+		t.Fatalf("second download: %d %s, want 404 and %s", again.Code, again.Body, CodeResultNotFound)
+	}
+	if sm.spills.used != 0 {
+		t.Fatalf("%d bytes still counted after the download", sm.spills.used)
+	}
+
+	// A raw result is spilled and served as is
+	_, response = postScript(sm, `setContentType("text/plain"); "x".repeat(500)`)
+	got = downloadSpill(sm, response.ResultURL)
+	if got.Code != http.StatusOK || got.Header().Get("Content-Type") != "text/plain" || got.Body.String() != strings.Repeat("x", 500) {
+		t.Fatalf("raw download: %d %q %d bytes", got.Code, got.Header().Get("Content-Type"), got.Body.Len())
+	}
+
+	// Over spill_max_bytes the result fails as it would without spilling
+	if rec, response := postScript(sm, `"x".repeat(20000)`); rec.Code != http.StatusUnprocessableEntity || response.Code != CodeResultTooLarge {
+		t.Fatalf("result over spill_max_bytes: %d %s, want 422 and %s", rec.Code, rec.Body, CodeResultTooLarge)
+	}
+}
+
+func TestSpillTTL(t *testing.T) {
+	sm := spillManager(t, 50*time.Millisecond, 1<<20)
+	_, first := postScript(sm, `"x".repeat(500)`)
+	_, second := postScript(sm, `"y".repeat(500)`)
+	if first.ResultURL == "" || second.ResultURL == "" {
+		t.Fatal("results not spilled")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Past the TTL the result cannot be downloaded, even before the sweep
+	if got := downloadSpill(sm, first.ResultURL); got.Code != http.StatusNotFound {
+		t.Fatalf("download past the TTL: %d, want 404", got.Code)
+	}
+	sm.spills.sweep()
+	if n := spillFiles(t, sm); n != 0 {
+		t.Fatalf("%d spill files after the sweep, want 0", n)
+	}
+	if sm.spills.used != 0 || len(sm.spills.files) != 0 {
+		t.Fatalf("%d bytes and %d files still counted after the sweep", sm.spills.used, len(sm.spills.files))
+	}
+}
+
+func TestSpillFull(t *testing.T) {
+	// Room for two results of about 1000 bytes, not three
+	sm := spillManager(t, time.Minute, 2500)
+	var urls []string
+	for i := 0; i < 2; i++ {
+		rec, response := postScript(sm, `"x".repeat(1000)`)
+		if response.ResultURL == "" {
+			t.Fatalf("result %d: %d %s, want it spilled", i, rec.Code, rec.Body)
+		}
+		urls = append(urls, response.ResultURL)
+	}
+	rec, response := postScript(sm, `"x".repeat(1000)`)
+	if rec.Code != http.StatusInsufficientStorage || response.Code != CodeSpillFull {
+		t.Fatalf("third result: %d %s, want 507 and %s", rec.Code, rec.Body, CodeSpillFull)
+	}
+	// The partly written file is gone and its bytes are given back
+	if n := spillFiles(t, sm); n != 2 {
+		t.Fatalf("%d spill files, want the 2 stored", n)
+	}
+
+	// A download makes room again
+	downloadSpill(sm, urls[0])
+	if _, response := postScript(sm, `"x".repeat(1000)`); response.ResultURL == "" {
+		t.Fatalf("after a download: %+v, want the result spilled", response)
+	}
+	if _, err := sm.spills.take("unknown"); !errors.Is(err, ErrSpillNotFound) {
+		t.Fatalf("take of an unknown ID = %v, want ErrSpillNotFound", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/grafana/sobek"
+)
+
+// installStdlib exposes the optional helper library enabled by the enable_stdlib setting
+func installStdlib(vm *sobek.Runtime) {
+	vm.Set("encodeBase64", func(call sobek.FunctionCall) sobek.Value {
+		return vm.ToValue(base64.StdEncoding.EncodeToString(bytesArgument(vm, "encodeBase64", call.Argument(0))))
+	})
+	vm.Set("decodeBase64", func(s string) string {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			panic(vm.NewTypeError("decodeBase64: invalid input: %v", err))
+		}
+		return string(data)
+	})
+	vm.Set("encodeHex", func(call sobek.FunctionCall) sobek.Value {
+		return vm.ToValue(hex.EncodeToString(bytesArgument(vm, "encodeHex", call.Argument(0))))
+	})
+	vm.Set("decodeHex", func(s string) string {
+		data, err := hex.DecodeString(s)
+		if err != nil {
+			panic(vm.NewTypeError("decodeHex: invalid input: %v", err))
+		}
+		return string(data)
+	})
+}
+
+// bytesArgument converts a string, ArrayBuffer or typed array argument to bytes,
+// throwing a TypeError in the script for anything else
+func bytesArgument(vm *sobek.Runtime, fn string, arg sobek.Value) []byte {
+	switch v := arg.Export().(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	case sobek.ArrayBuffer:
+		return v.Bytes()
+	default:
+		panic(vm.NewTypeError("%s: expected a string, ArrayBuffer or Uint8Array", fn))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdlibEncoding(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableStdlib = true
+	})
+	tests := []struct {
+		name    string
+		script  string
+		want    interface{}
+		wantErr string
+	}{
+		{"base64 of a string", `encodeBase64("hello")`, "aGVsbG8=", ""},
+		{"base64 of UTF-8", `encodeBase64("é")`, "w6k=", ""},
+		{"base64 of a Uint8Array", `encodeBase64(new Uint8Array([0, 255, 1]))`, "AP8B", ""},
+		{"base64 of an ArrayBuffer", `encodeBase64(new Uint8Array([0, 255, 1]).buffer)`, "AP8B", ""},
+		{"base64 round trip", `decodeBase64(encodeBase64("round trip"))`, "round trip", ""},
+		{"invalid base64", `decodeBase64("not base64!")`, nil, "decodeBase64: invalid input"},
+		{"base64 of a number", `encodeBase64(42)`, nil, "encodeBase64: expected a string"},
+		{"hex of a string", `encodeHex("hi")`, "6869", ""},
+		{"hex of a Uint8Array", `encodeHex(new Uint8Array([0, 15, 255]))`, "000fff", ""},
+		{"hex round trip", `decodeHex("6869")`, "hi", ""},
+		{"odd length hex", `decodeHex("abc")`, nil, "decodeHex: invalid input"},
+		{"invalid hex", `decodeHex("zz")`, nil, "decodeHex: invalid input"},
+		{"hex of an object", `encodeHex({})`, nil, "encodeHex: expected a string"},
+		{"errors are catchable", `try { decodeHex("zz") } catch (e) { e instanceof TypeError }`, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sm.ExecuteScriptWithTimeout(tt.script)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("result = %#v, want %#v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestStdlibDisabled(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.EnableStdlib = false
+	})
+	result, err := sm.ExecuteScriptWithTimeout(`[typeof encodeBase64, typeof decodeHex].join()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "undefined,undefined" {
+		t.Fatalf("helpers installed without enable_stdlib: %v", result)
+	}
+}
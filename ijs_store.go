@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrScriptNotFound   = errors.New("script reference not found")
+	ErrInvalidScriptRef = errors.New("invalid script reference")
+)
+
+// ScriptStore resolves pre-registered scripts by name
+type ScriptStore interface {
+	Load(name string) (string, error)
+}
+
+// inputSchemaStore is implemented by stores that keep a JSON Schema for the
+// input of their scripts. LoadInputSchema returns nil when a script has none.
+type inputSchemaStore interface {
+	LoadInputSchema(name string) ([]byte, error)
+}
+
+// scriptRefPattern accepts names like "reports/daily": slash separated segments of
+// letters, digits, dots, dashes and underscores
+var scriptRefPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+
+// newScriptStore creates the store selected by the script_store setting, nil when disabled
+func newScriptStore(cfg Config) (ScriptStore, error) {
+	switch cfg.ScriptStore {
+	case "":
+		return nil, nil
+	case "filesystem":
+		return &fileScriptStore{dir: cfg.ScriptStoreDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown script store %q", cfg.ScriptStore)
+	}
+}
+
+// fileScriptStore loads scripts from <dir>/<name>.js, and the schema of their
+// input from <dir>/<name>.schema.json when there is one
+type fileScriptStore struct {
+	dir string
+}
+
+// path returns the file of script name with extension ext
+func (s *fileScriptStore) path(name, ext string) (string, error) {
+	if !scriptRefPattern.MatchString(name) || strings.Contains(name, "..") {
+		return "", ErrInvalidScriptRef
+	}
+
+	root, err := filepath.Abs(s.dir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, filepath.FromSlash(name)+ext)
+
+	// The pattern already rules out traversal, this guards against anything it missed
+	if rel, err := filepath.Rel(root, path); err != nil || strings.HasPrefix(rel, "..") {
+		return "", ErrInvalidScriptRef
+	}
+	return path, nil
+}
+
+func (s *fileScriptStore) Load(name string) (string, error) {
+	path, err := s.path(name, ".js")
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrScriptNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load script %s: %w", name, err)
+	}
+	return string(data), nil
+}
+
+func (s *fileScriptStore) LoadInputSchema(name string) ([]byte, error) {
+	path, err := s.path(name, ".schema.json")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load input schema of %s: %w", name, err)
+	}
+	return data, nil
+}
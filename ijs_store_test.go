@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileScriptStore(t *testing.T) {
+	// secret.js sits next to the store directory, where a traversal would reach
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "scripts")
+	for path, content := range map[string]string{
+		filepath.Join(parent, "secret.js"):               "'secret'",
+		filepath.Join(dir, "daily.js"):                   "'daily'",
+		filepath.Join(dir, "reports", "v1.2_final-2.js"): "'report'",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := &fileScriptStore{dir: dir}
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr error
+	}{
+		{name: "script", ref: "daily", want: "'daily'"},
+		{name: "nested script", ref: "reports/v1.2_final-2", want: "'report'"},
+		{name: "missing script", ref: "weekly", wantErr: ErrScriptNotFound},
+		{name: "parent directory", ref: "../secret", wantErr: ErrInvalidScriptRef},
+		{name: "parent inside a path", ref: "reports/../../secret", wantErr: ErrInvalidScriptRef},
+		{name: "dots in a segment", ref: "reports..secret", wantErr: ErrInvalidScriptRef},
+		{name: "current directory", ref: "./daily", wantErr: ErrInvalidScriptRef},
+		{name: "absolute path", ref: "/etc/passwd", wantErr: ErrInvalidScriptRef},
+		{name: "absolute path to the store", ref: filepath.Join(dir, "daily"), wantErr: ErrInvalidScriptRef},
+		{name: "encoded slash", ref: "..%2fsecret", wantErr: ErrInvalidScriptRef},
+		{name: "encoded dots", ref: "%2e%2e/secret", wantErr: ErrInvalidScriptRef},
+		{name: "backslashes", ref: `..\secret`, wantErr: ErrInvalidScriptRef},
+		{name: "drive letter", ref: `C:\secret`, wantErr: ErrInvalidScriptRef},
+		{name: "empty segment", ref: "reports//v1", wantErr: ErrInvalidScriptRef},
+		{name: "trailing slash", ref: "reports/", wantErr: ErrInvalidScriptRef},
+		{name: "hidden file", ref: ".daily", wantErr: ErrInvalidScriptRef},
+		{name: "NUL byte", ref: "daily\x00", wantErr: ErrInvalidScriptRef},
+		{name: "newline", ref: "daily\n", wantErr: ErrInvalidScriptRef},
+		{name: "empty", ref: "", wantErr: ErrInvalidScriptRef},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := store.Load(tt.ref)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Load(%q) = %q, %v, want %v", tt.ref, script, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if script != tt.want {
+				t.Fatalf("Load(%q) = %q, want %q", tt.ref, script, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileScriptStoreInputSchema(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "typed.schema.json"), []byte(`{"type": "object"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := &fileScriptStore{dir: dir}
+
+	schema, err := store.LoadInputSchema("typed")
+	if err != nil || string(schema) != `{"type": "object"}` {
+		t.Fatalf("LoadInputSchema = %s, %v", schema, err)
+	}
+	if schema, err := store.LoadInputSchema("untyped"); schema != nil || err != nil {
+		t.Fatalf("script without a schema: %s, %v, want nil, nil", schema, err)
+	}
+	if _, err := store.LoadInputSchema("../typed"); !errors.Is(err, ErrInvalidScriptRef) {
+		t.Fatalf("traversal: %v, want ErrInvalidScriptRef", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// streamIdleTimeout is how long /stream-batch waits for the next request line,
+// and how long it allows for a response line to be written after its script ran
+const streamIdleTimeout = 10 * time.Second
+
+// StreamLine is one NDJSON response line of /stream-batch, Line being the
+// 1-based line of the request it answers
+type StreamLine struct {
+	Line   int         `json:"line"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Code   string      `json:"code,omitempty"`
+}
+
+// streamBatchHandler serves /stream-batch. Each request line is an envelope, run
+// through the worker pool in order, its response line being flushed as soon as
+// the script is done.
+func streamBatchHandler(scriptManager *ScriptManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+			logrus.Warn("Request method not allowed")
+			return
+		}
+		defer r.Body.Close()
+
+		// Lines are read while results are written, and the stream may outlast
+		// the server timeouts, which are pushed back line by line instead
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil {
+			logrus.WithError(err).Debug("Full duplex not available for stream batch")
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		trailers := wantsTrailers(r)
+		if trailers {
+			declareUsageTrailers(w)
+		}
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+
+		scanner := bufio.NewScanner(r.Body)
+		// Room for an envelope holding a script of the maximum size
+		scanner.Buffer(make([]byte, 0, 64*1024), int(scriptManager.maxScriptSize)*2+64*1024)
+
+		lines := 0
+		var duration time.Duration
+		var allocBytes uint64
+		var logsTruncated bool
+		for {
+			rc.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+			if !scanner.Scan() {
+				break
+			}
+			lines++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			rc.SetWriteDeadline(time.Now().Add(config.ScriptTimeout + streamIdleTimeout))
+			out, result := scriptManager.runStreamLine(r, lines, scanner.Bytes())
+			duration += result.Duration
+			allocBytes += result.AllocBytes
+			logsTruncated = logsTruncated || result.LogsTruncated
+			if err := enc.Encode(out); err != nil {
+				logrus.WithError(err).Warn("Stream batch client went away")
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				logrus.WithError(err).Warn("Failed to flush stream batch line")
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			// The body cannot be read past a bad line, report it and stop
+			lines++
+			if errors.Is(err, bufio.ErrTooLong) {
+				err = ErrScriptTooLarge
+			}
+			enc.Encode(StreamLine{Line: lines, Error: err.Error(), Code: errorCode(err)})
+			rc.Flush()
+		}
+		if trailers {
+			writeUsageTrailers(w, duration, allocBytes, logsTruncated)
+		}
+		logrus.WithField("lines", lines).Info("Stream batch completed")
+	}
+}
+
+// runStreamLine runs the envelope on one /stream-batch request line, also
+// returning the execution result for its resource usage
+func (sm *ScriptManager) runStreamLine(r *http.Request, line int, data []byte) (StreamLine, ScriptResult) {
+	out := StreamLine{Line: line}
+	if !sm.GetAcceptingScript() {
+		out.Error = config.BackoffMessage
+		out.Code = CodeIntakePaused
+		return out, ScriptResult{}
+	}
+
+	var env Envelope
+	if err := decodeEnvelopeJSON(data, &env); err != nil {
+		out.Error = fmt.Errorf("%w: %v", ErrInvalidEnvelope, err).Error()
+		out.Code = CodeInvalidRequest
+		return out, ScriptResult{}
+	}
+	job, err := sm.jobFromEnvelope(ScriptJob{Priority: isPriorityRequest(r), Origin: requestOrigin(r)}, env, nil)
+	if err == nil && config.DeterministicMode {
+		err = checkDeterministic(job)
+	}
+	if err != nil {
+		out.Error = err.Error()
+		out.Code = errorCode(err)
+		return out, ScriptResult{}
+	}
+
+	result := sm.ExecuteScriptWithContext(r.Context(), job)
+	if result.Error != nil {
+		out.Error = result.Error.Error()
+		out.Code = errorCode(result.Error)
+	} else {
+		out.Result = result.Result
+	}
+	return out, result
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamLines decodes the NDJSON response lines of /stream-batch
+func streamLines(t *testing.T, body string) []StreamLine {
+	t.Helper()
+	var lines []StreamLine
+	dec := json.NewDecoder(strings.NewReader(body))
+	for dec.More() {
+		var line StreamLine
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("%v in %s", err, body)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestStreamBatch(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.MaxScriptSize = 100
+	})
+	sm.maxScriptSize = 100
+
+	body := strings.Join([]string{
+		`{"script": "input.n * 2", "input": {"n": 21}}`,
+		`{"script": "throw new Error('boom')"}`,
+		`{"script": `,
+		``,
+		`{"script": "1 +"}`,
+		`{"script": "` + strings.Repeat("1", 101) + `"}`,
+		`["not", "an", "envelope"]`,
+		`{"script": "'last'"}`,
+	}, "\n")
+	rec := httptest.NewRecorder()
+	streamBatchHandler(sm)(rec, httptest.NewRequest(http.MethodPost, "/stream-batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status = %d %s, want 200 NDJSON", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	want := []struct {
+		line   int
+		result interface{}
+		code   string
+	}{
+		{line: 1, result: float64(42)},
+		{line: 2, code: CodeRuntimeError},
+		{line: 3, code: CodeInvalidRequest},
+		// line 4 is empty and gets no response line
+		{line: 5, code: CodeSyntaxError},
+		{line: 6, code: CodeScriptTooLarge},
+		{line: 7, code: CodeInvalidRequest},
+		{line: 8, result: "last"},
+	}
+	got := streamLines(t, rec.Body.String())
+	if len(got) != len(want) {
+		t.Fatalf("%d response lines, want %d: %s", len(got), len(want), rec.Body)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Line != w.line || g.Result != w.result || g.Code != w.code || (w.code != "") != (g.Error != "") {
+			t.Fatalf("response line %d = %+v, want line %d, result %v, code %q", i+1, g, w.line, w.result, w.code)
+		}
+	}
+}
+
+func TestStreamBatchLineTooLong(t *testing.T) {
+	sm := newTestManager(t, nil)
+	sm.maxScriptSize = 10
+
+	// The scanner buffer holds twice max_script_size plus 64 KiB
+	body := `{"script": "1"}` + "\n" + `{"script": "` + strings.Repeat("1", 70*1024) + `"}` + "\n" + `{"script": "2"}`
+	rec := httptest.NewRecorder()
+	streamBatchHandler(sm)(rec, httptest.NewRequest(http.MethodPost, "/stream-batch", strings.NewReader(body)))
+
+	got := streamLines(t, rec.Body.String())
+	if len(got) != 2 || got[0].Result != float64(1) || got[1].Line != 2 || got[1].Code != CodeScriptTooLarge {
+		t.Fatalf("response lines = %+v, want the first result then a script too large error ending the stream", got)
+	}
+}
+
+func TestStreamBatchIntakePaused(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.BackoffMessage = "busy"
+	})
+	sm.setAcceptingScript(false)
+
+	rec := httptest.NewRecorder()
+	streamBatchHandler(sm)(rec, httptest.NewRequest(http.MethodPost, "/stream-batch", strings.NewReader(`{"script": "1"}`)))
+	got := streamLines(t, rec.Body.String())
+	if len(got) != 1 || got[0].Code != CodeIntakePaused || got[0].Error != "busy" {
+		t.Fatalf("response lines = %+v, want the backoff message", got)
+	}
+}
+
+// TestStreamBatchPipelined checks each response line is flushed as soon as its
+// script ran, while the client is still sending the next request lines.
+func TestStreamBatchPipelined(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	srv := httptest.NewServer(streamBatchHandler(sm))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest(http.MethodPost, srv.URL, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.WriteString(pw, `{"script": "'first'"}`+"\n")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+	for i, script := range []string{"first", "second", "third"} {
+		if i > 0 {
+			if _, err := io.WriteString(pw, `{"script": "'`+script+`'"}`+"\n"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !lines.Scan() {
+			t.Fatalf("no response line for %s: %v", script, lines.Err())
+		}
+		var line StreamLine
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Line != i+1 || line.Result != script {
+			t.Fatalf("response line = %+v, want line %d with %q", line, i+1, script)
+		}
+	}
+	pw.Close()
+	if lines.Scan() {
+		t.Fatalf("unexpected response line %s", lines.Bytes())
+	}
+}
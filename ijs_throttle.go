@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// newExecutionLimiter returns the token bucket pacing script starts to perSecond,
+// nil when perSecond is 0. The bucket holds a single token so bursts are spread
+// out instead of let through.
+func newExecutionLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
+
+// rateMeter counts events per wall-clock second
+type rateMeter struct {
+	sync.Mutex
+	second   int64 // unix second being counted
+	current  int
+	previous int // count of the last complete second
+}
+
+// mark records one event
+func (m *rateMeter) mark() {
+	m.Lock()
+	defer m.Unlock()
+	m.roll(time.Now().Unix())
+	m.current++
+}
+
+// rate returns the number of events during the last complete second
+func (m *rateMeter) rate() int {
+	m.Lock()
+	defer m.Unlock()
+	m.roll(time.Now().Unix())
+	return m.previous
+}
+
+func (m *rateMeter) roll(now int64) {
+	switch {
+	case now == m.second:
+	case now == m.second+1:
+		m.previous, m.current = m.current, 0
+	default:
+		m.previous, m.current = 0, 0
+	}
+	m.second = now
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecutionThrottle(t *testing.T) {
+	const perSecond, burst = 20, 11
+	sm := newTestManager(t, func(c *Config) {
+		c.WorkerPoolSize = 4
+		c.QueueSize = burst
+		c.MaxExecutionsPerSecond = perSecond
+	})
+	sm.limiter = newExecutionLimiter(config.MaxExecutionsPerSecond)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"}); result.Error != nil {
+				t.Error(result.Error)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The first start is free, each of the others waits its 1/20th of a second
+	if elapsed, want := time.Since(start), (burst-1)*time.Second/perSecond; elapsed < want-10*time.Millisecond {
+		t.Fatalf("%d executions took %s, want at least %s", burst, elapsed, want)
+	}
+	if got := sm.Stats().MaxExecutionsPerSecond; got != perSecond {
+		t.Fatalf("max_executions_per_second = %g, want %d", got, perSecond)
+	}
+}
+
+func TestExecutionThrottleCallerGivesUp(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.MaxExecutionsPerSecond = 0.1
+	})
+	sm.limiter = newExecutionLimiter(config.MaxExecutionsPerSecond)
+
+	if result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "1"}); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// The next turn is ten seconds away, past the deadline of the caller
+	result := sm.ExecuteScriptWithContext(ctx, ScriptJob{Script: "1"})
+	if !errors.Is(result.Error, ErrQueueWaitExceeded) {
+		t.Fatalf("error = %v, want ErrQueueWaitExceeded", result.Error)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the job was failed once the caller gave up, not when its turn was known to be too late")
+	}
+	rec := httptest.NewRecorder()
+	handleExecutionError(result.Error, rec)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+}
+
+func TestNewExecutionLimiter(t *testing.T) {
+	for _, perSecond := range []float64{0, -1} {
+		if limiter := newExecutionLimiter(perSecond); limiter != nil {
+			t.Fatalf("newExecutionLimiter(%g) = %v, want no limiter", perSecond, limiter)
+		}
+	}
+	if limiter := newExecutionLimiter(2.5); limiter == nil || limiter.Limit() != 2.5 || limiter.Burst() != 1 {
+		t.Fatalf("newExecutionLimiter(2.5) = %+v, want 2.5 per second and no burst", limiter)
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	for _, step := range []struct {
+		second int64
+		marks  int
+		want   int
+	}{
+		{second: 100, marks: 3, want: 0},
+		{second: 101, marks: 2, want: 3},
+		{second: 101, marks: 1, want: 3},
+		{second: 102, marks: 0, want: 3},
+		{second: 103, marks: 0, want: 0},
+		{second: 110, marks: 5, want: 0},
+		{second: 111, marks: 0, want: 5},
+	} {
+		m.roll(step.second)
+		m.current += step.marks
+		if m.previous != step.want {
+			t.Fatalf("second %d: rate = %d, want %d", step.second, m.previous, step.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// scaledTimeout returns the script_timeout of a job given its input. With
+// timeout_per_input_item set, an array input adds that much per element to
+// script_timeout, up to max_script_timeout. Any other input, objects included,
+// gets script_timeout as is.
+func scaledTimeout(input interface{}) time.Duration {
+	items, ok := input.([]interface{})
+	if !ok || config.TimeoutPerInputItem <= 0 {
+		return config.ScriptTimeout
+	}
+	// Divided rather than multiplied, a huge input must not overflow past the cap
+	headroom := config.MaxScriptTimeout - config.ScriptTimeout
+	if time.Duration(len(items)) >= headroom/config.TimeoutPerInputItem {
+		return config.MaxScriptTimeout
+	}
+	return config.ScriptTimeout + time.Duration(len(items))*config.TimeoutPerInputItem
+}
+
+// jitterTimeout moves timeout by a random amount within ±timeout_jitter of it,
+// so scripts started together do not all time out at the same instant. The
+// result never exceeds longestScriptTimeout, which caps scaled timeouts.
+func jitterTimeout(timeout time.Duration) time.Duration {
+	if config.TimeoutJitter <= 0 {
+		return timeout
+	}
+	offset := (rand.Float64()*2 - 1) * config.TimeoutJitter * float64(timeout)
+	return min(timeout+time.Duration(offset), longestScriptTimeout())
+}
+
+// longestScriptTimeout returns the longest a script may run before it is
+// interrupted, what the other timeouts are checked against
+func longestScriptTimeout() time.Duration {
+	if config.TimeoutPerInputItem > 0 {
+		return config.MaxScriptTimeout
+	}
+	return config.ScriptTimeout + time.Duration(config.TimeoutJitter*float64(config.ScriptTimeout))
+}
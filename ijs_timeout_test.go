@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestScaledTimeout(t *testing.T) {
+	items := func(n int) []interface{} { return make([]interface{}, n) }
+	tests := []struct {
+		name    string
+		perItem time.Duration
+		input   interface{}
+		want    time.Duration
+	}{
+		{name: "disabled", input: items(1000), want: time.Second},
+		{name: "no input", perItem: time.Millisecond, want: time.Second},
+		{name: "object input", perItem: time.Millisecond, input: map[string]interface{}{"rows": items(1000)}, want: time.Second},
+		{name: "empty array", perItem: time.Millisecond, input: items(0), want: time.Second},
+		{name: "small array", perItem: time.Millisecond, input: items(10), want: time.Second + 10*time.Millisecond},
+		{name: "large array", perItem: time.Millisecond, input: items(2000), want: 3 * time.Second},
+		{name: "just under the cap", perItem: time.Millisecond, input: items(3999), want: 5*time.Second - time.Millisecond},
+		{name: "at the cap", perItem: time.Millisecond, input: items(4000), want: 5 * time.Second},
+		{name: "past the cap", perItem: time.Millisecond, input: items(100000), want: 5 * time.Second},
+		// Multiplied out this would overflow a Duration and wrap around
+		{name: "huge per item", perItem: time.Duration(1 << 62), input: items(8), want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.TimeoutPerInputItem = tt.perItem
+				c.MaxScriptTimeout = 5 * time.Second
+			})
+			if got := scaledTimeout(tt.input); got != tt.want {
+				t.Fatalf("scaledTimeout = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScaledTimeoutApplied(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = 200 * time.Millisecond
+		c.TimeoutPerInputItem = 50 * time.Millisecond
+		c.MaxScriptTimeout = 2 * time.Second
+	})
+	// Busy for 400ms, over script_timeout but not over 200ms + 10 × 50ms
+	const script = `const end = Date.now() + 400; while (Date.now() < end) {}; input.length`
+	tests := []struct {
+		name       string
+		input      string
+		wantStatus int
+	}{
+		{name: "large array", input: `[0, 1, 2, 3, 4, 5, 6, 7, 8, 9]`, wantStatus: http.StatusOK},
+		{name: "small array", input: `[0]`, wantStatus: http.StatusRequestTimeout},
+		{name: "object", input: `{"length": 10}`, wantStatus: http.StatusRequestTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]interface{}{"script": script, "input": json.RawMessage(tt.input)})
+			rec := postEnvelope(handler(sm), "/data", string(body))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestLongestScriptTimeout(t *testing.T) {
+	tests := []struct {
+		perItem time.Duration
+		jitter  float64
+		want    time.Duration
+	}{
+		{want: time.Second},
+		{jitter: 0.25, want: 1250 * time.Millisecond},
+		{perItem: time.Millisecond, want: 5 * time.Second},
+		{perItem: time.Millisecond, jitter: 0.25, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%g", tt.perItem, tt.jitter), func(t *testing.T) {
+			newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.TimeoutPerInputItem = tt.perItem
+				c.MaxScriptTimeout = 5 * time.Second
+				c.TimeoutJitter = tt.jitter
+			})
+			if got := longestScriptTimeout(); got != tt.want {
+				t.Fatalf("longestScriptTimeout = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJitterTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		perItem  time.Duration
+		jitter   float64
+		timeout  time.Duration
+		low      time.Duration
+		high     time.Duration
+		constant bool
+	}{
+		{name: "disabled", timeout: time.Second, low: time.Second, high: time.Second, constant: true},
+		{name: "10%", jitter: 0.1, timeout: time.Second, low: 900 * time.Millisecond, high: 1100 * time.Millisecond},
+		{name: "50%", jitter: 0.5, timeout: time.Second, low: 500 * time.Millisecond, high: 1500 * time.Millisecond},
+		{name: "per request timeout", jitter: 0.1, timeout: 200 * time.Millisecond, low: 180 * time.Millisecond, high: 220 * time.Millisecond},
+		// A timeout scaled up to the cap is only ever moved down
+		{name: "scaled to the cap", perItem: time.Millisecond, jitter: 0.1, timeout: 5 * time.Second, low: 4500 * time.Millisecond, high: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.TimeoutPerInputItem = tt.perItem
+				c.MaxScriptTimeout = 5 * time.Second
+				c.TimeoutJitter = tt.jitter
+			})
+			lowest, highest := tt.high, tt.low
+			for range 1000 {
+				got := jitterTimeout(tt.timeout)
+				if got < tt.low || got > tt.high {
+					t.Fatalf("jitterTimeout(%s) = %s, want within %s-%s", tt.timeout, got, tt.low, tt.high)
+				}
+				lowest, highest = min(lowest, got), max(highest, got)
+			}
+			// 1000 draws spread over the band, unless there is no band
+			if spread := highest - lowest; tt.constant && spread != 0 || !tt.constant && spread < (tt.high-tt.low)/2 {
+				t.Fatalf("timeouts ranged %s-%s", lowest, highest)
+			}
+		})
+	}
+}
+
+func TestJitterTimeoutApplied(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.TimeoutJitter = 0.1
+	})
+	hook := new(test.Hook)
+	saved := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	logrus.AddHook(hook)
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(saved) })
+
+	for range 20 {
+		if _, err := sm.ExecuteScriptWithTimeout("1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeouts := map[time.Duration]bool{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message != "Worker executing script" {
+			continue
+		}
+		timeout := entry.Data["timeout"].(time.Duration)
+		if timeout < 900*time.Millisecond || timeout > 1100*time.Millisecond {
+			t.Fatalf("timeout = %s, want within 10%% of script_timeout", timeout)
+		}
+		timeouts[timeout] = true
+	}
+	if len(timeouts) < 2 {
+		t.Fatalf("20 executions ran with %d distinct timeouts", len(timeouts))
+	}
+}
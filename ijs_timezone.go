@@ -0,0 +1,227 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/grafana/sobek"
+)
+
+// Layouts of the Date string methods, the same ones sobek uses for time.Local
+var timezoneLayouts = map[string]string{
+	"toString":           "Mon Jan 02 2006 15:04:05 GMT-0700 (MST)",
+	"toDateString":       "Mon Jan 02 2006",
+	"toTimeString":       "15:04:05 GMT-0700 (MST)",
+	"toLocaleString":     "01/02/2006, 15:04:05",
+	"toLocaleDateString": "01/02/2006",
+	"toLocaleTimeString": "15:04:05",
+}
+
+// Local date-time forms without an offset, which Date reads in the local zone
+var localDateTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// maxDateMsec is the largest time value a Date can hold
+const maxDateMsec = 8.64e15
+
+// installTimezone makes Date use loc as its local time zone. sobek reads the
+// process-wide time.Local, so instead of changing it the local getters, setters
+// and string methods are replaced, and the Date constructor is wrapped so that
+// local components and local date-time strings are read in loc.
+func installTimezone(vm *sobek.Runtime, loc *time.Location) {
+	dateCtor := vm.Get("Date").ToObject(vm)
+	construct, _ := sobek.AssertConstructor(dateCtor)
+	proto := dateCtor.Get("prototype").ToObject(vm)
+	getTime, _ := sobek.AssertFunction(proto.Get("getTime"))
+	setTime, _ := sobek.AssertFunction(proto.Get("setTime"))
+	parse := dateCtor.Get("parse")
+	isPrototypeOf, _ := sobek.AssertFunction(proto.Get("isPrototypeOf"))
+
+	// local returns the time held by the Date this in loc, false when it is invalid
+	local := func(this sobek.Value) (time.Time, bool) {
+		v, err := getTime(this)
+		if err != nil {
+			panic(err)
+		}
+		msec := v.ToFloat()
+		if math.IsNaN(msec) {
+			return time.Time{}, false
+		}
+		return time.UnixMilli(int64(msec)).In(loc), true
+	}
+
+	// fields are year, month, day, hours, minutes, seconds and milliseconds
+	fieldsOf := func(t time.Time) [7]float64 {
+		return [7]float64{
+			float64(t.Year()), float64(t.Month() - 1), float64(t.Day()),
+			float64(t.Hour()), float64(t.Minute()), float64(t.Second()),
+			float64(t.Nanosecond() / int(time.Millisecond)),
+		}
+	}
+
+	names := []string{"FullYear", "Month", "Date", "Hours", "Minutes", "Seconds", "Milliseconds"}
+	// Number of fields each setter accepts, setHours(h, m, s, ms) sets four
+	setterArgs := []int{3, 2, 1, 4, 3, 2, 1}
+	for i, name := range names {
+		proto.Set("get"+name, func(call sobek.FunctionCall) sobek.Value {
+			t, ok := local(call.This)
+			if !ok {
+				return vm.ToValue(math.NaN())
+			}
+			return vm.ToValue(fieldsOf(t)[i])
+		})
+		proto.Set("set"+name, func(call sobek.FunctionCall) sobek.Value {
+			t, ok := local(call.This)
+			if !ok {
+				if i != 0 {
+					return vm.ToValue(math.NaN())
+				}
+				// setFullYear starts an invalid date from the epoch
+				t = time.UnixMilli(0).In(loc)
+			}
+			fields := fieldsOf(t)
+			fields[i] = math.NaN()
+			for k := 0; k < setterArgs[i] && k < len(call.Arguments); k++ {
+				fields[i+k] = call.Arguments[k].ToFloat()
+			}
+			v, err := setTime(call.This, vm.ToValue(localMsec(fields, loc)))
+			if err != nil {
+				panic(err)
+			}
+			return v
+		})
+	}
+	proto.Set("getDay", func(call sobek.FunctionCall) sobek.Value {
+		t, ok := local(call.This)
+		if !ok {
+			return vm.ToValue(math.NaN())
+		}
+		return vm.ToValue(int(t.Weekday()))
+	})
+	proto.Set("getTimezoneOffset", func(call sobek.FunctionCall) sobek.Value {
+		t, ok := local(call.This)
+		if !ok {
+			return vm.ToValue(math.NaN())
+		}
+		_, offset := t.Zone()
+		return vm.ToValue(-offset / 60)
+	})
+	for method, layout := range timezoneLayouts {
+		proto.Set(method, func(call sobek.FunctionCall) sobek.Value {
+			t, ok := local(call.This)
+			if !ok {
+				return vm.ToValue("Invalid Date")
+			}
+			return vm.ToValue(t.Format(layout))
+		})
+	}
+
+	zonedParse := vm.ToValue(func(call sobek.FunctionCall) sobek.Value {
+		s := call.Argument(0).String()
+		if msec, ok := parseLocalDateTime(s, loc); ok {
+			return vm.ToValue(msec)
+		}
+		fn, _ := sobek.AssertFunction(parse)
+		v, err := fn(dateCtor, call.Argument(0))
+		if err != nil {
+			panic(err)
+		}
+		return v
+	})
+
+	hasInstance := vm.ToValue(func(call sobek.FunctionCall) sobek.Value {
+		v, err := isPrototypeOf(proto, call.Argument(0))
+		if err != nil {
+			panic(err)
+		}
+		return v
+	})
+
+	zoned := vm.NewProxy(dateCtor, &sobek.ProxyTrapConfig{
+		Construct: func(target *sobek.Object, args []sobek.Value, newTarget *sobek.Object) *sobek.Object {
+			switch {
+			case len(args) >= 2:
+				args = []sobek.Value{vm.ToValue(localMsec(constructorFields(args), loc))}
+			case len(args) == 1:
+				if s, ok := args[0].Export().(string); ok {
+					if msec, ok := parseLocalDateTime(s, loc); ok {
+						args = []sobek.Value{vm.ToValue(msec)}
+					}
+				}
+			}
+			obj, err := construct(newTarget, args...)
+			if err != nil {
+				panic(err)
+			}
+			return obj
+		},
+		// Date() called as a function returns the current time as a string
+		Apply: func(target *sobek.Object, this sobek.Value, args []sobek.Value) sobek.Value {
+			now, err := construct(nil)
+			if err != nil {
+				panic(err)
+			}
+			t, _ := local(now)
+			return vm.ToValue(t.Format(timezoneLayouts["toString"]))
+		},
+		Get: func(target *sobek.Object, property string, receiver sobek.Value) sobek.Value {
+			if property == "parse" {
+				return zonedParse
+			}
+			return target.Get(property)
+		},
+		// sobek cannot run instanceof against a proxy, answer it here
+		GetSym: func(target *sobek.Object, property *sobek.Symbol, receiver sobek.Value) sobek.Value {
+			if property == sobek.SymHasInstance {
+				return hasInstance
+			}
+			return target.GetSymbol(property)
+		},
+	})
+	zonedValue := vm.ToValue(zoned)
+	proto.Set("constructor", zonedValue)
+	vm.Set("Date", zonedValue)
+}
+
+// constructorFields reads the local components given to new Date(year, month, ...)
+func constructorFields(args []sobek.Value) [7]float64 {
+	fields := [7]float64{0, 0, 1, 0, 0, 0, 0}
+	for i := 0; i < len(args) && i < len(fields); i++ {
+		fields[i] = args[i].ToFloat()
+	}
+	// Two-digit years mean 19xx
+	if y := math.Trunc(fields[0]); y >= 0 && y <= 99 {
+		fields[0] = 1900 + y
+	}
+	return fields
+}
+
+// localMsec returns the time value of local fields in loc, NaN when a field
+// is not finite or the result is out of the Date range. Fields overflow into
+// the next ones as with Date, month 12 is January of the following year.
+func localMsec(fields [7]float64, loc *time.Location) float64 {
+	var ints [7]int
+	for i, f := range fields {
+		// Beyond 1e12 any field lands outside the Date range anyway
+		if math.IsNaN(f) || math.Abs(f) > 1e12 {
+			return math.NaN()
+		}
+		ints[i] = int(math.Trunc(f))
+	}
+	t := time.Date(ints[0], time.Month(ints[1]+1), ints[2], ints[3], ints[4], ints[5], 0, loc)
+	msec := float64(t.UnixMilli()) + float64(ints[6])
+	if math.Abs(msec) > maxDateMsec {
+		return math.NaN()
+	}
+	return msec
+}
+
+// parseLocalDateTime reads an ISO date-time without offset, such as
+// 2024-03-01T09:30, in loc. Other forms are left to Date.parse.
+func parseLocalDateTime(s string, loc *time.Location) (float64, bool) {
+	for _, layout := range localDateTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return float64(t.UnixMilli()), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// timingBuckets are the upper bounds, in seconds, of the runtime histograms
+var timingBuckets = [...]float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// timingHistogram counts durations into timingBuckets. The zero value is ready to use.
+type timingHistogram struct {
+	sync.Mutex
+	count  uint64
+	sum    time.Duration
+	counts [len(timingBuckets)]uint64 // per bucket, not cumulative
+}
+
+// observe records one duration
+func (h *timingHistogram) observe(d time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	h.count++
+	h.sum += d
+	for i, bound := range timingBuckets {
+		if d.Seconds() <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// metric returns the histogram as a Prometheus metric of desc
+func (h *timingHistogram) metric(desc *prometheus.Desc) prometheus.Metric {
+	h.Lock()
+	defer h.Unlock()
+	buckets := make(map[float64]uint64, len(timingBuckets))
+	var cumulative uint64
+	for i, bound := range timingBuckets {
+		cumulative += h.counts[i]
+		buckets[bound] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(desc, h.count, h.sum.Seconds(), buckets)
+}
+
+// stats returns the number of observations and their average in milliseconds
+func (h *timingHistogram) stats() TimingStats {
+	h.Lock()
+	defer h.Unlock()
+	stats := TimingStats{Count: h.count}
+	if h.count > 0 {
+		stats.AvgMs = float64(h.sum.Microseconds()) / float64(h.count) / 1000
+	}
+	return stats
+}
+
+// runtimeTimings measures what sobek costs per execution. There is no VM pool,
+// every execution sets up a fresh VM and drops it afterwards, so vmSetup is the
+// price a pool would save.
+type runtimeTimings struct {
+	compile timingHistogram // parsing a script into a program
+	vmSetup timingHistogram // creating a VM and installing the host functions
+	run     timingHistogram // running the program on its VM
+}
+
+// TimingStats summarizes a runtime histogram on /stats
+type TimingStats struct {
+	Count uint64  `json:"count"`
+	AvgMs float64 `json:"avg_ms"`
+}
+
+// RuntimeStats reports the sobek costs on /stats
+type RuntimeStats struct {
+	Compile TimingStats `json:"compile"`
+	VMSetup TimingStats `json:"vm_setup"`
+	Run     TimingStats `json:"run"`
+}
+
+// StageTimings splits the time of one execution by stage
+type StageTimings struct {
+	Queue  time.Duration // waiting for a worker, zero for runs not queued
+	Parse  time.Duration // compiling the script, zero when it came compiled
+	Exec   time.Duration // running it, settling its promise included
+	Encode time.Duration // checking and exporting its result to Go values
+}
+
+// ResponseTiming is the timing object of a response, in milliseconds
+type ResponseTiming struct {
+	QueueMs  float64 `json:"queue_ms"`
+	ParseMs  float64 `json:"parse_ms"`
+	ExecMs   float64 `json:"exec_ms"`
+	EncodeMs float64 `json:"encode_ms"`
+	TotalMs  float64 `json:"total_ms"` // from reading the request to writing the response
+}
+
+// responseTiming converts stages to milliseconds, with total the time the
+// request took so far
+func responseTiming(stages StageTimings, total time.Duration) *ResponseTiming {
+	ms := func(d time.Duration) float64 { return math.Round(float64(d)/1e3) / 1e3 }
+	return &ResponseTiming{
+		QueueMs:  ms(stages.Queue),
+		ParseMs:  ms(stages.Parse),
+		ExecMs:   ms(stages.Exec),
+		EncodeMs: ms(stages.Encode),
+		TotalMs:  ms(total),
+	}
+}
+
+// wantsTiming reports whether the client asked for the timing breakdown with
+// an X-Timing: true header
+func wantsTiming(r *http.Request) bool {
+	timing, _ := strconv.ParseBool(r.Header.Get("X-Timing"))
+	return timing
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWantsTiming(t *testing.T) {
+	for value, want := range map[string]bool{"": false, "true": true, "1": true, "TRUE": true, "false": false, "yes": false} {
+		r := httptest.NewRequest(http.MethodPost, "/data", nil)
+		if value != "" {
+			r.Header.Set("X-Timing", value)
+		}
+		if got := wantsTiming(r); got != want {
+			t.Errorf("X-Timing: %q: wantsTiming = %t, want %t", value, got, want)
+		}
+	}
+}
+
+func TestResponseTiming(t *testing.T) {
+	got := responseTiming(StageTimings{
+		Queue:  1500 * time.Microsecond,
+		Parse:  1234567 * time.Nanosecond,
+		Exec:   2 * time.Second,
+		Encode: 400 * time.Nanosecond,
+	}, 3*time.Second)
+	want := ResponseTiming{QueueMs: 1.5, ParseMs: 1.235, ExecMs: 2000, EncodeMs: 0, TotalMs: 3000}
+	if *got != want {
+		t.Fatalf("responseTiming = %+v, want %+v", *got, want)
+	}
+}
+
+// timedPost runs script through /data with X-Timing: true, returning the
+// status and the timing of the response
+func timedPost(t *testing.T, sm *ScriptManager, script string) (int, *ResponseTiming) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(script))
+	r.Header.Set("X-Timing", "true")
+	rec := httptest.NewRecorder()
+	handler(sm)(rec, r)
+	var response Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, response.Timing
+}
+
+// checkTimingOrder fails unless every stage fits in the total
+func checkTimingOrder(t *testing.T, timing *ResponseTiming) {
+	t.Helper()
+	if timing == nil {
+		t.Fatal("no timing in the response")
+	}
+	for _, stage := range []float64{timing.QueueMs, timing.ParseMs, timing.ExecMs, timing.EncodeMs} {
+		if stage < 0 || stage > timing.TotalMs {
+			t.Fatalf("timing = %+v, want every stage within total_ms", *timing)
+		}
+	}
+	// Rounding to the microsecond may add up to one per stage
+	if sum := timing.QueueMs + timing.ParseMs + timing.ExecMs + timing.EncodeMs; sum > timing.TotalMs+0.004 {
+		t.Fatalf("timing = %+v, stages add up to %g, over total_ms", *timing, sum)
+	}
+}
+
+func TestTimingBreakdown(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+		c.WorkerPoolSize = 1
+	})
+
+	t.Run("not asked", func(t *testing.T) {
+		rec, _ := postScript(sm, "1")
+		if strings.Contains(rec.Body.String(), "timing") {
+			t.Fatalf("body = %s, want no timing without X-Timing", rec.Body)
+		}
+	})
+	t.Run("exec", func(t *testing.T) {
+		status, timing := timedPost(t, sm, `const end = Date.now() + 50; while (Date.now() < end) {}; 1`)
+		if status != http.StatusOK {
+			t.Fatalf("status = %d", status)
+		}
+		checkTimingOrder(t, timing)
+		// Date.now has a millisecond resolution, the loop may end early by as much
+		if timing.ExecMs < 49 || timing.ParseMs <= 0 {
+			t.Fatalf("timing = %+v, want a parse and about 50ms of exec", *timing)
+		}
+	})
+	t.Run("encode", func(t *testing.T) {
+		status, timing := timedPost(t, sm, `Array.from({length: 100000}, (_, i) => ({i}))`)
+		if status != http.StatusOK {
+			t.Fatalf("status = %d", status)
+		}
+		checkTimingOrder(t, timing)
+		if timing.EncodeMs <= 0 {
+			t.Fatalf("timing = %+v, want the export of a large result counted", *timing)
+		}
+	})
+	t.Run("queue", func(t *testing.T) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postScript(sm, `const end = Date.now() + 200; while (Date.now() < end) {}`)
+		}()
+		waitRunning(t, sm, 1)
+		status, timing := timedPost(t, sm, "1")
+		wg.Wait()
+		if status != http.StatusOK {
+			t.Fatalf("status = %d", status)
+		}
+		checkTimingOrder(t, timing)
+		if timing.QueueMs < 100 {
+			t.Fatalf("timing = %+v, want the wait behind the busy worker in queue_ms", *timing)
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		status, timing := timedPost(t, sm, `for (;;) {}`)
+		if status != http.StatusRequestTimeout {
+			t.Fatalf("status = %d", status)
+		}
+		checkTimingOrder(t, timing)
+		if timing.ExecMs < 1000 {
+			t.Fatalf("timing = %+v, want script_timeout spent in exec", *timing)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// tracer is a no-op until initializeTracing installs a provider
+	tracer = otel.Tracer("ijs")
+
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// initializeTracing exports spans over OTLP/HTTP to otel_endpoint when it is set.
+// Incoming traceparent headers are honoured either way.
+func initializeTracing() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if config.OtelEndpoint == "" {
+		logrus.Info("Tracing disabled, no otel_endpoint configured")
+		return
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.OtelEndpoint),
+	)
+	if err != nil {
+		logrus.Fatalf("Error creating OTLP trace exporter: %v", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+	tracer = tracerProvider.Tracer("ijs")
+
+	logrus.Infof("Tracing initialized, exporting spans to %s", config.OtelEndpoint)
+}
+
+// shutdownTracing flushes the spans still buffered by the exporter
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("Tracer provider shutdown error")
+	}
+}
+
+// scriptHashAttribute identifies a script in spans without recording its source
+func scriptHashAttribute(js string) attribute.KeyValue {
+	sum := sha256.Sum256([]byte(js))
+	return attribute.String("script.sha256", hex.EncodeToString(sum[:]))
+}
+
+// endSpanWithError records err on span, if any, and ends it
+func endSpanWithError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("outcome", "error"))
+	} else {
+		span.SetAttributes(attribute.String("outcome", "success"))
+	}
+	span.End()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans sends the spans of the test to the returned recorder
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	savedTracer, savedPropagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer("ijs")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracer = savedTracer
+		otel.SetTextMapPropagator(savedPropagator)
+		provider.Shutdown(context.Background())
+	})
+	return recorder
+}
+
+func TestRequestSpans(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		script      string
+		wantOutcome string
+		wantStatus  codes.Code
+	}{
+		{name: "success", script: "1 + 1", wantOutcome: "success", wantStatus: codes.Unset},
+		{name: "error", script: "throw new Error('boom')", wantOutcome: "error", wantStatus: codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := recordSpans(t)
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+			})
+			r := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(tt.script))
+			r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			handler(sm)(httptest.NewRecorder(), r)
+
+			spans := make(map[string]sdktrace.ReadOnlySpan)
+			for _, span := range recorder.Ended() {
+				spans[span.Name()] = span
+				if got := span.SpanContext().TraceID().String(); got != traceID {
+					t.Fatalf("span %q in trace %s, want the incoming %s", span.Name(), got, traceID)
+				}
+			}
+			for _, name := range []string{"POST /data", "queue wait", "execution"} {
+				if _, ok := spans[name]; !ok {
+					t.Fatalf("no %q span among %d", name, len(spans))
+				}
+			}
+			root := spans["POST /data"]
+			if root.Status().Code != tt.wantStatus {
+				t.Fatalf("request span status = %v, want %v", root.Status().Code, tt.wantStatus)
+			}
+			attrs := attribute.NewSet(root.Attributes()...)
+			if outcome, _ := attrs.Value("outcome"); outcome.AsString() != tt.wantOutcome {
+				t.Fatalf("outcome = %q, want %q", outcome.AsString(), tt.wantOutcome)
+			}
+			if hash, _ := attrs.Value("script.sha256"); hash.AsString() != scriptHashAttribute(tt.script).Value.AsString() {
+				t.Fatalf("script.sha256 = %q", hash.AsString())
+			}
+			if exec := spans["execution"]; exec.Parent().SpanID() != root.SpanContext().SpanID() {
+				t.Fatal("execution span not a child of the request span")
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trailers reporting the resources used by an execution, sent to clients asking
+// for trailers with TE: trailers, once the body is written
+const (
+	trailerDurationMs = "X-Script-Duration-Ms"
+	trailerAllocBytes = "X-Script-Alloc-Bytes"
+	trailerLogsTrunc  = "X-Script-Logs-Truncated"
+)
+
+// heapAllocBytes returns the bytes allocated on the heap since the process
+// started. Unlike runtime.ReadMemStats it does not stop the world, but it counts
+// every goroutine, so the difference over an execution includes whatever ran
+// alongside it.
+func heapAllocBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// wantsTrailers reports whether the client announced it accepts trailers
+func wantsTrailers(r *http.Request) bool {
+	for _, te := range strings.Split(r.Header.Get("TE"), ",") {
+		if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+// declareUsageTrailers announces the usage trailers, it must be called before
+// the header is written
+func declareUsageTrailers(w http.ResponseWriter) {
+	w.Header().Set("Trailer", trailerDurationMs+", "+trailerAllocBytes+", "+trailerLogsTrunc)
+}
+
+// writeUsageTrailers sets the usage trailers, once the body is written
+func writeUsageTrailers(w http.ResponseWriter, duration time.Duration, allocBytes uint64, logsTruncated bool) {
+	w.Header().Set(trailerDurationMs, strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', 3, 64))
+	w.Header().Set(trailerAllocBytes, strconv.FormatUint(allocBytes, 10))
+	w.Header().Set(trailerLogsTrunc, strconv.FormatBool(logsTruncated))
+}
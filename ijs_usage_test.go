@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageTrailers(t *testing.T) {
+	const noisy = `for (let i = 0; i < 100; i++) console.log("x".repeat(1000)); 1`
+	tests := []struct {
+		name          string
+		path          string
+		body          string
+		te            string
+		wantTruncated string // "" when no trailers are expected
+	}{
+		{name: "data", path: "/data", body: "1 + 1", te: "trailers", wantTruncated: "false"},
+		{name: "data with logs truncated", path: "/data", body: noisy, te: "trailers", wantTruncated: "true"},
+		{name: "data without TE", path: "/data", body: noisy},
+		{name: "stream", path: "/stream-batch", body: `{"script": "1"}` + "\n" + `{"script": "2"}`, te: "gzip, trailers", wantTruncated: "false"},
+		{name: "stream with logs truncated on a line", path: "/stream-batch", body: `{"script": "1"}` + "\n" + `{"script": ` + strconv.Quote(noisy) + `}`, te: "trailers", wantTruncated: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) { c.ScriptTimeout = time.Second })
+			mux := http.NewServeMux()
+			mux.Handle("/data", handler(sm))
+			mux.Handle("/stream-batch", streamBatchHandler(sm))
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.te != "" {
+				r.Header.Set("TE", tt.te)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, r)
+			res := rec.Result()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d %s", res.StatusCode, rec.Body)
+			}
+
+			if tt.wantTruncated == "" {
+				if len(res.Trailer) != 0 {
+					t.Fatalf("trailers = %v, want none", res.Trailer)
+				}
+				return
+			}
+			if got := res.Trailer.Get(trailerLogsTrunc); got != tt.wantTruncated {
+				t.Errorf("%s = %q, want %q", trailerLogsTrunc, got, tt.wantTruncated)
+			}
+			if ms, err := strconv.ParseFloat(res.Trailer.Get(trailerDurationMs), 64); err != nil || ms <= 0 {
+				t.Errorf("%s = %q, want a positive duration", trailerDurationMs, res.Trailer.Get(trailerDurationMs))
+			}
+			if _, err := strconv.ParseUint(res.Trailer.Get(trailerAllocBytes), 10, 64); err != nil {
+				t.Errorf("%s = %q: %v", trailerAllocBytes, res.Trailer.Get(trailerAllocBytes), err)
+			}
+		})
+	}
+}
+
+// TestUsageTrailersGzip checks the trailers stay trailers behind the gzip
+// middleware, for small responses it sends late as well as compressed ones
+func TestUsageTrailersGzip(t *testing.T) {
+	tests := []struct {
+		name         string
+		minBytes     int
+		wantEncoding string
+	}{
+		{name: "under gzip_min_bytes", minBytes: 1 << 20},
+		{name: "compressed", minBytes: 0, wantEncoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = time.Second
+				c.EnableGzip = true
+				c.GzipMinBytes = tt.minBytes
+			})
+			mux := http.NewServeMux()
+			mux.Handle("/data", handler(sm))
+			server := httptest.NewServer(gzipMiddleware(mux))
+			defer server.Close()
+
+			r, err := http.NewRequest(http.MethodPost, server.URL+"/data", strings.NewReader(`"x".repeat(100)`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("TE", "trailers")
+			r.Header.Set("Accept-Encoding", "gzip")
+			res, err := server.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if got := res.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			for _, key := range []string{trailerDurationMs, trailerAllocBytes, trailerLogsTrunc} {
+				if got := res.Header.Get(key); got != "" {
+					t.Errorf("%s sent as a header: %q", key, got)
+				}
+			}
+			if _, err := io.Copy(io.Discard, res.Body); err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Trailer.Get(trailerLogsTrunc); got != "false" {
+				t.Errorf("%s trailer = %q, want false", trailerLogsTrunc, got)
+			}
+			if ms, err := strconv.ParseFloat(res.Trailer.Get(trailerDurationMs), 64); err != nil || ms <= 0 {
+				t.Errorf("%s trailer = %q, want a positive duration", trailerDurationMs, res.Trailer.Get(trailerDurationMs))
+			}
+		})
+	}
+}
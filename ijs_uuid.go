@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+
+	"github.com/grafana/sobek"
+)
+
+// uuidSeedSalt keeps the uuid() sequence apart from the Math.random one when
+// both derive from the same request seed
+const uuidSeedSalt = 0x5eed0f1d
+
+// installUUID exposes uuid(), returning random version 4 UUIDs. With a seed the
+// sequence is reproducible, otherwise it is drawn from crypto/rand.
+func installUUID(vm *sobek.Runtime, seed *int64) {
+	var source io.Reader = rand.Reader
+	if seed != nil {
+		source = mathrand.New(mathrand.NewSource(*seed ^ uuidSeedSalt))
+	}
+
+	vm.Set("uuid", func() string {
+		var b [16]byte
+		if _, err := io.ReadFull(source, b[:]); err != nil {
+			panic(vm.NewGoError(fmt.Errorf("uuid: %w", err)))
+		}
+		b[6] = b[6]&0x0f | 0x40 // version 4
+		b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var uuidV4Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// uuids returns n values of uuid() from a VM installed with seed
+func uuids(t *testing.T, seed *int64, n int) []string {
+	t.Helper()
+	vm := newRuntime()
+	installUUID(vm, seed)
+	ids := make([]string, n)
+	for i := range ids {
+		value, err := vm.RunString("uuid()")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = value.String()
+	}
+	return ids
+}
+
+func TestUUID(t *testing.T) {
+	seed, other := int64(42), int64(43)
+	tests := []struct {
+		name     string
+		seed     *int64
+		again    *int64 // seed of a second sequence
+		wantSame bool
+	}{
+		{name: "random", seed: nil, again: nil},
+		{name: "same seed", seed: &seed, again: &seed, wantSame: true},
+		{name: "different seeds", seed: &seed, again: &other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := uuids(t, tt.seed, 5), uuids(t, tt.again, 5)
+			seen := make(map[string]bool)
+			for _, id := range first {
+				if !uuidV4Pattern.MatchString(id) {
+					t.Fatalf("%q is not a version 4 UUID", id)
+				}
+				if seen[id] {
+					t.Fatalf("%q returned twice in a sequence", id)
+				}
+				seen[id] = true
+			}
+			for i := range first {
+				if (first[i] == second[i]) != tt.wantSame {
+					t.Fatalf("uuid %d: %s and %s, want the same %v", i, first[i], second[i], tt.wantSame)
+				}
+			}
+		})
+	}
+}
+
+// Only deterministic_mode makes the UUIDs of a seeded request reproducible
+func TestUUIDSeedOnlyInDeterministicMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		deterministic bool
+		wantSame      bool
+	}{
+		{name: "deterministic_mode", deterministic: true, wantSame: true},
+		{name: "seed alone", deterministic: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.EnableUUID = true
+				c.DeterministicMode = tt.deterministic
+				c.ScriptTimeout = time.Second
+			})
+			seed := int64(42)
+			run := func() interface{} {
+				result := sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "uuid()", Seed: &seed})
+				if result.Error != nil {
+					t.Fatal(result.Error)
+				}
+				return result.Result
+			}
+			if first, second := run(), run(); (first == second) != tt.wantSame {
+				t.Fatalf("uuids %v and %v, want the same %v", first, second, tt.wantSame)
+			}
+		})
+	}
+}
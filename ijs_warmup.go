@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// warmup runs script runs times, each in a throwaway VM set up like the ones of
+// real requests, so the first requests after boot do not pay for cold caches.
+// It never fails startup: a failing run is logged and the next one tried. It
+// returns how many runs completed.
+func (sm *ScriptManager) warmup(script string, runs int) int {
+	program, err := sm.compileScript(script)
+	if err != nil {
+		logrus.WithError(err).Warn("Warmup script does not compile, skipping warmup")
+		return 0
+	}
+
+	start := time.Now()
+	completed := 0
+	for i := 0; i < runs; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), config.ScriptTimeout)
+		vm := newRuntime()
+		sm.installHostFunctions(vm, ctx, ScriptJob{}, &scriptOutput{})
+		timer := time.AfterFunc(config.ScriptTimeout, func() { vm.Interrupt(ErrScriptTimeout) })
+		_, err := vm.RunProgram(program)
+		timer.Stop()
+		cancel()
+		if err != nil {
+			logrus.WithError(err).WithField("run", i+1).Warn("Warmup run failed")
+			continue
+		}
+		completed++
+	}
+	logrus.WithFields(logrus.Fields{
+		"runs":      runs,
+		"completed": completed,
+		"took":      time.Since(start),
+	}).Info("Warmup done")
+	return completed
+}
+
+// warmupFromFile runs the warmup script at path, a missing file only being warned about
+func (sm *ScriptManager) warmupFromFile(path string, runs int) {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		logrus.WithError(err).Warn("Cannot read warmup script, skipping warmup")
+		return
+	}
+	sm.warmup(string(script), runs)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// countLogs counts the entries of hook with message
+func countLogs(hook *test.Hook, message string) int {
+	n := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == message {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWarmup(t *testing.T) {
+	tests := []struct {
+		name          string
+		script        string
+		runs          int
+		wantCompleted int
+		wantFailed    int
+		wantSkipped   bool
+	}{
+		{name: "every run", script: `let s = 0; for (let i = 0; i < 100; i++) s += i; JSON.stringify({s})`, runs: 5, wantCompleted: 5},
+		{name: "with host functions", script: `render("{{.}}", 1) + uuid()`, runs: 2, wantCompleted: 2},
+		{name: "failing runs", script: `throw new Error("warmup")`, runs: 3, wantFailed: 3},
+		{name: "runs past the timeout", script: `for (;;) {}`, runs: 2, wantFailed: 2},
+		{name: "does not compile", script: `1 +`, runs: 3, wantSkipped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.ScriptTimeout = 50 * time.Millisecond
+				c.EnableUUID = true
+			})
+			hook := new(test.Hook)
+			saved := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+			logrus.AddHook(hook)
+			t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(saved) })
+
+			if completed := sm.warmup(tt.script, tt.runs); completed != tt.wantCompleted {
+				t.Fatalf("%d runs completed, want %d", completed, tt.wantCompleted)
+			}
+			if failed := countLogs(hook, "Warmup run failed"); failed != tt.wantFailed {
+				t.Fatalf("%d runs failed, want %d", failed, tt.wantFailed)
+			}
+			if skipped := countLogs(hook, "Warmup script does not compile, skipping warmup") == 1; skipped != tt.wantSkipped {
+				t.Fatalf("skipped = %t, want %t", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestWarmupFromFile(t *testing.T) {
+	sm := newTestManager(t, func(c *Config) {
+		c.ScriptTimeout = time.Second
+	})
+	hook := new(test.Hook)
+	saved := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	logrus.AddHook(hook)
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(saved) })
+
+	path := filepath.Join(t.TempDir(), "warmup.js")
+	if err := os.WriteFile(path, []byte(`[1, 2, 3].map(x => x * 2)`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sm.warmupFromFile(path, 3)
+	if done := hook.LastEntry(); done == nil || done.Message != "Warmup done" || done.Data["completed"] != 3 {
+		t.Fatalf("last entry %v, want the 3 runs completed", done)
+	}
+
+	// A missing file is warned about, and startup goes on
+	sm.warmupFromFile(path+".missing", 3)
+	if countLogs(hook, "Cannot read warmup script, skipping warmup") != 1 {
+		t.Fatal("missing warmup script not warned about")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// workerProgress is what a worker reports of its current job to the watchdog
+type workerProgress struct {
+	sync.Mutex
+	lane      string
+	scriptID  string    // script being run, "" while idle
+	started   time.Time // when the current job started
+	completed time.Time // when the last job completed
+	flagged   bool      // the current job was already reported stuck
+}
+
+func (p *workerProgress) start(scriptID string) {
+	p.Lock()
+	defer p.Unlock()
+	p.scriptID, p.started, p.flagged = scriptID, time.Now(), false
+}
+
+func (p *workerProgress) finish() {
+	p.Lock()
+	defer p.Unlock()
+	p.scriptID, p.completed = "", time.Now()
+}
+
+// trackWorker registers a worker of lane with the watchdog
+func (sm *ScriptManager) trackWorker(lane *workerLane) *workerProgress {
+	p := &workerProgress{lane: lane.name}
+	sm.workersMu.Lock()
+	defer sm.workersMu.Unlock()
+	sm.workers[p] = struct{}{}
+	return p
+}
+
+// untrackWorker forgets an exiting worker
+func (sm *ScriptManager) untrackWorker(p *workerProgress) {
+	sm.workersMu.Lock()
+	defer sm.workersMu.Unlock()
+	delete(sm.workers, p)
+}
+
+// watchdog flags the workers that have been on the same job for longer than
+// stuck_worker_after. hard_kill_timeout should free a worker well before, so a
+// stuck worker means the bound is off or not holding. With stuck_worker_restart
+// set, that many workers stuck at once recover the process following
+// recover_mode, as the memory monitor does.
+type watchdog struct {
+	sm      *ScriptManager
+	clock   clock
+	restart func()
+}
+
+func newWatchdog(sm *ScriptManager, clock clock) *watchdog {
+	w := &watchdog{
+		sm:    sm,
+		clock: clock,
+	}
+	w.restart = recoverAction(sm, w.holdOff)
+	return w
+}
+
+// holdOff stands in for the restart under recover_mode none: the process never
+// exits, /health reports the stuck workers until they are fewer than
+// stuck_worker_restart again, so the orchestrator can decide to restart it
+func (w *watchdog) holdOff() {
+	if !areWorkersStuck() {
+		logrus.Error("Too many stuck workers. Leaving the restart to the orchestrator...")
+	}
+	setWorkersStuck(true)
+}
+
+// run checks the workers every watchdog_interval until shutdown
+func (w *watchdog) run() {
+	for {
+		select {
+		case <-w.sm.done:
+			return
+		default:
+		}
+		w.clock.Sleep(config.WatchdogInterval)
+		w.check()
+	}
+}
+
+// check flags the stuck workers, each job once, and returns how many are stuck
+func (w *watchdog) check() int {
+	now := w.clock.Now()
+	w.sm.workersMu.Lock()
+	workers := make([]*workerProgress, 0, len(w.sm.workers))
+	for p := range w.sm.workers {
+		workers = append(workers, p)
+	}
+	w.sm.workersMu.Unlock()
+
+	stuck := 0
+	for _, p := range workers {
+		p.Lock()
+		scriptID, running := p.scriptID, now.Sub(p.started)
+		isStuck := scriptID != "" && running > config.StuckWorkerAfter
+		report := isStuck && !p.flagged
+		p.flagged = p.flagged || isStuck
+		p.Unlock()
+		if isStuck {
+			stuck++
+		}
+		if !report {
+			continue
+		}
+
+		atomic.AddUint64(&w.sm.stuckWorkers, 1)
+		w.sm.RLock()
+		entry, tracked := w.sm.runningScripts[scriptID]
+		w.sm.RUnlock()
+		fields := logrus.Fields{
+			"lane":      p.lane,
+			"script_id": scriptID,
+			"running":   running,
+			"tracked":   tracked,
+		}
+		if tracked {
+			fields["script_length"] = len(entry.script)
+		}
+		logrus.WithFields(fields).Error("Watchdog found a stuck worker")
+	}
+	atomic.StoreInt64(&w.sm.stuckNow, int64(stuck))
+
+	if config.StuckWorkerRestart > 0 && stuck >= config.StuckWorkerRestart {
+		if config.RecoverMode != recoverModeNone {
+			logrus.WithFields(logrus.Fields{
+				"stuck": stuck,
+				"limit": config.StuckWorkerRestart,
+			}).Error("Too many stuck workers. Restarting...")
+		}
+		w.restart()
+	} else {
+		setWorkersStuck(false)
+	}
+	return stuck
+}
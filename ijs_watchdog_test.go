@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchdogRecoverMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		limit       int
+		wantRestart bool
+		wantHealth  int
+	}{
+		{name: "restart", mode: recoverModeRestart, limit: 1, wantRestart: true, wantHealth: http.StatusOK},
+		{name: "none", mode: recoverModeNone, limit: 1, wantHealth: http.StatusServiceUnavailable},
+		{name: "under stuck_worker_restart", mode: recoverModeNone, limit: 2, wantHealth: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.RecoverMode = tt.mode
+				c.StuckWorkerAfter = time.Second
+				c.StuckWorkerRestart = tt.limit
+				c.WatchdogInterval = 0
+				c.HardKillTimeout = 0
+				c.ScriptTimeout = time.Minute
+			})
+			restarted := false
+			saved := restartProcess
+			restartProcess = func(*http.Server, *ScriptManager) error {
+				restarted = true
+				return nil
+			}
+			t.Cleanup(func() {
+				restartProcess = saved
+				setWorkersStuck(false)
+			})
+
+			// A script that never ends holds its worker, stuck once the clock
+			// is past stuck_worker_after
+			done := make(chan ScriptResult, 1)
+			go func() { done <- sm.ExecuteScriptWithContext(context.Background(), ScriptJob{Script: "for (;;) {}"}) }()
+			waitRunning(t, sm, 1)
+			clock := newFakeClock()
+			clock.Sleep(time.Minute)
+			w := newWatchdog(sm, clock)
+
+			if stuck := w.check(); stuck != 1 {
+				t.Fatalf("stuck = %d, want 1", stuck)
+			}
+			if restarted != tt.wantRestart {
+				t.Fatalf("restarted = %t, want %t", restarted, tt.wantRestart)
+			}
+			rec := httptest.NewRecorder()
+			healthHandler()(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if rec.Code != tt.wantHealth {
+				t.Fatalf("health = %d %s, want %d", rec.Code, rec.Body, tt.wantHealth)
+			}
+
+			// Once the worker is freed the instance is healthy again
+			sm.cancelAllScripts(ErrScriptCancelled)
+			<-done
+			w.check()
+			if areWorkersStuck() {
+				t.Fatal("still reported stuck once the worker is free")
+			}
+		})
+	}
+}
+
+// waitRunning waits for n scripts to be running on sm
+func waitRunning(t *testing.T, sm *ScriptManager, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		sm.RLock()
+		running := len(sm.runningScripts)
+		sm.RUnlock()
+		if running == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d scripts running, want %d", running, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
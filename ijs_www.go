@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/grafana/sobek"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -19,19 +31,53 @@ var (
 type Response struct {
 	Result interface{} `json:"result,omitempty"`
 	Error  string      `json:"error,omitempty"`
+	Code   string      `json:"code,omitempty"` // stable error code, see ijs_errors.go
+
+	ErrorName string `json:"error_name,omitempty"` // name of an error thrown as a plain object, with code SCRIPT_ERROR
+
+	Violations []SchemaViolation `json:"violations,omitempty"` // how the input breaks its schema, with code INPUT_SCHEMA_VIOLATION
+
+	Logs []ConsoleLine `json:"logs,omitempty"` // console output, as selected by logs_on
+
+	ResultURL string `json:"result_url,omitempty"` // where a result spilled to disk is downloaded, set instead of result
+
+	// Bytes allocated while the script ran, reported when max_script_alloc_mb is set
+	AllocBytes      uint64 `json:"alloc_bytes,omitempty"`
+	AllocAccounting string `json:"alloc_accounting,omitempty"` // always approximate, see ijs_alloc.go
+
+	Timing *ResponseTiming `json:"timing,omitempty"` // time spent per stage, sent when asked with X-Timing: true
+
+	// Audit fields, set on successful responses when audit_fields is enabled
+	ScriptSHA256 string `json:"script_sha256,omitempty"`
+	ResultSHA256 string `json:"result_sha256,omitempty"`
+	Timestamp    string `json:"timestamp,omitempty"`
+	Signature    string `json:"signature,omitempty"`
 }
 
 // initializeWebServer sets up and starts the HTTP or HTTPS server
+// newHTTPServer returns a server for handler with the timeouts of the configuration
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		// ReadHeaderTimeout drops clients dribbling their headers (slowloris)
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
 func initializeWebServer(secure bool, certFile, keyFile string) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/data", handler(scriptManager))
+	registerRoutes(mux, scriptManager)
 
 	addr := fmt.Sprintf("localhost:%d", config.ServerPort)
-	server = &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+	server = newHTTPServer(addr, gzipMiddleware(securityHeadersMiddleware(corsMiddleware(inflightBytesMiddleware(mux)))))
+
+	listener, err := newListener(addr)
+	if err != nil {
+		logrus.Fatalf("Failed to listen on %s: %v", addr, err)
 	}
 
 	// Check if secure mode is enabled
@@ -43,14 +89,14 @@ func initializeWebServer(secure bool, certFile, keyFile string) {
 
 		go func() {
 			logrus.Infof("Starting HTTPS server on %s with cert: %s and key: %s", addr, certFile, keyFile)
-			if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+			if err := server.ServeTLS(listener, certFile, keyFile); err != nil && err != http.ErrServerClosed {
 				logrus.Fatalf("HTTPS server error: %v", err)
 			}
 		}()
 	} else {
 		go func() {
 			logrus.Infof("Starting HTTP server on %s", addr)
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 				logrus.Fatalf("HTTP server error: %v", err)
 			}
 		}()
@@ -76,6 +122,10 @@ func handler(scriptManager *ScriptManager) http.HandlerFunc {
 			"addr":   r.RemoteAddr,
 		}).Info("Received request")
 
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
 		// Check if the request method is POST
 		if r.Method != http.MethodPost {
 			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
@@ -84,58 +134,355 @@ func handler(scriptManager *ScriptManager) http.HandlerFunc {
 		}
 
 		// Read and validate request body
-		body, err := io.ReadAll(io.LimitReader(r.Body, scriptManager.maxScriptSize))
-		defer r.Body.Close()
-		if err != nil {
-			http.Error(w, "Failed to read request body", http.StatusBadRequest)
-			logrus.WithError(err).Error("Failed to read request body")
+		body, ok := readScriptBody(w, r, scriptManager.maxScriptSize)
+		if !ok {
 			return
 		}
 
 		// Check if accepting scripts
 		if !scriptManager.GetAcceptingScript() {
-			http.Error(w, "Currently not accepting script, please wait...", http.StatusMethodNotAllowed)
+			w.Header().Set("Retry-After", strconv.Itoa(int(memoryResumeDelay.Seconds())))
+			writeJSON(w, http.StatusServiceUnavailable, Response{Error: config.BackoffMessage, Code: CodeIntakePaused})
 			logrus.Warn("Rejected script as the system is not accepting scripts")
 			return
 		}
 
+		job, err := scriptManager.parseRequest(r, body)
+		if err != nil {
+			writeRequestError(w, err)
+			logrus.WithError(err).Warn("Rejected invalid request")
+			return
+		}
+
 		logrus.Info("Executing script")
-		logrus.Trace(string(body))
+		logrus.Trace(job.Script)
+		span.SetAttributes(scriptHashAttribute(job.Script))
+		job.spillable = scriptManager.spills != nil
 
-		result, execErr := scriptManager.ExecuteScriptWithTimeout(string(body))
+		execResult := scriptManager.executeCached(ctx, r, w, job)
+		result, execErr := execResult.Result, execResult.Error
+		var attachment string
+		if d, ok := downloadFrom(result); ok && execErr == nil {
+			execResult.Result, execResult.ContentType = d.body, d.contentType
+			result = d.body
+			attachment = contentDisposition(d.filename)
+		}
+		if execErr == nil && execResult.ContentType != "" {
+			profileName, profile := profileFor(r)
+			if execErr = profile.checkContentType(execResult.ContentType); execErr != nil {
+				logrus.WithField("profile", profileName).Warn("Script picked a content type outside its profile")
+			}
+		}
+		var resultURL string
+		if execErr == nil && execResult.Spill {
+			var id string
+			if id, execErr = scriptManager.spills.store(execResult); execErr == nil {
+				resultURL = "/results/" + id
+				logrus.WithField("result_url", resultURL).Info("Script result spilled to disk")
+			}
+			result, execResult.ContentType = nil, ""
+		}
+		if attachment != "" && execErr == nil && resultURL == "" {
+			if execResult.ContentType == "" {
+				execResult.ContentType = "application/octet-stream"
+			}
+			w.Header().Set("Content-Disposition", attachment)
+		}
+		raw := execErr == nil && (isRawContentType(execResult.ContentType) || attachment != "" && resultURL == "")
+		cbor := !raw && wantsCBOR(r)
+		trailers := wantsTrailers(r)
+		if trailers {
+			declareUsageTrailers(w)
+		}
 
 		// Prepare response
-		response := Response{}
+		status := http.StatusOK
+		response := Response{Logs: execResult.Logs}
+		if config.MaxScriptAllocMB > 0 && execResult.AllocBytes > 0 {
+			response.AllocBytes, response.AllocAccounting = execResult.AllocBytes, allocApproximate
+		}
+		if wantsTiming(r) {
+			response.Timing = responseTiming(execResult.Stages, time.Since(startTime))
+		}
+		w.Header().Add("Vary", "Accept")
+		switch {
+		case raw:
+			w.Header().Set("Content-Type", execResult.ContentType)
+		case cbor:
+			w.Header().Set("Content-Type", cborContentType)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+		}
 		if execErr != nil {
 			handleExecutionError(execErr, w)
 			response.Error = execErr.Error()
+			response.Code = errorCode(execErr)
+			var scriptErr *ScriptError
+			if errors.As(execErr, &scriptErr) {
+				response.Error, response.ErrorName = scriptErr.Message, scriptErr.Name
+			}
 		} else {
 			response.Result = result
+			response.ResultURL = resultURL
+			if config.AuditFields && !raw && resultURL == "" {
+				if err := addAuditFields(&response, job.Script, time.Now()); err != nil {
+					logrus.WithError(err).Error("Failed to compute audit fields")
+				}
+			}
+			if execResult.Status != 0 {
+				status = execResult.Status
+			}
+			w.WriteHeader(status)
 			logrus.Info("Script executed successfully, returning result")
 		}
 
 		// Send response
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(response); err != nil {
+		cw := &countingWriter{w: w}
+		switch {
+		case raw:
+			err = writeRawResult(cw, result)
+		case cbor:
+			err = encodeCBOR(cw, response)
+		default:
+			err = encodeResponse(cw, response, isPrettyRequest(r))
+		}
+		if err != nil {
 			logrus.WithError(err).Error("Failed to encode response")
 		}
+		if trailers {
+			writeUsageTrailers(w, execResult.Duration, execResult.AllocBytes, execResult.LogsTruncated)
+		}
+		span.SetAttributes(attribute.Int64("result.size", cw.n))
+		if execErr != nil {
+			span.RecordError(execErr)
+			span.SetStatus(codes.Error, execErr.Error())
+			span.SetAttributes(attribute.String("outcome", "error"))
+		} else {
+			span.SetAttributes(attribute.String("outcome", "success"))
+		}
 
 		logrus.WithFields(logrus.Fields{
-			"status": http.StatusOK,
+			"status": status,
 			"took":   time.Since(startTime),
 		}).Info("Request processed")
 	}
 }
 
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// isRawContentType reports whether a result of that content type is sent as
+// the body itself rather than in the JSON envelope
+func isRawContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType != "application/json"
+}
+
+// writeRawResult sends a result as the response body. Strings and binary data
+// are written as is, other values as JSON.
+func writeRawResult(w io.Writer, result interface{}) error {
+	var err error
+	switch v := result.(type) {
+	case string:
+		_, err = io.WriteString(w, v)
+	case []byte:
+		_, err = w.Write(v)
+	case sobek.ArrayBuffer:
+		_, err = w.Write(v.Bytes())
+	default:
+		err = json.NewEncoder(w).Encode(v)
+	}
+	return err
+}
+
+// writeRequestError answers a request parseRequest rejected: 404 for what it
+// references and cannot find, 400 for what the client got wrong, 500 otherwise
+func writeRequestError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrScriptNotFound), errors.Is(err, ErrSessionNotFound):
+		status = http.StatusNotFound
+	case !errors.Is(err, ErrInvalidEnvelope) && !errors.Is(err, ErrInvalidScriptRef) && !errors.Is(err, ErrInputSchema):
+		status = http.StatusInternalServerError
+	}
+	response := Response{Error: err.Error(), Code: errorCode(err)}
+	var schemaErr *inputSchemaError
+	if errors.As(err, &schemaErr) {
+		response.Violations = schemaErr.violations
+	}
+	writeJSON(w, status, response)
+}
+
+// readScriptBody reads the body of a request carrying a script. When it cannot
+// be read or is over maxBytes it answers the request and returns false. One
+// byte past the limit is read, so a body over it is refused rather than cut.
+func readScriptBody(w http.ResponseWriter, r *http.Request, maxBytes int64) ([]byte, bool) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		logrus.WithError(err).Error("Failed to read request body")
+		return nil, false
+	}
+	if int64(len(body)) > maxBytes {
+		writeJSON(w, http.StatusBadRequest, Response{Error: ErrScriptTooLarge.Error(), Code: CodeScriptTooLarge})
+		logrus.Warn("Rejected a request body over max_script_size")
+		return nil, false
+	}
+	return body, true
+}
+
+// isPrettyRequest reports whether the client asked for an indented response
+// with ?pretty=true or an X-Pretty: true header
+func isPrettyRequest(r *http.Request) bool {
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	if header, err := strconv.ParseBool(r.Header.Get("X-Pretty")); err == nil {
+		pretty = pretty || header
+	}
+	return pretty
+}
+
+// encodeResponse writes response as JSON, indented by two spaces when pretty is
+// set. Indentation never pushes a response over max_result_bytes, such a
+// response is sent compact instead.
+func encodeResponse(w io.Writer, response interface{}, pretty bool) error {
+	if pretty {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(response); err != nil {
+			return err
+		}
+		if config.MaxResultBytes == 0 || buf.Len() <= config.MaxResultBytes {
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// writeJSON sends response as JSON with the given status code
+func writeJSON(w http.ResponseWriter, status int, response Response) {
+	writeJSONValue(w, status, response)
+}
+
+// writeJSONValue sends any value as JSON with the given status code
+func writeJSONValue(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logrus.WithError(err).Error("Failed to encode response")
+	}
+}
+
+// isPriorityRequest reports whether the request carries one of the configured X-Priority tokens
+func isPriorityRequest(r *http.Request) bool {
+	token := r.Header.Get("X-Priority")
+	if token == "" {
+		return false
+	}
+	for _, allowed := range config.PriorityTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin identifies the client of a request for fair scheduling, by IP
+func requestOrigin(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // handleExecutionError handles specific script execution errors and sets appropriate HTTP status codes
 func handleExecutionError(err error, w http.ResponseWriter) {
-	switch err {
-	case ErrScriptTooLarge:
+	var scriptErr *ScriptError
+	switch {
+	case errors.As(err, &scriptErr):
+		logrus.WithError(err).Info("Script threw an error")
+		w.WriteHeader(scriptErr.Status)
+	case errors.Is(err, ErrScriptTooLarge):
 		logrus.WithError(err).Warn("Script too large")
 		w.WriteHeader(http.StatusBadRequest)
-	case ErrNoWorkerAvailable:
+	case errors.Is(err, ErrNoWorkerAvailable):
 		logrus.WithError(err).Warn("No worker available")
 		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, ErrQueueWaitExceeded):
+		logrus.WithError(err).Warn("Script waited too long in the queue")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, ErrScriptTimeout):
+		logrus.WithError(err).Warn("Script timed out")
+		w.WriteHeader(http.StatusRequestTimeout)
+	case errors.Is(err, ErrShuttingDown):
+		logrus.WithError(err).Warn("Server shutting down")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, ErrScriptShed):
+		logrus.WithError(err).Warn("Script shed for a priority script")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, ErrCPUPressure):
+		logrus.WithError(err).Warn("Script shed under CPU pressure")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, ErrScriptCancelled):
+		logrus.WithError(err).Warn("Script cancelled by an administrator")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, ErrResultTooLarge), errors.Is(err, ErrResultArrayTooLong):
+		// The script ran, what it produced is over a limit and would be again
+		logrus.WithError(err).Warn("Script result over the result limits")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrRunTimeBudget):
+		// Timed from its first statement, the script is too slow rather than the server too busy
+		logrus.WithError(err).Warn("Script ran past its run time budget")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrCallStackExceeded):
+		logrus.WithError(err).Warn("Script exceeded the call stack limit")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrHostCallLimit):
+		logrus.WithError(err).Warn("Script called host functions past max_host_calls")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrExecutionAbandoned):
+		// Past its timeout like ErrScriptTimeout, it only took longer to give up on
+		logrus.WithError(err).Warn("Script abandoned past the hard kill timeout")
+		w.WriteHeader(http.StatusRequestTimeout)
+	case errors.Is(err, ErrMemoryLimit):
+		logrus.WithError(err).Warn("Script cancelled over a memory limit")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, ErrSpillFull):
+		logrus.WithError(err).Warn("No spill space left for a script result")
+		w.WriteHeader(http.StatusInsufficientStorage)
+	case errors.Is(err, ErrInvalidEncoding):
+		logrus.WithError(err).Warn("Script is not valid UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, ErrBannedSyntax):
+		logrus.WithError(err).Warn("Script uses banned syntax")
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, ErrDeniedPattern):
+		logrus.WithError(err).Warn("Script contains a denied pattern")
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, ErrCompileFailed):
+		logrus.WithError(err).Warn("Script has a syntax error")
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, ErrContentTypeNotAllowed):
+		logrus.WithError(err).Warn("Script content type not allowed")
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, ErrTooManyGlobals):
+		logrus.WithError(err).Warn("Script defined too many globals")
+		w.WriteHeader(http.StatusBadRequest)
 	default:
 		logrus.WithError(err).Error("Internal server error while processing script")
 		w.WriteHeader(http.StatusInternalServerError)
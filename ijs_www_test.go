@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsPriorityRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []string
+		header string
+		want   bool
+	}{
+		{name: "configured token", tokens: []string{"alpha", "beta"}, header: "beta", want: true},
+		{name: "unknown token", tokens: []string{"alpha"}, header: "alph"},
+		{name: "token prefix", tokens: []string{"alpha"}, header: "alphabet"},
+		{name: "no header", tokens: []string{"alpha"}},
+		{name: "no tokens configured", header: "alpha"},
+		{name: "empty token configured", tokens: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := config
+			t.Cleanup(func() { config = saved })
+			config.PriorityTokens = tt.tokens
+
+			r := httptest.NewRequest(http.MethodPost, "/data", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Priority", tt.header)
+			}
+			if got := isPriorityRequest(r); got != tt.want {
+				t.Fatalf("isPriorityRequest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntakePaused(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*ScriptManager) http.HandlerFunc
+		path    string
+		body    string
+	}{
+		{name: "data", handler: handler, path: "/data", body: "1"},
+		{name: "fanout", handler: fanoutHandler, path: "/fanout", body: `{"script": "1", "inputs": [1]}`},
+		{name: "jobs", handler: submitJobHandler, path: "/jobs", body: "1"},
+		{name: "repl", handler: replSnippetHandler, path: "/repl/abc", body: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t, func(c *Config) {
+				c.BackoffMessage = "busy, come back later"
+			})
+			sm.setAcceptingScript(false)
+
+			rec := httptest.NewRecorder()
+			tt.handler(sm)(rec, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503", rec.Code)
+			}
+			if got, want := rec.Header().Get("Retry-After"), strconv.Itoa(int(memoryResumeDelay.Seconds())); got != want {
+				t.Fatalf("Retry-After = %q, want %q", got, want)
+			}
+			var response Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Error != "busy, come back later" || response.Code != CodeIntakePaused {
+				t.Fatalf("response = %q %s, want the backoff_message and %s", response.Error, response.Code, CodeIntakePaused)
+			}
+		})
+	}
+}
+
+func TestIsPrettyRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   bool
+	}{
+		{name: "default", target: "/data"},
+		{name: "query", target: "/data?pretty=true", want: true},
+		{name: "query 1", target: "/data?pretty=1", want: true},
+		{name: "query false", target: "/data?pretty=false"},
+		{name: "query not a bool", target: "/data?pretty=yes"},
+		{name: "header", target: "/data", header: "true", want: true},
+		{name: "header false", target: "/data", header: "false"},
+		{name: "header false does not undo the query", target: "/data?pretty=true", header: "false", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Pretty", tt.header)
+			}
+			if got := isPrettyRequest(r); got != tt.want {
+				t.Fatalf("isPrettyRequest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrettyResponse(t *testing.T) {
+	sm := newTestManager(t, nil)
+	post := func(target string, header string) []byte {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`({a: [1, 2], b: {c: "x"}})`))
+		if header != "" {
+			r.Header.Set("X-Pretty", header)
+		}
+		rec := httptest.NewRecorder()
+		handler(sm)(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d %s", rec.Code, rec.Body)
+		}
+		return rec.Body.Bytes()
+	}
+	result := func(body []byte) string {
+		t.Helper()
+		var response struct {
+			Result json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, response.Result); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	compact := post("/data", "")
+	if bytes.Count(compact, []byte("\n")) != 1 {
+		t.Fatalf("default response is not on one line: %s", compact)
+	}
+	for _, pretty := range [][]byte{post("/data?pretty=true", ""), post("/data", "true")} {
+		if !bytes.Contains(pretty, []byte("\n  \"result\": {\n    \"a\": [\n      1,")) {
+			t.Fatalf("pretty response is not indented by two spaces: %s", pretty)
+		}
+		if got, want := result(pretty), result(compact); got != want {
+			t.Fatalf("pretty result = %s, compact result = %s", got, want)
+		}
+	}
+}
+
+func TestEncodeResponseMaxResultBytes(t *testing.T) {
+	response := map[string]interface{}{"result": []int{1, 2, 3}}
+	var compact, pretty bytes.Buffer
+	if err := encodeResponse(&compact, response, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeResponse(&pretty, response, true); err != nil {
+		t.Fatal(err)
+	}
+	if pretty.Len() <= compact.Len() {
+		t.Fatalf("pretty response %q is not longer than %q", pretty.String(), compact.String())
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  string
+	}{
+		{name: "no limit", limit: 0, want: pretty.String()},
+		{name: "indented fits", limit: pretty.Len(), want: pretty.String()},
+		{name: "indentation over the limit", limit: pretty.Len() - 1, want: compact.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := config
+			t.Cleanup(func() { config = saved })
+			config.MaxResultBytes = tt.limit
+
+			var buf bytes.Buffer
+			if err := encodeResponse(&buf, response, true); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Fatalf("response = %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+// serveTimeouts serves a handler answering ok on a server built by
+// newHTTPServer, with the timeouts set by configure, and returns its address
+func serveTimeouts(t *testing.T, configure func(*Config)) string {
+	t.Helper()
+	newTestManager(t, configure)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return listener.Addr().String()
+}
+
+// waitClosed reads conn until the server closes it, failing past limit. A
+// reset counts as closed: the server closing on unread data sends one.
+func waitClosed(t *testing.T, conn net.Conn, limit time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(limit))
+	if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection still open after %s: %v", limit, err)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	addr := serveTimeouts(t, func(c *Config) {
+		c.ReadHeaderTimeout = 200 * time.Millisecond
+		c.ReadTimeout = 10 * time.Second
+	})
+
+	t.Run("slow headers dropped", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		start := time.Now()
+		// Dribble a header line every 50ms, never ending the headers
+		go func() {
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+			for i := 0; i < 100; i++ {
+				time.Sleep(50 * time.Millisecond)
+				if _, err := io.WriteString(conn, "X-Slow: 1\r\n"); err != nil {
+					return
+				}
+			}
+		}()
+		waitClosed(t, conn, 3*time.Second)
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+			t.Fatalf("connection closed after %s, want about read_header_timeout", elapsed)
+		}
+	})
+
+	t.Run("prompt headers served", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", res.StatusCode)
+		}
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := serveTimeouts(t, func(c *Config) {
+		c.IdleTimeout = 200 * time.Millisecond
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	// The kept-alive connection is closed once idle for idle_timeout
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(3 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("read = %v, want the idle connection closed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("idle connection closed after %s, want about idle_timeout", elapsed)
+	}
+}